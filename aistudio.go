@@ -0,0 +1,298 @@
+package geminiclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/env/v2"
+	"google.golang.org/api/iterator"
+)
+
+const defaultAIStudioBaseURL = "https://generativelanguage.googleapis.com"
+
+// AIStudioBackend is a Backend for the Gemini API in Google AI Studio, which only needs an API key.
+type AIStudioBackend struct {
+	APIKey     string
+	BaseURL    string       // the default is https://generativelanguage.googleapis.com
+	HTTPClient *http.Client // the default is http.DefaultClient
+}
+
+// aiStudioStream is a ResponseIterator for the server-sent events of a streaming request.
+type aiStudioStream struct {
+	events *sseReader
+	err    error
+}
+
+// aiStudioFile is a file that has been uploaded with the Files API.
+type aiStudioFile struct {
+	Name     string `json:"name"`
+	URI      string `json:"uri"`
+	MIMEType string `json:"mimeType"`
+	State    string `json:"state"`
+}
+
+// FileUploader is a Backend that can upload files, so that they can be referred to by URI instead of being sent inline.
+type FileUploader interface {
+	UploadFile(ctx context.Context, r io.Reader, mimeType, displayName string) (genai.FileData, error)
+}
+
+// NewAIStudioBackend creates a new Google AI Studio backend with the given API key.
+func NewAIStudioBackend(apiKey string) *AIStudioBackend {
+	return &AIStudioBackend{APIKey: apiKey, BaseURL: defaultAIStudioBaseURL}
+}
+
+// apiKeyFromEnv returns the Gemini API key from $GEMINI_API_KEY or $GOOGLE_API_KEY, if set.
+func apiKeyFromEnv() string {
+	return env.StrAlt("GEMINI_API_KEY", "GOOGLE_API_KEY", "")
+}
+
+func (b *AIStudioBackend) httpClient() *http.Client {
+	if b.HTTPClient != nil {
+		return b.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (b *AIStudioBackend) baseURL() string {
+	if b.BaseURL == "" {
+		return defaultAIStudioBaseURL
+	}
+	return strings.TrimSuffix(b.BaseURL, "/")
+}
+
+// modelURL returns the URL for calling the given method on the given model, like "generateContent".
+func (b *AIStudioBackend) modelURL(modelName, method string) string {
+	if !strings.Contains(modelName, "/") {
+		modelName = "models/" + modelName
+	}
+	return fmt.Sprintf("%s/v1beta/%s:%s", b.baseURL(), modelName, method)
+}
+
+// do sends a request with the API key, and returns the response if the status code is 2xx.
+// Other responses are returned as a *googleapi.Error, so that they can be retried or fall back like other errors.
+func (b *AIStudioBackend) do(ctx context.Context, method, URL, contentType string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, URL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-goog-api-key", b.APIKey)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := b.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, httpError(resp)
+	}
+	return resp, nil
+}
+
+// post sends the given value as JSON, and decodes the JSON response into result.
+func (b *AIStudioBackend) post(ctx context.Context, URL string, value, result any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(ctx, http.MethodPost, URL, "application/json", bytes.NewReader(data), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// GenerateContent sends the given contents to the model.
+func (b *AIStudioBackend) GenerateContent(ctx context.Context, cfg *ModelConfig, contents ...*genai.Content) (*genai.GenerateContentResponse, error) {
+	req, err := toRESTRequest(cfg, contents)
+	if err != nil {
+		return nil, err
+	}
+	var res restResponse
+	if err := b.post(ctx, b.modelURL(cfg.ModelName, "generateContent"), req, &res); err != nil {
+		return nil, err
+	}
+	return fromRESTResponse(&res)
+}
+
+// GenerateContentStream sends the given contents to the model, and streams the response as server-sent events.
+func (b *AIStudioBackend) GenerateContentStream(ctx context.Context, cfg *ModelConfig, contents ...*genai.Content) ResponseIterator {
+	req, err := toRESTRequest(cfg, contents)
+	if err != nil {
+		return &aiStudioStream{err: err}
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return &aiStudioStream{err: err}
+	}
+	resp, err := b.do(ctx, http.MethodPost, b.modelURL(cfg.ModelName, "streamGenerateContent")+"?alt=sse", "application/json", bytes.NewReader(data), nil)
+	if err != nil {
+		return &aiStudioStream{err: err}
+	}
+	return &aiStudioStream{events: newSSEReader(resp.Body)}
+}
+
+// Next returns the next response, or iterator.Done when there are no more.
+func (s *aiStudioStream) Next() (*genai.GenerateContentResponse, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	data, err := s.events.Next()
+	if err == io.EOF {
+		return nil, s.fail(iterator.Done)
+	}
+	if err != nil {
+		return nil, s.fail(err)
+	}
+	var res restResponse
+	if err := json.Unmarshal([]byte(data), &res); err != nil {
+		return nil, s.fail(fmt.Errorf("invalid streamed response: %v", err))
+	}
+	response, err := fromRESTResponse(&res)
+	if err != nil {
+		return nil, s.fail(err)
+	}
+	return response, nil
+}
+
+// fail closes the stream, and makes all further calls to Next return the given error.
+func (s *aiStudioStream) fail(err error) error {
+	s.err = err
+	s.events.Close()
+	return err
+}
+
+// CountTokens counts the tokens in the given parts.
+func (b *AIStudioBackend) CountTokens(ctx context.Context, cfg *ModelConfig, parts ...genai.Part) (int, error) {
+	contents, err := toRESTContents([]*genai.Content{genai.NewUserContent(parts...)})
+	if err != nil {
+		return 0, err
+	}
+	var res restCountTokensResponse
+	if err := b.post(ctx, b.modelURL(cfg.ModelName, "countTokens"), &restCountTokensRequest{Contents: contents}, &res); err != nil {
+		return 0, err
+	}
+	return int(res.TotalTokens), nil
+}
+
+// StartChat starts a new chat session.
+func (b *AIStudioBackend) StartChat(cfg *ModelConfig) ChatSession {
+	return NewChatSession(b, cfg)
+}
+
+// UploadFile uploads a file with the resumable upload protocol of the Files API, and waits until it can be used.
+// The returned FileData can be added to a request, instead of sending the data inline.
+func (b *AIStudioBackend) UploadFile(ctx context.Context, r io.Reader, mimeType, displayName string) (genai.FileData, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return genai.FileData{}, err
+	}
+	metadata, err := json.Marshal(map[string]any{"file": map[string]string{"displayName": displayName}})
+	if err != nil {
+		return genai.FileData{}, err
+	}
+	resp, err := b.do(ctx, http.MethodPost, b.baseURL()+"/upload/v1beta/files", "application/json", bytes.NewReader(metadata), map[string]string{
+		"X-Goog-Upload-Protocol":              "resumable",
+		"X-Goog-Upload-Command":               "start",
+		"X-Goog-Upload-Header-Content-Length": strconv.Itoa(len(data)),
+		"X-Goog-Upload-Header-Content-Type":   mimeType,
+	})
+	if err != nil {
+		return genai.FileData{}, fmt.Errorf("failed to start upload: %w", err)
+	}
+	resp.Body.Close()
+	uploadURL := resp.Header.Get("X-Goog-Upload-URL")
+	if uploadURL == "" {
+		return genai.FileData{}, errors.New("failed to start upload: no upload URL in the response")
+	}
+
+	resp, err = b.do(ctx, http.MethodPost, uploadURL, mimeType, bytes.NewReader(data), map[string]string{
+		"X-Goog-Upload-Offset":  "0",
+		"X-Goog-Upload-Command": "upload, finalize",
+	})
+	if err != nil {
+		return genai.FileData{}, fmt.Errorf("failed to upload file: %w", err)
+	}
+	defer resp.Body.Close()
+	var uploaded struct {
+		File aiStudioFile `json:"file"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&uploaded); err != nil {
+		return genai.FileData{}, fmt.Errorf("failed to upload file: %v", err)
+	}
+	file, err := b.waitForFile(ctx, uploaded.File)
+	if err != nil {
+		return genai.FileData{}, err
+	}
+	if file.MIMEType == "" {
+		file.MIMEType = mimeType
+	}
+	return genai.FileData{MIMEType: file.MIMEType, FileURI: file.URI}, nil
+}
+
+// waitForFile waits until an uploaded file, like a video, is no longer being processed.
+func (b *AIStudioBackend) waitForFile(ctx context.Context, file aiStudioFile) (aiStudioFile, error) {
+	for file.State == "PROCESSING" {
+		select {
+		case <-ctx.Done():
+			return file, ctx.Err()
+		case <-time.After(time.Second):
+		}
+		resp, err := b.do(ctx, http.MethodGet, b.baseURL()+"/v1beta/"+file.Name, "", nil, nil)
+		if err != nil {
+			return file, fmt.Errorf("failed to get the state of %s: %w", file.Name, err)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&file)
+		resp.Body.Close()
+		if err != nil {
+			return file, err
+		}
+	}
+	if file.State == "FAILED" {
+		return file, fmt.Errorf("processing of %s failed", file.Name)
+	}
+	return file, nil
+}
+
+// UploadFile uploads the given file, if the backend supports it, and adds it to the prompt parts as a reference.
+func (gc *GeminiClient) UploadFile(ctx context.Context, filename string) error {
+	backend, err := gc.backend(ctx, "")
+	if err != nil {
+		return err
+	}
+	uploader, ok := backend.(FileUploader)
+	if !ok {
+		return errors.New("the backend does not support uploading files")
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	mimeType, _, _ := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(filename)))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	fileData, err := uploader.UploadFile(ctx, f, mimeType, filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	gc.Parts = append(gc.Parts, fileData)
+	return nil
+}
@@ -0,0 +1,183 @@
+package geminiclient_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/env/v2"
+	"github.com/xyproto/geminiclient"
+)
+
+// newFakeAIStudio starts a fake Generative Language API that answers function calls and echoes the prompt.
+func newFakeAIStudio(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1beta/models/{method}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-goog-api-key") != "test-key" {
+			http.Error(w, `{"error": {"code": 403, "message": "invalid API key"}}`, http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Contents []struct {
+				Parts []map[string]any `json:"parts"`
+			} `json:"contents"`
+			Tools            []any          `json:"tools"`
+			GenerationConfig map[string]any `json:"generationConfig"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		last := req.Contents[len(req.Contents)-1].Parts[0]
+		switch method := r.PathValue("method"); method {
+		case "gemini-1.5-flash:countTokens":
+			fmt.Fprint(w, `{"totalTokens": 7}`)
+		case "gemini-1.5-flash:streamGenerateContent":
+			if r.URL.Query().Get("alt") != "sse" {
+				t.Error("Expected server-sent events to be requested")
+			}
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \"Hello\"}]}}]}\n\n")
+			fmt.Fprint(w, "data: {\"candidates\": [{\"content\": {\"role\": \"model\", \"parts\": [{\"text\": \", World\"}]}, \"finishReason\": \"STOP\"}], \"usageMetadata\": {\"totalTokenCount\": 5}}\n\n")
+		case "gemini-1.5-flash:generateContent":
+			if response, ok := last["functionResponse"]; ok {
+				data, _ := json.Marshal(response)
+				fmt.Fprintf(w, `{"candidates": [{"content": {"role": "model", "parts": [{"text": %q}]}}]}`, string(data))
+			} else if len(req.Tools) > 0 {
+				fmt.Fprint(w, `{"candidates": [{"content": {"role": "model", "parts": [{"functionCall": {"name": "add", "args": {"param1": 2, "param2": 3}}}]}}]}`)
+			} else if req.GenerationConfig["responseMimeType"] == "application/json" {
+				fmt.Fprint(w, `{"candidates": [{"content": {"role": "model", "parts": [{"text": "{\"answer\": 42}"}]}}]}`)
+			} else {
+				fmt.Fprintf(w, `{"candidates": [{"content": {"role": "model", "parts": [{"text": %q}]}}], "usageMetadata": {"totalTokenCount": 3}}`, last["text"])
+			}
+		default:
+			http.Error(w, `{"error": {"code": 429, "message": "quota exceeded", "status": "RESOURCE_EXHAUSTED"}}`, http.StatusTooManyRequests)
+		}
+	})
+	mux.HandleFunc("POST /upload/v1beta/files", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Goog-Upload-Command") != "start" {
+			t.Error("Expected the upload to be started")
+		}
+		w.Header().Set("X-Goog-Upload-URL", server.URL+"/upload/session")
+	})
+	mux.HandleFunc("POST /upload/session", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, `{"file": {"name": "files/abc", "uri": "%s/v1beta/files/abc", "mimeType": %q, "state": "ACTIVE", "sizeBytes": "%d"}}`, server.URL, r.Header.Get("Content-Type"), len(data))
+	})
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newAIStudioClient(t *testing.T) *geminiclient.GeminiClient {
+	server := newFakeAIStudio(t)
+	backend := geminiclient.NewAIStudioBackend("test-key")
+	backend.BaseURL = server.URL
+	gc := &geminiclient.GeminiClient{ModelName: "gemini-1.5-flash", Functions: map[string]reflect.Value{}}
+	gc.SetBackend(backend)
+	return gc
+}
+
+func TestAIStudioBackend(t *testing.T) {
+	gc := newAIStudioClient(t)
+	ctx := context.Background()
+
+	result, err := gc.QueryContext(ctx, "ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "ping" {
+		t.Errorf("Expected \"ping\" but got %q", result)
+	}
+
+	var streamed strings.Builder
+	gc.AddText("Say hello")
+	result, err = gc.SubmitToClientStreaming(ctx, func(s string) { streamed.WriteString(s) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Hello, World" || streamed.String() != "Hello, World" {
+		t.Errorf("Expected \"Hello, World\" but got %q and %q", result, streamed.String())
+	}
+
+	n, err := gc.CountTextTokensContext(ctx, "count me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 7 {
+		t.Errorf("Expected 7 tokens but got %d", n)
+	}
+}
+
+func TestAIStudioFunctionCall(t *testing.T) {
+	gc := newAIStudioClient(t)
+	err := gc.AddFunctionTool("add", "Add two numbers", func(a, b int) int { return a + b })
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := gc.Query("What is 2 + 3?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(result, "5") {
+		t.Errorf("Expected the function result to be sent back, but got %q", result)
+	}
+}
+
+func TestAIStudioJSONAndErrors(t *testing.T) {
+	gc := newAIStudioClient(t)
+	ctx := context.Background()
+
+	res, err := gc.Generate(ctx, geminiclient.NewTextRequest("What is the answer?").WithGenerationConfig(genai.GenerationConfig{ResponseMIMEType: "application/json"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != `{"answer": 42}` {
+		t.Errorf("Expected JSON but got %q", res.Text)
+	}
+
+	gc.SetRetryPolicy(geminiclient.NoRetryPolicy())
+	_, err = gc.Generate(ctx, geminiclient.NewTextRequest("hi").WithModel("gemini-over-quota"))
+	if !geminiclient.FallbackOnQuota.Matches(err) {
+		t.Errorf("Expected a quota error but got %v", err)
+	}
+}
+
+func TestAIStudioUploadFile(t *testing.T) {
+	gc := newAIStudioClient(t)
+	filename := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(filename, []byte("some notes"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.UploadFile(context.Background(), filename); err != nil {
+		t.Fatal(err)
+	}
+	fileData, ok := gc.Parts[0].(genai.FileData)
+	if !ok || !strings.HasSuffix(fileData.FileURI, "/v1beta/files/abc") || fileData.MIMEType != "text/plain" {
+		t.Errorf("Expected an uploaded text file but got %v", gc.Parts[0])
+	}
+}
+
+func TestAIStudioFromEnv(t *testing.T) {
+	t.Cleanup(env.Load) // runs after the environment variables have been restored
+	t.Setenv("GCP_PROJECT_ID", "")
+	t.Setenv("PROJECT_ID", "")
+	t.Setenv("GEMINI_API_KEY", "test-key")
+	env.Load()
+	gc, err := geminiclient.New("gemini-1.5-flash", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gc.Backend.(*geminiclient.AIStudioBackend); !ok {
+		t.Errorf("Expected the AI Studio backend to be used, but got %T", gc.Backend)
+	}
+}
@@ -0,0 +1,181 @@
+package geminiclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+)
+
+// cloudPlatformScope is the OAuth2 scope that is needed for Vertex AI
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+var (
+	// ErrNoCredentials is returned when no credentials are given and no Application Default Credentials are found
+	ErrNoCredentials = errors.New("no Google Cloud credentials found (run \"gcloud auth application-default login\", set GOOGLE_APPLICATION_CREDENTIALS or use an option like WithCredentialsFile)")
+	// ErrPermissionDenied is returned when the credentials are valid, but lack permission to use Vertex AI
+	ErrPermissionDenied = errors.New("the credentials lack permission to use Vertex AI (grant the Vertex AI User role, roles/aiplatform.user, and make sure that the Vertex AI API is enabled)")
+)
+
+// permissionError wraps a PermissionDenied error from Vertex AI, so that it matches both ErrPermissionDenied and the original error.
+type permissionError struct {
+	projectID string
+	err       error
+}
+
+func (e *permissionError) Error() string {
+	return fmt.Sprintf("%v in project %s: %v", ErrPermissionDenied, e.projectID, e.err)
+}
+
+func (e *permissionError) Unwrap() []error {
+	return []error{ErrPermissionDenied, e.err}
+}
+
+// credentialsFile is the part of a credentials JSON file that is checked before it is used
+type credentialsFile struct {
+	Type      string `json:"type"`
+	ProjectID string `json:"project_id"`
+}
+
+// WithCredentialsFile makes the client use the credentials in the given JSON file, like a service account key
+// or a workload identity federation configuration, instead of the Application Default Credentials.
+func WithCredentialsFile(filename string) Option {
+	return func(gc *GeminiClient) error {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("failed to read the credentials file: %v", err)
+		}
+		return WithCredentialsJSON(data)(gc)
+	}
+}
+
+// WithCredentialsJSON is like WithCredentialsFile, but takes the contents of the file.
+// If no project ID is set, the project ID of a service account is used.
+func WithCredentialsJSON(data []byte) Option {
+	return func(gc *GeminiClient) error {
+		var f credentialsFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			return fmt.Errorf("invalid credentials JSON: %v", err)
+		}
+		if f.Type == "" {
+			return errors.New("invalid credentials JSON: the type is missing")
+		}
+		if gc.ProjectID == "" {
+			gc.ProjectID = f.ProjectID
+		}
+		gc.credentialsJSON = data
+		gc.tokenSource = nil
+		return nil
+	}
+}
+
+// WithWorkloadIdentityFederation makes the client use a workload identity federation configuration file,
+// as created by "gcloud iam workload-identity-pools create-cred-config", for exchanging credentials from
+// another identity provider (like AWS, Azure or a CI system with OIDC tokens) for Google Cloud credentials.
+func WithWorkloadIdentityFederation(configFilename string) Option {
+	return func(gc *GeminiClient) error {
+		data, err := os.ReadFile(configFilename)
+		if err != nil {
+			return fmt.Errorf("failed to read the workload identity federation configuration: %v", err)
+		}
+		var f credentialsFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			return fmt.Errorf("invalid workload identity federation configuration: %v", err)
+		}
+		if f.Type != "external_account" {
+			return fmt.Errorf("invalid workload identity federation configuration: the type is %q and not \"external_account\"", f.Type)
+		}
+		return WithCredentialsJSON(data)(gc)
+	}
+}
+
+// WithTokenSource makes the client use the given token source for the OAuth2 access tokens,
+// instead of the Application Default Credentials. The tokens need the cloud-platform scope.
+func WithTokenSource(tokenSource oauth2.TokenSource) Option {
+	return func(gc *GeminiClient) error {
+		if tokenSource == nil {
+			return errors.New("the token source is nil")
+		}
+		gc.tokenSource = tokenSource
+		gc.credentialsJSON = nil
+		return nil
+	}
+}
+
+// WithImpersonation makes the client act as the given service account, like "vertex@my-project.iam.gserviceaccount.com",
+// by using the other credentials to create short-lived tokens for it. This needs the Service Account Token Creator role
+// on the target service account. Delegates are service accounts in a chain of impersonation, if there is one.
+func WithImpersonation(targetPrincipal string, delegates ...string) Option {
+	return func(gc *GeminiClient) error {
+		if targetPrincipal == "" {
+			return errors.New("the service account to impersonate is empty")
+		}
+		gc.impersonate = &impersonate.CredentialsConfig{
+			TargetPrincipal: targetPrincipal,
+			Delegates:       delegates,
+			Scopes:          []string{cloudPlatformScope},
+		}
+		return nil
+	}
+}
+
+// credentials returns the configured credentials, or the Application Default Credentials if none are configured,
+// together with a token source for them. The credentials are nil if only a token source is available.
+func (gc *GeminiClient) credentials(ctx context.Context) (*google.Credentials, oauth2.TokenSource, error) {
+	var (
+		creds       *google.Credentials
+		tokenSource = gc.tokenSource
+		err         error
+	)
+	switch {
+	case tokenSource != nil:
+	case gc.credentialsJSON != nil:
+		creds, err = google.CredentialsFromJSON(ctx, gc.credentialsJSON, cloudPlatformScope)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to use the credentials: %v", err)
+		}
+		tokenSource = creds.TokenSource
+	default:
+		creds, err = google.FindDefaultCredentials(ctx, cloudPlatformScope)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrNoCredentials, err)
+		}
+		tokenSource = creds.TokenSource
+	}
+	if gc.impersonate == nil {
+		return creds, tokenSource, nil
+	}
+	tokenSource, err = impersonate.CredentialsTokenSource(ctx, *gc.impersonate, option.WithTokenSource(tokenSource))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to impersonate %s: %v", gc.impersonate.TargetPrincipal, err)
+	}
+	return nil, tokenSource, nil
+}
+
+// credentialOptions returns the client options for the configured credentials,
+// or for the Application Default Credentials if none are configured.
+func (gc *GeminiClient) credentialOptions(ctx context.Context) ([]option.ClientOption, error) {
+	creds, tokenSource, err := gc.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if creds != nil {
+		return []option.ClientOption{option.WithCredentials(creds)}, nil
+	}
+	return []option.ClientOption{option.WithTokenSource(tokenSource)}, nil
+}
+
+// vertexError makes PermissionDenied errors from Vertex AI match ErrPermissionDenied.
+func vertexError(projectID string, err error) error {
+	if err != nil && errorCode(err) == codes.PermissionDenied {
+		return &permissionError{projectID: projectID, err: err}
+	}
+	return err
+}
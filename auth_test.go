@@ -0,0 +1,86 @@
+package geminiclient_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/xyproto/env/v2"
+	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// clearProjectID makes sure that the project ID from the environment is not used.
+func clearProjectID(t *testing.T) {
+	t.Cleanup(env.Load)
+	t.Setenv("GCP_PROJECT_ID", "")
+	t.Setenv("PROJECT_ID", "")
+	t.Setenv("GEMINI_API_KEY", "")
+	t.Setenv("GOOGLE_API_KEY", "")
+	env.Load()
+}
+
+func TestNoCredentials(t *testing.T) {
+	clearProjectID(t)
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "/nonexistent/credentials.json")
+	_, err := geminiclient.NewText("gemini-1.5-flash", "us-central1", "test-project", 0)
+	if !errors.Is(err, geminiclient.ErrNoCredentials) {
+		t.Errorf("Expected ErrNoCredentials but got %v", err)
+	}
+}
+
+func TestTokenSource(t *testing.T) {
+	clearProjectID(t)
+	server := geminitest.NewVertexServer(t, geminitest.NewRules())
+	server.Token = "secret"
+	gc, err := geminiclient.NewText("gemini-1.5-flash", "us-central1", "test-project", 0,
+		geminiclient.WithEndpoint(server.URL),
+		geminiclient.WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "secret"})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := gc.Query("Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Hello" {
+		t.Errorf("Expected \"Hello\" but got %q", result)
+	}
+	headers := server.Headers()
+	if auth := headers[len(headers)-1].Get("Authorization"); auth != "Bearer secret" {
+		t.Errorf("Expected \"Bearer secret\" but got %q", auth)
+	}
+}
+
+func TestCredentialsJSON(t *testing.T) {
+	clearProjectID(t)
+	serviceAccount := []byte(`{"type": "service_account", "project_id": "sa-project", "client_email": "sa@sa-project.iam.gserviceaccount.com", "private_key": "", "token_uri": "https://oauth2.googleapis.com/token"}`)
+	gc, err := geminiclient.NewText("gemini-1.5-flash", "us-central1", "", 0, geminiclient.WithCredentialsJSON(serviceAccount))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.ProjectID != "sa-project" {
+		t.Errorf("Expected the project ID of the service account but got %q", gc.ProjectID)
+	}
+	if _, err := geminiclient.NewText("gemini-1.5-flash", "us-central1", "test-project", 0, geminiclient.WithCredentialsJSON([]byte("{"))); err == nil {
+		t.Error("Expected an error for invalid JSON")
+	}
+}
+
+func TestPermissionDenied(t *testing.T) {
+	fake := geminitest.New()
+	server := geminitest.NewVertexServer(t, fake)
+	for name, gc := range map[string]*geminiclient.GeminiClient{
+		"REST": server.NewClient(t),
+		"gRPC": server.NewGRPCClient(t),
+	} {
+		fake.QueueError(status.Error(codes.PermissionDenied, "Permission 'aiplatform.endpoints.predict' denied"))
+		_, err := gc.Query("Hello")
+		if !errors.Is(err, geminiclient.ErrPermissionDenied) || !strings.Contains(err.Error(), "aiplatform.endpoints.predict") {
+			t.Errorf("%s: Expected ErrPermissionDenied with the original message, but got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package geminiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// ModelConfig is the model name and the settings that are sent along with every request to a model.
+type ModelConfig struct {
+	ModelName         string
+	GenerationConfig  genai.GenerationConfig
+	SystemInstruction *genai.Content
+	Tools             []*genai.Tool
+	SafetySettings    []*genai.SafetySetting
+}
+
+// Backend is a provider of generative models, like Vertex AI. The genai types are used for the
+// contents and the responses, no matter which provider is used.
+// Implementations must be safe for concurrent use.
+type Backend interface {
+	// GenerateContent sends the given contents, which is the conversation so far, to the model
+	GenerateContent(ctx context.Context, cfg *ModelConfig, contents ...*genai.Content) (*genai.GenerateContentResponse, error)
+	// GenerateContentStream is like GenerateContent, but streams the response. The iterator returns iterator.Done at the end.
+	GenerateContentStream(ctx context.Context, cfg *ModelConfig, contents ...*genai.Content) ResponseIterator
+	// CountTokens counts the tokens in the given parts
+	CountTokens(ctx context.Context, cfg *ModelConfig, parts ...genai.Part) (int, error)
+	// StartChat starts a new chat session, where the history is sent along with every message
+	StartChat(cfg *ModelConfig) ChatSession
+}
+
+// LocationBackend is a Backend that can create a Backend for another location, which is needed by SetLocations.
+type LocationBackend interface {
+	Backend
+	WithLocation(ctx context.Context, location string) (Backend, error)
+}
+
+// ResponseIterator returns the responses of a streaming request, one by one.
+type ResponseIterator interface {
+	Next() (*genai.GenerateContentResponse, error)
+}
+
+// ChatSession is a conversation with a model.
+type ChatSession interface {
+	// SendMessage sends the given parts, together with the history, and adds both the parts and the response to the history
+	SendMessage(ctx context.Context, parts ...genai.Part) (*genai.GenerateContentResponse, error)
+	History() []*genai.Content
+	SetHistory(history []*genai.Content)
+}
+
+// chatSession is a ChatSession for any Backend.
+type chatSession struct {
+	backend Backend
+	cfg     *ModelConfig
+	history []*genai.Content
+}
+
+// ErrNoBackend is returned when a client has neither a Backend nor a Vertex AI client.
+var ErrNoBackend = errors.New("no backend is configured")
+
+// NewChatSession returns a ChatSession that keeps the history itself, and sends it with backend.GenerateContent.
+// It can be used by Backend implementations that have no chat sessions of their own.
+func NewChatSession(backend Backend, cfg *ModelConfig) ChatSession {
+	return &chatSession{backend: backend, cfg: cfg}
+}
+
+// SendMessage sends the given parts, together with the history, and adds both the parts and the response to the history.
+func (cs *chatSession) SendMessage(ctx context.Context, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	cs.history = append(cs.history, genai.NewUserContent(parts...))
+	res, err := cs.backend.GenerateContent(ctx, cs.cfg, cs.history...)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Candidates) > 0 && res.Candidates[0] != nil && res.Candidates[0].Content != nil {
+		content := *res.Candidates[0].Content
+		content.Role = "model"
+		cs.history = append(cs.history, &content)
+	}
+	return res, nil
+}
+
+// History returns the messages so far.
+func (cs *chatSession) History() []*genai.Content {
+	return cs.history
+}
+
+// SetHistory replaces the messages so far.
+func (cs *chatSession) SetHistory(history []*genai.Content) {
+	cs.history = history
+}
+
+// SetBackend makes the client use the given backend, instead of Vertex AI.
+// Other locations than gc.ProjectLocation can only be used if the backend is a LocationBackend.
+func (gc *GeminiClient) SetBackend(backend Backend) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	gc.Backend = backend
+	gc.backends = nil
+}
+
+// backend returns the backend for the given location, creating and keeping it if needed.
+// The backend for a new location is created without holding gc.mu, since that may need network access.
+func (gc *GeminiClient) backend(ctx context.Context, location string) (Backend, error) {
+	gc.mu.Lock()
+	primary := gc.Backend
+	if primary == nil {
+		if gc.Client == nil {
+			gc.mu.Unlock()
+			return nil, ErrNoBackend
+		}
+		// The client was created or replaced by hand
+		primary = &VertexBackend{Client: gc.Client, ProjectID: gc.ProjectID, Location: gc.ProjectLocation}
+	}
+	if location == "" || location == gc.ProjectLocation {
+		gc.mu.Unlock()
+		return primary, nil
+	}
+	if b, ok := gc.backends[location]; ok {
+		gc.mu.Unlock()
+		return b, nil
+	}
+	gc.mu.Unlock()
+
+	lb, ok := primary.(LocationBackend)
+	if !ok {
+		return nil, fmt.Errorf("the backend can not be used for other locations than %s", gc.ProjectLocation)
+	}
+	b, err := lb.WithLocation(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if existing, ok := gc.backends[location]; ok {
+		// Another request created a backend for the same location in the meantime
+		if closer, ok := b.(io.Closer); ok {
+			closer.Close()
+		}
+		return existing, nil
+	}
+	if gc.Backend != nil && gc.Backend != primary {
+		return b, nil // the backend was replaced in the meantime, so do not keep a backend that was made from the old one
+	}
+	if gc.backends == nil {
+		gc.backends = make(map[string]Backend)
+	}
+	gc.backends[location] = b
+	return b, nil
+}
+
+// joinResponses merges a streamed response into the responses that have been streamed so far.
+// Text parts are concatenated, and the last finish reason and usage metadata are kept.
+func joinResponses(merged, res *genai.GenerateContentResponse) *genai.GenerateContentResponse {
+	if merged == nil {
+		merged = &genai.GenerateContentResponse{}
+	}
+	if res.PromptFeedback != nil {
+		merged.PromptFeedback = res.PromptFeedback
+	}
+	if res.UsageMetadata != nil {
+		merged.UsageMetadata = res.UsageMetadata
+	}
+	for i, candidate := range res.Candidates {
+		if candidate == nil {
+			continue
+		}
+		if i >= len(merged.Candidates) {
+			c := *candidate
+			if candidate.Content != nil {
+				c.Content = &genai.Content{Role: candidate.Content.Role, Parts: slices.Clone(candidate.Content.Parts)}
+			}
+			merged.Candidates = append(merged.Candidates, &c)
+			continue
+		}
+		m := merged.Candidates[i]
+		m.FinishReason = candidate.FinishReason
+		if candidate.SafetyRatings != nil {
+			m.SafetyRatings = candidate.SafetyRatings
+		}
+		if candidate.Content == nil {
+			continue
+		}
+		if m.Content == nil {
+			m.Content = &genai.Content{Role: candidate.Content.Role}
+		}
+		for _, part := range candidate.Content.Parts {
+			last := len(m.Content.Parts) - 1
+			if text, ok := part.(genai.Text); ok && last >= 0 {
+				if prev, ok := m.Content.Parts[last].(genai.Text); ok {
+					m.Content.Parts[last] = prev + text
+					continue
+				}
+			}
+			m.Content.Parts = append(m.Content.Parts, part)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,92 @@
+package geminiclient_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/geminiclient"
+	"google.golang.org/api/iterator"
+)
+
+// echoBackend is a Backend that responds with the text of the last message, in upper case.
+type echoBackend struct{}
+
+func (echoBackend) GenerateContent(ctx context.Context, cfg *geminiclient.ModelConfig, contents ...*genai.Content) (*genai.GenerateContentResponse, error) {
+	var sb strings.Builder
+	for _, part := range contents[len(contents)-1].Parts {
+		if text, ok := part.(genai.Text); ok {
+			sb.WriteString(strings.ToUpper(string(text)))
+		}
+	}
+	return &genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{{Content: genai.NewUserContent(genai.Text(sb.String()))}},
+	}, nil
+}
+
+func (b echoBackend) GenerateContentStream(ctx context.Context, cfg *geminiclient.ModelConfig, contents ...*genai.Content) geminiclient.ResponseIterator {
+	res, _ := b.GenerateContent(ctx, cfg, contents...)
+	return &sliceIterator{responses: []*genai.GenerateContentResponse{res, res}}
+}
+
+func (echoBackend) CountTokens(ctx context.Context, cfg *geminiclient.ModelConfig, parts ...genai.Part) (int, error) {
+	return len(parts), nil
+}
+
+func (b echoBackend) StartChat(cfg *geminiclient.ModelConfig) geminiclient.ChatSession {
+	return geminiclient.NewChatSession(b, cfg)
+}
+
+type sliceIterator struct {
+	responses []*genai.GenerateContentResponse
+}
+
+func (it *sliceIterator) Next() (*genai.GenerateContentResponse, error) {
+	if len(it.responses) == 0 {
+		return nil, iterator.Done
+	}
+	res := it.responses[0]
+	it.responses = it.responses[1:]
+	return res, nil
+}
+
+func TestSetBackend(t *testing.T) {
+	gc := &geminiclient.GeminiClient{ModelName: "echo"}
+	gc.SetBackend(echoBackend{})
+
+	res, err := gc.Generate(context.Background(), geminiclient.NewTextRequest("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "HELLO" {
+		t.Errorf("Expected \"HELLO\" but got %q", res.Text)
+	}
+
+	var streamed []string
+	res, err = gc.GenerateStream(context.Background(), geminiclient.NewTextRequest("hi"), func(s string) {
+		streamed = append(streamed, s)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streamed) != 2 || res.Text != "HIHI" {
+		t.Errorf("Expected two streamed parts and \"HIHI\" but got %v and %q", streamed, res.Text)
+	}
+	if text := res.Raw.Candidates[0].Content.Parts[0]; text != genai.Text("HIHI") {
+		t.Errorf("Expected the streamed parts to be merged, but got %v", text)
+	}
+
+	gc.Parts = []genai.Part{genai.Text("a"), genai.Text("b")}
+	n, err := gc.CountTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 but got %d", n)
+	}
+
+	if _, err := (&geminiclient.GeminiClient{}).Generate(context.Background(), geminiclient.NewTextRequest("hello")); err == nil {
+		t.Error("Expected an error when there is no backend")
+	}
+}
@@ -0,0 +1,231 @@
+package geminiclient
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// CircuitState is the state of a circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed means that requests are sent as usual
+	CircuitClosed CircuitState = iota
+	// CircuitOpen means that requests fail fast with ErrCircuitOpen
+	CircuitOpen
+	// CircuitHalfOpen means that a limited number of requests are sent, to find out if the backend has recovered
+	CircuitHalfOpen
+)
+
+// ErrCircuitOpen is returned, without contacting the backend, when the circuit breaker for a model and location is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreakerPolicy configures the circuit breakers, one per model and location.
+type CircuitBreakerPolicy struct {
+	Enabled        bool
+	ErrorRate      float64       // the fraction of failed requests within the window that opens the circuit, like 0.5
+	MinRequests    int           // how many requests there must be within the window before the error rate is used
+	Window         time.Duration // how far back in time requests are counted
+	OpenDuration   time.Duration // how long the circuit stays open before it is half-opened
+	HalfOpenProbes int           // how many successful requests are needed in the half-open state to close the circuit
+
+	// OnStateChange is called, if set, every time a circuit changes state
+	OnStateChange func(modelName, location string, from, to CircuitState)
+}
+
+// CircuitStatus is the state of the circuit breaker for a single model and location.
+type CircuitStatus struct {
+	ModelName string
+	Location  string
+	State     CircuitState
+}
+
+// circuit is the circuit breaker for a single model and location.
+type circuit struct {
+	state     CircuitState
+	outcomes  []circuitOutcome // the requests within the window, oldest first
+	openedAt  time.Time
+	probes    int // probes in flight, when half-open
+	successes int // successful probes, when half-open
+}
+
+type circuitOutcome struct {
+	at     time.Time
+	failed bool
+}
+
+type circuitKey struct {
+	modelName string
+	location  string
+}
+
+// DefaultCircuitBreakerPolicy returns a circuit breaker policy that opens when at least half of
+// at least 10 requests within a minute have failed, and probes again after 30 seconds.
+func DefaultCircuitBreakerPolicy() CircuitBreakerPolicy {
+	return CircuitBreakerPolicy{
+		Enabled:        true,
+		ErrorRate:      0.5,
+		MinRequests:    10,
+		Window:         time.Minute,
+		OpenDuration:   30 * time.Second,
+		HalfOpenProbes: 1,
+	}
+}
+
+// String returns the name of the circuit state.
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// SetCircuitBreaker configures the circuit breakers that are used for every model and location.
+func (gc *GeminiClient) SetCircuitBreaker(policy CircuitBreakerPolicy) {
+	gc.CircuitBreaker = policy
+}
+
+// CircuitState returns the state of the circuit breaker for the given model and location.
+func (gc *GeminiClient) CircuitState(modelName, location string) CircuitState {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if c, ok := gc.circuits[circuitKey{modelName, location}]; ok {
+		return c.state
+	}
+	return CircuitClosed
+}
+
+// CircuitStates returns the state of all circuit breakers that have been used, for instance
+// for reporting a degraded mode from a health endpoint.
+func (gc *GeminiClient) CircuitStates() []CircuitStatus {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	statuses := make([]CircuitStatus, 0, len(gc.circuits))
+	for key, c := range gc.circuits {
+		statuses = append(statuses, CircuitStatus{ModelName: key.modelName, Location: key.location, State: c.state})
+	}
+	return statuses
+}
+
+// circuitFailure returns true if the given error indicates a problem with the backend,
+// as opposed to a problem with the request.
+func circuitFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	switch errorCode(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
+
+// allow returns ErrCircuitOpen if requests to the given model and location should fail fast.
+// If it returns nil, done must be called with the result of the request.
+func (gc *GeminiClient) allow(modelName, location string) (done func(error), err error) {
+	if !gc.CircuitBreaker.Enabled {
+		return func(error) {}, nil
+	}
+	key := circuitKey{modelName, location}
+	gc.mu.Lock()
+	if gc.circuits == nil {
+		gc.circuits = make(map[circuitKey]*circuit)
+	}
+	c, ok := gc.circuits[key]
+	if !ok {
+		c = &circuit{}
+		gc.circuits[key] = c
+	}
+	var transition func()
+	if c.state == CircuitOpen && time.Since(c.openedAt) >= gc.CircuitBreaker.OpenDuration {
+		transition = gc.setState(key, c, CircuitHalfOpen)
+	}
+	probe := c.state == CircuitHalfOpen
+	if c.state == CircuitOpen || (probe && c.probes >= max(gc.CircuitBreaker.HalfOpenProbes, 1)) {
+		gc.mu.Unlock()
+		if transition != nil {
+			transition()
+		}
+		return nil, ErrCircuitOpen
+	}
+	if probe {
+		c.probes++
+	}
+	gc.mu.Unlock()
+	if transition != nil {
+		transition()
+	}
+	return func(err error) {
+		gc.recordCircuit(key, c, probe, err)
+	}, nil
+}
+
+// recordCircuit records the result of a request and changes the state of the circuit if needed.
+func (gc *GeminiClient) recordCircuit(key circuitKey, c *circuit, probe bool, err error) {
+	failed := circuitFailure(err)
+	now := time.Now()
+	gc.mu.Lock()
+	var transition func()
+	switch {
+	case probe:
+		c.probes--
+		if c.state != CircuitHalfOpen {
+			break
+		}
+		if failed {
+			c.openedAt = now
+			transition = gc.setState(key, c, CircuitOpen)
+		} else if err == nil {
+			c.successes++
+			if c.successes >= max(gc.CircuitBreaker.HalfOpenProbes, 1) {
+				transition = gc.setState(key, c, CircuitClosed)
+			}
+		}
+	case c.state == CircuitClosed && (err == nil || failed):
+		c.outcomes = append(c.outcomes, circuitOutcome{at: now, failed: failed})
+		i := 0
+		for i < len(c.outcomes) && now.Sub(c.outcomes[i].at) > gc.CircuitBreaker.Window {
+			i++
+		}
+		c.outcomes = c.outcomes[i:]
+		failures := 0
+		for _, outcome := range c.outcomes {
+			if outcome.failed {
+				failures++
+			}
+		}
+		if len(c.outcomes) >= gc.CircuitBreaker.MinRequests && float64(failures) >= gc.CircuitBreaker.ErrorRate*float64(len(c.outcomes)) && failures > 0 {
+			c.openedAt = now
+			transition = gc.setState(key, c, CircuitOpen)
+		}
+	}
+	gc.mu.Unlock()
+	if transition != nil {
+		transition()
+	}
+}
+
+// setState changes the state of the circuit, and returns a function that calls the OnStateChange callback,
+// which must be called after gc.mu has been unlocked. gc.mu must be held.
+func (gc *GeminiClient) setState(key circuitKey, c *circuit, to CircuitState) func() {
+	from := c.state
+	c.state = to
+	c.outcomes = nil
+	c.successes = 0
+	callback := gc.CircuitBreaker.OnStateChange
+	if callback == nil || from == to {
+		return nil
+	}
+	return func() {
+		callback(key.modelName, key.location, from, to)
+	}
+}
@@ -0,0 +1,156 @@
+package geminiclient_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// transitions records the state changes of circuit breakers
+type transitions struct {
+	mu      sync.Mutex
+	changes []string
+}
+
+func (tr *transitions) record(modelName, location string, from, to geminiclient.CircuitState) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.changes = append(tr.changes, fmt.Sprintf("%s in %s: %s -> %s", modelName, location, from, to))
+}
+
+func (tr *transitions) String() string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return fmt.Sprint(tr.changes)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var tr transitions
+	gc, fake := geminitest.NewClient(t, geminiclient.WithLocation("us-central1"), geminiclient.WithCircuitBreaker(geminiclient.CircuitBreakerPolicy{
+		Enabled:        true,
+		ErrorRate:      0.5,
+		MinRequests:    4,
+		Window:         time.Minute,
+		OpenDuration:   50 * time.Millisecond,
+		HalfOpenProbes: 1,
+		OnStateChange:  tr.record,
+	}))
+	generate := func() error {
+		_, err := gc.Generate(context.Background(), geminiclient.NewTextRequest("What is the capital of Norway?"))
+		return err
+	}
+	state := func() geminiclient.CircuitState {
+		return gc.CircuitState(geminitest.DefaultModelName, "us-central1")
+	}
+	unavailable := status.Error(codes.Unavailable, "service unavailable")
+
+	// The circuit opens when half of at least 4 requests have failed
+	fake.QueueText("Oslo")
+	fake.QueueError(unavailable)
+	fake.QueueText("Oslo")
+	for i := 0; i < 3; i++ {
+		generate()
+	}
+	if state() != geminiclient.CircuitClosed {
+		t.Fatalf("Expected the circuit to be closed after 3 requests, but it is %s", state())
+	}
+	fake.QueueError(unavailable)
+	generate()
+	if state() != geminiclient.CircuitOpen {
+		t.Fatalf("Expected the circuit to be open after 2 of 4 requests failed, but it is %s", state())
+	}
+
+	// Requests fail fast, without reaching the backend
+	if err := generate(); !errors.Is(err, geminiclient.ErrCircuitOpen) || len(fake.Requests()) != 4 {
+		t.Errorf("Expected ErrCircuitOpen without a request, but got %v and %d requests", err, len(fake.Requests()))
+	}
+
+	// After the cooldown, a failed probe opens the circuit again
+	time.Sleep(60 * time.Millisecond)
+	fake.QueueError(unavailable)
+	if err := generate(); status.Code(err) != codes.Unavailable || state() != geminiclient.CircuitOpen {
+		t.Errorf("Expected the failed probe to open the circuit again, but got %v and %s", err, state())
+	}
+	if err := generate(); !errors.Is(err, geminiclient.ErrCircuitOpen) {
+		t.Errorf("Expected ErrCircuitOpen after the failed probe, but got %v", err)
+	}
+
+	// After the next cooldown, only a single probe is sent, and it closes the circuit when it succeeds
+	time.Sleep(60 * time.Millisecond)
+	fake.QueueText("Oslo").WithDelay(100 * time.Millisecond)
+	probed := make(chan error)
+	go func() {
+		probed <- generate()
+	}()
+	time.Sleep(30 * time.Millisecond)
+	if err := generate(); !errors.Is(err, geminiclient.ErrCircuitOpen) || state() != geminiclient.CircuitHalfOpen {
+		t.Errorf("Expected ErrCircuitOpen while the probe is in flight, but got %v and %s", err, state())
+	}
+	if err := <-probed; err != nil || state() != geminiclient.CircuitClosed {
+		t.Errorf("Expected the successful probe to close the circuit, but got %v and %s", err, state())
+	}
+	if n := len(fake.Requests()); n != 6 {
+		t.Errorf("Expected 6 requests to reach the backend, but got %d", n)
+	}
+
+	prefix := geminitest.DefaultModelName + " in us-central1: "
+	expected := fmt.Sprint([]string{
+		prefix + "closed -> open",
+		prefix + "open -> half-open",
+		prefix + "half-open -> open",
+		prefix + "open -> half-open",
+		prefix + "half-open -> closed",
+	})
+	if tr.String() != expected {
+		t.Errorf("Expected the transitions %s, but got %s", expected, tr.String())
+	}
+}
+
+func TestCircuitBreakerKeys(t *testing.T) {
+	policy := geminiclient.DefaultCircuitBreakerPolicy()
+	policy.MinRequests = 1
+	gc, backend := regionalClient(t, geminiclient.WithCircuitBreaker(policy))
+	us, europe := backend.fakes["us-central1"], backend.fakes["europe-west4"]
+	us.QueueError(status.Error(codes.Unavailable, "service unavailable"))
+	europe.QueueText("Oslo")
+	europe.QueueText("Oslo")
+	us.QueueText("Bergen")
+
+	// The circuit for us-central1 opens, so the next request fails over to europe-west4 without reaching us-central1
+	for i := 0; i < 2; i++ {
+		res, err := gc.Generate(context.Background(), geminiclient.NewTextRequest("What is the capital of Norway?"))
+		if err != nil || res.Metadata.Location != "europe-west4" {
+			t.Fatalf("Expected an answer from europe-west4, but got %v and %v", res, err)
+		}
+	}
+	if n := len(us.Requests()); n != 1 {
+		t.Errorf("Expected 1 request to us-central1, but got %d", n)
+	}
+
+	// Other models in us-central1 have their own circuit
+	res, err := gc.Generate(context.Background(), geminiclient.NewTextRequest("What is the second largest city in Norway?").WithModel("gemini-1.5-pro"))
+	if err != nil || res.Text != "Bergen" || res.Metadata.Location != "us-central1" {
+		t.Errorf("Expected \"Bergen\" from us-central1, but got %v and %v", res, err)
+	}
+
+	for _, s := range []struct {
+		modelName, location string
+		state               geminiclient.CircuitState
+	}{
+		{geminitest.DefaultModelName, "us-central1", geminiclient.CircuitOpen},
+		{geminitest.DefaultModelName, "europe-west4", geminiclient.CircuitClosed},
+		{"gemini-1.5-pro", "us-central1", geminiclient.CircuitClosed},
+	} {
+		if state := gc.CircuitState(s.modelName, s.location); state != s.state {
+			t.Errorf("Expected the circuit for %s in %s to be %s, but it is %s", s.modelName, s.location, s.state, state)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package geminiclient
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// Cache stores responses by a key that is a canonical hash of the request, see CacheKey.
+// Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the cached response for the given key, or false if there is none or if it has expired
+	Get(key string) (*CachedResponse, bool)
+	// Set stores the given response for the given key
+	Set(key string, entry *CachedResponse) error
+}
+
+// CachedResponse is a response that has been stored in a Cache.
+type CachedResponse struct {
+	Text          string               `json:"text"`
+	ModelName     string               `json:"modelName"`
+	Location      string               `json:"location"`
+	UsageMetadata *genai.UsageMetadata `json:"usageMetadata,omitempty"`
+	Created       time.Time            `json:"created"`
+	Expires       time.Time            `json:"expires,omitempty"` // the zero time means that the entry never expires
+}
+
+// CacheStats is the number of cache hits and misses for a client.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// MemoryCache is an in-memory Cache that evicts the least recently used entries when it is full.
+type MemoryCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List // the most recently used entries first
+}
+
+type memoryCacheEntry struct {
+	key   string
+	entry *CachedResponse
+}
+
+// DirCache is a Cache that stores one JSON file per response in a directory,
+// named after the key, so that it can be kept between runs and shared between processes.
+type DirCache struct {
+	dir string
+}
+
+// NewMemoryCache creates a new in-memory LRU cache that holds at most the given number of responses.
+func NewMemoryCache(capacity int) *MemoryCache {
+	return &MemoryCache{
+		capacity: max(capacity, 1),
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get returns the cached response for the given key, if it exists and has not expired.
+func (c *MemoryCache) Get(key string) (*CachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*memoryCacheEntry).entry
+	if entry.expired() {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry, true
+}
+
+// Set stores the given response, evicting the least recently used response if the cache is full.
+func (c *MemoryCache) Set(key string, entry *CachedResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*memoryCacheEntry).entry = entry
+		c.order.MoveToFront(element)
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(&memoryCacheEntry{key: key, entry: entry})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+	return nil
+}
+
+// Len returns the number of responses in the cache.
+func (c *MemoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// NewDirCache creates a new cache that stores responses in the given directory, creating it if needed.
+func NewDirCache(dir string) (*DirCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %v", err)
+	}
+	return &DirCache{dir: dir}, nil
+}
+
+// path returns the filename for the given key. The first two characters are used as a subdirectory.
+func (c *DirCache) path(key string) string {
+	if len(key) < 2 {
+		return filepath.Join(c.dir, key+".json")
+	}
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// Get returns the cached response for the given key, if it exists and has not expired.
+// Expired responses are removed.
+func (c *DirCache) Get(key string) (*CachedResponse, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var entry CachedResponse
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+	if entry.expired() {
+		os.Remove(c.path(key))
+		return nil, false
+	}
+	return &entry, true
+}
+
+// Set stores the given response in a file. The file is written to a temporary file first,
+// so that other processes never see a partially written response.
+func (c *DirCache) Set(key string, entry *CachedResponse) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	filename := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(filename), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// expired returns true if the entry has an expiry time that has passed.
+func (entry *CachedResponse) expired() bool {
+	return !entry.Expires.IsZero() && time.Now().After(entry.Expires)
+}
+
+// SetCache configures a cache for responses, where each response is kept for the given duration (0 for no expiry).
+// A cache is mainly useful for deterministic requests, with a temperature of 0.
+func (gc *GeminiClient) SetCache(cache Cache, ttl time.Duration) {
+	gc.Cache = cache
+	gc.CacheTTL = ttl
+}
+
+// CacheStats returns the number of cache hits and misses for this client.
+func (gc *GeminiClient) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:   gc.cacheHits.Load(),
+		Misses: gc.cacheMisses.Load(),
+	}
+}
+
+// canonicalPart is a JSON-friendly representation of a part, where blobs are represented by a hash of their data.
+type canonicalPart struct {
+	Type     string         `json:"type"`
+	Text     string         `json:"text,omitempty"`
+	MIMEType string         `json:"mimeType,omitempty"`
+	Hash     string         `json:"hash,omitempty"`
+	URI      string         `json:"uri,omitempty"`
+	Name     string         `json:"name,omitempty"`
+	Args     map[string]any `json:"args,omitempty"`
+}
+
+// CacheKey returns a canonical hash of everything in the request that affects the response:
+// the model name, the generation config, the system instruction, the safety settings, the tools and all parts, including blob data.
+func (gc *GeminiClient) CacheKey(req *Request) (string, error) {
+	parts := make([]canonicalPart, 0, len(req.parts))
+	for _, part := range req.parts {
+		switch p := part.(type) {
+		case genai.Text:
+			parts = append(parts, canonicalPart{Type: "text", Text: string(p)})
+		case genai.Blob:
+			sum := sha256.Sum256(p.Data)
+			parts = append(parts, canonicalPart{Type: "blob", MIMEType: p.MIMEType, Hash: hex.EncodeToString(sum[:])})
+		case genai.FileData:
+			parts = append(parts, canonicalPart{Type: "file", MIMEType: p.MIMEType, URI: p.FileURI})
+		case genai.FunctionCall:
+			parts = append(parts, canonicalPart{Type: "functionCall", Name: p.Name, Args: p.Args})
+		case genai.FunctionResponse:
+			parts = append(parts, canonicalPart{Type: "functionResponse", Name: p.Name, Args: p.Response})
+		default:
+			return "", fmt.Errorf("can not create a cache key for part of type %T", part)
+		}
+	}
+	canonical := struct {
+		ModelName         string                 `json:"modelName"`
+		GenerationConfig  genai.GenerationConfig `json:"generationConfig"`
+		SystemInstruction string                 `json:"systemInstruction,omitempty"`
+		SafetySettings    []*genai.SafetySetting `json:"safetySettings,omitempty"`
+		Tools             []*genai.Tool          `json:"tools,omitempty"`
+		Parts             []canonicalPart        `json:"parts"`
+	}{
+		ModelName:         gc.requestModelName(req),
+		GenerationConfig:  gc.generationConfig(req),
+		SystemInstruction: gc.systemInstruction(req),
+		SafetySettings:    gc.SafetySettings,
+		Tools:             req.tools,
+		Parts:             parts,
+	}
+	data, err := json.Marshal(canonical) // map keys are sorted by encoding/json
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// WithCacheBypass returns a copy of the request that is neither read from nor written to the cache.
+func (req *Request) WithCacheBypass() *Request {
+	c := req.clone()
+	c.bypassCache = true
+	return c
+}
+
+// cacheLookup returns the cache key for the request and the cached response, if there is one.
+// The key is blank if the cache should not be used for this request.
+func (gc *GeminiClient) cacheLookup(req *Request) (string, *Response) {
+	if gc.Cache == nil || req.bypassCache {
+		return "", nil
+	}
+	key, err := gc.CacheKey(req)
+	if err != nil {
+		if gc.Verbose {
+			fmt.Printf("Not using the cache: %v\n", err)
+		}
+		return "", nil
+	}
+	entry, ok := gc.Cache.Get(key)
+	if !ok {
+		gc.cacheMisses.Add(1)
+		return key, nil
+	}
+	gc.cacheHits.Add(1)
+	if gc.Verbose {
+		fmt.Printf("Using a cached response from %s.\n", entry.Created.Format(time.RFC3339))
+	}
+	return key, &Response{
+		Text: entry.Text,
+		Raw: &genai.GenerateContentResponse{
+			Candidates: []*genai.Candidate{{
+				Content:      &genai.Content{Role: "model", Parts: []genai.Part{genai.Text(entry.Text)}},
+				FinishReason: genai.FinishReasonStop,
+			}},
+			UsageMetadata: entry.UsageMetadata,
+		},
+		Metadata: ResponseMetadata{
+			UsageMetadata: entry.UsageMetadata,
+			ModelName:     entry.ModelName,
+			Location:      entry.Location,
+			Cached:        true,
+		},
+	}
+}
+
+// cacheStore stores the given response in the cache, if the key is not blank.
+func (gc *GeminiClient) cacheStore(key string, res *Response) {
+	if key == "" || gc.Cache == nil {
+		return
+	}
+	entry := &CachedResponse{
+		Text:          res.Text,
+		ModelName:     res.Metadata.ModelName,
+		Location:      res.Metadata.Location,
+		UsageMetadata: res.Metadata.UsageMetadata,
+		Created:       time.Now(),
+	}
+	if gc.CacheTTL > 0 {
+		entry.Expires = entry.Created.Add(gc.CacheTTL)
+	}
+	if err := gc.Cache.Set(key, entry); err != nil && gc.Verbose {
+		fmt.Printf("Could not store the response in the cache: %v\n", err)
+	}
+}
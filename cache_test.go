@@ -0,0 +1,104 @@
+package geminiclient_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xyproto/geminiclient"
+)
+
+func TestMemoryCacheEviction(t *testing.T) {
+	cache := geminiclient.NewMemoryCache(2)
+	cache.Set("a", &geminiclient.CachedResponse{Text: "A"})
+	cache.Set("b", &geminiclient.CachedResponse{Text: "B"})
+	cache.Get("a") // "b" is now the least recently used
+	cache.Set("c", &geminiclient.CachedResponse{Text: "C"})
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+	if entry, ok := cache.Get("a"); !ok || entry.Text != "A" {
+		t.Errorf("Expected \"A\" to still be cached, but got %v", entry)
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Expected 2 entries but got %d", cache.Len())
+	}
+
+	cache.Set("d", &geminiclient.CachedResponse{Text: "D", Expires: time.Now().Add(-time.Second)})
+	if _, ok := cache.Get("d"); ok {
+		t.Error("Expected an expired entry to not be returned")
+	}
+}
+
+func TestDirCache(t *testing.T) {
+	cache, err := geminiclient.NewDirCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("abcdef", &geminiclient.CachedResponse{Text: "cached"}); err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := cache.Get("abcdef"); !ok || entry.Text != "cached" {
+		t.Errorf("Expected \"cached\" but got %v", entry)
+	}
+	if _, ok := cache.Get("fedcba"); ok {
+		t.Error("Expected a missing entry to not be found")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	gc := &geminiclient.GeminiClient{ModelName: "gemini-1.5-flash"}
+	req := geminiclient.NewTextRequest("Describe this image").WithData("image/png", []byte{1, 2, 3})
+
+	key1, err := gc.CacheKey(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, _ := gc.CacheKey(geminiclient.NewTextRequest("Describe this image").WithData("image/png", []byte{1, 2, 3}))
+	if key1 != key2 {
+		t.Error("Expected identical requests to have the same cache key")
+	}
+	for name, other := range map[string]*geminiclient.Request{
+		"blob data":          geminiclient.NewTextRequest("Describe this image").WithData("image/png", []byte{1, 2, 4}),
+		"model name":         req.WithModel("gemini-1.5-pro"),
+		"temperature":        req.WithTemperature(0.5),
+		"system instruction": req.WithSystemInstruction("Be brief."),
+	} {
+		key, _ := gc.CacheKey(other)
+		if key == key1 {
+			t.Errorf("Expected a different %s to give a different cache key", name)
+		}
+	}
+}
+
+func TestGenerateCached(t *testing.T) {
+	gc := &geminiclient.GeminiClient{ModelName: "gemini-1.5-flash"}
+	cache := geminiclient.NewMemoryCache(10)
+	gc.SetCache(cache, time.Hour)
+
+	req := geminiclient.NewTextRequest("What is the capital of France?")
+	key, _ := gc.CacheKey(req)
+	cache.Set(key, &geminiclient.CachedResponse{Text: "Paris"})
+
+	// No model is contacted, since the response is cached
+	res, err := gc.Generate(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "Paris" || !res.Metadata.Cached {
+		t.Errorf("Expected a cached \"Paris\" but got %q (cached: %v)", res.Text, res.Metadata.Cached)
+	}
+
+	var streamed string
+	if _, err := gc.GenerateStream(context.Background(), req, func(s string) { streamed += s }); err != nil {
+		t.Fatal(err)
+	}
+	if streamed != "Paris" {
+		t.Errorf("Expected the cached response to be replayed through the callback, but got %q", streamed)
+	}
+
+	if stats := gc.CacheStats(); stats.Hits != 2 || stats.Misses != 0 {
+		t.Errorf("Expected 2 hits and 0 misses but got %+v", stats)
+	}
+}
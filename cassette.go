@@ -0,0 +1,460 @@
+package geminiclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/env/v2"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A cassette is a JSONL file with one recorded interaction with a model per line, see NewRecorder and NewReplayer.
+// The requests and responses are stored in the JSON format of the Gemini REST API.
+
+// cassetteEntry is a recorded request, together with the response or the error.
+type cassetteEntry struct {
+	ID          string            `json:"request_id"` // the hash of the canonical request, which is used for matching
+	Method      string            `json:"method"`     // "generateContent", "streamGenerateContent" or "countTokens"
+	ModelName   string            `json:"model"`
+	Request     json.RawMessage   `json:"request"`
+	Responses   []json.RawMessage `json:"responses,omitempty"` // one per streamed chunk
+	TotalTokens int32             `json:"totalTokens,omitempty"`
+	Error       *cassetteError    `json:"error,omitempty"` // returned after the responses, if any
+}
+
+// cassetteError is a recorded error, which is replayed as a gRPC status error with the same code.
+type cassetteError struct {
+	Code    codes.Code `json:"code"`
+	Status  string     `json:"status"` // the name of the code, for readability
+	Message string     `json:"message"`
+}
+
+// ErrUnmatchedRequest is returned by a Replayer when no recorded interaction matches the request.
+var ErrUnmatchedRequest = errors.New("no recorded response matches the request")
+
+// Patterns for credentials that are always redacted.
+var redactPatterns = []struct {
+	re          *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`AIza[0-9A-Za-z_\-]{35}`), "REDACTED_API_KEY"},
+	{regexp.MustCompile(`ya29\.[0-9A-Za-z_\-.]+`), "REDACTED_ACCESS_TOKEN"},
+	{regexp.MustCompile(`projects/[a-z][a-z0-9\-]{4,28}[a-z0-9]/`), "projects/PROJECT_ID/"},
+}
+
+// redactor replaces secrets in the recorded requests and responses with placeholders.
+type redactor struct {
+	mu      sync.Mutex
+	secrets map[string]string
+}
+
+// newRedactor returns a redactor for the project ID and the API keys in the environment, and the ones used by the given backend.
+func newRedactor(backend Backend) *redactor {
+	r := &redactor{secrets: make(map[string]string)}
+	r.add(env.StrAlt("GCP_PROJECT_ID", "PROJECT_ID", ""), "PROJECT_ID")
+	r.add(apiKeyFromEnv(), "API_KEY")
+	switch b := backend.(type) {
+	case *VertexBackend:
+		r.add(b.ProjectID, "PROJECT_ID")
+	case *AIStudioBackend:
+		r.add(b.APIKey, "API_KEY")
+	case *OpenAIBackend:
+		r.add(b.APIKey, "API_KEY")
+	}
+	return r
+}
+
+func (r *redactor) add(secret, placeholder string) {
+	if secret == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.secrets[secret] = placeholder
+}
+
+// redact returns the given data with all secrets replaced.
+func (r *redactor) redact(data []byte) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := string(data)
+	for secret, placeholder := range r.secrets {
+		s = strings.ReplaceAll(s, secret, placeholder)
+	}
+	for _, p := range redactPatterns {
+		s = p.re.ReplaceAllString(s, p.replacement)
+	}
+	return []byte(s)
+}
+
+// newCassetteEntry returns an entry for the given request, with a canonical and redacted request and a matching ID.
+func newCassetteEntry(r *redactor, method, modelName string, req any) (*cassetteEntry, error) {
+	data, err := json.Marshal(req) // the fields are in a fixed order, and map keys are sorted
+	if err != nil {
+		return nil, err
+	}
+	entry := &cassetteEntry{Method: method, ModelName: string(r.redact([]byte(modelName))), Request: r.redact(data)}
+	sum := sha256.Sum256([]byte(entry.Method + "\n" + entry.ModelName + "\n" + string(entry.Request)))
+	entry.ID = hex.EncodeToString(sum[:8])
+	return entry, nil
+}
+
+// cassetteRequest returns an entry for a request to generate content.
+func cassetteRequest(r *redactor, method string, cfg *ModelConfig, contents []*genai.Content) (*cassetteEntry, error) {
+	req, err := toRESTRequest(cfg, contents)
+	if err != nil {
+		return nil, err
+	}
+	return newCassetteEntry(r, method, cfg.ModelName, req)
+}
+
+// cassetteTokenRequest returns an entry for a request to count tokens.
+func cassetteTokenRequest(r *redactor, cfg *ModelConfig, parts []genai.Part) (*cassetteEntry, error) {
+	contents, err := toRESTContents([]*genai.Content{genai.NewUserContent(parts...)})
+	if err != nil {
+		return nil, err
+	}
+	return newCassetteEntry(r, "countTokens", cfg.ModelName, &restCountTokensRequest{Contents: contents})
+}
+
+// prompt returns the beginning of the text of the last content of the request, for error messages.
+func (entry *cassetteEntry) prompt() string {
+	var req restRequest
+	json.Unmarshal(entry.Request, &req)
+	if len(req.Contents) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	for _, part := range req.Contents[len(req.Contents)-1].Parts {
+		sb.WriteString(part.Text)
+	}
+	s := sb.String()
+	if len(s) > 60 {
+		s = s[:60] + "..."
+	}
+	return s
+}
+
+// Recorder is a Backend that sends all requests to another backend, and records the requests and responses
+// in a cassette file, so that they can be replayed later with a Replayer.
+// The project ID and API keys are redacted, both the ones in the environment and the ones used by the backend.
+type Recorder struct {
+	backend  Backend
+	redactor *redactor
+	mu       sync.Mutex
+	f        *os.File
+}
+
+// recordingStream records the chunks of a streamed response, and writes them when the stream ends.
+type recordingStream struct {
+	rec   *Recorder
+	iter  ResponseIterator
+	entry *cassetteEntry
+	done  bool
+}
+
+// NewRecorder creates the given cassette file, and returns a Recorder that records all interactions with the given backend to it.
+// Close must be called when done.
+func NewRecorder(backend Backend, filename string) (*Recorder, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{backend: backend, redactor: newRedactor(backend), f: f}, nil
+}
+
+// Redact makes the recorder replace the given secret with the given placeholder, in addition to the project ID and API keys.
+// The same must be done for the Replayer, if the secret is part of the requests.
+func (rec *Recorder) Redact(secret, placeholder string) {
+	rec.redactor.add(secret, placeholder)
+}
+
+// Close closes the cassette file.
+func (rec *Recorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.f.Close()
+}
+
+// write adds the given entry to the cassette file, together with the given error, if any.
+func (rec *Recorder) write(entry *cassetteEntry, err error) error {
+	if err != nil {
+		entry.Error = &cassetteError{Code: errorCode(err), Message: string(rec.redactor.redact([]byte(err.Error())))}
+		entry.Error.Status = entry.Error.Code.String()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	_, err = rec.f.Write(append(data, '\n'))
+	return err
+}
+
+// addResponse adds the given response to the entry. A blocked response is recorded as the response that was blocked.
+func (rec *Recorder) addResponse(entry *cassetteEntry, res *genai.GenerateContentResponse, err error) error {
+	var blockedErr *genai.BlockedError
+	if errors.As(err, &blockedErr) {
+		res = &genai.GenerateContentResponse{PromptFeedback: blockedErr.PromptFeedback}
+		if blockedErr.Candidate != nil {
+			res.Candidates = []*genai.Candidate{blockedErr.Candidate}
+		}
+		err = nil
+	}
+	if res != nil {
+		r, convErr := toRESTResponse(res)
+		if convErr != nil {
+			return convErr
+		}
+		data, convErr := json.Marshal(r)
+		if convErr != nil {
+			return convErr
+		}
+		entry.Responses = append(entry.Responses, rec.redactor.redact(data))
+	}
+	return err
+}
+
+// GenerateContent sends the request to the backend, and records the response.
+func (rec *Recorder) GenerateContent(ctx context.Context, cfg *ModelConfig, contents ...*genai.Content) (*genai.GenerateContentResponse, error) {
+	entry, err := cassetteRequest(rec.redactor, "generateContent", cfg, contents)
+	if err != nil {
+		return nil, err
+	}
+	res, err := rec.backend.GenerateContent(ctx, cfg, contents...)
+	if err := rec.write(entry, rec.addResponse(entry, res, err)); err != nil {
+		return nil, fmt.Errorf("failed to record response: %w", err)
+	}
+	return res, err
+}
+
+// GenerateContentStream sends the request to the backend, and records the streamed chunks.
+func (rec *Recorder) GenerateContentStream(ctx context.Context, cfg *ModelConfig, contents ...*genai.Content) ResponseIterator {
+	entry, err := cassetteRequest(rec.redactor, "streamGenerateContent", cfg, contents)
+	if err != nil {
+		return &replayStream{err: err}
+	}
+	return &recordingStream{rec: rec, iter: rec.backend.GenerateContentStream(ctx, cfg, contents...), entry: entry}
+}
+
+// Next returns the next chunk from the backend, and writes the recorded chunks when the stream ends.
+func (s *recordingStream) Next() (*genai.GenerateContentResponse, error) {
+	res, err := s.iter.Next()
+	if s.done {
+		return res, err
+	}
+	if err == iterator.Done {
+		s.done = true
+		if err := s.rec.write(s.entry, nil); err != nil {
+			return nil, fmt.Errorf("failed to record response: %w", err)
+		}
+		return nil, iterator.Done
+	}
+	if err != nil {
+		s.done = true
+		if err := s.rec.write(s.entry, s.rec.addResponse(s.entry, nil, err)); err != nil {
+			return nil, fmt.Errorf("failed to record response: %w", err)
+		}
+		return res, err
+	}
+	if err := s.rec.addResponse(s.entry, res, nil); err != nil {
+		return nil, fmt.Errorf("failed to record response: %w", err)
+	}
+	return res, nil
+}
+
+// CountTokens counts the tokens with the backend, and records the count.
+func (rec *Recorder) CountTokens(ctx context.Context, cfg *ModelConfig, parts ...genai.Part) (int, error) {
+	entry, err := cassetteTokenRequest(rec.redactor, cfg, parts)
+	if err != nil {
+		return 0, err
+	}
+	n, err := rec.backend.CountTokens(ctx, cfg, parts...)
+	entry.TotalTokens = int32(n)
+	if err := rec.write(entry, err); err != nil {
+		return 0, fmt.Errorf("failed to record response: %w", err)
+	}
+	return n, err
+}
+
+// StartChat starts a chat session, where every message is recorded with the whole history.
+func (rec *Recorder) StartChat(cfg *ModelConfig) ChatSession {
+	return NewChatSession(rec, cfg)
+}
+
+// Replayer is a Backend that responds with the interactions that were recorded by a Recorder.
+// Requests are matched by their canonical form, so identical requests get the recorded responses in the recorded order.
+// Requests that were not recorded fail with ErrUnmatchedRequest.
+type Replayer struct {
+	filename string
+	redactor *redactor
+	mu       sync.Mutex
+	entries  map[string][]*cassetteEntry // the unused entries, by ID
+	used     map[string]int              // how many entries have been used, by ID
+}
+
+// replayStream is a ResponseIterator for recorded chunks.
+type replayStream struct {
+	responses []json.RawMessage
+	err       error
+}
+
+// NewReplayer reads the given cassette file, and returns a Replayer that responds with the recorded interactions.
+func NewReplayer(filename string) (*Replayer, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &Replayer{
+		filename: filename,
+		redactor: newRedactor(nil),
+		entries:  make(map[string][]*cassetteEntry),
+		used:     make(map[string]int),
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var entry cassetteEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, line, err)
+		}
+		r.entries[entry.ID] = append(r.entries[entry.ID], &entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Redact makes the replayer replace the given secret with the given placeholder before matching requests,
+// like Recorder.Redact.
+func (r *Replayer) Redact(secret, placeholder string) {
+	r.redactor.add(secret, placeholder)
+}
+
+// Unused returns how many of the recorded interactions have not been replayed.
+func (r *Replayer) Unused() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, entries := range r.entries {
+		n += len(entries)
+	}
+	return n
+}
+
+// match returns the next recorded entry for the given request.
+func (r *Replayer) match(req *cassetteEntry) (*cassetteEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := r.entries[req.ID]
+	if len(entries) == 0 {
+		if n := r.used[req.ID]; n > 0 {
+			return nil, fmt.Errorf("%w in %s: the request %s was recorded %d times, but is now sent once more", ErrUnmatchedRequest, r.filename, req.ID, n)
+		}
+		return nil, fmt.Errorf("%w in %s: %s for %s with the prompt %q, record the cassette again if the request has changed", ErrUnmatchedRequest, r.filename, req.Method, req.ModelName, req.prompt())
+	}
+	r.entries[req.ID] = entries[1:]
+	r.used[req.ID]++
+	return entries[0], nil
+}
+
+// replayError returns the recorded error, if any.
+func (entry *cassetteEntry) replayError() error {
+	if entry.Error == nil {
+		return nil
+	}
+	return status.Error(entry.Error.Code, entry.Error.Message)
+}
+
+// GenerateContent returns the recorded response for the request.
+func (r *Replayer) GenerateContent(ctx context.Context, cfg *ModelConfig, contents ...*genai.Content) (*genai.GenerateContentResponse, error) {
+	req, err := cassetteRequest(r.redactor, "generateContent", cfg, contents)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := r.match(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := entry.replayError(); err != nil {
+		return nil, err
+	}
+	if len(entry.Responses) == 0 {
+		return nil, fmt.Errorf("the recorded request %s in %s has no response", entry.ID, r.filename)
+	}
+	return replayResponse(entry.Responses[0])
+}
+
+// replayResponse converts a recorded response to a genai response.
+func replayResponse(data json.RawMessage) (*genai.GenerateContentResponse, error) {
+	var res restResponse
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("invalid recorded response: %v", err)
+	}
+	return fromRESTResponse(&res)
+}
+
+// GenerateContentStream returns the recorded chunks for the request.
+func (r *Replayer) GenerateContentStream(ctx context.Context, cfg *ModelConfig, contents ...*genai.Content) ResponseIterator {
+	req, err := cassetteRequest(r.redactor, "streamGenerateContent", cfg, contents)
+	if err != nil {
+		return &replayStream{err: err}
+	}
+	entry, err := r.match(req)
+	if err != nil {
+		return &replayStream{err: err}
+	}
+	return &replayStream{responses: entry.Responses, err: entry.replayError()}
+}
+
+// Next returns the next recorded chunk, and then the recorded error or iterator.Done.
+func (s *replayStream) Next() (*genai.GenerateContentResponse, error) {
+	if len(s.responses) == 0 {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, iterator.Done
+	}
+	data := s.responses[0]
+	s.responses = s.responses[1:]
+	return replayResponse(data)
+}
+
+// CountTokens returns the recorded token count for the request.
+func (r *Replayer) CountTokens(ctx context.Context, cfg *ModelConfig, parts ...genai.Part) (int, error) {
+	req, err := cassetteTokenRequest(r.redactor, cfg, parts)
+	if err != nil {
+		return 0, err
+	}
+	entry, err := r.match(req)
+	if err != nil {
+		return 0, err
+	}
+	if err := entry.replayError(); err != nil {
+		return 0, err
+	}
+	return int(entry.TotalTokens), nil
+}
+
+// StartChat starts a chat session, where every message is matched with the whole history.
+func (r *Replayer) StartChat(cfg *ModelConfig) ChatSession {
+	return NewChatSession(r, cfg)
+}
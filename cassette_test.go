@@ -0,0 +1,91 @@
+package geminiclient_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xyproto/env/v2"
+	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// session runs the same requests against a client, both when recording and when replaying.
+func session(t *testing.T, gc *geminiclient.GeminiClient) {
+	result, err := gc.Query("What is the weather in NY, for the project my-secret-project?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "It is sunny." {
+		t.Errorf("Expected \"It is sunny.\" but got %q", result)
+	}
+
+	var streamed strings.Builder
+	res, err := gc.GenerateStream(context.Background(), geminiclient.NewTextRequest("Tell a story"), func(s string) { streamed.WriteString(s) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "Once upon a time" || streamed.String() != "Once upon a time" {
+		t.Errorf("Expected \"Once upon a time\" but got %q and %q", res.Text, streamed.String())
+	}
+	if res.Metadata.UsageMetadata == nil || res.Metadata.UsageMetadata.TotalTokenCount != 7 {
+		t.Errorf("Expected the usage to be replayed, but got %v", res.Metadata.UsageMetadata)
+	}
+
+	if _, err := gc.Query("Token ya29.a0AfH6SMBx"); status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected an unavailable error but got %v", err)
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	t.Cleanup(env.Load)
+	t.Setenv("GCP_PROJECT_ID", "my-secret-project")
+	env.Load()
+
+	filename := filepath.Join(t.TempDir(), "cassette.jsonl")
+
+	gc, fake := geminitest.NewClient(t)
+	rec, err := geminiclient.NewRecorder(fake, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc.SetBackend(rec)
+	if err := gc.AddFunctionTool("get_weather", "Get the weather", func(location string) string { return "sunny" }); err != nil {
+		t.Fatal(err)
+	}
+	fake.QueueFunctionCall("get_weather", map[string]any{"param1": "NY"})
+	fake.QueueText("It is sunny.")
+	fake.QueueStream("Once ", "upon ", "a time").WithUsage(4, 3)
+	fake.QueueError(status.Error(codes.Unavailable, "service unavailable"))
+	session(t, gc)
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 4 {
+		t.Errorf("Expected 4 recorded interactions but got %d", n)
+	}
+	if strings.Contains(string(data), "my-secret-project") || strings.Contains(string(data), "ya29.") {
+		t.Errorf("Expected the project ID and the token to be redacted, but got:\n%s", data)
+	}
+
+	gc = geminitest.NewCassetteClient(t, filename)
+	if err := gc.AddFunctionTool("get_weather", "Get the weather", func(location string) string { return "sunny" }); err != nil {
+		t.Fatal(err)
+	}
+	session(t, gc)
+
+	_, err = gc.Query("What is the weather in Oslo?")
+	if !errors.Is(err, geminiclient.ErrUnmatchedRequest) || !strings.Contains(err.Error(), "Oslo") {
+		t.Errorf("Expected ErrUnmatchedRequest for the new prompt, but got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+// fakevertex is a local fake of the Vertex AI API, for end-to-end tests without Google Cloud credentials.
+//
+// Point a client at it with:
+//
+//	gc, err := geminiclient.NewText("gemini-1.5-flash", "us-central1", "test-project", 0,
+//		geminiclient.WithEndpoint("http://localhost:8080"), geminiclient.WithoutAuthentication())
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/xyproto/geminiclient/geminitest"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "the address for the REST API")
+	grpcAddr := flag.String("grpc", "", "the address for the gRPC API (disabled if empty)")
+	rulesFile := flag.String("rules", "", "a JSON file with a list of rules for the answers (prompts are echoed back if empty)")
+	token := flag.String("token", "", "the bearer token that clients must send (any client is accepted if empty)")
+	flag.Parse()
+
+	rules := geminitest.NewRules()
+	if *rulesFile != "" {
+		var err error
+		if rules, err = geminitest.LoadRules(*rulesFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	service := geminitest.NewVertexService(rules)
+	service.Token = *token
+
+	if *grpcAddr != "" {
+		lis, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		server := grpc.NewServer()
+		service.RegisterGRPC(server)
+		log.Printf("Serving gRPC on %s", lis.Addr())
+		go func() {
+			log.Fatalln(server.Serve(lis))
+		}()
+	}
+
+	log.Printf("Serving REST on http://%s", *addr)
+	log.Fatalln(http.ListenAndServe(*addr, service))
+}
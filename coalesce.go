@@ -0,0 +1,158 @@
+package geminiclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// flight is a request that is in progress, and that can be shared between several callers.
+// Text parts that are streamed are kept, so that callers that join late can catch up.
+type flight struct {
+	mu      sync.Mutex
+	chunks  []string
+	update  chan struct{} // closed and replaced when a chunk arrives, or when the flight is done
+	done    bool
+	res     *Response
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// SetCoalescing enables or disables coalescing of identical requests. When enabled, concurrent calls
+// with identical requests (see CacheKey) share a single request to the model, and all receive the result or the error.
+// Streaming callers receive the text parts from the single stream, including the ones that arrived before they joined.
+// Requests with function calls are never coalesced, since the function handlers could differ.
+func (gc *GeminiClient) SetCoalescing(enabled bool) {
+	gc.Coalesce = enabled
+}
+
+// coalesce calls fn, unless an identical request is already in flight, in which case that request is joined instead.
+// The request to the model is only canceled when all of the callers have given up.
+func (gc *GeminiClient) coalesce(ctx context.Context, req *Request, streamCallback func(string), fn func(context.Context, func(string)) (*Response, error)) (*Response, error) {
+	if !gc.Coalesce || len(req.functions) > 0 || len(req.handlers) > 0 {
+		return fn(ctx, streamCallback)
+	}
+	key, err := gc.CacheKey(req)
+	if err != nil {
+		return fn(ctx, streamCallback)
+	}
+
+	gc.mu.Lock()
+	f, joined := gc.flights[key]
+	if !joined {
+		f = &flight{update: make(chan struct{})}
+		if gc.flights == nil {
+			gc.flights = make(map[string]*flight)
+		}
+		gc.flights[key] = f
+		gc.startFlight(ctx, key, f, fn)
+	}
+	f.mu.Lock()
+	f.waiters++
+	f.mu.Unlock()
+	gc.mu.Unlock()
+
+	if joined && gc.Verbose {
+		fmt.Println("Joining an identical request that is already in flight.")
+	}
+	res, err := gc.follow(ctx, key, f, streamCallback)
+	if err != nil {
+		return nil, err
+	}
+	response := *res
+	response.Metadata.Coalesced = joined
+	return &response, nil
+}
+
+// startFlight sends the request in a goroutine, with a context that is not canceled when the first caller gives up,
+// but that keeps the deadline of the first caller.
+func (gc *GeminiClient) startFlight(ctx context.Context, key string, f *flight, fn func(context.Context, func(string)) (*Response, error)) {
+	flightCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	if deadline, ok := ctx.Deadline(); ok {
+		flightCtx, cancel = context.WithDeadline(context.WithoutCancel(ctx), deadline)
+	}
+	f.cancel = cancel
+	go func() {
+		defer cancel()
+		var (
+			res *Response
+			err error
+		)
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic occurred: %v", r)
+				}
+			}()
+			res, err = fn(flightCtx, f.publish)
+		}()
+		gc.removeFlight(key, f)
+		f.finish(res, err)
+	}()
+}
+
+// removeFlight removes the flight, so that new identical requests are sent to the model again.
+func (gc *GeminiClient) removeFlight(key string, f *flight) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if gc.flights[key] == f {
+		delete(gc.flights, key)
+	}
+}
+
+// follow waits for the flight to finish, passing on the streamed text parts to the streamCallback function, if it is not nil.
+// If the request was not streamed, the whole response is passed on as a single text part.
+func (gc *GeminiClient) follow(ctx context.Context, key string, f *flight, streamCallback func(string)) (*Response, error) {
+	delivered := 0
+	for {
+		f.mu.Lock()
+		chunks, done, update := f.chunks[delivered:], f.done, f.update
+		res, err := f.res, f.err
+		f.mu.Unlock()
+
+		if streamCallback != nil {
+			for _, chunk := range chunks {
+				streamCallback(chunk)
+			}
+		}
+		delivered += len(chunks)
+		if done {
+			if streamCallback != nil && delivered == 0 && res != nil {
+				streamCallback(res.Text)
+			}
+			return res, err
+		}
+
+		select {
+		case <-update:
+		case <-ctx.Done():
+			f.mu.Lock()
+			f.waiters--
+			abandoned := f.waiters == 0 && !f.done
+			f.mu.Unlock()
+			if abandoned {
+				gc.removeFlight(key, f)
+				f.cancel()
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// publish adds a streamed text part to the flight, and wakes up the callers.
+func (f *flight) publish(chunk string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chunks = append(f.chunks, chunk)
+	close(f.update)
+	f.update = make(chan struct{})
+}
+
+// finish stores the result of the flight, and wakes up the callers.
+func (f *flight) finish(res *Response, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.res, f.err, f.done = res, err, true
+	close(f.update)
+}
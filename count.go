@@ -8,75 +8,102 @@ import (
 
 // CountPromptTokensWithClient counts the tokens in the given text prompt using a specific client and model.
 func (gc *GeminiClient) CountPromptTokensWithClient(ctx context.Context, client *genai.Client, prompt, modelName string) (int, error) {
-	model := client.GenerativeModel(modelName)
-	resp, err := model.CountTokens(ctx, genai.Text(prompt))
-	if err != nil {
-		return 0, err
-	}
-	return int(resp.TotalTokens), nil
+	return gc.countTokens(ctx, &VertexBackend{Client: client}, modelName, genai.Text(prompt))
 }
 
 // CountPromptTokensWithModel counts the tokens in the given text prompt using the specified model within the default client.
 func (gc *GeminiClient) CountPromptTokensWithModel(ctx context.Context, prompt, modelName string) (int, error) {
-	model := gc.Client.GenerativeModel(modelName)
-	resp, err := model.CountTokens(ctx, genai.Text(prompt))
+	backend, err := gc.backend(ctx, "")
 	if err != nil {
 		return 0, err
 	}
-	return int(resp.TotalTokens), nil
+	return gc.countTokens(ctx, backend, modelName, genai.Text(prompt))
 }
 
 // CountPromptTokens counts the number of tokens in the given text prompt using the default client and model.
 func (gc *GeminiClient) CountPromptTokens(prompt string) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), gc.Timeout)
+	return gc.CountPromptTokensContext(context.Background(), prompt)
+}
+
+// CountPromptTokensContext is like CountPromptTokens, but the request is canceled when the given context is done.
+func (gc *GeminiClient) CountPromptTokensContext(ctx context.Context, prompt string) (int, error) {
+	ctx, cancel := gc.withTimeout(ctx)
 	defer cancel()
 	return gc.CountPromptTokensWithModel(ctx, prompt, gc.ModelName)
 }
 
 // CountPartTokensWithContext counts the tokens in the current multimodal parts using the default client and model.
 func (gc *GeminiClient) CountPartTokensWithContext(ctx context.Context) (int, error) {
-	model := gc.Client.GenerativeModel(gc.ModelName)
+	backend, err := gc.backend(ctx, "")
+	if err != nil {
+		return 0, err
+	}
 	var totalTokens int
 	for _, part := range gc.Parts {
-		resp, err := model.CountTokens(ctx, part)
+		n, err := gc.countTokens(ctx, backend, gc.ModelName, part)
 		if err != nil {
 			return totalTokens, err
 		}
-		totalTokens += int(resp.TotalTokens)
+		totalTokens += n
 	}
 	return totalTokens, nil
 }
 
 // CountTokens counts the tokens in the current multimodal parts using the default client, model, and a new context.
 func (gc *GeminiClient) CountTokens() (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), gc.Timeout)
+	return gc.CountTokensContext(context.Background())
+}
+
+// CountTokensContext is like CountTokens, but the request is canceled when the given context is done.
+func (gc *GeminiClient) CountTokensContext(ctx context.Context) (int, error) {
+	ctx, cancel := gc.withTimeout(ctx)
 	defer cancel()
 	return gc.CountPartTokensWithContext(ctx)
 }
 
 // CountTextTokensWithClient counts the tokens in the given text using a specific client and model.
 func (gc *GeminiClient) CountTextTokensWithClient(ctx context.Context, client *genai.Client, text, modelName string) (int, error) {
-	model := client.GenerativeModel(modelName)
-	resp, err := model.CountTokens(ctx, genai.Text(text))
+	return gc.countTokens(ctx, &VertexBackend{Client: client}, modelName, genai.Text(text))
+}
+
+// CountTextTokensWithModel counts the tokens in the given text using the specified model within the default client.
+func (gc *GeminiClient) CountTextTokensWithModel(ctx context.Context, text, modelName string) (int, error) {
+	backend, err := gc.backend(ctx, "")
 	if err != nil {
 		return 0, err
 	}
-	return int(resp.TotalTokens), nil
+	return gc.countTokens(ctx, backend, modelName, genai.Text(text))
 }
 
-// CountTextTokensWithModel counts the tokens in the given text using the specified model within the default client.
-func (gc *GeminiClient) CountTextTokensWithModel(ctx context.Context, text, modelName string) (int, error) {
-	model := gc.Client.GenerativeModel(modelName)
-	resp, err := model.CountTokens(ctx, genai.Text(text))
+// countTokens counts the tokens in the given parts with the given backend and model, retrying transient errors.
+func (gc *GeminiClient) countTokens(ctx context.Context, backend Backend, modelName string, parts ...genai.Part) (int, error) {
+	staged, err := gc.stageParts(ctx, parts)
 	if err != nil {
 		return 0, err
 	}
-	return int(resp.TotalTokens), nil
+	if staged != nil {
+		parts = staged
+	}
+	var n int
+	_, err = gc.withRetry(ctx, func(ctx context.Context) error {
+		var err error
+		n, err = backend.CountTokens(ctx, &ModelConfig{ModelName: modelName}, parts...)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
 }
 
 // CountTextTokens counts the tokens in the given text using the default client and model.
 func (gc *GeminiClient) CountTextTokens(text string) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), gc.Timeout)
+	return gc.CountTextTokensContext(context.Background(), text)
+}
+
+// CountTextTokensContext is like CountTextTokens, but the request is canceled when the given context is done.
+func (gc *GeminiClient) CountTextTokensContext(ctx context.Context, text string) (int, error) {
+	ctx, cancel := gc.withTimeout(ctx)
 	defer cancel()
 	return gc.CountTextTokensWithModel(ctx, text, gc.ModelName)
 }
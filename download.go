@@ -0,0 +1,289 @@
+package geminiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrBlockedAddress is returned when a URL resolves to a private, loopback or link-local address, and these are blocked
+	ErrBlockedAddress = errors.New("the address is not allowed")
+	// ErrDownloadTooLarge is returned when a download is larger than the maximum size of the download policy
+	ErrDownloadTooLarge = errors.New("the download is too large")
+	// ErrMIMETypeNotAllowed is returned when a download has a MIME type that the download policy does not allow
+	ErrMIMETypeNotAllowed = errors.New("the MIME type is not allowed")
+	// ErrTooManyRedirects is returned when a download is redirected more times than the download policy allows
+	ErrTooManyRedirects = errors.New("too many redirects")
+)
+
+const (
+	defaultDownloadMaxSize   = 20 << 20 // 20 MiB, which is the size limit of inline data in a request
+	defaultDownloadRedirects = 10       // the same as the http package
+)
+
+// DownloadError is returned when a file could not be downloaded from a URL.
+// It wraps the cause, like ErrBlockedAddress or context.DeadlineExceeded, which can be checked with errors.Is.
+type DownloadError struct {
+	URL        string
+	StatusCode int   // the HTTP status code, if the server responded with something else than 200 OK
+	Err        error // the cause, or nil if the status code was not 200 OK
+}
+
+func (e *DownloadError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("failed to download the file from %s: bad status: %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("failed to download the file from %s: %v", e.URL, e.Err)
+}
+
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+// DownloadPolicy configures how files are downloaded by AddURL, see SetDownloadPolicy.
+// The zero value downloads at most 20 MiB, follows up to 10 redirects and allows all addresses and MIME types.
+type DownloadPolicy struct {
+	Timeout          time.Duration // the timeout for each download, or 0 for using the timeout of the client
+	MaxSize          int64         // the largest number of bytes that are downloaded, or 0 for the default of 20 MiB
+	AllowedMIMETypes []string      // like "application/pdf" or "image/*", or nil for allowing all MIME types
+	MaxRedirects     int           // the number of redirects that are followed, 0 for the default of 10 or negative for none
+	BlockPrivate     bool          // refuse to connect to private, loopback and link-local addresses, after DNS resolution
+	HTTPClient       *http.Client  // the HTTP client to download with, or nil for http.DefaultClient
+	KeepHTML         bool          // add HTML pages as they are, instead of converting them to Markdown text
+}
+
+// DefaultDownloadPolicy returns a download policy for URLs that come from users: downloads time out after 30 seconds,
+// are at most 20 MiB, follow at most 5 redirects and can not reach private, loopback or link-local addresses.
+func DefaultDownloadPolicy() DownloadPolicy {
+	return DownloadPolicy{
+		Timeout:      30 * time.Second,
+		MaxSize:      defaultDownloadMaxSize,
+		MaxRedirects: 5,
+		BlockPrivate: true,
+	}
+}
+
+// SetDownloadPolicy configures how files are downloaded by AddURL and AddURLContext.
+// Blocking private addresses is important if the URLs come from end users, since a server that runs the client
+// can often reach internal services and cloud metadata endpoints that the users should not be able to reach.
+func (gc *GeminiClient) SetDownloadPolicy(policy DownloadPolicy) {
+	gc.Downloads = policy
+}
+
+// validate returns an error if the download policy has invalid settings.
+func (policy DownloadPolicy) validate() error {
+	switch {
+	case policy.Timeout < 0:
+		return fmt.Errorf("the download timeout must not be negative, but is %v", policy.Timeout)
+	case policy.MaxSize < 0:
+		return fmt.Errorf("the maximum download size must not be negative, but is %d", policy.MaxSize)
+	}
+	for _, mimeType := range policy.AllowedMIMETypes {
+		if !strings.Contains(mimeType, "/") {
+			return fmt.Errorf("the allowed MIME type %q is not of the form type/subtype or type/*", mimeType)
+		}
+	}
+	return nil
+}
+
+// maxSize returns the largest number of bytes that are downloaded
+func (policy DownloadPolicy) maxSize() int64 {
+	if policy.MaxSize <= 0 {
+		return defaultDownloadMaxSize
+	}
+	return policy.MaxSize
+}
+
+// allows checks if the given MIME type is allowed, either exactly or by a type/* wildcard
+func (policy DownloadPolicy) allows(mimeType string) bool {
+	if len(policy.AllowedMIMETypes) == 0 {
+		return true
+	}
+	for _, allowed := range policy.AllowedMIMETypes {
+		if allowed == mimeType || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// client returns a copy of the HTTP client of the policy, which follows the redirect limit and blocks private addresses.
+// Blocking private addresses needs an *http.Transport, which is given a dialer that checks each resolved address,
+// and no proxy, since the address of the proxy would be checked instead of the address of the server.
+func (policy DownloadPolicy) client() (*http.Client, error) {
+	client := http.Client{}
+	if policy.HTTPClient != nil {
+		client = *policy.HTTPClient
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		redirects := policy.MaxRedirects
+		if redirects == 0 {
+			redirects = defaultDownloadRedirects
+		}
+		if len(via) > redirects {
+			return fmt.Errorf("%w: %d", ErrTooManyRedirects, len(via))
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("can not be redirected to a %s URL", req.URL.Scheme)
+		}
+		return nil
+	}
+	if !policy.BlockPrivate {
+		return &client, nil
+	}
+	var transport *http.Transport
+	switch t := client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return nil, fmt.Errorf("private addresses can only be blocked when the HTTP client has an *http.Transport, not a %T", t)
+	}
+	transport.Proxy = nil
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: checkAddress}
+	transport.DialContext = dialer.DialContext
+	client.Transport = transport
+	return &client, nil
+}
+
+// reservedPrefixes are address ranges that are not public, but that netip.Addr does not have a method for
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"), // shared address space for carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),   // reserved, including the broadcast address
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, which can reach private IPv4 addresses
+}
+
+// publicAddress checks if the given address can be reached by anyone on the Internet
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkAddress is called by the dialer after DNS resolution, for every connection, including redirects.
+// Checking the resolved address, instead of the host name, also protects against DNS rebinding.
+func checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !publicAddress(addr) {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+	}
+	return nil
+}
+
+// Download downloads a file from the given URL, according to the policy, and returns the data and the MIME type.
+// The MIME type is taken from the Content-Type header, or detected from the contents if the header is missing or generic.
+// All errors are of the type *DownloadError.
+func Download(ctx context.Context, URL string, policy DownloadPolicy) ([]byte, string, error) {
+	d, err := fetch(ctx, URL, policy)
+	if err != nil {
+		return nil, "", err
+	}
+	return d.data, d.mimeType, nil
+}
+
+// downloaded is a downloaded file, with the MIME type and the charset from the Content-Type header, if any
+type downloaded struct {
+	data              []byte
+	mimeType, charset string
+}
+
+// fetch is like Download, but also returns the charset
+func fetch(ctx context.Context, URL string, policy DownloadPolicy) (*downloaded, error) {
+	d, err := download(ctx, URL, policy)
+	if err != nil {
+		var downloadErr *DownloadError
+		if !errors.As(err, &downloadErr) {
+			err = &DownloadError{URL: URL, Err: err}
+		}
+		return nil, err
+	}
+	return d, nil
+}
+
+// download is like fetch, but the errors are not wrapped
+func download(ctx context.Context, URL string, policy DownloadPolicy) (*downloaded, error) {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("only http and https URLs can be downloaded, not %s", URL)
+	}
+	client, err := policy.client()
+	if err != nil {
+		return nil, err
+	}
+	if policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &DownloadError{URL: URL, StatusCode: resp.StatusCode}
+	}
+
+	mimeType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mimeType == "application/octet-stream" {
+		mimeType = ""
+	}
+	// Check the MIME type and the size before downloading, when possible
+	if mimeType != "" && !policy.allows(mimeType) {
+		return nil, fmt.Errorf("%w: %s", ErrMIMETypeNotAllowed, mimeType)
+	}
+	maxSize := policy.maxSize()
+	if resp.ContentLength > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes is more than %d", ErrDownloadTooLarge, resp.ContentLength, maxSize)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the response body: %w", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrDownloadTooLarge, maxSize)
+	}
+
+	if mimeType == "" {
+		if mimeType = DetectMIMEType(data); mimeType == "" {
+			return nil, ErrUnknownFileType
+		}
+		if !policy.allows(mimeType) {
+			return nil, fmt.Errorf("%w: %s", ErrMIMETypeNotAllowed, mimeType)
+		}
+	}
+	return &downloaded{data: data, mimeType: mimeType, charset: params["charset"]}, nil
+}
@@ -0,0 +1,113 @@
+package geminiclient_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
+)
+
+// downloadServer serves a PNG image, a large file, an HTML page without a Content-Type header and a redirect loop
+func downloadServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		for i := 0; i < 100; i++ {
+			w.Write([]byte(strings.Repeat("large ", 100))) // written in chunks, without a Content-Length
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = nil // do not let the server detect it
+		w.Write([]byte("%PDF-1.7\n"))
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDownloadPolicy(t *testing.T) {
+	server := downloadServer(t)
+	ctx := context.Background()
+
+	data, mimeType, err := geminiclient.Download(ctx, server.URL+"/page", geminiclient.DownloadPolicy{})
+	if err != nil || mimeType != "application/pdf" || len(data) != 9 {
+		t.Errorf("Expected a PDF document of 9 bytes, but got %s of %d bytes and %v", mimeType, len(data), err)
+	}
+
+	_, _, err = geminiclient.Download(ctx, server.URL+"/large", geminiclient.DownloadPolicy{MaxSize: 1000})
+	if !errors.Is(err, geminiclient.ErrDownloadTooLarge) {
+		t.Errorf("Expected the download to be too large, but got %v", err)
+	}
+
+	_, _, err = geminiclient.Download(ctx, server.URL+"/large", geminiclient.DownloadPolicy{AllowedMIMETypes: []string{"image/*"}})
+	if !errors.Is(err, geminiclient.ErrMIMETypeNotAllowed) {
+		t.Errorf("Expected the MIME type to not be allowed, but got %v", err)
+	}
+	if _, mimeType, err = geminiclient.Download(ctx, server.URL+"/image", geminiclient.DownloadPolicy{AllowedMIMETypes: []string{"image/*"}}); err != nil || mimeType != "image/png" {
+		t.Errorf("Expected a PNG image to be allowed, but got %s and %v", mimeType, err)
+	}
+
+	_, _, err = geminiclient.Download(ctx, server.URL+"/loop", geminiclient.DownloadPolicy{MaxRedirects: 3})
+	if !errors.Is(err, geminiclient.ErrTooManyRedirects) {
+		t.Errorf("Expected too many redirects, but got %v", err)
+	}
+
+	_, _, err = geminiclient.Download(ctx, server.URL+"/missing", geminiclient.DownloadPolicy{})
+	var downloadErr *geminiclient.DownloadError
+	if !errors.As(err, &downloadErr) || downloadErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a download error with status 404, but got %v", err)
+	}
+}
+
+func TestDownloadBlockPrivate(t *testing.T) {
+	server := downloadServer(t)
+	policy := geminiclient.DefaultDownloadPolicy()
+	for _, URL := range []string{
+		server.URL + "/image",                       // loopback
+		"http://169.254.169.254/computeMetadata/v1", // link-local, like cloud metadata endpoints
+		"http://10.0.0.1/",                          // private
+		"http://[::ffff:127.0.0.1]/",                // IPv4-mapped loopback
+	} {
+		_, _, err := geminiclient.Download(context.Background(), URL, policy)
+		var downloadErr *geminiclient.DownloadError
+		if !errors.Is(err, geminiclient.ErrBlockedAddress) || !errors.As(err, &downloadErr) || downloadErr.URL != URL {
+			t.Errorf("Expected %s to be blocked, but got %v", URL, err)
+		}
+	}
+	if _, _, err := geminiclient.Download(context.Background(), "file:///etc/passwd", policy); err == nil {
+		t.Error("Expected file URLs to not be downloaded")
+	}
+}
+
+func TestAddURLDownloadPolicy(t *testing.T) {
+	server := downloadServer(t)
+	gc, _ := geminitest.NewClient(t, geminiclient.WithDownloadPolicy(geminiclient.DownloadPolicy{MaxSize: 100}))
+	if err := gc.AddURL(server.URL + "/image"); err != nil {
+		t.Fatal(err)
+	}
+	if blob, ok := gc.Parts[0].(genai.Blob); !ok || blob.MIMEType != "image/png" {
+		t.Errorf("Expected a PNG image, but got %v", gc.Parts[0])
+	}
+	if err := gc.AddURL(server.URL + "/large"); !errors.Is(err, geminiclient.ErrDownloadTooLarge) || len(gc.Parts) != 1 {
+		t.Errorf("Expected the download to be too large, but got %v", err)
+	}
+
+	gc.SetDownloadPolicy(geminiclient.DefaultDownloadPolicy())
+	if err := gc.AddURL(server.URL + "/image"); !errors.Is(err, geminiclient.ErrBlockedAddress) {
+		t.Errorf("Expected the loopback address to be blocked, but got %v", err)
+	}
+}
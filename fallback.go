@@ -0,0 +1,128 @@
+package geminiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"google.golang.org/grpc/codes"
+)
+
+// FallbackCondition is a set of failures that makes a request fall back to the next model in the chain.
+type FallbackCondition uint
+
+const (
+	// FallbackOnQuota falls back when the quota is exhausted (ResourceExhausted / 429)
+	FallbackOnQuota FallbackCondition = 1 << iota
+	// FallbackOnUnavailable falls back when the model is unavailable (Unavailable / 503, or ErrCircuitOpen)
+	FallbackOnUnavailable
+	// FallbackOnTimeout falls back when the model does not respond in time (DeadlineExceeded)
+	FallbackOnTimeout
+	// FallbackOnSafety falls back when the prompt or the response is blocked by the safety filters
+	FallbackOnSafety
+
+	// FallbackOnAll falls back on all of the above conditions
+	FallbackOnAll = FallbackOnQuota | FallbackOnUnavailable | FallbackOnTimeout | FallbackOnSafety
+)
+
+// Fallback is a model, and optionally a location, that can be used if the preferred model fails.
+type Fallback struct {
+	ModelName string
+	Location  string // the Google Cloud location, like "us-central1", or blank for gc.ProjectLocation
+}
+
+// FallbackPolicy is an ordered list of models to try, after the model that was asked for has failed.
+type FallbackPolicy struct {
+	Models     []Fallback
+	Conditions FallbackCondition
+	Timeout    time.Duration // the timeout for each model except the last one, so that there is time left for the fallbacks (0 for no timeout)
+}
+
+// noFallbackError wraps an error that should be returned without trying the next model,
+// like an error that happened after a part of the response was streamed.
+type noFallbackError struct {
+	err error
+}
+
+func (e *noFallbackError) Error() string {
+	return e.err.Error()
+}
+
+func (e *noFallbackError) Unwrap() error {
+	return e.err
+}
+
+// SetFallbacks configures the models to fall back to, in order, when a request fails with one of the given conditions.
+// For example:
+//
+//	gc.SetFallbacks(geminiclient.FallbackOnQuota|geminiclient.FallbackOnUnavailable,
+//		geminiclient.Fallback{ModelName: "gemini-1.5-flash"},
+//		geminiclient.Fallback{ModelName: "gemini-1.5-flash", Location: "europe-west4"})
+func (gc *GeminiClient) SetFallbacks(conditions FallbackCondition, fallbacks ...Fallback) {
+	gc.Fallback.Conditions = conditions
+	gc.Fallback.Models = fallbacks
+}
+
+// Matches returns true if the given error is one of the conditions for falling back to the next model.
+func (c FallbackCondition) Matches(err error) bool {
+	if err == nil {
+		return false
+	}
+	var blockedErr *genai.BlockedError
+	if errors.As(err, &blockedErr) {
+		return c&FallbackOnSafety != 0
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		return c&FallbackOnUnavailable != 0
+	}
+	switch errorCode(err) {
+	case codes.ResourceExhausted:
+		return c&FallbackOnQuota != 0
+	case codes.Unavailable:
+		return c&FallbackOnUnavailable != 0
+	case codes.DeadlineExceeded:
+		return c&FallbackOnTimeout != 0
+	}
+	return false
+}
+
+// withFallback calls fn with the model that was asked for, and then with each of the fallback models,
+// until it succeeds or fails with an error that does not match the fallback conditions.
+// Fallbacks without a location, and the model that was asked for, are tried in all configured locations,
+// see RegionPolicy. Requests are only hedged if hedge is true.
+// The model and location that were actually used are recorded in the response metadata.
+func (gc *GeminiClient) withFallback(ctx context.Context, req *Request, hedge bool, fn func(context.Context, Backend, string) (*Response, error)) (*Response, error) {
+	targets := append([]Fallback{{ModelName: gc.requestModelName(req)}}, gc.Fallback.Models...)
+	for i, target := range targets {
+		last := i == len(targets)-1
+		locations := []string{target.Location}
+		if target.Location == "" {
+			locations = gc.regionOrder()
+		}
+		targetCtx, cancel := ctx, context.CancelFunc(func() {})
+		if gc.Fallback.Timeout > 0 && !last {
+			targetCtx, cancel = context.WithTimeout(ctx, gc.Fallback.Timeout)
+		}
+		call := gc.tryRegions(targetCtx, target.ModelName, locations, hedge, fn)
+		cancel()
+		if call.err == nil {
+			call.res.Metadata.ModelName = target.ModelName
+			call.res.Metadata.Location = call.location
+			call.res.Metadata.Fallbacks = i
+			return call.res, nil
+		}
+		var noFallback *noFallbackError
+		if errors.As(call.err, &noFallback) {
+			return nil, noFallback.err
+		}
+		if last || ctx.Err() != nil || !gc.Fallback.Conditions.Matches(call.err) {
+			return nil, call.err
+		}
+		if gc.Verbose {
+			fmt.Printf("%s failed (%v), falling back to %s.\n", target.ModelName, call.err, targets[i+1].ModelName)
+		}
+	}
+	return nil, errors.New("no models to try")
+}
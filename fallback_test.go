@@ -0,0 +1,75 @@
+package geminiclient_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFallbackConditions(t *testing.T) {
+	quotaErr := fmt.Errorf("failed to send message: %w", status.Error(codes.ResourceExhausted, "quota exceeded"))
+	unavailableErr := status.Error(codes.Unavailable, "service unavailable")
+	timeoutErr := fmt.Errorf("failed to send message: %w", context.DeadlineExceeded)
+	blockedErr := fmt.Errorf("failed to send message: %w", &genai.BlockedError{})
+	otherErr := status.Error(codes.InvalidArgument, "bad request")
+
+	conditions := geminiclient.FallbackOnQuota | geminiclient.FallbackOnSafety
+	if !conditions.Matches(quotaErr) {
+		t.Error("Expected a quota error to match FallbackOnQuota")
+	}
+	if !conditions.Matches(blockedErr) {
+		t.Error("Expected a blocked response to match FallbackOnSafety")
+	}
+	if conditions.Matches(unavailableErr) || conditions.Matches(timeoutErr) {
+		t.Error("Expected unavailable and timeout errors to not match when they are not configured")
+	}
+	if geminiclient.FallbackOnAll.Matches(otherErr) {
+		t.Error("Expected an invalid argument error to never match")
+	}
+	if !geminiclient.FallbackOnAll.Matches(unavailableErr) || !geminiclient.FallbackOnAll.Matches(timeoutErr) {
+		t.Error("Expected unavailable and timeout errors to match FallbackOnAll")
+	}
+}
+
+func TestFallbackMetadata(t *testing.T) {
+	gc, fake := geminitest.NewClient(t, geminiclient.WithFallbacks(geminiclient.FallbackOnQuota, geminiclient.Fallback{ModelName: "gemini-1.5-pro"}))
+	fake.QueueError(status.Error(codes.ResourceExhausted, "quota exceeded"))
+	fake.QueueText("Paris")
+
+	// The model that actually answered should be recorded in the response metadata
+	res, err := gc.Generate(context.Background(), geminiclient.NewTextRequest("What is the capital of France? Reply with a single word."))
+	if err != nil {
+		t.Fatalf("Failed to query Gemini: %v", err)
+	}
+	requests := fake.Requests()
+	if len(requests) != 2 || requests[0].Config.ModelName != geminitest.DefaultModelName || requests[1].Config.ModelName != "gemini-1.5-pro" {
+		t.Fatalf("Expected a request to %s and then to gemini-1.5-pro, but got %d requests", geminitest.DefaultModelName, len(requests))
+	}
+	if res.Text != "Paris" || res.Metadata.ModelName != "gemini-1.5-pro" || res.Metadata.Fallbacks != 1 || res.Metadata.Location != gc.ProjectLocation {
+		t.Errorf("Expected \"Paris\" from gemini-1.5-pro in %s after 1 fallback, but got %q from %s in %s after %d",
+			gc.ProjectLocation, res.Text, res.Metadata.ModelName, res.Metadata.Location, res.Metadata.Fallbacks)
+	}
+}
+
+func TestFallbackMidStream(t *testing.T) {
+	gc, fake := geminitest.NewClient(t, geminiclient.WithFallbacks(geminiclient.FallbackOnAll, geminiclient.Fallback{ModelName: "gemini-1.5-pro"}))
+	fake.QueueStream("The capital ", "of France").ThenError(status.Error(codes.Unavailable, "service unavailable"))
+
+	// Falling back after a part of the response was streamed would stream the answer twice
+	var streamed string
+	_, err := gc.GenerateStream(context.Background(), geminiclient.NewTextRequest("What is the capital of France?"), func(s string) {
+		streamed += s
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected the Unavailable error, but got %v", err)
+	}
+	if n := len(fake.Requests()); n != 1 || streamed != "The capital of France" {
+		t.Errorf("Expected 1 request and no fallback, but got %d requests and %q", n, streamed)
+	}
+}
@@ -2,7 +2,6 @@ package geminiclient
 
 import (
 	"context"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"reflect"
@@ -16,21 +15,37 @@ var ErrEmptyPrompt = errors.New("empty prompt")
 // FunctionCallHandler defines a callback type for handling function responses.
 type FunctionCallHandler func(response map[string]any) (map[string]any, error)
 
+// contextType is the type of context.Context, for functions that take a context as their first argument.
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 // AddFunctionTool registers a custom Go function as a tool that the model can call.
+// If the first argument of the function is a context.Context, it is given the context of the request,
+// so that it can stop when the request is canceled.
 func (gc *GeminiClient) AddFunctionTool(name, description string, fn interface{}) error {
-	fnValue := reflect.ValueOf(fn)
-	fnType := fnValue.Type()
+	tool, fnValue, err := functionTool(name, description, fn)
+	if err != nil {
+		return err
+	}
+	gc.Functions[name] = fnValue
+	gc.Tools = append(gc.Tools, tool)
+	return nil
+}
 
-	if fnType.Kind() != reflect.Func {
-		return fmt.Errorf("provided argument is not a function")
+// functionTool creates a tool with a function declaration for the given Go function.
+func functionTool(name, description string, fn interface{}) (*genai.Tool, reflect.Value, error) {
+	fnValue := reflect.ValueOf(fn)
+	if !fnValue.IsValid() || fnValue.Type().Kind() != reflect.Func {
+		return nil, reflect.Value{}, fmt.Errorf("provided argument is not a function")
 	}
+	fnType := fnValue.Type()
 
 	parameters := make(map[string]*genai.Schema)
 	var required []string
 
-	for i := 0; i < fnType.NumIn(); i++ {
+	offset := contextOffset(fnType)
+	for i := offset; i < fnType.NumIn(); i++ {
 		paramType := fnType.In(i)
-		paramName := fmt.Sprintf("param%d", i+1)
+		paramName := fmt.Sprintf("param%d", i+1-offset)
 
 		parameters[paramName] = &genai.Schema{
 			Type: mapGoTypeToGenaiType(paramType),
@@ -38,8 +53,6 @@ func (gc *GeminiClient) AddFunctionTool(name, description string, fn interface{}
 		required = append(required, paramName)
 	}
 
-	gc.Functions[name] = fnValue
-
 	functionDecl := &genai.FunctionDeclaration{
 		Name:        name,
 		Description: description,
@@ -53,142 +66,72 @@ func (gc *GeminiClient) AddFunctionTool(name, description string, fn interface{}
 	tool := &genai.Tool{
 		FunctionDeclarations: []*genai.FunctionDeclaration{functionDecl},
 	}
-	gc.Tools = append(gc.Tools, tool)
-
-	return nil
+	return tool, fnValue, nil
 }
 
 // MultiQueryWithCallbacks processes a prompt, supports function tools, and uses a callback function to handle function responses.
 func (gc *GeminiClient) MultiQueryWithCallbacks(prompt string, base64Data, dataMimeType *string, temperature *float32, callback FunctionCallHandler) (string, error) {
-	if strings.TrimSpace(prompt) == "" {
-		return "", ErrEmptyPrompt
-	}
-
-	gc.ClearParts()
-	gc.AddText(prompt)
+	return gc.MultiQueryWithCallbacksContext(context.Background(), prompt, base64Data, dataMimeType, temperature, callback)
+}
 
-	if base64Data != nil && dataMimeType != nil {
-		data, err := base64.StdEncoding.DecodeString(*base64Data)
-		if err != nil {
-			return "", fmt.Errorf("failed to decode base64 data: %v", err)
-		}
-		gc.AddData(*dataMimeType, data)
+// MultiQueryWithCallbacksContext is like MultiQueryWithCallbacks, but the request and any function calls
+// are canceled when the given context is done.
+func (gc *GeminiClient) MultiQueryWithCallbacksContext(ctx context.Context, prompt string, base64Data, dataMimeType *string, temperature *float32, callback FunctionCallHandler) (string, error) {
+	req, err := gc.queryRequest(prompt, base64Data, dataMimeType, temperature)
+	if err != nil {
+		return "", err
 	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), gc.Timeout)
-	defer cancel()
-
-	model := gc.Client.GenerativeModel(gc.ModelName)
-	if temperature != nil {
-		model.SetTemperature(*temperature)
+	if callback != nil {
+		req = req.WithFunctionCallback(callback)
 	}
-	model.Tools = gc.Tools
-	session := model.StartChat()
 
-	res, err := session.SendMessage(ctx, genai.Text(prompt))
-	if err != nil {
-		return "", fmt.Errorf("failed to send message: %v", err)
-	}
-
-	for _, candidate := range res.Candidates {
-		for _, part := range candidate.Content.Parts {
-			if funcall, ok := part.(genai.FunctionCall); ok {
-				responseData, err := gc.invokeFunction(funcall.Name, funcall.Args)
-				if err != nil {
-					return "", fmt.Errorf("failed to handle function call: %v", err)
-				}
-
-				if callback != nil {
-					responseData, err = callback(responseData)
-					if err != nil {
-						return "", fmt.Errorf("callback processing failed: %v", err)
-					}
-				}
-
-				res, err = session.SendMessage(ctx, genai.FunctionResponse{
-					Name:     funcall.Name,
-					Response: responseData,
-				})
-				if err != nil {
-					return "", fmt.Errorf("failed to send function response: %v", err)
-				}
-
-				var finalResult strings.Builder
-				for _, part := range res.Candidates[0].Content.Parts {
-					if textPart, ok := part.(genai.Text); ok {
-						finalResult.WriteString(string(textPart))
-						finalResult.WriteString("\n")
-					}
-				}
-				return strings.TrimSpace(finalResult.String()), nil
-			}
-		}
-	}
+	ctx, cancel := gc.withTimeout(ctx)
+	defer cancel()
 
-	result, err := gc.SubmitToClient(ctx)
+	res, err := gc.Generate(ctx, req)
 	if err != nil {
-		return "", fmt.Errorf("failed to process response: %v", err)
+		return "", err
 	}
-
-	return strings.TrimSpace(result), nil
+	gc.setMetadata(res.Metadata)
+	return strings.TrimSpace(res.Text), nil
 }
 
 // MultiQueryWithSequentialCallbacks handles multiple function calls in sequence, using callback functions to manage responses.
 func (gc *GeminiClient) MultiQueryWithSequentialCallbacks(prompt string, callbacks map[string]FunctionCallHandler) (string, error) {
-	if strings.TrimSpace(prompt) == "" {
-		return "", ErrEmptyPrompt
-	}
+	return gc.MultiQueryWithSequentialCallbacksContext(context.Background(), prompt, callbacks)
+}
 
-	gc.ClearParts()
-	gc.AddText(prompt)
+// MultiQueryWithSequentialCallbacksContext is like MultiQueryWithSequentialCallbacks, but the request and any
+// function calls are canceled when the given context is done.
+func (gc *GeminiClient) MultiQueryWithSequentialCallbacksContext(ctx context.Context, prompt string, callbacks map[string]FunctionCallHandler) (string, error) {
+	req, err := gc.queryRequest(prompt, nil, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithFunctionHandlers(callbacks)
 
-	ctx, cancel := context.WithTimeout(context.Background(), gc.Timeout)
+	ctx, cancel := gc.withTimeout(ctx)
 	defer cancel()
 
-	model := gc.Client.GenerativeModel(gc.ModelName)
-	model.Tools = gc.Tools
-	session := model.StartChat()
-
-	res, err := session.SendMessage(ctx, genai.Text(prompt))
+	res, err := gc.Generate(ctx, req)
 	if err != nil {
-		return "", fmt.Errorf("failed to send message: %v", err)
-	}
-
-	for _, candidate := range res.Candidates {
-		for _, part := range candidate.Content.Parts {
-			if funcall, ok := part.(genai.FunctionCall); ok {
-				handler, exists := callbacks[funcall.Name]
-				if !exists {
-					return "", fmt.Errorf("no handler found for function: %s", funcall.Name)
-				}
-
-				responseData, err := handler(funcall.Args)
-				if err != nil {
-					return "", fmt.Errorf("handler error for function %s: %v", funcall.Name, err)
-				}
-
-				res, err = session.SendMessage(ctx, genai.FunctionResponse{
-					Name:     funcall.Name,
-					Response: responseData,
-				})
-				if err != nil {
-					return "", fmt.Errorf("failed to send function response: %v", err)
-				}
-			}
-		}
+		return "", err
 	}
+	gc.setMetadata(res.Metadata)
+	return strings.TrimSpace(res.Text), nil
+}
 
-	finalResult, err := gc.SubmitToClient(ctx)
-	if err != nil {
-		return "", fmt.Errorf("failed to process final response: %v", err)
+// contextOffset returns 1 if the first argument of the given function type is a context.Context, and 0 otherwise.
+func contextOffset(fnType reflect.Type) int {
+	if fnType.NumIn() > 0 && fnType.In(0) == contextType {
+		return 1
 	}
-
-	return strings.TrimSpace(finalResult), nil
+	return 0
 }
 
 // invokeFunction uses reflection to call the appropriate user-defined function based on the AI's request.
-func (gc *GeminiClient) invokeFunction(name string, args map[string]any) (map[string]any, error) {
-	fn, exists := gc.Functions[name]
+func invokeFunction(ctx context.Context, functions map[string]reflect.Value, name string, args map[string]any) (map[string]any, error) {
+	fn, exists := functions[name]
 	if !exists {
 		return nil, fmt.Errorf("function %s not found", name)
 	}
@@ -196,13 +139,17 @@ func (gc *GeminiClient) invokeFunction(name string, args map[string]any) (map[st
 	fnType := fn.Type()
 
 	in := make([]reflect.Value, fnType.NumIn())
-	for i := 0; i < fnType.NumIn(); i++ {
-		paramName := fmt.Sprintf("param%d", i+1)
+	offset := contextOffset(fnType)
+	if offset == 1 {
+		in[0] = reflect.ValueOf(ctx)
+	}
+	for i := offset; i < fnType.NumIn(); i++ {
+		paramName := fmt.Sprintf("param%d", i+1-offset)
 		argValue, exists := args[paramName]
 		if !exists {
 			return nil, fmt.Errorf("missing argument: %s", paramName)
 		}
-		in[i] = reflect.ValueOf(argValue)
+		in[i] = convertArgument(reflect.ValueOf(argValue), fnType.In(i))
 	}
 
 	out := fn.Call(in)
@@ -215,6 +162,48 @@ func (gc *GeminiClient) invokeFunction(name string, args map[string]any) (map[st
 	return result, nil
 }
 
+// convertArgument converts a number to the type of the parameter it is given for. This is needed for all backends,
+// since numbers in function call arguments are always float64, both when they are decoded from JSON and from protobuf.
+func convertArgument(arg reflect.Value, paramType reflect.Type) reflect.Value {
+	if arg.IsValid() && isNumber(arg.Kind()) && isNumber(paramType.Kind()) {
+		return arg.Convert(paramType)
+	}
+	return arg
+}
+
+// isNumber returns true for the integer and floating point kinds.
+func isNumber(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Float64
+}
+
+// callWithContext runs fn in a separate goroutine, and returns early with the context error if the context is done
+// before fn returns. A panic in fn is returned as an error.
+func callWithContext(ctx context.Context, fn func() (map[string]any, error)) (map[string]any, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type result struct {
+		data map[string]any
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{err: fmt.Errorf("panic occurred: %v", r)}
+			}
+		}()
+		data, err := fn()
+		done <- result{data, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-done:
+		return r.data, r.err
+	}
+}
+
 // ClearToolsAndFunctions clears all registered tools and functions.
 func (gc *GeminiClient) ClearToolsAndFunctions() {
 	gc.Functions = make(map[string]reflect.Value)
@@ -1,35 +1,22 @@
 package geminiclient_test
 
 import (
-	"fmt"
-	"os"
+	"context"
+	"errors"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/xyproto/env/v2"
-	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
 )
 
-var projectID string
-
-func TestMain(m *testing.M) {
-	// Check the project ID once before running any tests
-	projectID = env.StrAlt("GCP_PROJECT_ID", "PROJECT_ID", "")
-	if projectID == "" {
-		fmt.Println(geminiclient.ErrGoogleCloudProjectID)
-		os.Exit(1)
-	}
-
-	// Run the tests
-	os.Exit(m.Run())
-}
-
 func TestCustomFunction(t *testing.T) {
-	gc := geminiclient.MustNew()
+	gc, fake := geminitest.NewClient(t)
 
 	// Define a custom function for getting weather
+	var calledWith string
 	getWeatherRightNow := func(location string) string {
-		fmt.Println("getWeatherRightNow was called")
+		calledWith = location
 		switch location {
 		case "NY":
 			return "It's sunny in New York."
@@ -46,26 +33,33 @@ func TestCustomFunction(t *testing.T) {
 		t.Fatalf("Failed to add function tool: %v", err)
 	}
 
-	// Query Gemini with a prompt that requires using a tool
+	// The model asks for the function to be called, and then answers with the result
+	fake.QueueFunctionCall("get_weather_right_now", map[string]any{"param1": "NY"})
+	fake.QueueText("It is sunny in New York right now.")
+
 	result, err := gc.Query("What is the weather in NY?")
 	if err != nil {
 		t.Fatalf("Failed to query Gemini: %v", err)
 	}
 
-	// Check the response
-	if !strings.Contains(result, "sunny") {
-		t.Errorf("Expected 'sunny' to be in the response, but got: %v", result)
+	if calledWith != "NY" {
+		t.Errorf("Expected the function to be called with \"NY\", but got %q", calledWith)
+	}
+	if response, ok := fake.LastRequest().FunctionResponse("get_weather_right_now"); !ok || response["return1"] != "It's sunny in New York." {
+		t.Errorf("Expected the function result to be sent back, but got %v", response)
+	}
+	if result != "It is sunny in New York right now." {
+		t.Errorf("Expected the final answer, but got: %v", result)
 	}
-
-	fmt.Println("AI Response:", result)
 }
 
 func TestReverseStringFunction(t *testing.T) {
-	gc := geminiclient.MustNew()
+	gc, fake := geminitest.NewClient(t)
 
 	// Define a custom function for reversing a string
+	var calledWith string
 	reverseString := func(input string) string {
-		fmt.Println("reverseString was called")
+		calledWith = input
 		runes := []rune(input)
 		for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
 			runes[i], runes[j] = runes[j], runes[i]
@@ -79,23 +73,28 @@ func TestReverseStringFunction(t *testing.T) {
 		t.Fatalf("Failed to add function tool: %v", err)
 	}
 
-	// Query Gemini with a prompt that requires using the reverse_string function
-	result, err := gc.Query("Reverse the string 'hello'. Reply with a single word.")
+	fake.QueueFunctionCall("reverse_string", map[string]any{"param1": "hello"})
+	fake.QueueText("The reversed string is olleh.")
+
+	result, err := gc.Query("Reverse the string 'hello'")
 	if err != nil {
 		t.Fatalf("Failed to query Gemini: %v", err)
 	}
 
-	// Check the response
-	expected := "olleh"
-	if !strings.Contains(result, expected) {
-		t.Errorf("Expected '%s' to be in the response, but got: %v", expected, result)
+	if calledWith != "hello" {
+		t.Errorf("Expected the function to be called with \"hello\", but got %q", calledWith)
+	}
+	if response, ok := fake.LastRequest().FunctionResponse("reverse_string"); !ok || response["return1"] != "olleh" {
+		t.Errorf("Expected \"olleh\" to be sent back, but got %v", response)
+	}
+	if result != "The reversed string is olleh." {
+		t.Errorf("Expected the final answer, but got: %v", result)
 	}
-
-	fmt.Println("Gemini:", result)
 }
 
 func TestNoFunctionsRegistered(t *testing.T) {
-	gc := geminiclient.MustNew()
+	gc, fake := geminitest.NewClient(t)
+	fake.QueueText("Paris")
 
 	// Query Gemini with a prompt without any registered functions
 	result, err := gc.Query("What is the capital of France? Reply with a single word.")
@@ -103,13 +102,37 @@ func TestNoFunctionsRegistered(t *testing.T) {
 		t.Fatalf("Failed to query Gemini: %v", err)
 	}
 
-	if !strings.Contains(result, "Paris") {
-		t.Errorf("Expected 'Paris' to be in the response, but got: %v", result)
+	if result != "Paris" {
+		t.Errorf("Expected 'Paris', but got: %v", result)
+	}
+	if len(fake.LastRequest().Config.Tools) != 0 {
+		t.Errorf("Expected no tools to be sent, but got %d", len(fake.LastRequest().Config.Tools))
+	}
+}
+
+func TestFunctionNumberArguments(t *testing.T) {
+	gc, fake := geminitest.NewClient(t)
+
+	// Numbers in function call arguments are float64, and are converted to the types of the parameters
+	add := func(a int, b uint8, c float32) float64 {
+		return float64(a) + float64(b) + float64(c)
+	}
+	if err := gc.AddFunctionTool("add", "Add three numbers", add); err != nil {
+		t.Fatalf("Failed to add function tool: %v", err)
+	}
+	fake.QueueFunctionCall("add", map[string]any{"param1": 2.0, "param2": 3.0, "param3": 0.5})
+	fake.QueueText("The sum is 5.5.")
+
+	if _, err := gc.Query("What is 2 + 3 + 0.5?"); err != nil {
+		t.Fatal(err)
+	}
+	if response, ok := fake.LastRequest().FunctionResponse("add"); !ok || response["return1"] != 5.5 {
+		t.Errorf("Expected the function to return 5.5, but got %v", response)
 	}
 }
 
 func TestInvalidFunctionRegistration(t *testing.T) {
-	gc := geminiclient.MustNew()
+	gc, _ := geminitest.NewClient(t)
 
 	// Attempt to register an invalid function (non-function type)
 	err := gc.AddFunctionTool("invalid_tool", "This should fail", "not_a_function")
@@ -124,7 +147,7 @@ func TestInvalidFunctionRegistration(t *testing.T) {
 }
 
 func TestEmptyPrompt(t *testing.T) {
-	gc := geminiclient.MustNew()
+	gc, _ := geminitest.NewClient(t)
 
 	// Query Gemini with an empty prompt
 	_, err := gc.Query("")
@@ -134,7 +157,7 @@ func TestEmptyPrompt(t *testing.T) {
 }
 
 func TestAddImageInvalidPath(t *testing.T) {
-	gc := geminiclient.MustNew()
+	gc, _ := geminitest.NewClient(t)
 
 	// Attempt to add an image from an invalid path
 	err := gc.AddImage("/non/existent/path.png")
@@ -149,7 +172,7 @@ func TestAddImageInvalidPath(t *testing.T) {
 }
 
 func TestAddURLInvalid(t *testing.T) {
-	gc := geminiclient.MustNew()
+	gc, _ := geminitest.NewClient(t)
 
 	// Attempt to add a URL that does not exist
 	err := gc.AddURL("http://invalid.url/nonexistent.png")
@@ -162,3 +185,30 @@ func TestAddURLInvalid(t *testing.T) {
 		t.Errorf("Expected error '%s', but got: %v", expectedErr, err)
 	}
 }
+
+func TestFunctionCallCanceled(t *testing.T) {
+	gc, fake := geminitest.NewClient(t)
+
+	// Define a custom function that takes a context, and only returns when it is canceled
+	waitForever := func(ctx context.Context, location string) string {
+		<-ctx.Done()
+		return "canceled"
+	}
+
+	err := gc.AddFunctionTool("get_weather_right_now", "Get the current weather for a specific location", waitForever)
+	if err != nil {
+		t.Fatalf("Failed to add function tool: %v", err)
+	}
+	fake.QueueFunctionCall("get_weather_right_now", map[string]any{"param1": "NY"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err = gc.QueryContext(ctx, "What is the weather in NY?")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the function call to be canceled, but got: %v", err)
+	}
+	if n := len(fake.Requests()); n != 1 {
+		t.Errorf("Expected the function result to not be sent, but got %d requests", n)
+	}
+}
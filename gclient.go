@@ -5,29 +5,71 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"net/http"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/vertexai/genai"
 	"github.com/xyproto/env/v2"
-	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
 	"google.golang.org/api/option"
 )
 
 type GeminiClient struct {
-	Client              *genai.Client
+	Client              *genai.Client            // The Vertex AI client, if Backend is a VertexBackend
+	Backend             Backend                  // The provider of the models, see SetBackend
 	Functions           map[string]reflect.Value // For custom functions that the LLM can call
 	ModelName           string
 	MultiModalModelName string
+	Router              ModelRouter // Picks the model for each request, see SetModelRouter
 	ProjectLocation     string
 	ProjectID           string
 	Tools               []*genai.Tool
 	Parts               []genai.Part
+	Retry               RetryPolicy
+	Fallback            FallbackPolicy
+	Regions             RegionPolicy
+	CircuitBreaker      CircuitBreakerPolicy
+	RateLimiter         *RateLimiter   // Optional, and may be shared between clients
+	Cache               Cache          // Optional, and may be shared between clients
+	CacheTTL            time.Duration  // How long cached responses are kept (0 for no expiry)
+	Coalesce            bool           // Share identical requests that are in flight, see SetCoalescing
+	Images              ImagePolicy    // How images are prepared before they are added, see SetImagePolicy
+	Staging             StagingPolicy  // How large parts are uploaded to Cloud Storage, see SetStaging
+	Downloads           DownloadPolicy // How files are downloaded by AddURL, see SetDownloadPolicy
 	Timeout             time.Duration
 	Temperature         float32
+	GenerationConfig    genai.GenerationConfig // The generation config for requests that do not have one
+	SystemInstruction   string                 // The system instruction for requests that do not have one
+	SafetySettings      []*genai.SafetySetting // Optional thresholds for blocking harmful content
 	Trim                bool
 	Verbose             bool
+
+	mu              sync.Mutex
+	metadata        ResponseMetadata               // the metadata of the most recent response, see LastMetadata
+	clientOptions   []option.ClientOption          // extra options for the Vertex AI client, see WithEndpoint
+	withREST        bool                           // use the REST transport instead of gRPC for Vertex AI
+	withGRPC        bool                           // gRPC was explicitly asked for, see WithGRPC
+	withoutAuth     bool                           // do not look up or send any credentials, see WithoutAuthentication
+	httpClient      *http.Client                   // a custom HTTP client for the REST transport, see WithHTTPClient
+	headers         http.Header                    // extra headers for all requests to Vertex AI, see WithHeader
+	credentialsJSON []byte                         // credentials to use instead of the Application Default Credentials, see WithCredentialsJSON
+	tokenSource     oauth2.TokenSource             // a token source to use instead of the Application Default Credentials
+	impersonate     *impersonate.CredentialsConfig // a service account to act as, see WithImpersonation
+	profiles        []profileSelection             // the profiles that are selected with WithProfile, see NewClient
+	profilesApplied bool                           // the selected profiles have been applied, before the other options
+	storage         *http.Client                   // the client for Cloud Storage, see StagingPolicy
+	staged          map[string]time.Time           // when staged objects were last uploaded or used
+	backends        map[string]Backend             // backends for other locations than ProjectLocation
+	health          map[string]*regionHealth       // the recent failures and latencies per location
+	circuits        map[circuitKey]*circuit        // circuit breakers per model and location
+	flights         map[string]*flight             // coalesced requests that are in flight
+	cacheHits       atomic.Uint64
+	cacheMisses     atomic.Uint64
 }
 
 const (
@@ -43,73 +85,206 @@ const (
 )
 
 var (
-	ErrGoogleCloudProjectID = errors.New("please set GCP_PROJECT_ID or PROJECT_ID to your Google Cloud project ID")
+	ErrGoogleCloudProjectID = errors.New("please set GCP_PROJECT_ID or PROJECT_ID to your Google Cloud project ID, or GEMINI_API_KEY to a Gemini API key")
 )
 
-func NewCustom(modelName, multiModalModelName, projectLocation, projectID string, temperature float32, timeout time.Duration) (*GeminiClient, error) {
+// NewClient creates a new client, configured with the given options. The settings are taken from the options,
+// then from the environment variables (see the README), then from the profile that is selected with $GEMINI_PROFILE
+// (see WithProfile) and then from the defaults. All invalid options are reported at once, in the returned error.
+// Unless a backend is given with WithBackend, Google AI Studio is used if no project ID is set but a Gemini API key is,
+// and Vertex AI otherwise. The given context is used for looking up the credentials and creating the Vertex AI client.
+func NewClient(ctx context.Context, opts ...Option) (*GeminiClient, error) {
+	gc, errs := newClient(nil, opts)
+	if len(gc.profiles) > 0 {
+		// Profiles are applied before all other options, no matter where WithProfile is given,
+		// so start over with the selected profiles instead of the default profile
+		gc, errs = newClient(gc.profiles, opts)
+	}
+	errs = append(errs, gc.validate()...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if gc.Backend != nil {
+		return gc, nil
+	}
+	if gc.ProjectID == "" {
+		// Use Google AI Studio instead of Vertex AI if a Gemini API key is set
+		if apiKey := apiKeyFromEnv(); apiKey != "" {
+			gc.Backend = NewAIStudioBackend(apiKey)
+			return gc, nil
+		}
+		return nil, ErrGoogleCloudProjectID
+	}
+	clientOptions, err := gc.vertexOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := NewVertexBackend(ctx, gc.ProjectID, gc.ProjectLocation, clientOptions...)
+	if err != nil {
+		return nil, err
+	}
+	backend.Headers = gc.headers
+	gc.Client = backend.Client
+	gc.Backend = backend
+	return gc, nil
+}
+
+// newClient returns a client with the defaults, the settings from the environment, the given profiles (or else the
+// default profile) and the given options, in that order, together with all problems that were found on the way.
+func newClient(profiles []profileSelection, opts []Option) (*GeminiClient, []error) {
 	gc := &GeminiClient{
-		ModelName:           env.Str("MODEL_NAME", modelName),
-		MultiModalModelName: env.Str("MULTI_MODAL_MODEL_NAME", multiModalModelName),
-		ProjectLocation:     env.StrAlt("GCP_LOCATION", "PROJECT_LOCATION", projectLocation),
-		ProjectID:           env.StrAlt("GCP_PROJECT_ID", "PROJECT_ID", projectID),
-		Timeout:             timeout,
-		Temperature:         temperature,
+		ModelName:           env.Str("MODEL_NAME", defaultModelName),
+		MultiModalModelName: env.Str("MULTI_MODAL_MODEL_NAME", defaultMultiModalModelName),
+		ProjectLocation:     env.StrAlt("GCP_LOCATION", "PROJECT_LOCATION", defaultProjectLocation),
+		ProjectID:           env.StrAlt("GCP_PROJECT_ID", "PROJECT_ID", defaultProjectID),
+		Timeout:             defaultTimeout,
+		Temperature:         defaultTemperature,
 		Tools:               []*genai.Tool{},
 		Functions:           make(map[string]reflect.Value),
 		Trim:                defaultTrim,
 		Verbose:             defaultVerbose,
 		Parts:               make([]genai.Part, 0),
+		Retry:               DefaultRetryPolicy(),
+		Regions:             DefaultRegionPolicy(),
 	}
-	if gc.ProjectID == "" {
-		return nil, ErrGoogleCloudProjectID
+	var errs []error
+	if profiles == nil {
+		if err := gc.applyDefaultProfile(); err != nil {
+			errs = append(errs, err)
+		}
+	} else {
+		for _, profile := range profiles {
+			if err := profile.apply(gc); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		gc.profilesApplied = true
 	}
-	ctx := context.Background()
-	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
-	if err != nil {
-		return nil, fmt.Errorf("failed to obtain default credentials: %v", err)
+	for _, opt := range opts {
+		if err := opt(gc); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	genaiClient, err := genai.NewClient(ctx, gc.ProjectID, gc.ProjectLocation, option.WithCredentials(creds))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create genai client: %v", err)
+	return gc, errs
+}
+
+// validate returns all problems with the configuration of the client.
+func (gc *GeminiClient) validate() []error {
+	var errs []error
+	if gc.ModelName == "" {
+		errs = append(errs, errors.New("the model name is empty"))
 	}
-	gc.Client = genaiClient
-	return gc, nil
+	if gc.Temperature < 0 || gc.Temperature > 2 {
+		errs = append(errs, fmt.Errorf("the temperature must be between 0 and 2, but is %v", gc.Temperature))
+	}
+	if gc.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("the timeout must not be negative, but is %v", gc.Timeout))
+	}
+	if gc.withGRPC && gc.httpClient != nil {
+		errs = append(errs, errors.New("gRPC can not be used together with WithHTTPClient"))
+	}
+	if gc.Backend == nil && gc.ProjectID != "" && gc.ProjectLocation == "" {
+		errs = append(errs, errors.New("the Google Cloud location is empty"))
+	}
+	if gc.Retry.MaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("the retry policy must allow at least 1 attempt, but allows %d", gc.Retry.MaxAttempts))
+	}
+	if gc.CacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("the cache TTL must not be negative, but is %v", gc.CacheTTL))
+	}
+	if err := gc.Images.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := gc.Staging.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := gc.Downloads.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
 }
 
-func New(modelName string, temperature float32) (*GeminiClient, error) {
+// NewCustom creates a new client with the given settings. Environment variables take precedence
+// over the given model names, location and project ID, while the given settings take precedence over the profile.
+// Empty strings are not used. See NewClient for a more flexible constructor.
+func NewCustom(modelName, multiModalModelName, projectLocation, projectID string, temperature float32, timeout time.Duration, opts ...Option) (*GeminiClient, error) {
+	return NewCustomContext(context.Background(), modelName, multiModalModelName, projectLocation, projectID, temperature, timeout, opts...)
+}
+
+// NewCustomContext is like NewCustom, but uses the given context for looking up the credentials and creating the client.
+func NewCustomContext(ctx context.Context, modelName, multiModalModelName, projectLocation, projectID string, temperature float32, timeout time.Duration, opts ...Option) (*GeminiClient, error) {
+	args := arguments{modelName: modelName, multiModalModelName: multiModalModelName, projectLocation: projectLocation, projectID: projectID, temperature: &temperature, timeout: &timeout}
+	return NewClient(ctx, append(args.options(), opts...)...)
+}
+
+// arguments are the settings that are given to the constructors with positional arguments.
+// Settings that are not given are empty or nil, and are taken from the environment, a profile or the defaults instead.
+type arguments struct {
+	modelName, multiModalModelName, projectLocation, projectID string
+	temperature                                                *float32
+	timeout                                                    *time.Duration
+}
+
+// options returns the options for the given settings
+func (args arguments) options() []Option {
+	var opts []Option
+	if args.modelName != "" {
+		opts = append(opts, WithModel(env.Str("MODEL_NAME", args.modelName)))
+	}
+	if args.multiModalModelName != "" {
+		opts = append(opts, WithMultiModalModel(env.Str("MULTI_MODAL_MODEL_NAME", args.multiModalModelName)))
+	}
+	if args.projectLocation != "" {
+		opts = append(opts, WithLocation(env.StrAlt("GCP_LOCATION", "PROJECT_LOCATION", args.projectLocation)))
+	}
+	if args.projectID != "" {
+		opts = append(opts, WithProjectID(env.StrAlt("GCP_PROJECT_ID", "PROJECT_ID", args.projectID)))
+	}
+	if args.temperature != nil {
+		opts = append(opts, WithTemperature(*args.temperature))
+	}
+	if args.timeout != nil {
+		opts = append(opts, WithTimeout(*args.timeout))
+	}
+	return opts
+}
+
+func New(modelName string, temperature float32, opts ...Option) (*GeminiClient, error) {
 	// The Google Cloud Project ID is fetched from $GCP_PROJECT_ID or $PROJECT_ID instead.
-	return NewCustom(modelName, defaultMultiModalModelName, defaultProjectLocation, defaultProjectID, temperature, defaultTimeout)
+	args := arguments{modelName: modelName, temperature: &temperature}
+	return NewClient(context.Background(), append(args.options(), opts...)...)
 }
 
-func MustNew() *GeminiClient {
-	gc, err := New(defaultModelName, defaultTemperature)
+func MustNew(opts ...Option) *GeminiClient {
+	gc, err := NewClient(context.Background(), opts...)
 	if err != nil {
 		panic(err)
 	}
 	return gc
 }
 
-func NewText(modelName, projectLocation, projectID string, temperature float32) (*GeminiClient, error) {
-	return NewCustom(modelName, defaultMultiModalModelName, projectLocation, projectID, temperature, defaultTimeout)
+func NewText(modelName, projectLocation, projectID string, temperature float32, opts ...Option) (*GeminiClient, error) {
+	args := arguments{modelName: modelName, projectLocation: projectLocation, projectID: projectID, temperature: &temperature}
+	return NewClient(context.Background(), append(args.options(), opts...)...)
 }
 
-func MustNewText(modelName string, temperature float32) *GeminiClient {
+func MustNewText(modelName string, temperature float32, opts ...Option) *GeminiClient {
 	// The Google Cloud Project ID is fetched from $GCP_PROJECT_ID or $PROJECT_ID instead.
-	gc, err := NewText(modelName, defaultProjectLocation, defaultProjectID, temperature)
+	gc, err := New(modelName, temperature, opts...)
 	if err != nil {
 		panic(err)
 	}
 	return gc
 }
 
-func NewWithTimeout(modelName string, temperature float32, timeout time.Duration) (*GeminiClient, error) {
+func NewWithTimeout(modelName string, temperature float32, timeout time.Duration, opts ...Option) (*GeminiClient, error) {
 	// The Google Cloud Project ID is fetched from $GCP_PROJECT_ID or $PROJECT_ID instead.
-	return NewCustom(modelName, defaultMultiModalModelName, defaultProjectLocation, defaultProjectID, temperature, timeout)
+	args := arguments{modelName: modelName, temperature: &temperature, timeout: &timeout}
+	return NewClient(context.Background(), append(args.options(), opts...)...)
 }
 
-func MustNewWithTimeout(modelName string, temperature float32, timeout time.Duration) *GeminiClient {
-	// The Google Cloud Project ID is fetched from $GCP_PROJECT_ID or $PROJECT_ID instead.
-	gc, err := NewCustom(modelName, defaultMultiModalModelName, defaultProjectLocation, defaultProjectID, temperature, timeout)
+func MustNewWithTimeout(modelName string, temperature float32, timeout time.Duration, opts ...Option) *GeminiClient {
+	gc, err := NewWithTimeout(modelName, temperature, timeout, opts...)
 	if err != nil {
 		panic(err)
 	}
@@ -118,100 +293,92 @@ func MustNewWithTimeout(modelName string, temperature float32, timeout time.Dura
 
 // MultiQuery processes a prompt with optional base64-encoded data and MIME type for the data.
 func (gc *GeminiClient) MultiQuery(prompt string, base64Data, dataMimeType *string, temperature *float32) (string, error) {
-	if strings.TrimSpace(prompt) == "" {
-		return "", ErrEmptyPrompt
+	return gc.MultiQueryContext(context.Background(), prompt, base64Data, dataMimeType, temperature)
+}
+
+// MultiQueryContext is like MultiQuery, but the request is canceled when the given context is done.
+func (gc *GeminiClient) MultiQueryContext(ctx context.Context, prompt string, base64Data, dataMimeType *string, temperature *float32) (string, error) {
+	req, err := gc.queryRequest(prompt, base64Data, dataMimeType, temperature)
+	if err != nil {
+		return "", err
 	}
 
-	gc.ClearParts()
-	gc.AddText(prompt)
+	ctx, cancel := gc.withTimeout(ctx)
+	defer cancel()
 
-	// If base64Data and dataMimeType are provided, decode the data and add it to the multimodal instance.
-	if base64Data != nil && dataMimeType != nil {
-		data, err := base64.StdEncoding.DecodeString(*base64Data)
-		if err != nil {
-			return "", fmt.Errorf("failed to decode base64 data: %v", err)
-		}
-		gc.AddData(*dataMimeType, data)
+	// Submit the multimodal query, handle function calls if present and process the result.
+	res, err := gc.Generate(ctx, req)
+	if err != nil {
+		return "", err
 	}
+	gc.setMetadata(res.Metadata)
 
-	ctx, cancel := context.WithTimeout(context.Background(), gc.Timeout)
-	defer cancel()
+	return strings.TrimSpace(res.Text), nil
+}
 
-	// Set up the model with tools and start a chat session.
-	model := gc.Client.GenerativeModel(gc.ModelName)
-	if temperature != nil {
-		model.SetTemperature(*temperature)
+// queryRequest builds a Request from a prompt with optional base64-encoded data and MIME type for the data,
+// together with the tools and functions that are registered with the client.
+func (gc *GeminiClient) queryRequest(prompt string, base64Data, dataMimeType *string, temperature *float32) (*Request, error) {
+	if strings.TrimSpace(prompt) == "" {
+		return nil, ErrEmptyPrompt
 	}
-	model.Tools = gc.Tools
-	session := model.StartChat()
+	req := gc.Request()
+	req.parts = []genai.Part{genai.Text(prompt)}
 
-	// Submit the multimodal query and process the result.
-	res, err := session.SendMessage(ctx, genai.Text(prompt))
-	if err != nil {
-		return "", fmt.Errorf("failed to send message: %v", err)
-	}
-
-	// Handle function calls if present.
-	for _, candidate := range res.Candidates {
-		for _, part := range candidate.Content.Parts {
-			if funcall, ok := part.(genai.FunctionCall); ok {
-				// Invoke the user-defined function using reflection.
-				responseData, err := gc.invokeFunction(funcall.Name, funcall.Args)
-				if err != nil {
-					return "", fmt.Errorf("failed to handle function call: %v", err)
-				}
-
-				// Send the function response back to the model.
-				res, err = session.SendMessage(ctx, genai.FunctionResponse{
-					Name:     funcall.Name,
-					Response: responseData,
-				})
-				if err != nil {
-					return "", fmt.Errorf("failed to send function response: %v", err)
-				}
-
-				var finalResult strings.Builder
-				// Process the final response from the LLM.
-				for _, part := range res.Candidates[0].Content.Parts {
-					if textPart, ok := part.(genai.Text); ok {
-						finalResult.WriteString(string(textPart))
-						finalResult.WriteString("\n")
-					}
-				}
-				return strings.TrimSpace(finalResult.String()), nil
-			}
+	// If base64Data and dataMimeType are provided, decode the data and add it to the request.
+	if base64Data != nil && dataMimeType != nil {
+		data, err := base64.StdEncoding.DecodeString(*base64Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode base64 data: %v", err)
 		}
+		req = req.WithData(*dataMimeType, data)
 	}
-
-	// Handle the usual case where no function call is made.
-	result, err := gc.SubmitToClient(ctx)
-	if err != nil {
-		return "", fmt.Errorf("failed to process response: %v", err)
+	if temperature != nil {
+		req = req.WithTemperature(*temperature)
 	}
-
-	return strings.TrimSpace(result), nil
+	return req, nil
 }
 
 func (gc *GeminiClient) Query(prompt string) (string, error) {
 	return gc.MultiQuery(prompt, nil, nil, nil)
 }
 
+// QueryContext is like Query, but the request is canceled when the given context is done.
+func (gc *GeminiClient) QueryContext(ctx context.Context, prompt string) (string, error) {
+	return gc.MultiQueryContext(ctx, prompt, nil, nil, nil)
+}
+
 // QueryWithCallbacks allows querying with a prompt and processing function calls via a callback handler.
 func (gc *GeminiClient) QueryWithCallbacks(prompt string, callback FunctionCallHandler) (string, error) {
 	return gc.MultiQueryWithCallbacks(prompt, nil, nil, nil, callback)
 }
 
+// QueryWithCallbacksContext is like QueryWithCallbacks, but the request is canceled when the given context is done.
+func (gc *GeminiClient) QueryWithCallbacksContext(ctx context.Context, prompt string, callback FunctionCallHandler) (string, error) {
+	return gc.MultiQueryWithCallbacksContext(ctx, prompt, nil, nil, nil, callback)
+}
+
 // QueryWithSequentialCallbacks allows querying with a prompt and processing multiple function calls in sequence via a map of callback handlers.
 func (gc *GeminiClient) QueryWithSequentialCallbacks(prompt string, callbacks map[string]FunctionCallHandler) (string, error) {
 	return gc.MultiQueryWithSequentialCallbacks(prompt, callbacks)
 }
 
+// QueryWithSequentialCallbacksContext is like QueryWithSequentialCallbacks, but the request is canceled when the given context is done.
+func (gc *GeminiClient) QueryWithSequentialCallbacksContext(ctx context.Context, prompt string, callbacks map[string]FunctionCallHandler) (string, error) {
+	return gc.MultiQueryWithSequentialCallbacksContext(ctx, prompt, callbacks)
+}
+
 func Ask(prompt string, temperature float32) (string, error) {
-	gc, err := NewWithTimeout(defaultModelName, temperature, 10*time.Second)
+	return AskContext(context.Background(), prompt, temperature)
+}
+
+// AskContext is like Ask, but creating the client and sending the request is canceled when the given context is done.
+func AskContext(ctx context.Context, prompt string, temperature float32) (string, error) {
+	gc, err := NewCustomContext(ctx, defaultModelName, defaultMultiModalModelName, defaultProjectLocation, defaultProjectID, temperature, 10*time.Second)
 	if err != nil {
 		return "", err
 	}
-	result, err := gc.Query(prompt)
+	result, err := gc.QueryContext(ctx, prompt)
 	if err != nil {
 		return "", err
 	}
@@ -252,44 +419,58 @@ func (gc *GeminiClient) SetTrim(trim bool) {
 // SubmitToClient sends all added parts to the specified Vertex AI model for processing,
 // returning the model's response. It supports temperature configuration and response trimming.
 func (gc *GeminiClient) SubmitToClient(ctx context.Context) (result string, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = fmt.Errorf("panic occurred: %v", r)
-		}
-	}()
-	// Configure the model.
-	model := gc.Client.GenerativeModel(gc.ModelName)
-	model.SetTemperature(gc.Temperature)
 	// Pass in the parts and generate a response.
-	res, err := model.GenerateContent(ctx, gc.Parts...)
+	res, err := gc.Generate(ctx, gc.Request())
 	if err != nil {
+		if errors.Is(err, ErrEmptyPrompt) {
+			return "", err
+		}
 		return "", fmt.Errorf("unable to generate contents: %v", err)
 	}
-	// Examine the response defensively.
-	if res == nil || len(res.Candidates) == 0 || res.Candidates[0] == nil ||
-		res.Candidates[0].Content == nil || res.Candidates[0].Content.Parts == nil ||
-		len(res.Candidates[0].Content.Parts) == 0 {
-		return "", errors.New("empty response from model")
-	}
-	// Return the result as a string.
-	result = fmt.Sprintf("%s\n", res.Candidates[0].Content.Parts[0])
-	if gc.Trim {
-		return strings.TrimSpace(result), nil
-	}
-	return result, nil
+	gc.setMetadata(res.Metadata)
+	return res.Text, nil
 }
 
 // Submit sends all added parts to the specified Vertex AI model for processing,
 // returning the model's response. It supports temperature configuration and response trimming.
 // This function creates a temporary client and is not meant to be used within Google Cloud (use SubmitToClient instead).
 func (gc *GeminiClient) Submit() (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), gc.Timeout)
+	return gc.SubmitContext(context.Background())
+}
+
+// SubmitContext is like Submit, but the request is canceled when the given context is done.
+func (gc *GeminiClient) SubmitContext(ctx context.Context) (string, error) {
+	ctx, cancel := gc.withTimeout(ctx)
 	defer cancel()
 	return gc.SubmitToClient(ctx)
 }
 
+// withTimeout returns a context that is done when the given context is done or when gc.Timeout has passed.
+func (gc *GeminiClient) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if gc.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, gc.Timeout)
+}
+
+// LastMetadata returns information about the most recent response from Query, Submit and the other functions
+// that return the text only. Generate and GenerateStream return the metadata together with each response instead,
+// which is better when the client is used from several goroutines.
+func (gc *GeminiClient) LastMetadata() ResponseMetadata {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.metadata
+}
+
+// setMetadata stores the metadata of the most recent response, see LastMetadata.
+func (gc *GeminiClient) setMetadata(metadata ResponseMetadata) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	gc.metadata = metadata
+}
+
 // Clear clears the prompt parts, tools, and functions registered with the client.
 func (gc *GeminiClient) Clear() {
-	gc.ClearParts() // Not really needed, since Query also calls this.
+	gc.ClearParts()
 	gc.ClearToolsAndFunctions()
 }
@@ -0,0 +1,393 @@
+// Package geminitest provides a scripted fake backend for geminiclient, so that code that uses
+// Gemini can be tested without network access, credentials or a Google Cloud project.
+//
+// Responses are queued with the Queue methods and handed out in order, one per request to the model.
+// Every request is recorded, so that the parts, tools and generation config can be checked afterwards.
+package geminitest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/env/v2"
+	"github.com/xyproto/geminiclient"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultModelName is the model name that is used by NewClient.
+const DefaultModelName = "gemini-1.5-flash"
+
+// ErrNoResponse is returned when a request is sent to the model, but no more responses are queued.
+var ErrNoResponse = errors.New("geminitest: no response is queued")
+
+// Fake is a geminiclient.Backend that returns queued responses, and records the requests it receives.
+// It is safe for concurrent use.
+type Fake struct {
+	mu         sync.Mutex
+	turns      []*Turn
+	requests   []*Request
+	tokenCount int // -1 for estimating the number of tokens
+}
+
+// Turn is a queued response. It can be adjusted with the With and Then methods, before it is used.
+type Turn struct {
+	chunks []*genai.GenerateContentResponse // the streamed chunks, which are merged when not streaming
+	err    error                            // returned after the chunks, if any
+	delay  time.Duration                    // how long to wait before responding
+}
+
+// Request is a request that was received by the fake.
+type Request struct {
+	Method   string // "GenerateContent", "GenerateContentStream" or "CountTokens"
+	Config   geminiclient.ModelConfig
+	Contents []*genai.Content // the conversation so far, where the last content is the new message
+}
+
+// New returns a new Fake without any queued responses.
+func New() *Fake {
+	return &Fake{tokenCount: -1}
+}
+
+// testOptions returns the options for the clients of this package, followed by the given options:
+// the default model name, instead of the one from the environment, and no retries.
+func testOptions(opts ...geminiclient.Option) []geminiclient.Option {
+	return append([]geminiclient.Option{
+		geminiclient.WithModel(DefaultModelName),
+		geminiclient.WithTemperature(0),
+		geminiclient.WithRetryPolicy(geminiclient.NoRetryPolicy()),
+	}, opts...)
+}
+
+// NewClient returns a new GeminiClient that uses a new Fake, together with the Fake.
+// The client does not retry failed requests, so that queued errors are returned right away.
+// The test fails at the end if not all of the queued responses were used.
+func NewClient(tb testing.TB, opts ...geminiclient.Option) (*geminiclient.GeminiClient, *Fake) {
+	tb.Helper()
+	fake := New()
+	gc, err := geminiclient.NewClient(context.Background(), append(testOptions(geminiclient.WithBackend(fake)), opts...)...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { fake.AssertExhausted(tb) })
+	return gc, fake
+}
+
+// NewCassetteClient returns a GeminiClient that replays the interactions in the given cassette file,
+// which must have been recorded with geminiclient.NewRecorder.
+// If $GEMINI_RECORD is set, a client for the real backend is created instead, and the interactions are recorded
+// to the cassette file. The client does not retry failed requests, so that recording and replaying behave the same.
+func NewCassetteClient(tb testing.TB, filename string, opts ...geminiclient.Option) *geminiclient.GeminiClient {
+	tb.Helper()
+	if env.Bool("GEMINI_RECORD") {
+		gc, err := geminiclient.NewClient(context.Background(), append(testOptions(), opts...)...)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		rec, err := geminiclient.NewRecorder(gc.Backend, filename)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() {
+			if err := rec.Close(); err != nil {
+				tb.Error(err)
+			}
+		})
+		gc.SetBackend(rec)
+		return gc
+	}
+	replayer, err := geminiclient.NewReplayer(filename)
+	if err != nil {
+		tb.Fatalf("%v (set GEMINI_RECORD=1 to record the cassette)", err)
+	}
+	gc, err := geminiclient.NewClient(context.Background(), append(testOptions(geminiclient.WithBackend(replayer)), opts...)...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if n := replayer.Unused(); n > 0 {
+			tb.Errorf("Expected all recorded interactions to be replayed, but %d are left", n)
+		}
+	})
+	return gc
+}
+
+// queue adds a turn with the given chunks to the queue.
+func (f *Fake) queue(chunks ...*genai.GenerateContentResponse) *Turn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	turn := &Turn{chunks: chunks}
+	f.turns = append(f.turns, turn)
+	return turn
+}
+
+// modelResponse returns a response with a single candidate with the given parts.
+func modelResponse(parts ...genai.Part) *genai.GenerateContentResponse {
+	return &genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{{
+			Content:      &genai.Content{Role: "model", Parts: parts},
+			FinishReason: genai.FinishReasonStop,
+		}},
+	}
+}
+
+// QueueText queues a text response.
+func (f *Fake) QueueText(text string) *Turn {
+	return f.queue(modelResponse(genai.Text(text)))
+}
+
+// QueueStream queues a response that is streamed as the given text chunks.
+// When the request is not streaming, the chunks are joined.
+func (f *Fake) QueueStream(chunks ...string) *Turn {
+	responses := make([]*genai.GenerateContentResponse, len(chunks))
+	for i, chunk := range chunks {
+		responses[i] = modelResponse(genai.Text(chunk))
+		if i < len(chunks)-1 {
+			responses[i].Candidates[0].FinishReason = genai.FinishReasonUnspecified
+		}
+	}
+	return f.queue(responses...)
+}
+
+// QueueFunctionCall queues a response where the model asks for the given function to be called.
+// The arguments of functions that are registered with AddFunctionTool are named param1, param2 and so on.
+func (f *Fake) QueueFunctionCall(name string, args map[string]any) *Turn {
+	return f.queue(modelResponse(genai.FunctionCall{Name: name, Args: args}))
+}
+
+// QueueResponse queues the given response as it is, for responses that need more control, like blocked responses.
+func (f *Fake) QueueResponse(res *genai.GenerateContentResponse) *Turn {
+	return f.queue(res)
+}
+
+// QueueError queues an error, which is returned instead of a response.
+func (f *Fake) QueueError(err error) *Turn {
+	turn := f.queue()
+	turn.err = err
+	return turn
+}
+
+// WithUsage sets the token usage that is reported with the last chunk of the response.
+func (t *Turn) WithUsage(promptTokens, candidatesTokens int32) *Turn {
+	if len(t.chunks) > 0 {
+		t.chunks[len(t.chunks)-1].UsageMetadata = &genai.UsageMetadata{
+			PromptTokenCount:     promptTokens,
+			CandidatesTokenCount: candidatesTokens,
+			TotalTokenCount:      promptTokens + candidatesTokens,
+		}
+	}
+	return t
+}
+
+// WithDelay makes the response wait for the given duration, or until the request is canceled.
+func (t *Turn) WithDelay(delay time.Duration) *Turn {
+	t.delay = delay
+	return t
+}
+
+// ThenError makes the response fail with the given error after the chunks have been streamed.
+// When the request is not streaming, only the error is returned.
+func (t *Turn) ThenError(err error) *Turn {
+	t.err = err
+	return t
+}
+
+// SetTokenCount sets the number of tokens that CountTokens returns.
+// By default, the number is estimated with geminiclient.EstimateTokens.
+func (f *Fake) SetTokenCount(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tokenCount = n
+}
+
+// record records a request, and returns the next turn, if any.
+func (f *Fake) record(method string, cfg *geminiclient.ModelConfig, contents []*genai.Content) (*Turn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	req := &Request{Method: method, Config: *cfg, Contents: slices.Clone(contents)}
+	f.requests = append(f.requests, req)
+	if len(f.turns) == 0 {
+		return nil, fmt.Errorf("%w for %s with the prompt %q", ErrNoResponse, method, req.Text())
+	}
+	turn := f.turns[0]
+	f.turns = f.turns[1:]
+	return turn, nil
+}
+
+// wait waits for the delay of the turn, or until the context is done.
+func (t *Turn) wait(ctx context.Context) error {
+	if t.delay <= 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(t.delay):
+		return nil
+	}
+}
+
+// GenerateContent returns the next queued response, with the chunks merged into one response.
+func (f *Fake) GenerateContent(ctx context.Context, cfg *geminiclient.ModelConfig, contents ...*genai.Content) (*genai.GenerateContentResponse, error) {
+	turn, err := f.record("GenerateContent", cfg, contents)
+	if err != nil {
+		return nil, err
+	}
+	if err := turn.wait(ctx); err != nil {
+		return nil, err
+	}
+	if turn.err != nil {
+		return nil, turn.err
+	}
+	merged := &genai.GenerateContentResponse{}
+	for _, chunk := range turn.chunks {
+		merged.PromptFeedback = chunk.PromptFeedback
+		if chunk.UsageMetadata != nil {
+			merged.UsageMetadata = chunk.UsageMetadata
+		}
+		for i, candidate := range chunk.Candidates {
+			if i >= len(merged.Candidates) {
+				c := *candidate
+				c.Content = &genai.Content{Role: "model"}
+				merged.Candidates = append(merged.Candidates, &c)
+			}
+			m := merged.Candidates[i]
+			m.FinishReason = candidate.FinishReason
+			if candidate.Content != nil {
+				m.Content.Parts = append(m.Content.Parts, candidate.Content.Parts...)
+			}
+		}
+	}
+	return merged, nil
+}
+
+// fakeStream is a ResponseIterator for the chunks of a queued response.
+type fakeStream struct {
+	ctx    context.Context
+	chunks []*genai.GenerateContentResponse
+	err    error
+}
+
+// GenerateContentStream returns the chunks of the next queued response, one by one.
+func (f *Fake) GenerateContentStream(ctx context.Context, cfg *geminiclient.ModelConfig, contents ...*genai.Content) geminiclient.ResponseIterator {
+	turn, err := f.record("GenerateContentStream", cfg, contents)
+	if err != nil {
+		return &fakeStream{err: err}
+	}
+	if err := turn.wait(ctx); err != nil {
+		return &fakeStream{err: err}
+	}
+	return &fakeStream{ctx: ctx, chunks: slices.Clone(turn.chunks), err: turn.err}
+}
+
+// Next returns the next chunk, and then the error of the turn or iterator.Done.
+func (s *fakeStream) Next() (*genai.GenerateContentResponse, error) {
+	if len(s.chunks) == 0 {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, iterator.Done
+	}
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return chunk, nil
+}
+
+// CountTokens records the request, and returns the number of tokens set with SetTokenCount, or an estimate.
+// It does not use the queued responses.
+func (f *Fake) CountTokens(ctx context.Context, cfg *geminiclient.ModelConfig, parts ...genai.Part) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, &Request{Method: "CountTokens", Config: *cfg, Contents: []*genai.Content{genai.NewUserContent(parts...)}})
+	if f.tokenCount >= 0 {
+		return f.tokenCount, nil
+	}
+	return geminiclient.EstimateTokens(parts...), nil
+}
+
+// StartChat starts a new chat session, where the history is sent with every request.
+func (f *Fake) StartChat(cfg *geminiclient.ModelConfig) geminiclient.ChatSession {
+	return geminiclient.NewChatSession(f, cfg)
+}
+
+// Requests returns all requests that have been received so far.
+func (f *Fake) Requests() []*Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.requests)
+}
+
+// LastRequest returns the most recent request, or nil if there are none.
+func (f *Fake) LastRequest() *Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) == 0 {
+		return nil
+	}
+	return f.requests[len(f.requests)-1]
+}
+
+// Pending returns how many queued responses have not been used yet.
+func (f *Fake) Pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.turns)
+}
+
+// AssertExhausted fails the test if not all of the queued responses have been used.
+func (f *Fake) AssertExhausted(tb testing.TB) {
+	tb.Helper()
+	if n := f.Pending(); n > 0 {
+		tb.Errorf("Expected all queued responses to be used, but %d are left", n)
+	}
+}
+
+// Parts returns the parts of the new message, which is the last content of the request.
+func (r *Request) Parts() []genai.Part {
+	if len(r.Contents) == 0 {
+		return nil
+	}
+	return r.Contents[len(r.Contents)-1].Parts
+}
+
+// Text returns the text parts of the new message, joined together.
+func (r *Request) Text() string {
+	var sb strings.Builder
+	for _, part := range r.Parts() {
+		if text, ok := part.(genai.Text); ok {
+			sb.WriteString(string(text))
+		}
+	}
+	return sb.String()
+}
+
+// HasTool checks if a function with the given name was declared in the request.
+func (r *Request) HasTool(name string) bool {
+	for _, tool := range r.Config.Tools {
+		for _, fd := range tool.FunctionDeclarations {
+			if fd.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FunctionResponse returns the response of the given function, if the new message contains one.
+func (r *Request) FunctionResponse(name string) (map[string]any, bool) {
+	for _, part := range r.Parts() {
+		if fr, ok := part.(genai.FunctionResponse); ok && fr.Name == name {
+			return fr.Response, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,201 @@
+package geminitest_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestQueueText(t *testing.T) {
+	gc, fake := geminitest.NewClient(t)
+	fake.QueueText(" Paris ").WithUsage(10, 1)
+
+	result, err := gc.Query("What is the capital of France?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Paris" {
+		t.Errorf("Expected \"Paris\" but got %q", result)
+	}
+	if gc.LastMetadata().UsageMetadata == nil || gc.LastMetadata().UsageMetadata.TotalTokenCount != 11 {
+		t.Errorf("Expected 11 tokens to be used, but got %v", gc.LastMetadata().UsageMetadata)
+	}
+
+	req := fake.LastRequest()
+	if req.Text() != "What is the capital of France?" {
+		t.Errorf("Expected the prompt to be sent, but got %q", req.Text())
+	}
+	if req.Config.ModelName != geminitest.DefaultModelName {
+		t.Errorf("Expected the model %s but got %s", geminitest.DefaultModelName, req.Config.ModelName)
+	}
+
+	// No more responses are queued
+	if _, err := gc.Query("And Germany?"); !errors.Is(err, geminitest.ErrNoResponse) {
+		t.Errorf("Expected ErrNoResponse but got %v", err)
+	}
+}
+
+func TestFunctionCall(t *testing.T) {
+	gc, fake := geminitest.NewClient(t)
+
+	var called string
+	err := gc.AddFunctionTool("get_weather_right_now", "Get the current weather for a specific location", func(location string) string {
+		called = location
+		return "It's sunny in New York."
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.QueueFunctionCall("get_weather_right_now", map[string]any{"param1": "NY"})
+	fake.QueueText("It is sunny in New York.")
+
+	result, err := gc.Query("What is the weather in NY?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if called != "NY" {
+		t.Errorf("Expected the function to be called with \"NY\" but got %q", called)
+	}
+	if !strings.Contains(result, "sunny") {
+		t.Errorf("Expected 'sunny' to be in the response, but got: %v", result)
+	}
+
+	requests := fake.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests but got %d", len(requests))
+	}
+	if !requests[0].HasTool("get_weather_right_now") {
+		t.Error("Expected the function to be declared as a tool")
+	}
+	response, ok := requests[1].FunctionResponse("get_weather_right_now")
+	if !ok || response["return1"] != "It's sunny in New York." {
+		t.Errorf("Expected the function result to be sent back, but got %v", response)
+	}
+	if len(requests[1].Contents) != 3 {
+		t.Errorf("Expected the prompt and the function call to be sent along, but got %d contents", len(requests[1].Contents))
+	}
+}
+
+func TestStream(t *testing.T) {
+	gc, fake := geminitest.NewClient(t)
+	fake.QueueStream("Once ", "upon ", "a time").WithUsage(5, 3)
+
+	var chunks []string
+	res, err := gc.GenerateStream(context.Background(), geminiclient.NewTextRequest("Tell a story"), func(s string) {
+		chunks = append(chunks, s)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 || res.Text != "Once upon a time" {
+		t.Errorf("Expected three chunks and \"Once upon a time\" but got %v and %q", chunks, res.Text)
+	}
+	if res.Metadata.UsageMetadata == nil || res.Metadata.UsageMetadata.TotalTokenCount != 8 {
+		t.Errorf("Expected 8 tokens to be used, but got %v", res.Metadata.UsageMetadata)
+	}
+	if fake.LastRequest().Method != "GenerateContentStream" {
+		t.Errorf("Expected a streaming request but got %s", fake.LastRequest().Method)
+	}
+
+	// An error after some of the response has been streamed
+	broken := errors.New("connection reset")
+	fake.QueueStream("Once ").ThenError(broken)
+	chunks = nil
+	if _, err := gc.GenerateStream(context.Background(), geminiclient.NewTextRequest("Tell another story"), func(s string) {
+		chunks = append(chunks, s)
+	}); !errors.Is(err, broken) {
+		t.Errorf("Expected the stream to fail, but got %v", err)
+	}
+	if len(chunks) != 1 {
+		t.Errorf("Expected one chunk before the error, but got %v", chunks)
+	}
+}
+
+func TestGenerationConfig(t *testing.T) {
+	gc, fake := geminitest.NewClient(t)
+	fake.QueueText(`{"answer": 42}`)
+
+	req := geminiclient.NewTextRequest("What is the answer?").
+		WithTemperature(0.5).
+		WithGenerationConfig(genai.GenerationConfig{ResponseMIMEType: "application/json"})
+	if _, err := gc.Generate(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	cfg := fake.LastRequest().Config.GenerationConfig
+	if cfg.ResponseMIMEType != "application/json" || cfg.Temperature == nil || *cfg.Temperature != 0.5 {
+		t.Errorf("Expected JSON output and a temperature of 0.5, but got %q and %v", cfg.ResponseMIMEType, cfg.Temperature)
+	}
+
+	fake.SetTokenCount(42)
+	n, err := gc.CountTextTokens("How many tokens is this?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 42 {
+		t.Errorf("Expected 42 tokens but got %d", n)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	gc, fake := geminitest.NewClient(t)
+	policy := geminiclient.DefaultRetryPolicy()
+	policy.BaseDelay = time.Millisecond
+	gc.SetRetryPolicy(policy)
+	fake.QueueError(status.Error(codes.Unavailable, "service unavailable"))
+	fake.QueueText("Oslo")
+
+	res, err := gc.Generate(context.Background(), geminiclient.NewTextRequest("What is the capital of Norway?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "Oslo" || res.Metadata.Attempts != 2 {
+		t.Errorf("Expected \"Oslo\" after 2 attempts, but got %q after %d", res.Text, res.Metadata.Attempts)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	gc, fake := geminitest.NewClient(t)
+	gc.SetCoalescing(true)
+	fake.QueueText("Berlin").WithDelay(200 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	results := make([]*geminiclient.Response, 3)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := gc.Generate(context.Background(), geminiclient.NewTextRequest("What is the capital of Germany?"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = res
+		}()
+	}
+	wg.Wait()
+
+	if n := len(fake.Requests()); n != 1 {
+		t.Errorf("Expected 1 request but got %d", n)
+	}
+	coalesced := 0
+	for _, res := range results {
+		if res == nil || res.Text != "Berlin" {
+			t.Fatalf("Expected \"Berlin\" but got %v", res)
+		}
+		if res.Metadata.Coalesced {
+			coalesced++
+		}
+	}
+	if coalesced != 2 {
+		t.Errorf("Expected 2 of the responses to be shared, but got %d", coalesced)
+	}
+}
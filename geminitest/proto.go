@@ -0,0 +1,222 @@
+package geminitest
+
+import (
+	"fmt"
+	"strings"
+
+	pb "cloud.google.com/go/aiplatform/apiv1beta1/aiplatformpb"
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/geminiclient"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Conversions between the protocol buffers of Vertex AI, which are used on the wire, and the genai types.
+// The enums of the genai package have the same values as the ones in the protocol buffers.
+
+// modelName returns the model name from a resource name like "projects/p/locations/l/publishers/google/models/gemini-1.5-flash".
+func modelName(resource string) string {
+	if i := strings.LastIndex(resource, "/models/"); i >= 0 {
+		return resource[i+len("/models/"):]
+	}
+	return resource
+}
+
+// modelConfig returns the model configuration of a request.
+func modelConfig(req *pb.GenerateContentRequest) *geminiclient.ModelConfig {
+	cfg := &geminiclient.ModelConfig{
+		ModelName:         modelName(req.GetModel()),
+		SystemInstruction: contentFromProto(req.GetSystemInstruction()),
+		Tools:             toolsFromProto(req.GetTools()),
+	}
+	for _, setting := range req.GetSafetySettings() {
+		cfg.SafetySettings = append(cfg.SafetySettings, &genai.SafetySetting{
+			Category:  genai.HarmCategory(setting.Category),
+			Threshold: genai.HarmBlockThreshold(setting.Threshold),
+			Method:    genai.HarmBlockMethod(setting.Method),
+		})
+	}
+	if gc := req.GetGenerationConfig(); gc != nil {
+		cfg.GenerationConfig = genai.GenerationConfig{
+			Temperature:      gc.Temperature,
+			TopP:             gc.TopP,
+			CandidateCount:   gc.CandidateCount,
+			MaxOutputTokens:  gc.MaxOutputTokens,
+			StopSequences:    gc.StopSequences,
+			PresencePenalty:  gc.PresencePenalty,
+			FrequencyPenalty: gc.FrequencyPenalty,
+			ResponseMIMEType: gc.ResponseMimeType,
+			ResponseSchema:   schemaFromProto(gc.ResponseSchema),
+		}
+		if gc.TopK != nil {
+			topK := int32(*gc.TopK)
+			cfg.GenerationConfig.TopK = &topK
+		}
+	}
+	return cfg
+}
+
+func contentsFromProto(contents []*pb.Content) []*genai.Content {
+	var cs []*genai.Content
+	for _, c := range contents {
+		cs = append(cs, contentFromProto(c))
+	}
+	return cs
+}
+
+func contentFromProto(c *pb.Content) *genai.Content {
+	if c == nil {
+		return nil
+	}
+	content := &genai.Content{Role: c.Role}
+	for _, p := range c.Parts {
+		switch data := p.Data.(type) {
+		case *pb.Part_Text:
+			content.Parts = append(content.Parts, genai.Text(data.Text))
+		case *pb.Part_InlineData:
+			content.Parts = append(content.Parts, genai.Blob{MIMEType: data.InlineData.MimeType, Data: data.InlineData.Data})
+		case *pb.Part_FileData:
+			content.Parts = append(content.Parts, genai.FileData{MIMEType: data.FileData.MimeType, FileURI: data.FileData.FileUri})
+		case *pb.Part_FunctionCall:
+			content.Parts = append(content.Parts, genai.FunctionCall{Name: data.FunctionCall.Name, Args: data.FunctionCall.Args.AsMap()})
+		case *pb.Part_FunctionResponse:
+			content.Parts = append(content.Parts, genai.FunctionResponse{Name: data.FunctionResponse.Name, Response: data.FunctionResponse.Response.AsMap()})
+		}
+	}
+	return content
+}
+
+func contentsToProto(contents []*genai.Content) ([]*pb.Content, error) {
+	var cs []*pb.Content
+	for _, c := range contents {
+		content, err := contentToProto(c)
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, content)
+	}
+	return cs, nil
+}
+
+func contentToProto(c *genai.Content) (*pb.Content, error) {
+	if c == nil {
+		return nil, nil
+	}
+	content := &pb.Content{Role: c.Role}
+	for _, part := range c.Parts {
+		var p *pb.Part
+		switch v := part.(type) {
+		case genai.Text:
+			p = &pb.Part{Data: &pb.Part_Text{Text: string(v)}}
+		case genai.Blob:
+			p = &pb.Part{Data: &pb.Part_InlineData{InlineData: &pb.Blob{MimeType: v.MIMEType, Data: v.Data}}}
+		case genai.FileData:
+			p = &pb.Part{Data: &pb.Part_FileData{FileData: &pb.FileData{MimeType: v.MIMEType, FileUri: v.FileURI}}}
+		case genai.FunctionCall:
+			args, err := structpb.NewStruct(v.Args)
+			if err != nil {
+				return nil, fmt.Errorf("invalid arguments for %s: %v", v.Name, err)
+			}
+			p = &pb.Part{Data: &pb.Part_FunctionCall{FunctionCall: &pb.FunctionCall{Name: v.Name, Args: args}}}
+		case genai.FunctionResponse:
+			response, err := structpb.NewStruct(v.Response)
+			if err != nil {
+				return nil, fmt.Errorf("invalid response from %s: %v", v.Name, err)
+			}
+			p = &pb.Part{Data: &pb.Part_FunctionResponse{FunctionResponse: &pb.FunctionResponse{Name: v.Name, Response: response}}}
+		default:
+			return nil, fmt.Errorf("unsupported part type: %T", part)
+		}
+		content.Parts = append(content.Parts, p)
+	}
+	return content, nil
+}
+
+func toolsFromProto(tools []*pb.Tool) []*genai.Tool {
+	var ts []*genai.Tool
+	for _, t := range tools {
+		tool := &genai.Tool{}
+		for _, fd := range t.FunctionDeclarations {
+			tool.FunctionDeclarations = append(tool.FunctionDeclarations, &genai.FunctionDeclaration{
+				Name:        fd.Name,
+				Description: fd.Description,
+				Parameters:  schemaFromProto(fd.Parameters),
+				Response:    schemaFromProto(fd.Response),
+			})
+		}
+		ts = append(ts, tool)
+	}
+	return ts
+}
+
+func schemaFromProto(s *pb.Schema) *genai.Schema {
+	if s == nil {
+		return nil
+	}
+	schema := &genai.Schema{
+		Type:        genai.Type(s.Type),
+		Format:      s.Format,
+		Title:       s.Title,
+		Description: s.Description,
+		Nullable:    s.Nullable,
+		Items:       schemaFromProto(s.Items),
+		Enum:        s.Enum,
+		Required:    s.Required,
+	}
+	if len(s.Properties) > 0 {
+		schema.Properties = make(map[string]*genai.Schema, len(s.Properties))
+		for name, property := range s.Properties {
+			schema.Properties[name] = schemaFromProto(property)
+		}
+	}
+	return schema
+}
+
+func responseToProto(res *genai.GenerateContentResponse) (*pb.GenerateContentResponse, error) {
+	response := &pb.GenerateContentResponse{}
+	for _, c := range res.Candidates {
+		if c == nil {
+			continue
+		}
+		content, err := contentToProto(c.Content)
+		if err != nil {
+			return nil, err
+		}
+		candidate := &pb.Candidate{
+			Index:         c.Index,
+			Content:       content,
+			FinishReason:  pb.Candidate_FinishReason(c.FinishReason),
+			SafetyRatings: safetyRatingsToProto(c.SafetyRatings),
+		}
+		if c.FinishMessage != "" {
+			candidate.FinishMessage = &c.FinishMessage
+		}
+		response.Candidates = append(response.Candidates, candidate)
+	}
+	if pf := res.PromptFeedback; pf != nil {
+		response.PromptFeedback = &pb.GenerateContentResponse_PromptFeedback{
+			BlockReason:        pb.GenerateContentResponse_PromptFeedback_BlockedReason(pf.BlockReason),
+			BlockReasonMessage: pf.BlockReasonMessage,
+			SafetyRatings:      safetyRatingsToProto(pf.SafetyRatings),
+		}
+	}
+	if u := res.UsageMetadata; u != nil {
+		response.UsageMetadata = &pb.GenerateContentResponse_UsageMetadata{
+			PromptTokenCount:     u.PromptTokenCount,
+			CandidatesTokenCount: u.CandidatesTokenCount,
+			TotalTokenCount:      u.TotalTokenCount,
+		}
+	}
+	return response, nil
+}
+
+func safetyRatingsToProto(ratings []*genai.SafetyRating) []*pb.SafetyRating {
+	var rs []*pb.SafetyRating
+	for _, r := range ratings {
+		rs = append(rs, &pb.SafetyRating{
+			Category:    pb.HarmCategory(r.Category),
+			Probability: pb.SafetyRating_HarmProbability(r.Probability),
+			Blocked:     r.Blocked,
+		})
+	}
+	return rs
+}
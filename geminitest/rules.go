@@ -0,0 +1,158 @@
+package geminitest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/geminiclient"
+)
+
+// Rule is an answer for prompts that match a regular expression.
+type Rule struct {
+	Match        string         `json:"match"`                  // a regular expression for the text of the prompt
+	Text         string         `json:"text,omitempty"`         // the answer, where $1 and so on are replaced with the submatches
+	FunctionCall string         `json:"functionCall,omitempty"` // the name of a function to call, instead of answering with text
+	Args         map[string]any `json:"args,omitempty"`         // the arguments for the function call
+}
+
+// Rules is a geminiclient.Backend that answers with the first rule that matches the text of the prompt.
+// Prompts that match no rule are echoed back, and the results of function calls are answered with
+// "The result of <name> is <JSON>". Streamed answers are split into words. It is safe for concurrent use.
+type Rules struct {
+	rules  []Rule
+	mu     sync.Mutex
+	regexp map[string]*regexp.Regexp
+}
+
+// NewRules returns a new rule-based backend.
+func NewRules(rules ...Rule) *Rules {
+	return &Rules{rules: rules, regexp: make(map[string]*regexp.Regexp)}
+}
+
+// LoadRules reads rules from a JSON file with a list of rules.
+func LoadRules(filename string) (*Rules, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	r := NewRules(rules...)
+	for _, rule := range rules {
+		if _, err := r.compile(rule.Match); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+	return r, nil
+}
+
+// compile returns the compiled regular expression, compiling it only once.
+func (r *Rules) compile(expr string) (*regexp.Regexp, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if re, ok := r.regexp[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	r.regexp[expr] = re
+	return re, nil
+}
+
+// answer returns the parts of the answer to the given contents.
+func (r *Rules) answer(contents []*genai.Content) ([]genai.Part, error) {
+	if len(contents) == 0 {
+		return nil, fmt.Errorf("no contents")
+	}
+	var prompt strings.Builder
+	for _, part := range contents[len(contents)-1].Parts {
+		switch p := part.(type) {
+		case genai.Text:
+			prompt.WriteString(string(p))
+		case genai.FunctionResponse:
+			data, err := json.Marshal(p.Response)
+			if err != nil {
+				return nil, err
+			}
+			return []genai.Part{genai.Text(fmt.Sprintf("The result of %s is %s", p.Name, data))}, nil
+		}
+	}
+	text := prompt.String()
+	for _, rule := range r.rules {
+		re, err := r.compile(rule.Match)
+		if err != nil {
+			return nil, err
+		}
+		m := re.FindStringSubmatchIndex(text)
+		if m == nil {
+			continue
+		}
+		if rule.FunctionCall != "" {
+			return []genai.Part{genai.FunctionCall{Name: rule.FunctionCall, Args: rule.Args}}, nil
+		}
+		return []genai.Part{genai.Text(re.ExpandString(nil, rule.Text, text, m))}, nil
+	}
+	return []genai.Part{genai.Text(text)}, nil
+}
+
+// response returns a response with the given parts, and estimated token usage.
+func response(contents []*genai.Content, parts ...genai.Part) *genai.GenerateContentResponse {
+	res := modelResponse(parts...)
+	var prompt int32
+	for _, content := range contents {
+		prompt += int32(geminiclient.EstimateTokens(content.Parts...))
+	}
+	res.UsageMetadata = &genai.UsageMetadata{PromptTokenCount: prompt, CandidatesTokenCount: int32(geminiclient.EstimateTokens(parts...))}
+	res.UsageMetadata.TotalTokenCount = res.UsageMetadata.PromptTokenCount + res.UsageMetadata.CandidatesTokenCount
+	return res
+}
+
+// GenerateContent answers with the first rule that matches.
+func (r *Rules) GenerateContent(ctx context.Context, cfg *geminiclient.ModelConfig, contents ...*genai.Content) (*genai.GenerateContentResponse, error) {
+	parts, err := r.answer(contents)
+	if err != nil {
+		return nil, err
+	}
+	return response(contents, parts...), nil
+}
+
+// GenerateContentStream answers with the first rule that matches, where text is streamed word by word.
+func (r *Rules) GenerateContentStream(ctx context.Context, cfg *geminiclient.ModelConfig, contents ...*genai.Content) geminiclient.ResponseIterator {
+	parts, err := r.answer(contents)
+	if err != nil {
+		return &fakeStream{err: err}
+	}
+	text, ok := parts[0].(genai.Text)
+	if !ok {
+		return &fakeStream{ctx: ctx, chunks: []*genai.GenerateContentResponse{response(contents, parts...)}}
+	}
+	var chunks []*genai.GenerateContentResponse
+	for _, word := range strings.SplitAfter(string(text), " ") {
+		chunk := modelResponse(genai.Text(word))
+		chunk.Candidates[0].FinishReason = genai.FinishReasonUnspecified
+		chunks = append(chunks, chunk)
+	}
+	chunks[len(chunks)-1].Candidates[0].FinishReason = genai.FinishReasonStop
+	chunks[len(chunks)-1].UsageMetadata = response(contents, parts...).UsageMetadata
+	return &fakeStream{ctx: ctx, chunks: chunks}
+}
+
+// CountTokens returns an estimate of the number of tokens.
+func (r *Rules) CountTokens(ctx context.Context, cfg *geminiclient.ModelConfig, parts ...genai.Part) (int, error) {
+	return geminiclient.EstimateTokens(parts...), nil
+}
+
+// StartChat starts a new chat session.
+func (r *Rules) StartChat(cfg *geminiclient.ModelConfig) geminiclient.ChatSession {
+	return geminiclient.NewChatSession(r, cfg)
+}
@@ -0,0 +1,347 @@
+package geminitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// StorageService is a fake of the parts of the Cloud Storage JSON API that are used for staging large parts:
+// resumable uploads, getting, patching, listing and deleting objects, and the lifecycle rules of buckets.
+// Buckets are created when they are first used, and everything is kept in memory.
+type StorageService struct {
+	// FailChunks is the number of upload chunks to fail with 503 Service Unavailable, after half of the chunk has been received
+	FailChunks int
+	// FailStatus is the number of requests for the status of an upload to fail with 503 Service Unavailable
+	FailStatus int
+
+	mu       sync.Mutex
+	mux      *http.ServeMux
+	objects  map[string]*storageObject // by bucket and object name, separated by a slash
+	sessions map[string]*uploadSession
+	rules    map[string]json.RawMessage // the lifecycle of each bucket
+	uploads  int
+	nextID   int
+}
+
+// StorageServer is a StorageService that is served with httptest.
+type StorageServer struct {
+	*StorageService
+	URL string // the endpoint, for geminiclient.StagingPolicy
+}
+
+type storageObject struct {
+	Name        string            `json:"name"`
+	Bucket      string            `json:"bucket"`
+	Size        string            `json:"size"`
+	ContentType string            `json:"contentType,omitempty"`
+	TimeCreated time.Time         `json:"timeCreated"`
+	CustomTime  *time.Time        `json:"customTime,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	data        []byte
+}
+
+type uploadSession struct {
+	object *storageObject
+	size   int
+	data   []byte
+}
+
+// NewStorageService returns a new fake Cloud Storage service.
+func NewStorageService() *StorageService {
+	s := &StorageService{
+		objects:  make(map[string]*storageObject),
+		sessions: make(map[string]*uploadSession),
+		rules:    make(map[string]json.RawMessage),
+	}
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("POST /upload/storage/v1/b/{bucket}/o", s.serveStartUpload)
+	s.mux.HandleFunc("PUT /upload/storage/v1/b/{bucket}/o", s.serveUpload)
+	s.mux.HandleFunc("GET /storage/v1/b/{bucket}/o", s.serveList)
+	s.mux.HandleFunc("GET /storage/v1/b/{bucket}/o/{object...}", s.serveGet)
+	s.mux.HandleFunc("PATCH /storage/v1/b/{bucket}/o/{object...}", s.servePatch)
+	s.mux.HandleFunc("DELETE /storage/v1/b/{bucket}/o/{object...}", s.serveDelete)
+	s.mux.HandleFunc("GET /storage/v1/b/{bucket}", s.serveGetBucket)
+	s.mux.HandleFunc("PATCH /storage/v1/b/{bucket}", s.servePatchBucket)
+	return s
+}
+
+// NewStorageServer starts a fake Cloud Storage server, which is stopped when the test ends.
+func NewStorageServer(tb testing.TB) *StorageServer {
+	tb.Helper()
+	s := &StorageServer{StorageService: NewStorageService()}
+	server := httptest.NewServer(s.StorageService)
+	tb.Cleanup(server.Close)
+	s.URL = server.URL
+	return s
+}
+
+// ServeHTTP serves the Cloud Storage JSON API.
+func (s *StorageService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Object returns the contents of the given object, and false if there is no such object.
+func (s *StorageService) Object(bucket, name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[bucket+"/"+name]
+	if !ok {
+		return nil, false
+	}
+	return slices.Clone(object.data), true
+}
+
+// Objects returns the names of the objects in the given bucket, sorted.
+func (s *StorageService) Objects(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for key, object := range s.objects {
+		if strings.HasPrefix(key, bucket+"/") {
+			names = append(names, object.Name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// SetCustomTime sets the custom time of the given object, for testing that old objects are removed.
+func (s *StorageService) SetCustomTime(bucket, name string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if object, ok := s.objects[bucket+"/"+name]; ok {
+		object.CustomTime = &t
+	}
+}
+
+// Lifecycle returns the lifecycle configuration of the given bucket, as JSON, or nil if there is none.
+func (s *StorageService) Lifecycle(bucket string) json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.rules[bucket])
+}
+
+// Uploads returns the number of completed uploads.
+func (s *StorageService) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploads
+}
+
+// writeStorageError writes an error in the format of the Cloud Storage JSON API.
+func writeStorageError(w http.ResponseWriter, code int, format string, args ...any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	var body struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	body.Error.Code, body.Error.Message = code, fmt.Sprintf(format, args...)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *StorageService) serveStartUpload(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("uploadType") != "resumable" {
+		writeStorageError(w, http.StatusBadRequest, "only resumable uploads are supported")
+		return
+	}
+	var object storageObject
+	if err := json.NewDecoder(r.Body).Decode(&object); err != nil && err != io.EOF {
+		writeStorageError(w, http.StatusBadRequest, "invalid object metadata: %v", err)
+		return
+	}
+	if name := r.URL.Query().Get("name"); name != "" {
+		object.Name = name
+	}
+	size, err := strconv.Atoi(r.Header.Get("X-Upload-Content-Length"))
+	if object.Name == "" || err != nil {
+		writeStorageError(w, http.StatusBadRequest, "the object name and X-Upload-Content-Length are required")
+		return
+	}
+	object.Bucket = r.PathValue("bucket")
+	if object.ContentType == "" {
+		object.ContentType = r.Header.Get("X-Upload-Content-Type")
+	}
+	s.mu.Lock()
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	s.sessions[id] = &uploadSession{object: &object, size: size}
+	s.mu.Unlock()
+	w.Header().Set("Location", "http://"+r.Host+"/upload/storage/v1/b/"+object.Bucket+"/o?uploadType=resumable&upload_id="+id)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *StorageService) serveUpload(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[r.URL.Query().Get("upload_id")]
+	if !ok {
+		writeStorageError(w, http.StatusNotFound, "no such upload session")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeStorageError(w, http.StatusBadRequest, "could not read the chunk: %v", err)
+		return
+	}
+	// The Content-Range header is like "bytes 0-262143/1000000", or "bytes */1000000" for asking for the status
+	var start, end, size int
+	contentRange := strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes ")
+	if _, err := fmt.Sscanf(contentRange, "*/%d", &size); err == nil {
+		data = nil
+	} else if _, err := fmt.Sscanf(contentRange, "%d-%d/%d", &start, &end, &size); err != nil || end-start+1 != len(data) || start > len(session.data) {
+		writeStorageError(w, http.StatusBadRequest, "invalid Content-Range: %s", r.Header.Get("Content-Range"))
+		return
+	}
+	if size != session.size {
+		writeStorageError(w, http.StatusBadRequest, "the size is %d and not %d", size, session.size)
+		return
+	}
+	if data == nil && s.FailStatus > 0 {
+		s.FailStatus--
+		writeStorageError(w, http.StatusServiceUnavailable, "the service is unavailable")
+		return
+	}
+	if data != nil {
+		data = data[min(len(session.data)-start, len(data)):] // the part of the chunk that has not already been received
+		if s.FailChunks > 0 {
+			s.FailChunks--
+			session.data = append(session.data, data[:len(data)/2]...)
+			writeStorageError(w, http.StatusServiceUnavailable, "the service is unavailable")
+			return
+		}
+		session.data = append(session.data, data...)
+	}
+	if len(session.data) < session.size {
+		if len(session.data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(session.data)-1))
+		}
+		w.WriteHeader(308)
+		return
+	}
+	object := session.object
+	object.data, object.Size, object.TimeCreated = session.data, strconv.Itoa(len(session.data)), time.Now().UTC()
+	s.objects[object.Bucket+"/"+object.Name] = object
+	s.uploads++
+	writeJSON(w, object)
+}
+
+// object returns the object that the request is for, or writes an error if there is no such object.
+// The service must be locked.
+func (s *StorageService) object(w http.ResponseWriter, r *http.Request) (*storageObject, bool) {
+	object, ok := s.objects[r.PathValue("bucket")+"/"+r.PathValue("object")]
+	if !ok {
+		writeStorageError(w, http.StatusNotFound, "no such object: %s/%s", r.PathValue("bucket"), r.PathValue("object"))
+	}
+	return object, ok
+}
+
+func (s *StorageService) serveGet(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if object, ok := s.object(w, r); ok {
+		writeJSON(w, object)
+	}
+}
+
+func (s *StorageService) servePatch(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.object(w, r)
+	if !ok {
+		return
+	}
+	var patch storageObject
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeStorageError(w, http.StatusBadRequest, "invalid object metadata: %v", err)
+		return
+	}
+	if patch.CustomTime != nil {
+		if object.CustomTime != nil && patch.CustomTime.Before(*object.CustomTime) {
+			writeStorageError(w, http.StatusBadRequest, "the custom time can not be decreased")
+			return
+		}
+		object.CustomTime = patch.CustomTime
+	}
+	for k, v := range patch.Metadata {
+		if object.Metadata == nil {
+			object.Metadata = make(map[string]string)
+		}
+		object.Metadata[k] = v
+	}
+	writeJSON(w, object)
+}
+
+func (s *StorageService) serveDelete(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.object(w, r); ok {
+		delete(s.objects, r.PathValue("bucket")+"/"+r.PathValue("object"))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *StorageService) serveList(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefix := r.PathValue("bucket") + "/" + r.URL.Query().Get("prefix")
+	var list struct {
+		Kind  string           `json:"kind"`
+		Items []*storageObject `json:"items"`
+	}
+	list.Kind = "storage#objects"
+	for key, object := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			list.Items = append(list.Items, object)
+		}
+	}
+	slices.SortFunc(list.Items, func(a, b *storageObject) int { return strings.Compare(a.Name, b.Name) })
+	writeJSON(w, list)
+}
+
+func (s *StorageService) serveGetBucket(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeBucket(w, r.PathValue("bucket"))
+}
+
+func (s *StorageService) servePatchBucket(w http.ResponseWriter, r *http.Request) {
+	var patch struct {
+		Lifecycle json.RawMessage `json:"lifecycle"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeStorageError(w, http.StatusBadRequest, "invalid bucket metadata: %v", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if patch.Lifecycle != nil {
+		s.rules[r.PathValue("bucket")] = patch.Lifecycle
+	}
+	s.writeBucket(w, r.PathValue("bucket"))
+}
+
+// writeBucket writes the metadata of the given bucket. The service must be locked.
+func (s *StorageService) writeBucket(w http.ResponseWriter, name string) {
+	bucket := map[string]any{"name": name}
+	if rules, ok := s.rules[name]; ok {
+		bucket["lifecycle"] = rules
+	}
+	writeJSON(w, bucket)
+}
@@ -0,0 +1,617 @@
+package geminitest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "cloud.google.com/go/aiplatform/apiv1beta1/aiplatformpb"
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"github.com/xyproto/geminiclient"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// VertexService is a fake of the Vertex AI endpoints that are used for Gemini models: generateContent,
+// streamGenerateContent, countTokens and cachedContents. It can be served both over REST, since it is
+// an http.Handler, and over gRPC, see RegisterGRPC. The answers come from a geminiclient.Backend,
+// like a Fake or Rules, and the cached contents are kept in memory.
+type VertexService struct {
+	pb.UnimplementedPredictionServiceServer
+	pb.UnimplementedGenAiCacheServiceServer
+
+	// Token is the access token that requests must have in the Authorization header, if set
+	Token string
+
+	backend geminiclient.Backend
+	mux     *http.ServeMux
+	mu      sync.Mutex
+	caches  map[string]*pb.CachedContent
+	nextID  int
+	headers []http.Header
+}
+
+// VertexServer is a VertexService that is served over REST with httptest, and over gRPC on a local port.
+type VertexServer struct {
+	*VertexService
+	URL      string // the base URL of the REST endpoint, for geminiclient.WithEndpoint
+	GRPCAddr string // the address of the gRPC endpoint, for geminiclient.WithEndpoint
+}
+
+// NewVertexService returns a new fake Vertex AI service that answers with the given backend.
+func NewVertexService(backend geminiclient.Backend) *VertexService {
+	s := &VertexService{backend: backend, caches: make(map[string]*pb.CachedContent)}
+	const prefix = "/v1beta1/projects/{project}/locations/{location}"
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("POST "+prefix+"/publishers/{publisher}/models/{call}", s.serveModel)
+	s.mux.HandleFunc("POST "+prefix+"/cachedContents", s.serveCreateCachedContent)
+	s.mux.HandleFunc("GET "+prefix+"/cachedContents", s.serveListCachedContents)
+	s.mux.HandleFunc("GET "+prefix+"/cachedContents/{id}", s.serveGetCachedContent)
+	s.mux.HandleFunc("PATCH "+prefix+"/cachedContents/{id}", s.serveUpdateCachedContent)
+	s.mux.HandleFunc("DELETE "+prefix+"/cachedContents/{id}", s.serveDeleteCachedContent)
+	return s
+}
+
+// NewVertexServer starts a fake Vertex AI server that answers with the given backend, both over REST and gRPC.
+// The server is stopped when the test ends.
+func NewVertexServer(tb testing.TB, backend geminiclient.Backend) *VertexServer {
+	tb.Helper()
+	s := &VertexServer{VertexService: NewVertexService(backend)}
+	server := httptest.NewServer(s.VertexService)
+	tb.Cleanup(server.Close)
+	s.URL = server.URL
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	s.RegisterGRPC(grpcServer)
+	go grpcServer.Serve(lis)
+	tb.Cleanup(grpcServer.Stop)
+	s.GRPCAddr = lis.Addr().String()
+	return s
+}
+
+// NewClient returns a GeminiClient that uses the server over REST, without credentials.
+func (s *VertexServer) NewClient(tb testing.TB, opts ...geminiclient.Option) *geminiclient.GeminiClient {
+	tb.Helper()
+	return s.newClient(tb, s.URL, opts)
+}
+
+// NewGRPCClient returns a GeminiClient that uses the server over gRPC, without credentials.
+func (s *VertexServer) NewGRPCClient(tb testing.TB, opts ...geminiclient.Option) *geminiclient.GeminiClient {
+	tb.Helper()
+	return s.newClient(tb, s.GRPCAddr, opts)
+}
+
+func (s *VertexServer) newClient(tb testing.TB, endpoint string, opts []geminiclient.Option) *geminiclient.GeminiClient {
+	tb.Helper()
+	opts = append(testOptions(
+		geminiclient.WithProjectID("test-project"),
+		geminiclient.WithLocation("us-central1"),
+		geminiclient.WithEndpoint(endpoint),
+		geminiclient.WithoutAuthentication()), opts...)
+	gc, err := geminiclient.NewClient(context.Background(), opts...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if vb, ok := gc.Backend.(*geminiclient.VertexBackend); ok {
+		tb.Cleanup(func() { vb.Close() })
+	}
+	return gc
+}
+
+// RegisterGRPC registers the prediction and cache services with the given gRPC server.
+func (s *VertexService) RegisterGRPC(server *grpc.Server) {
+	pb.RegisterPredictionServiceServer(server, s)
+	pb.RegisterGenAiCacheServiceServer(server, s)
+}
+
+// Headers returns the headers of all requests so far, or the metadata for gRPC requests.
+func (s *VertexService) Headers() []http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.headers)
+}
+
+// authorize records the headers of the request, and checks the access token, if required.
+func (s *VertexService) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	header := make(http.Header, len(md))
+	for k, v := range md {
+		header[http.CanonicalHeaderKey(k)] = v
+	}
+	s.mu.Lock()
+	s.headers = append(s.headers, header)
+	s.mu.Unlock()
+	if s.Token != "" && header.Get("Authorization") != "Bearer "+s.Token {
+		return status.Error(codes.Unauthenticated, "request had invalid authentication credentials")
+	}
+	return nil
+}
+
+// statusError converts an error from the backend to a gRPC status error, which is what Vertex AI returns.
+func statusError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, ErrNoResponse):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if apiErr, ok := apierror.FromError(err); ok {
+		if s := apiErr.GRPCStatus(); s != nil && s.Code() != codes.Unknown {
+			return s.Err()
+		}
+		if code, ok := httpCodes[apiErr.HTTPCode()]; ok {
+			return status.Error(code, err.Error())
+		}
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+// blockedResponse converts a blocked response back to the response that Vertex AI returns, with the reason.
+func blockedResponse(err error) (*genai.GenerateContentResponse, bool) {
+	var blockedErr *genai.BlockedError
+	if !errors.As(err, &blockedErr) {
+		return nil, false
+	}
+	res := &genai.GenerateContentResponse{PromptFeedback: blockedErr.PromptFeedback}
+	if blockedErr.Candidate != nil {
+		res.Candidates = []*genai.Candidate{blockedErr.Candidate}
+	}
+	return res, true
+}
+
+// request returns the model configuration and contents of a request, including the cached content, if any.
+func (s *VertexService) request(req *pb.GenerateContentRequest) (*geminiclient.ModelConfig, []*genai.Content, error) {
+	if name := req.GetCachedContent(); name != "" {
+		cached, err := s.cachedContent(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.mu.Lock()
+		cached = proto.Clone(cached).(*pb.CachedContent)
+		s.mu.Unlock()
+		req = proto.Clone(req).(*pb.GenerateContentRequest)
+		req.Contents = append(slices.Clone(cached.Contents), req.Contents...)
+		if req.SystemInstruction == nil {
+			req.SystemInstruction = cached.SystemInstruction
+		}
+		if len(req.Tools) == 0 {
+			req.Tools = cached.Tools
+		}
+	}
+	if len(req.GetContents()) == 0 {
+		return nil, nil, status.Error(codes.InvalidArgument, "contents must not be empty")
+	}
+	return modelConfig(req), contentsFromProto(req.Contents), nil
+}
+
+// GenerateContent answers with the next response from the backend.
+func (s *VertexService) GenerateContent(ctx context.Context, req *pb.GenerateContentRequest) (*pb.GenerateContentResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	cfg, contents, err := s.request(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.backend.GenerateContent(ctx, cfg, contents...)
+	if err != nil {
+		blocked, ok := blockedResponse(err)
+		if !ok {
+			return nil, statusError(err)
+		}
+		res = blocked
+	}
+	return responseToProto(res)
+}
+
+// StreamGenerateContent streams the next response from the backend.
+func (s *VertexService) StreamGenerateContent(req *pb.GenerateContentRequest, stream pb.PredictionService_StreamGenerateContentServer) error {
+	ctx := stream.Context()
+	if err := s.authorize(ctx); err != nil {
+		return err
+	}
+	cfg, contents, err := s.request(req)
+	if err != nil {
+		return err
+	}
+	iter := s.backend.GenerateContentStream(ctx, cfg, contents...)
+	for {
+		res, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		blocked := false
+		if err != nil {
+			if res, blocked = blockedResponse(err); !blocked {
+				return statusError(err)
+			}
+		}
+		chunk, err := responseToProto(res)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+		if blocked {
+			return nil
+		}
+	}
+}
+
+// CountTokens counts the tokens with the backend.
+func (s *VertexService) CountTokens(ctx context.Context, req *pb.CountTokensRequest) (*pb.CountTokensResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	var parts []genai.Part
+	for _, content := range contentsFromProto(req.GetContents()) {
+		parts = append(parts, content.Parts...)
+	}
+	model := req.GetModel()
+	if model == "" {
+		model = req.GetEndpoint()
+	}
+	n, err := s.backend.CountTokens(ctx, &geminiclient.ModelConfig{ModelName: modelName(model)}, parts...)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.CountTokensResponse{TotalTokens: int32(n)}, nil
+}
+
+// expired checks if the given cached content has expired.
+func expired(cc *pb.CachedContent) bool {
+	expireTime := cc.GetExpireTime()
+	return expireTime != nil && time.Now().After(expireTime.AsTime())
+}
+
+// setExpiration converts a TTL to an expiration time, like Vertex AI does.
+func setExpiration(cc *pb.CachedContent, now time.Time) {
+	if ttl := cc.GetTtl(); ttl != nil {
+		cc.Expiration = &pb.CachedContent_ExpireTime{ExpireTime: timestamppb.New(now.Add(ttl.AsDuration()))}
+	}
+	if cc.Expiration == nil {
+		cc.Expiration = &pb.CachedContent_ExpireTime{ExpireTime: timestamppb.New(now.Add(time.Hour))}
+	}
+}
+
+// cachedContent returns the cached content with the given name.
+func (s *VertexService) cachedContent(name string) (*pb.CachedContent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cc, ok := s.caches[name]
+	if !ok || expired(cc) {
+		delete(s.caches, name)
+		return nil, status.Errorf(codes.NotFound, "cached content %s not found", name)
+	}
+	return cc, nil
+}
+
+// CreateCachedContent stores the given content, so that it can be referred to by name in requests.
+func (s *VertexService) CreateCachedContent(ctx context.Context, req *pb.CreateCachedContentRequest) (*pb.CachedContent, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	cc := proto.Clone(req.GetCachedContent()).(*pb.CachedContent)
+	if cc == nil || len(cc.Contents) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "the cached content must have contents")
+	}
+	now := time.Now()
+	setExpiration(cc, now)
+	cc.CreateTime = timestamppb.New(now)
+	cc.UpdateTime = cc.CreateTime
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	cc.Name = fmt.Sprintf("%s/cachedContents/%d", req.GetParent(), s.nextID)
+	s.caches[cc.Name] = cc
+	return proto.Clone(cc).(*pb.CachedContent), nil
+}
+
+// GetCachedContent returns the cached content with the given name.
+func (s *VertexService) GetCachedContent(ctx context.Context, req *pb.GetCachedContentRequest) (*pb.CachedContent, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	cc, err := s.cachedContent(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return proto.Clone(cc).(*pb.CachedContent), nil
+}
+
+// UpdateCachedContent changes the expiration of a cached content.
+func (s *VertexService) UpdateCachedContent(ctx context.Context, req *pb.UpdateCachedContentRequest) (*pb.CachedContent, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	cc, err := s.cachedContent(req.GetCachedContent().GetName())
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	cc.Expiration = req.GetCachedContent().Expiration
+	setExpiration(cc, now)
+	cc.UpdateTime = timestamppb.New(now)
+	return proto.Clone(cc).(*pb.CachedContent), nil
+}
+
+// DeleteCachedContent deletes the cached content with the given name.
+func (s *VertexService) DeleteCachedContent(ctx context.Context, req *pb.DeleteCachedContentRequest) (*emptypb.Empty, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if _, err := s.cachedContent(req.GetName()); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.caches, req.GetName())
+	return &emptypb.Empty{}, nil
+}
+
+// ListCachedContents returns all cached contents for the given parent, on a single page.
+func (s *VertexService) ListCachedContents(ctx context.Context, req *pb.ListCachedContentsRequest) (*pb.ListCachedContentsResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := &pb.ListCachedContentsResponse{}
+	for name, cc := range s.caches {
+		if strings.HasPrefix(name, req.GetParent()+"/") && !expired(cc) {
+			res.CachedContents = append(res.CachedContents, proto.Clone(cc).(*pb.CachedContent))
+		}
+	}
+	slices.SortFunc(res.CachedContents, func(a, b *pb.CachedContent) int { return strings.Compare(a.Name, b.Name) })
+	return res, nil
+}
+
+// The REST transport, which uses the JSON encoding of the protocol buffers.
+
+// httpCodes maps HTTP status codes to gRPC status codes, and httpStatus the other way.
+var (
+	httpCodes = map[int]codes.Code{
+		http.StatusBadRequest:          codes.InvalidArgument,
+		http.StatusUnauthorized:        codes.Unauthenticated,
+		http.StatusForbidden:           codes.PermissionDenied,
+		http.StatusNotFound:            codes.NotFound,
+		http.StatusConflict:            codes.Aborted,
+		http.StatusTooManyRequests:     codes.ResourceExhausted,
+		499:                            codes.Canceled,
+		http.StatusInternalServerError: codes.Internal,
+		http.StatusNotImplemented:      codes.Unimplemented,
+		http.StatusServiceUnavailable:  codes.Unavailable,
+		http.StatusGatewayTimeout:      codes.DeadlineExceeded,
+	}
+	httpStatus = map[codes.Code]int{
+		codes.Canceled:           499,
+		codes.Unknown:            http.StatusInternalServerError,
+		codes.InvalidArgument:    http.StatusBadRequest,
+		codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+		codes.NotFound:           http.StatusNotFound,
+		codes.AlreadyExists:      http.StatusConflict,
+		codes.PermissionDenied:   http.StatusForbidden,
+		codes.ResourceExhausted:  http.StatusTooManyRequests,
+		codes.FailedPrecondition: http.StatusBadRequest,
+		codes.Aborted:            http.StatusConflict,
+		codes.OutOfRange:         http.StatusBadRequest,
+		codes.Unimplemented:      http.StatusNotImplemented,
+		codes.Internal:           http.StatusInternalServerError,
+		codes.Unavailable:        http.StatusServiceUnavailable,
+		codes.DataLoss:           http.StatusInternalServerError,
+		codes.Unauthenticated:    http.StatusUnauthorized,
+	}
+	upperSnake = regexp.MustCompile(`([a-z])([A-Z])`)
+)
+
+// ServeHTTP serves the REST endpoints.
+func (s *VertexService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// restContext returns a context with the HTTP headers as gRPC metadata, so that the requests can be handled the same way.
+func restContext(r *http.Request) context.Context {
+	md := make(metadata.MD, len(r.Header))
+	for k, v := range r.Header {
+		md[strings.ToLower(k)] = v
+	}
+	return metadata.NewIncomingContext(r.Context(), md)
+}
+
+// readRequest decodes the JSON body of the request.
+func readRequest(w http.ResponseWriter, r *http.Request, msg proto.Message) bool {
+	data, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, msg)
+	}
+	if err != nil {
+		writeError(w, status.Errorf(codes.InvalidArgument, "invalid JSON payload: %v", err))
+		return false
+	}
+	return true
+}
+
+// marshalOptions returns the JSON options for the response, where enums are numbers if the client asks for it.
+func marshalOptions(r *http.Request) protojson.MarshalOptions {
+	return protojson.MarshalOptions{UseEnumNumbers: strings.Contains(r.URL.RawQuery, "enum-encoding=int")}
+}
+
+// writeResponse writes the given response as JSON, or the given error.
+func writeResponse(w http.ResponseWriter, r *http.Request, msg proto.Message, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data, err := marshalOptions(r).Marshal(msg)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(data)
+}
+
+// writeError writes an error in the JSON format of Google APIs.
+func writeError(w http.ResponseWriter, err error) {
+	s := status.Convert(err)
+	code, ok := httpStatus[s.Code()]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	name := strings.ToUpper(upperSnake.ReplaceAllString(s.Code().String(), "${1}_${2}"))
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error": {"code": %d, "message": %q, "status": %q}}`, code, s.Message(), name)
+}
+
+// serveModel serves the generateContent, streamGenerateContent and countTokens methods of a model.
+func (s *VertexService) serveModel(w http.ResponseWriter, r *http.Request) {
+	modelName, method, _ := strings.Cut(r.PathValue("call"), ":")
+	model := fmt.Sprintf("projects/%s/locations/%s/publishers/%s/models/%s", r.PathValue("project"), r.PathValue("location"), r.PathValue("publisher"), modelName)
+	ctx := restContext(r)
+	switch method {
+	case "generateContent":
+		req := &pb.GenerateContentRequest{}
+		if !readRequest(w, r, req) {
+			return
+		}
+		req.Model = model
+		res, err := s.GenerateContent(ctx, req)
+		writeResponse(w, r, res, err)
+	case "streamGenerateContent":
+		req := &pb.GenerateContentRequest{}
+		if !readRequest(w, r, req) {
+			return
+		}
+		req.Model = model
+		stream := &restStream{ctx: ctx, w: w, opts: marshalOptions(r)}
+		err := s.StreamGenerateContent(req, stream)
+		switch {
+		case err != nil && !stream.started:
+			writeError(w, err)
+		case err != nil:
+			// The status is already sent, so the only way to signal the error is to break the connection
+			panic(http.ErrAbortHandler)
+		case !stream.started:
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			fmt.Fprint(w, "[]")
+		default:
+			fmt.Fprint(w, "]")
+		}
+	case "countTokens":
+		req := &pb.CountTokensRequest{}
+		if !readRequest(w, r, req) {
+			return
+		}
+		req.Model = model
+		res, err := s.CountTokens(ctx, req)
+		writeResponse(w, r, res, err)
+	default:
+		writeError(w, status.Errorf(codes.Unimplemented, "the method %q is not implemented by the fake", method))
+	}
+}
+
+func parent(r *http.Request) string {
+	return fmt.Sprintf("projects/%s/locations/%s", r.PathValue("project"), r.PathValue("location"))
+}
+
+func (s *VertexService) serveCreateCachedContent(w http.ResponseWriter, r *http.Request) {
+	cc := &pb.CachedContent{}
+	if !readRequest(w, r, cc) {
+		return
+	}
+	res, err := s.CreateCachedContent(restContext(r), &pb.CreateCachedContentRequest{Parent: parent(r), CachedContent: cc})
+	writeResponse(w, r, res, err)
+}
+
+func (s *VertexService) serveListCachedContents(w http.ResponseWriter, r *http.Request) {
+	res, err := s.ListCachedContents(restContext(r), &pb.ListCachedContentsRequest{Parent: parent(r)})
+	writeResponse(w, r, res, err)
+}
+
+func (s *VertexService) serveGetCachedContent(w http.ResponseWriter, r *http.Request) {
+	res, err := s.GetCachedContent(restContext(r), &pb.GetCachedContentRequest{Name: parent(r) + "/cachedContents/" + r.PathValue("id")})
+	writeResponse(w, r, res, err)
+}
+
+func (s *VertexService) serveUpdateCachedContent(w http.ResponseWriter, r *http.Request) {
+	cc := &pb.CachedContent{}
+	if !readRequest(w, r, cc) {
+		return
+	}
+	cc.Name = parent(r) + "/cachedContents/" + r.PathValue("id")
+	res, err := s.UpdateCachedContent(restContext(r), &pb.UpdateCachedContentRequest{CachedContent: cc})
+	writeResponse(w, r, res, err)
+}
+
+func (s *VertexService) serveDeleteCachedContent(w http.ResponseWriter, r *http.Request) {
+	res, err := s.DeleteCachedContent(restContext(r), &pb.DeleteCachedContentRequest{Name: parent(r) + "/cachedContents/" + r.PathValue("id")})
+	writeResponse(w, r, res, err)
+}
+
+// restStream streams the chunks of a response as a JSON array, like Vertex AI does over REST.
+type restStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	w       http.ResponseWriter
+	opts    protojson.MarshalOptions
+	started bool
+}
+
+func (s *restStream) Context() context.Context {
+	return s.ctx
+}
+
+// Send writes the next element of the JSON array, and flushes it.
+func (s *restStream) Send(res *pb.GenerateContentResponse) error {
+	data, err := s.opts.Marshal(res)
+	if err != nil {
+		return err
+	}
+	if !s.started {
+		s.started = true
+		s.w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		fmt.Fprint(s.w, "[")
+	} else {
+		fmt.Fprint(s.w, ",\r\n")
+	}
+	if _, err := s.w.Write(data); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package geminitest_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// httpCode returns the HTTP status code of an error from the REST transport.
+func httpCode(err error) int {
+	var httpErr *googleapi.Error
+	if errors.As(err, &httpErr) {
+		return httpErr.Code
+	}
+	return 0
+}
+
+func TestVertexServer(t *testing.T) {
+	fake := geminitest.New()
+	server := geminitest.NewVertexServer(t, fake)
+	ctx := context.Background()
+
+	for name, gc := range map[string]*geminiclient.GeminiClient{
+		"REST": server.NewClient(t),
+		"gRPC": server.NewGRPCClient(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := gc.AddFunctionTool("get_weather", "Get the weather", func(location string) string { return "sunny in " + location }); err != nil {
+				t.Fatal(err)
+			}
+			fake.QueueFunctionCall("get_weather", map[string]any{"param1": "NY"})
+			fake.QueueText("It is sunny.").WithUsage(10, 3)
+			result, err := gc.Query("What is the weather in NY?")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != "It is sunny." || gc.LastMetadata().UsageMetadata.TotalTokenCount != 13 {
+				t.Errorf("Expected \"It is sunny.\" and 13 tokens, but got %q and %v", result, gc.LastMetadata().UsageMetadata)
+			}
+			last := fake.LastRequest()
+			if response, ok := last.FunctionResponse("get_weather"); !ok || response["return1"] != "sunny in NY" {
+				t.Errorf("Expected the function result to be sent back, but got %v", response)
+			}
+			if !last.HasTool("get_weather") || last.Config.ModelName != geminitest.DefaultModelName {
+				t.Errorf("Expected the tool and the model name to be sent, but got %v and %q", last.Config.Tools, last.Config.ModelName)
+			}
+
+			fake.QueueStream("Once ", "upon ", "a time").WithUsage(4, 3)
+			var chunks []string
+			res, err := gc.GenerateStream(ctx, geminiclient.NewTextRequest("Tell a story"), func(s string) { chunks = append(chunks, s) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chunks) != 3 || res.Text != "Once upon a time" {
+				t.Errorf("Expected three chunks and \"Once upon a time\" but got %v and %q", chunks, res.Text)
+			}
+
+			fake.SetTokenCount(42)
+			if n, err := gc.CountTextTokens("How many?"); err != nil || n != 42 {
+				t.Errorf("Expected 42 tokens but got %d and %v", n, err)
+			}
+
+			fake.QueueError(status.Error(codes.ResourceExhausted, "quota exceeded"))
+			if _, err := gc.Query("Hello?"); !geminiclient.FallbackOnQuota.Matches(err) {
+				t.Errorf("Expected a quota error but got %v", err)
+			}
+
+			header := server.Headers()[len(server.Headers())-1]
+			if header.Get("Authorization") != "" || !strings.Contains(header.Get("X-Goog-Api-Client"), "gccl/") {
+				t.Errorf("Expected no credentials and a client header, but got %v", header)
+			}
+		})
+	}
+}
+
+func TestVertexServerCachedContent(t *testing.T) {
+	server := geminitest.NewVertexServer(t, geminitest.NewRules(geminitest.Rule{Match: `(?i)capital of (\w+)`, Text: "I do not know the capital of $1."}))
+	gc := server.NewClient(t)
+	ctx := context.Background()
+
+	cc, err := gc.Client.CreateCachedContent(ctx, &genai.CachedContent{
+		Model:      geminitest.DefaultModelName,
+		Expiration: genai.ExpireTimeOrTTL{TTL: time.Minute},
+		Contents:   []*genai.Content{genai.NewUserContent(genai.Text("A long document"))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc.Name == "" || cc.Expiration.ExpireTime.IsZero() {
+		t.Errorf("Expected a name and an expiration time, but got %q and %v", cc.Name, cc.Expiration)
+	}
+	if _, err := gc.Client.GetCachedContent(ctx, cc.Name); err != nil {
+		t.Error(err)
+	}
+
+	res, err := gc.Client.GenerativeModelFromCachedContent(cc).GenerateContent(ctx, genai.Text("What is the capital of Norway?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := res.Candidates[0].Content.Parts[0]; text != genai.Text("I do not know the capital of Norway.") {
+		t.Errorf("Expected the rule to be used, but got %v", text)
+	}
+	if res.UsageMetadata.PromptTokenCount <= 3 {
+		t.Errorf("Expected the cached content to be counted, but got %d prompt tokens", res.UsageMetadata.PromptTokenCount)
+	}
+
+	if err := gc.Client.DeleteCachedContent(ctx, cc.Name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gc.Client.GetCachedContent(ctx, cc.Name); httpCode(err) != http.StatusNotFound {
+		t.Errorf("Expected the cached content to be deleted, but got %v", err)
+	}
+}
+
+func TestVertexServerToken(t *testing.T) {
+	server := geminitest.NewVertexServer(t, geminitest.NewRules())
+	server.Token = "secret"
+	gc := server.NewClient(t)
+	if _, err := gc.Query("Hello?"); httpCode(err) != http.StatusUnauthorized {
+		t.Errorf("Expected the request to be unauthenticated, but got %v", err)
+	}
+}
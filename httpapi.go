@@ -0,0 +1,69 @@
+package geminiclient
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+)
+
+// sseReader reads server-sent events, where only the data fields are used.
+type sseReader struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+}
+
+// httpError returns the given unsuccessful HTTP response as a *googleapi.Error,
+// so that it can be retried or fall back like the errors from the genai package.
+func httpError(resp *http.Response) error {
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	apiErr := &googleapi.Error{Code: resp.StatusCode, Body: string(data), Header: resp.Header}
+	var errResp struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &errResp) == nil {
+		apiErr.Message = errResp.Error.Message
+	}
+	return apiErr
+}
+
+// newSSEReader returns a reader for the server-sent events in the given response body.
+func newSSEReader(body io.ReadCloser) *sseReader {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &sseReader{body: body, scanner: scanner}
+}
+
+// Next returns the data of the next event, or io.EOF when there are no more.
+func (r *sseReader) Next() (string, error) {
+	var event strings.Builder
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+		if data, ok := strings.CutPrefix(line, "data:"); ok {
+			event.WriteString(strings.TrimSpace(data))
+			continue
+		}
+		if line != "" || event.Len() == 0 {
+			continue
+		}
+		return event.String(), nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return "", err
+	}
+	if event.Len() > 0 { // the last event was not followed by a blank line
+		return event.String(), nil
+	}
+	return "", io.EOF
+}
+
+// Close closes the response body.
+func (r *sseReader) Close() error {
+	return r.body.Close()
+}
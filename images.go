@@ -0,0 +1,291 @@
+package geminiclient
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// ImageFormat is a format that images can be re-encoded to, see ImagePolicy.
+type ImageFormat string
+
+const (
+	ImageFormatJPEG ImageFormat = "jpeg"
+	ImageFormatPNG  ImageFormat = "png"
+	ImageFormatWEBP ImageFormat = "webp" // lossless, so the quality is not used
+)
+
+// ErrImageTooLarge is returned when an image has more pixels than the image policy allows to be decoded
+var ErrImageTooLarge = errors.New("the image is too large")
+
+const (
+	defaultJPEGQuality    = 85         // the JPEG quality that is used if the image policy does not have one
+	defaultMaxImagePixels = 50_000_000 // 50 megapixels, which is more than most phone cameras, but less than a decompression bomb
+)
+
+// ImagePolicy configures how images are prepared before they are added to the prompt, see SetImagePolicy.
+// Prepared images are decoded, turned the right way up according to the EXIF orientation, scaled down and
+// re-encoded, which also removes all metadata, like EXIF data with GPS positions.
+// HEIC and GIF images are added as they are, since they can not be re-encoded in pure Go or may be animated.
+type ImagePolicy struct {
+	Enabled      bool
+	MaxDimension int         // the largest width or height, in pixels, or 0 for keeping the size
+	Format       ImageFormat // the format to re-encode to, or "" for keeping JPEG, PNG and WEBP images in their format
+	Quality      int         // the JPEG quality, from 1 to 100, or 0 for the default of 85
+	MaxPixels    int         // the largest width times height that is decoded, or 0 for the default of 50 megapixels
+}
+
+// DefaultImagePolicy returns an image policy that scales images down to at most 2048 pixels wide and high,
+// and re-encodes them in the same format, with a JPEG quality of 85.
+func DefaultImagePolicy() ImagePolicy {
+	return ImagePolicy{
+		Enabled:      true,
+		MaxDimension: 2048,
+		Quality:      defaultJPEGQuality,
+	}
+}
+
+// SetImagePolicy configures how images are prepared before they are added with AddImage, AddFile or AddReader.
+// This is useful for photos from phones, which may be too large for a request, and which may contain GPS positions.
+// Images are added as they are if the policy is not enabled, which is the default.
+func (gc *GeminiClient) SetImagePolicy(policy ImagePolicy) {
+	gc.Images = policy
+}
+
+// validate returns an error if the image policy is enabled and has invalid settings.
+func (policy ImagePolicy) validate() error {
+	if !policy.Enabled {
+		return nil
+	}
+	switch {
+	case policy.MaxDimension < 0:
+		return fmt.Errorf("the largest image dimension must not be negative, but is %d", policy.MaxDimension)
+	case policy.Quality < 0 || policy.Quality > 100:
+		return fmt.Errorf("the image quality must be between 1 and 100, but is %d", policy.Quality)
+	case policy.MaxPixels < 0:
+		return fmt.Errorf("the largest number of image pixels must not be negative, but is %d", policy.MaxPixels)
+	}
+	switch policy.Format {
+	case "", ImageFormatJPEG, ImageFormatPNG, ImageFormatWEBP:
+		return nil
+	}
+	return fmt.Errorf("unknown image format: %s", policy.Format)
+}
+
+// PrepareImage prepares the given image according to the policy, and returns the new image data and MIME type.
+// Images that can not be re-encoded, like HEIC and GIF images, are returned as they are.
+func PrepareImage(data []byte, policy ImagePolicy) ([]byte, string, error) {
+	prepared, err := prepareImage(data, policy)
+	if err != nil {
+		return nil, "", err
+	}
+	return prepared.data, prepared.mimeType, nil
+}
+
+// maxPixels returns the largest number of pixels that are decoded
+func (policy ImagePolicy) maxPixels() int {
+	if policy.MaxPixels <= 0 {
+		return defaultMaxImagePixels
+	}
+	return policy.MaxPixels
+}
+
+// preparedImage is an image that has been prepared, together with the sizes before and after
+type preparedImage struct {
+	data     []byte
+	mimeType string
+	from, to image.Point // the width and height, before and after
+}
+
+// prepareImage decodes, orients, scales and re-encodes the given image, according to the policy.
+func prepareImage(data []byte, policy ImagePolicy) (*preparedImage, error) {
+	mimeType := DetectMIMEType(data)
+	var format ImageFormat
+	switch mimeType {
+	case "image/jpeg":
+		format = ImageFormatJPEG
+	case "image/png":
+		format = ImageFormatPNG
+	case "image/webp":
+		format = ImageFormatWEBP
+	default:
+		return &preparedImage{data: data, mimeType: mimeType}, nil
+	}
+	// Check the size in the header before decoding, since a small file can declare an enormous image
+	var (
+		cfg image.Config
+		err error
+	)
+	if format == ImageFormatWEBP {
+		cfg, err = webp.DecodeConfig(bytes.NewReader(data))
+	} else {
+		cfg, _, err = image.DecodeConfig(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not decode the %s image: %v", format, err)
+	}
+	if maxPixels := policy.maxPixels(); cfg.Height > 0 && cfg.Width > maxPixels/cfg.Height {
+		return nil, fmt.Errorf("%w: %dx%d pixels is more than %d", ErrImageTooLarge, cfg.Width, cfg.Height, maxPixels)
+	}
+	var img image.Image
+	if format == ImageFormatWEBP {
+		img, err = webp.Decode(bytes.NewReader(data))
+	} else {
+		img, _, err = image.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not decode the %s image: %v", format, err)
+	}
+	prepared := &preparedImage{from: img.Bounds().Size()}
+	if format == ImageFormatJPEG {
+		img = orient(img, jpegOrientation(data))
+	}
+	img = downscale(img, policy.MaxDimension)
+	prepared.to = img.Bounds().Size()
+	if policy.Format != "" {
+		format = policy.Format
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case ImageFormatJPEG:
+		quality := policy.Quality
+		if quality == 0 {
+			quality = defaultJPEGQuality
+		}
+		err = jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: quality})
+	case ImageFormatPNG:
+		err = png.Encode(&buf, img)
+	case ImageFormatWEBP:
+		err = encodeWEBP(&buf, img)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not encode the image as %s: %v", format, err)
+	}
+	prepared.data, prepared.mimeType = buf.Bytes(), "image/"+string(format)
+	return prepared, nil
+}
+
+// downscale scales the image down, keeping the aspect ratio, so that neither the width nor the height is larger than maxDimension.
+func downscale(img image.Image, maxDimension int) image.Image {
+	size := img.Bounds().Size()
+	if maxDimension <= 0 || (size.X <= maxDimension && size.Y <= maxDimension) {
+		return img
+	}
+	width, height := maxDimension, size.Y*maxDimension/size.X
+	if size.Y > size.X {
+		width, height = size.X*maxDimension/size.Y, maxDimension
+	}
+	scaled := image.NewNRGBA(image.Rect(0, 0, max(width, 1), max(height, 1)))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return scaled
+}
+
+// flatten draws images with transparency on a white background, since JPEG images can not be transparent.
+func flatten(img image.Image) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+	b := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, b.Min, draw.Over)
+	return flat
+}
+
+// jpegOrientation returns the EXIF orientation of the given JPEG image, from 1 to 8, or 1 if there is none.
+func jpegOrientation(data []byte) int {
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker, length := data[i+1], int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xda || i+2+length > len(data) { // the image data starts
+			break
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation returns the orientation tag from the first IFD of the given TIFF data, or 1 if there is none.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 { // Orientation, a SHORT
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// orient returns the image turned the right way up, according to the given EXIF orientation.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 { // rotated by 90 or 270 degrees
+		dw, dh = h, w
+	}
+	src := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				sx, sy = w-1-x, y
+			case 3: // rotated by 180 degrees
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // mirrored along the top-left to bottom-right diagonal
+				sx, sy = y, x
+			case 6: // needs to be rotated by 90 degrees clockwise
+				sx, sy = y, h-1-x
+			case 7: // mirrored along the top-right to bottom-left diagonal
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs to be rotated by 90 degrees counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			dst.SetNRGBA(x, y, src.NRGBAAt(sx, sy))
+		}
+	}
+	return dst
+}
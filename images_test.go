@@ -0,0 +1,211 @@
+package geminiclient_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
+	"golang.org/x/image/webp"
+)
+
+// halves returns an image where the left half is red and the right half is blue
+func halves(width, height int, alpha uint8) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < width/2 {
+				img.SetNRGBA(x, y, color.NRGBA{R: 255, A: alpha})
+			} else {
+				img.SetNRGBA(x, y, color.NRGBA{B: 255, A: alpha})
+			}
+		}
+	}
+	return img
+}
+
+// withEXIF adds an EXIF segment with the given orientation and a GPS-like comment to the given JPEG image
+func withEXIF(jpegData []byte, orientation byte) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08" + // big endian, the first IFD at offset 8
+		"\x00\x01" + // one entry
+		"\x01\x12\x00\x03\x00\x00\x00\x01\x00" + string([]byte{orientation}) + "\x00\x00" + // the orientation, a SHORT
+		"\x00\x00\x00\x00" + // no more IFDs
+		"GPS 59.91N 10.75E")
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	header := []byte{0xff, 0xe1, byte((len(segment) + 2) >> 8), byte(len(segment) + 2)}
+	return append(append(append([]byte{0xff, 0xd8}, header...), segment...), jpegData[2:]...)
+}
+
+func TestPrepareImage(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, halves(400, 300, 255), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := withEXIF(buf.Bytes(), 6) // needs to be rotated by 90 degrees clockwise
+
+	prepared, mimeType, err := geminiclient.PrepareImage(data, geminiclient.ImagePolicy{Enabled: true, MaxDimension: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mimeType != "image/jpeg" || bytes.Contains(prepared, []byte("Exif")) || bytes.Contains(prepared, []byte("GPS")) {
+		t.Errorf("Expected a JPEG image without EXIF data, but got %s of %d bytes", mimeType, len(prepared))
+	}
+	img, err := jpeg.Decode(bytes.NewReader(prepared))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(75, 100) {
+		t.Fatalf("Expected a rotated and scaled image of 75x100 pixels, but got %v", size)
+	}
+	// The left half was red, so the top half is red after rotating clockwise
+	if r, _, b, _ := img.At(37, 10).RGBA(); r < b {
+		t.Errorf("Expected the top to be red, but got %v", img.At(37, 10))
+	}
+	if r, _, b, _ := img.At(37, 90).RGBA(); r > b {
+		t.Errorf("Expected the bottom to be blue, but got %v", img.At(37, 90))
+	}
+}
+
+func TestPrepareImageFormats(t *testing.T) {
+	transparent := halves(64, 48, 128)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, transparent); err != nil {
+		t.Fatal(err)
+	}
+
+	// WEBP images are lossless
+	prepared, mimeType, err := geminiclient.PrepareImage(buf.Bytes(), geminiclient.ImagePolicy{Enabled: true, Format: geminiclient.ImageFormatWEBP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mimeType != "image/webp" || geminiclient.DetectMIMEType(prepared) != "image/webp" {
+		t.Fatalf("Expected a WEBP image, but got %s", mimeType)
+	}
+	img, err := webp.Decode(bytes.NewReader(prepared))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []image.Point{{0, 0}, {31, 20}, {32, 20}, {63, 47}} {
+		if c := color.NRGBAModel.Convert(img.At(p.X, p.Y)); c != transparent.NRGBAAt(p.X, p.Y) {
+			t.Errorf("Expected %v at %v, but got %v", transparent.NRGBAAt(p.X, p.Y), p, c)
+		}
+	}
+
+	// Transparent images are drawn on white when they are encoded as JPEG
+	prepared, mimeType, err = geminiclient.PrepareImage(buf.Bytes(), geminiclient.ImagePolicy{Enabled: true, Format: geminiclient.ImageFormatJPEG, Quality: 95})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img, err = jpeg.Decode(bytes.NewReader(prepared)); err != nil || mimeType != "image/jpeg" {
+		t.Fatalf("Expected a JPEG image, but got %s and %v", mimeType, err)
+	}
+	if _, g, _, _ := img.At(10, 10).RGBA(); g>>8 < 100 {
+		t.Errorf("Expected a light red, but got %v", img.At(10, 10))
+	}
+
+	// GIF images are kept as they are
+	gif := []byte("GIF89a\x01\x00\x01\x00")
+	if prepared, mimeType, err = geminiclient.PrepareImage(gif, geminiclient.DefaultImagePolicy()); err != nil || mimeType != "image/gif" || !bytes.Equal(prepared, gif) {
+		t.Errorf("Expected the GIF image to be kept, but got %s and %v", mimeType, err)
+	}
+}
+
+func TestImagePolicy(t *testing.T) {
+	gc, _ := geminitest.NewClient(t, geminiclient.WithImagePolicy(geminiclient.ImagePolicy{Enabled: true, MaxDimension: 32, Format: geminiclient.ImageFormatPNG}))
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, halves(256, 128, 255), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.AddReader(&buf); err != nil {
+		t.Fatal(err)
+	}
+	blob := gc.Parts[0].(genai.Blob)
+	cfg, err := png.DecodeConfig(bytes.NewReader(blob.Data))
+	if err != nil || blob.MIMEType != "image/png" {
+		t.Fatalf("Expected a PNG image, but got %s and %v", blob.MIMEType, err)
+	}
+	if cfg.Width != 32 || cfg.Height != 16 {
+		t.Errorf("Expected a 32x16 image, but got %dx%d", cfg.Width, cfg.Height)
+	}
+
+	_, err = geminiclient.NewClient(context.Background(), geminiclient.WithBackend(geminitest.New()),
+		geminiclient.WithImagePolicy(geminiclient.ImagePolicy{Enabled: true, Quality: 101, Format: "bmp"}))
+	if err == nil || !strings.Contains(err.Error(), "quality") {
+		t.Errorf("Expected an error about the image quality, but got %v", err)
+	}
+}
+
+// withPNGSize changes the width and height in the header of the given PNG image, without changing the pixel data
+func withPNGSize(pngData []byte, width, height uint32) []byte {
+	data := bytes.Clone(pngData)
+	// The IHDR chunk follows the 8 byte signature, and has a length, a type, the width and height and a checksum
+	binary.BigEndian.PutUint32(data[16:20], width)
+	binary.BigEndian.PutUint32(data[20:24], height)
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestPrepareImageTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, halves(2, 2, 255)); err != nil {
+		t.Fatal(err)
+	}
+	// A small file that claims to be 100000x100000 pixels would need 40 GB of memory to be decoded
+	bomb := withPNGSize(buf.Bytes(), 100000, 100000)
+	if _, err := png.DecodeConfig(bytes.NewReader(bomb)); err != nil {
+		t.Fatalf("Expected a valid PNG header, but got %v", err)
+	}
+	if _, _, err := geminiclient.PrepareImage(bomb, geminiclient.DefaultImagePolicy()); !errors.Is(err, geminiclient.ErrImageTooLarge) {
+		t.Errorf("Expected ErrImageTooLarge, but got %v", err)
+	}
+	policy := geminiclient.DefaultImagePolicy()
+	policy.MaxPixels = 3
+	if _, _, err := geminiclient.PrepareImage(buf.Bytes(), policy); !errors.Is(err, geminiclient.ErrImageTooLarge) {
+		t.Errorf("Expected a 2x2 image to be too large for 3 pixels, but got %v", err)
+	}
+	policy.MaxPixels = 4
+	if _, _, err := geminiclient.PrepareImage(buf.Bytes(), policy); err != nil {
+		t.Errorf("Expected a 2x2 image to be allowed for 4 pixels, but got %v", err)
+	}
+}
+
+func TestWEBPLossless(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, 123, 45))
+	for y := 0; y < 45; y++ {
+		for x := 0; x < 123; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(2*x + r.Intn(16)), uint8(5 * y), uint8(x + y + r.Intn(4)), uint8(255 - r.Intn(64))})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	prepared, _, err := geminiclient.PrepareImage(buf.Bytes(), geminiclient.ImagePolicy{Enabled: true, Format: geminiclient.ImageFormatWEBP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := webp.Decode(bytes.NewReader(prepared))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 45; y++ {
+		for x := 0; x < 123; x++ {
+			if c := color.NRGBAModel.Convert(decoded.At(x, y)); c != img.NRGBAAt(x, y) {
+				t.Fatalf("Expected %v at %d,%d, but got %v", img.NRGBAAt(x, y), x, y, c)
+			}
+		}
+	}
+}
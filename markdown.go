@@ -0,0 +1,508 @@
+package geminiclient
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// skippedElements are elements that never contain readable content
+var skippedElements = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true, atom.Svg: true,
+	atom.Canvas: true, atom.Iframe: true, atom.Object: true, atom.Embed: true,
+	atom.Button: true, atom.Input: true, atom.Select: true, atom.Textarea: true, atom.Nav: true,
+	atom.Aside: true, atom.Footer: true, atom.Dialog: true, atom.Head: true, atom.Link: true, atom.Meta: true,
+}
+
+// boilerplateRoles are ARIA roles for parts of a page that are not the main content
+var boilerplateRoles = map[string]bool{
+	"navigation": true, "banner": true, "contentinfo": true, "complementary": true,
+	"search": true, "dialog": true, "menu": true, "menubar": true,
+}
+
+// boilerplatePattern matches the class names and IDs of parts of a page that are not the main content
+var boilerplatePattern = regexp.MustCompile(`(?i)(^|[\s_-])(nav|navbar|menu|footer|sidebar|breadcrumbs?|cookies?|consent|banner|share|sharing|social|ads?|advert\w*|promo\w*|related|newsletter|subscribe|popup|modal|comments?)($|[\s_-])`)
+
+// whitespace matches runs of whitespace, which are collapsed to one space outside of preformatted text
+var whitespace = regexp.MustCompile(`\s+`)
+
+// HTMLToMarkdown extracts the main content of an HTML page and returns it as Markdown.
+// Scripts, styles, navigation, forms like search and login forms and other boilerplate are left out, while headings, paragraphs, links,
+// lists, tables, quotes, images and code blocks are kept. Relative links are resolved against baseURL, if it is given.
+// The HTML must be UTF-8, see golang.org/x/net/html/charset for converting it.
+func HTMLToMarkdown(r io.Reader, baseURL string) (string, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return "", fmt.Errorf("could not parse the HTML: %v", err)
+	}
+	c := &markdownConverter{}
+	if baseURL != "" {
+		if c.base, err = url.Parse(baseURL); err != nil {
+			return "", err
+		}
+	}
+	if base := findElement(doc, func(n *html.Node) bool { return n.DataAtom == atom.Base }); base != nil && c.base != nil {
+		if href, err := c.base.Parse(attr(base, "href")); err == nil {
+			c.base = href
+		}
+	}
+	root := contentRoot(doc)
+	c.pruneLinks = root.DataAtom == atom.Body || root.Type == html.DocumentNode
+	markdown := strings.Join(c.blocks(root), "\n\n")
+
+	// Start with the title of the page, if the content does not start with a heading
+	if title := findElement(doc, func(n *html.Node) bool { return n.DataAtom == atom.Title }); title != nil && !strings.HasPrefix(markdown, "# ") {
+		if text := collapse(textContent(title)); text != "" {
+			markdown = strings.TrimSpace("# " + text + "\n\n" + markdown)
+		}
+	}
+	return markdown + "\n", nil
+}
+
+// markdownConverter converts HTML nodes to Markdown
+type markdownConverter struct {
+	base       *url.URL // for resolving relative links
+	pruneLinks bool     // leave out blocks that are mostly links, since there is no main or article element
+}
+
+// contentRoot returns the element with the main content: the main element, the only article element, or the body
+func contentRoot(doc *html.Node) *html.Node {
+	if main := findElement(doc, func(n *html.Node) bool { return n.DataAtom == atom.Main || attr(n, "role") == "main" }); main != nil {
+		return main
+	}
+	var articles []*html.Node
+	walk(doc, func(n *html.Node) bool {
+		if n.DataAtom == atom.Article {
+			articles = append(articles, n)
+			return false
+		}
+		return true
+	})
+	if len(articles) == 1 {
+		return articles[0]
+	}
+	if body := findElement(doc, func(n *html.Node) bool { return n.DataAtom == atom.Body }); body != nil {
+		return body
+	}
+	return doc
+}
+
+// skip checks if the given element is boilerplate, hidden or can not contain readable content
+func (c *markdownConverter) skip(n *html.Node) bool {
+	if n.Type == html.CommentNode {
+		return true
+	}
+	if n.Type != html.ElementNode {
+		return false
+	}
+	if skippedElements[n.DataAtom] || boilerplateRoles[attr(n, "role")] || attr(n, "aria-hidden") == "true" || hasAttr(n, "hidden") {
+		return true
+	}
+	if strings.Contains(strings.ReplaceAll(attr(n, "style"), " ", ""), "display:none") {
+		return true
+	}
+	switch n.DataAtom {
+	case atom.Header:
+		// The header of an article usually has the title, while the header of the page usually has the logo and the menu
+		return !hasAncestor(n, atom.Article, atom.Main)
+	case atom.Main, atom.Article, atom.Body, atom.Html:
+		return false
+	}
+	if boilerplatePattern.MatchString(attr(n, "class")) || boilerplatePattern.MatchString(attr(n, "id")) {
+		return true
+	}
+	if n.DataAtom == atom.Form {
+		// Some pages wrap the whole body in a form, so only forms like search and login forms are left out
+		return mostlyControls(n)
+	}
+	if c.pruneLinks {
+		switch n.DataAtom {
+		case atom.Div, atom.Section, atom.Ul, atom.Ol, atom.Table:
+			return mostlyLinks(n)
+		}
+	}
+	return false
+}
+
+// mostlyLinks checks if the given element has at least 3 links, and if more than 60% of the text is in links, like a menu
+func mostlyLinks(n *html.Node) bool {
+	links, linkText := 0, 0
+	walk(n, func(d *html.Node) bool {
+		if d.DataAtom == atom.A {
+			links++
+			linkText += len(collapse(textContent(d)))
+			return false
+		}
+		return true
+	})
+	text := len(collapse(textContent(n)))
+	return links >= 3 && linkText*10 > text*6
+}
+
+// mostlyControls checks if the given form has controls, and less than 50 characters of text for each control, like a login form.
+// Hidden inputs are not counted, since they are also used by forms that wrap a whole page, like ASP.NET Web Forms.
+func mostlyControls(n *html.Node) bool {
+	controls := 0
+	walk(n, func(d *html.Node) bool {
+		switch d.DataAtom {
+		case atom.Input:
+			if !strings.EqualFold(attr(d, "type"), "hidden") {
+				controls++
+			}
+		case atom.Button, atom.Select, atom.Textarea:
+			controls++
+			return false
+		}
+		return true
+	})
+	text := len(strings.TrimSpace(collapse(textContent(n))))
+	return controls > 0 && text < controls*50
+}
+
+// blocks converts the children of the given node to Markdown blocks, like paragraphs, headings and lists
+func (c *markdownConverter) blocks(n *html.Node) []string {
+	var (
+		blocks []string
+		inline strings.Builder
+	)
+	add := func(block string) {
+		if block = strings.TrimRight(block, " \n"); strings.TrimSpace(block) != "" {
+			blocks = append(blocks, block)
+		}
+	}
+	flush := func() {
+		add(paragraph(inline.String()))
+		inline.Reset()
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if c.skip(child) {
+			continue
+		}
+		if child.Type == html.TextNode {
+			inline.WriteString(whitespace.ReplaceAllString(child.Data, " "))
+			continue
+		}
+		if child.Type != html.ElementNode {
+			continue
+		}
+		switch child.DataAtom {
+		case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+			flush()
+			if text := paragraph(c.inline(child)); text != "" {
+				level := int(child.Data[1] - '0')
+				add(strings.Repeat("#", level) + " " + strings.ReplaceAll(text, "  \n", " "))
+			}
+		case atom.P:
+			flush()
+			add(paragraph(c.inline(child)))
+		case atom.Pre:
+			flush()
+			add(codeBlock(child))
+		case atom.Ul, atom.Ol:
+			flush()
+			add(c.list(child))
+		case atom.Blockquote:
+			flush()
+			add(prefixLines(strings.Join(c.blocks(child), "\n\n"), "> ", ">"))
+		case atom.Table:
+			flush()
+			add(c.table(child))
+		case atom.Hr:
+			flush()
+			add("---")
+		case atom.Dl:
+			flush()
+			for item := child.FirstChild; item != nil; item = item.NextSibling {
+				switch item.DataAtom {
+				case atom.Dt:
+					add("**" + paragraph(c.inline(item)) + "**")
+				case atom.Dd:
+					add(strings.Join(c.blocks(item), "\n\n"))
+				}
+			}
+		case atom.Div, atom.Section, atom.Article, atom.Main, atom.Header, atom.Figure, atom.Figcaption,
+			atom.Address, atom.Details, atom.Summary, atom.Center, atom.Li, atom.Dd, atom.Body, atom.Html, atom.Form, atom.Fieldset:
+			flush()
+			for _, block := range c.blocks(child) {
+				add(block)
+			}
+		default:
+			inline.WriteString(c.element(child))
+		}
+	}
+	flush()
+	return blocks
+}
+
+// inline converts the children of the given node to inline Markdown, where line breaks are kept as newlines
+func (c *markdownConverter) inline(n *html.Node) string {
+	var sb strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if c.skip(child) {
+			continue
+		}
+		switch child.Type {
+		case html.TextNode:
+			sb.WriteString(whitespace.ReplaceAllString(child.Data, " "))
+		case html.ElementNode:
+			sb.WriteString(c.element(child))
+		}
+	}
+	return sb.String()
+}
+
+// element converts an inline element, like a link, an image or emphasized text, to Markdown
+func (c *markdownConverter) element(n *html.Node) string {
+	switch n.DataAtom {
+	case atom.Br:
+		return "\n"
+	case atom.A:
+		text := strings.TrimSpace(collapse(c.inline(n)))
+		href := strings.TrimSpace(attr(n, "href"))
+		if text == "" || href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+			return c.inline(n)
+		}
+		return "[" + text + "](" + c.resolve(href) + ")"
+	case atom.Img:
+		alt := collapse(attr(n, "alt"))
+		if alt == "" || attr(n, "src") == "" {
+			return ""
+		}
+		return "![" + alt + "](" + c.resolve(attr(n, "src")) + ")"
+	case atom.Strong, atom.B:
+		return emphasize(c.inline(n), "**")
+	case atom.Em, atom.I:
+		return emphasize(c.inline(n), "*")
+	case atom.Del, atom.S, atom.Strike:
+		return emphasize(c.inline(n), "~~")
+	case atom.Code, atom.Kbd, atom.Samp, atom.Tt:
+		code := collapse(textContent(n))
+		if strings.TrimSpace(code) == "" {
+			return code
+		}
+		fence := "`"
+		for strings.Contains(code, fence) {
+			fence += "`"
+		}
+		return fence + code + fence
+	}
+	// Block elements inside inline content are kept on separate lines
+	switch n.DataAtom {
+	case atom.Div, atom.P, atom.Li, atom.Tr, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Blockquote, atom.Section:
+		return "\n" + c.inline(n) + "\n"
+	case atom.Td, atom.Th:
+		return " " + c.inline(n) + " "
+	}
+	return c.inline(n)
+}
+
+// list converts an ul or ol element to a Markdown list, where nested lists are indented
+func (c *markdownConverter) list(n *html.Node) string {
+	number, _ := strconv.Atoi(attr(n, "start"))
+	if number == 0 {
+		number = 1
+	}
+	var items []string
+	for item := n.FirstChild; item != nil; item = item.NextSibling {
+		if item.DataAtom != atom.Li || c.skip(item) {
+			continue
+		}
+		marker := "- "
+		if n.DataAtom == atom.Ol {
+			marker = strconv.Itoa(number) + ". "
+			number++
+		}
+		content := strings.Join(c.blocks(item), "\n")
+		if content == "" {
+			continue
+		}
+		items = append(items, marker+prefixLines(content, strings.Repeat(" ", len(marker)), "")[len(marker):])
+	}
+	return strings.Join(items, "\n")
+}
+
+// table converts a table element to a Markdown table, where the first row is the header.
+// Tables that are used for layout, with one column or with nested tables, are converted to blocks instead.
+func (c *markdownConverter) table(n *html.Node) string {
+	var rows [][]string
+	nested := false
+	walk(n, func(d *html.Node) bool {
+		switch {
+		case d != n && d.DataAtom == atom.Table:
+			nested = true
+			return false
+		case d.DataAtom == atom.Tr && !c.skip(d):
+			var row []string
+			for cell := d.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.DataAtom == atom.Td || cell.DataAtom == atom.Th {
+					text := strings.TrimSpace(collapse(c.inline(cell)))
+					row = append(row, strings.ReplaceAll(text, "|", `\|`))
+				}
+			}
+			if len(row) > 0 {
+				rows = append(rows, row)
+			}
+			return false
+		}
+		return true
+	})
+	columns := 0
+	for _, row := range rows {
+		columns = max(columns, len(row))
+	}
+	if nested || columns < 2 {
+		return strings.Join(c.blocks(n), "\n\n")
+	}
+	var sb strings.Builder
+	for i, row := range rows {
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		sb.WriteString("| " + strings.Join(row, " | ") + " |\n")
+		if i == 0 {
+			sb.WriteString("|" + strings.Repeat(" --- |", columns) + "\n")
+		}
+	}
+	return sb.String()
+}
+
+// resolve returns the given link as an absolute URL, if there is a base URL
+func (c *markdownConverter) resolve(href string) string {
+	if c.base == nil {
+		return href
+	}
+	u, err := c.base.Parse(href)
+	if err != nil {
+		return href
+	}
+	return u.String()
+}
+
+// codeBlock converts a pre element to a fenced code block, with the language from a class like "language-go"
+func codeBlock(n *html.Node) string {
+	code := strings.Trim(textContent(n), "\n")
+	language := ""
+	if first := n.FirstChild; first != nil && first.DataAtom == atom.Code {
+		for _, class := range strings.Fields(attr(first, "class")) {
+			if after, ok := strings.CutPrefix(class, "language-"); ok {
+				language = after
+			}
+		}
+	}
+	fence := "```"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	return fence + language + "\n" + code + "\n" + fence
+}
+
+// paragraph tidies up inline Markdown: spaces are collapsed, and line breaks become Markdown line breaks
+func paragraph(inline string) string {
+	var lines []string
+	for _, line := range strings.Split(inline, "\n") {
+		if line = strings.TrimSpace(collapse(line)); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "  \n")
+}
+
+// emphasize surrounds the text with the given marker, keeping the surrounding spaces outside of it
+func emphasize(text, marker string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+	i := strings.Index(text, trimmed)
+	return text[:i] + marker + trimmed + marker + text[i+len(trimmed):]
+}
+
+// prefixLines adds the prefix to each line of the text, or emptyPrefix to empty lines
+func prefixLines(text, prefix, emptyPrefix string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if line == "" {
+			lines[i] = emptyPrefix
+		} else {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// collapse replaces each run of whitespace with one space
+func collapse(s string) string {
+	return whitespace.ReplaceAllString(s, " ")
+}
+
+// textContent returns all the text in the given node
+func textContent(n *html.Node) string {
+	var sb strings.Builder
+	walk(n, func(d *html.Node) bool {
+		if d.Type == html.TextNode {
+			sb.WriteString(d.Data)
+		}
+		return d.Type != html.ElementNode || !skippedElements[d.DataAtom] || d == n
+	})
+	return sb.String()
+}
+
+// walk calls fn for the given node and its descendants, depth first, but not for the descendants of nodes where fn returns false
+func walk(n *html.Node, fn func(*html.Node) bool) {
+	if !fn(n) {
+		return
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		walk(child, fn)
+	}
+}
+
+// findElement returns the first node where match returns true, or nil
+func findElement(n *html.Node, match func(*html.Node) bool) *html.Node {
+	var found *html.Node
+	walk(n, func(d *html.Node) bool {
+		if found == nil && d.Type == html.ElementNode && match(d) {
+			found = d
+		}
+		return found == nil
+	})
+	return found
+}
+
+// hasAncestor checks if the given node is inside an element of one of the given kinds
+func hasAncestor(n *html.Node, atoms ...atom.Atom) bool {
+	for p := n.Parent; p != nil; p = p.Parent {
+		for _, a := range atoms {
+			if p.DataAtom == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// attr returns the value of the given attribute, or "" if it is missing
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// hasAttr checks if the given node has the given attribute
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package geminiclient_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
+)
+
+const testPage = `<!DOCTYPE html>
+<html>
+<head><title>Scones</title><script>var tracking = true;</script><style>body { color: red }</style></head>
+<body>
+<header><a href="/">Home</a> <a href="/recipes">Recipes</a> <a href="/about">About</a></header>
+<nav><ul><li><a href="/a">A</a></li><li><a href="/b">B</a></li></ul></nav>
+<div class="cookie-banner">We use cookies. <button>Accept</button></div>
+<main>
+  <h1>Baking   <em>scones</em></h1>
+  <p>Scones are <strong>easy</strong> to make, see <a href="/flour">the flour guide</a>.<br>Enjoy!</p>
+  <h2>Ingredients</h2>
+  <ul>
+    <li>Flour</li>
+    <li>Butter
+      <ol><li>Cold</li><li>Cubed</li></ol>
+    </li>
+  </ul>
+  <table>
+    <thead><tr><th>Oven</th><th>Time</th></tr></thead>
+    <tbody><tr><td>220 °C</td><td>12 | 15 min</td></tr></tbody>
+  </table>
+  <pre><code class="language-sh">preheat --oven 220</code></pre>
+  <blockquote><p>Best served warm.</p></blockquote>
+  <div class="share-buttons"><a href="https://example.com/share">Share</a></div>
+  <img src="scones.jpg" alt="Fresh scones"><img src="pixel.gif">
+</main>
+<footer>Copyright</footer>
+</body>
+</html>`
+
+func TestHTMLToMarkdown(t *testing.T) {
+	markdown, err := geminiclient.HTMLToMarkdown(strings.NewReader(testPage), "https://example.com/recipes/scones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# Baking *scones*\n\n" +
+		"Scones are **easy** to make, see [the flour guide](https://example.com/flour).  \nEnjoy!\n\n" +
+		"## Ingredients\n\n" +
+		"- Flour\n- Butter\n  1. Cold\n  2. Cubed\n\n" +
+		"| Oven | Time |\n| --- | --- |\n| 220 °C | 12 \\| 15 min |\n\n" +
+		"```sh\npreheat --oven 220\n```\n\n" +
+		"> Best served warm.\n\n" +
+		"![Fresh scones](https://example.com/recipes/scones.jpg)\n"
+	if markdown != expected {
+		t.Errorf("Expected:\n%s\nbut got:\n%s", expected, markdown)
+	}
+}
+
+func TestHTMLToMarkdownWithoutMain(t *testing.T) {
+	page := `<html><head><title>News</title></head><body>
+<div id="menu"><a href="/1">One</a> | <a href="/2">Two</a> | <a href="/3">Three</a></div>
+<div><a href="/x">X</a><a href="/y">Y</a><a href="/z">Z</a></div>
+<div><p>The news of the day.</p></div>
+<p hidden>Hidden</p><p style="display: none">Also hidden</p>
+</body></html>`
+	markdown, err := geminiclient.HTMLToMarkdown(strings.NewReader(page), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "# News\n\nThe news of the day.\n"; markdown != expected {
+		t.Errorf("Expected %q, but got %q", expected, markdown)
+	}
+}
+
+func TestHTMLToMarkdownForm(t *testing.T) {
+	// Like an ASP.NET Web Forms page, where the whole body is one form, next to a login form that should be left out
+	page := `<html><head><title>Library</title></head><body>
+<form method="post" action="./hours.aspx" id="form1">
+<input type="hidden" name="__VIEWSTATE" value="abc"><input type="hidden" name="__EVENTVALIDATION" value="def">
+<div><input type="search" name="q" placeholder="Search"><button>Search</button></div>
+<div class="content"><h1>Opening hours</h1><p>The library is open from 9 to 17 on weekdays, and from 10 to 14 on Saturdays.</p>
+<p>It is closed on public holidays.</p></div>
+</form>
+<form class="account"><label>Username <input name="user"></label><label>Password <input type="password" name="password"></label><input type="submit" value="Log in"></form>
+</body></html>`
+	markdown, err := geminiclient.HTMLToMarkdown(strings.NewReader(page), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "# Opening hours\n\nThe library is open from 9 to 17 on weekdays, and from 10 to 14 on Saturdays.\n\nIt is closed on public holidays.\n"; markdown != expected {
+		t.Errorf("Expected %q, but got %q", expected, markdown)
+	}
+}
+
+func TestAddURLHTML(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=iso-8859-1")
+		w.Write([]byte("<html><body><main><p>Cr\xe8me fra\xeeche</p></main></body></html>"))
+	}))
+	defer server.Close()
+
+	gc, _ := geminitest.NewClient(t)
+	if err := gc.AddURL(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if text, ok := gc.Parts[0].(genai.Text); !ok || text != "Crème fraîche\n" {
+		t.Errorf("Expected the page as Markdown text, but got %#v", gc.Parts[0])
+	}
+
+	gc.SetDownloadPolicy(geminiclient.DownloadPolicy{KeepHTML: true})
+	if err := gc.AddURL(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if blob, ok := gc.Parts[1].(genai.Blob); !ok || blob.MIMEType != "text/html" {
+		t.Errorf("Expected the page as HTML, but got %#v", gc.Parts[1])
+	}
+}
@@ -0,0 +1,143 @@
+package geminiclient
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// ErrUnknownFileType is returned when the type of a file can not be detected from its contents
+	ErrUnknownFileType = errors.New("unknown file type")
+	// ErrFileTypeMismatch is returned when the contents of a file do not match its extension, like a .png file that contains text
+	ErrFileTypeMismatch = errors.New("the file contents do not match the file type")
+)
+
+// sniffLen is the number of bytes that are looked at when detecting the MIME type
+const sniffLen = 512
+
+// extensionTypes are the MIME types for file extensions that mime.TypeByExtension may not know about
+var extensionTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".pdf":  "application/pdf",
+	".mp3":  "audio/mpeg",
+	".wav":  "audio/wav",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".mp4":  "video/mp4",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".txt":  "text/plain",
+	".md":   "text/markdown",
+	".csv":  "text/csv",
+}
+
+// ftypBrands are the MIME types of ISO base media files (MP4, MOV and HEIC), by the major brand in the ftyp box
+var ftypBrands = map[string]string{
+	"isom": "video/mp4",
+	"iso2": "video/mp4",
+	"mp41": "video/mp4",
+	"mp42": "video/mp4",
+	"avc1": "video/mp4",
+	"dash": "video/mp4",
+	"M4V ": "video/mp4",
+	"M4A ": "audio/mp4",
+	"qt  ": "video/quicktime",
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+}
+
+// MIMETypeByExtension returns the MIME type for the extension of the given filename or URI,
+// or an empty string if it is not known.
+func MIMETypeByExtension(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == "" {
+		return ""
+	}
+	if mimeType, ok := extensionTypes[ext]; ok {
+		return mimeType
+	}
+	if mimeType, _, err := mime.ParseMediaType(mime.TypeByExtension(ext)); err == nil {
+		return mimeType
+	}
+	return ""
+}
+
+// DetectMIMEType returns the MIME type of the given data, by looking at the first bytes.
+// PNG, JPEG, WEBP, HEIC, GIF, PDF, MP3, WAV, FLAC, MP4, MOV, WEBM and plain text are detected.
+// An empty string is returned if the type is not known.
+func DetectMIMEType(data []byte) string {
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff}):
+		return "image/jpeg"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "image/gif"
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:12]) == "WEBP":
+		return "image/webp"
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:12]) == "WAVE":
+		return "audio/wav"
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		return ftypBrands[string(data[8:12])]
+	case bytes.HasPrefix(data, []byte("%PDF-")):
+		return "application/pdf"
+	case bytes.HasPrefix(data, []byte("fLaC")):
+		return "audio/flac"
+	case bytes.HasPrefix(data, []byte("ID3")):
+		return "audio/mpeg"
+	case len(data) >= 2 && data[0] == 0xff && data[1]&0xe6 == 0xe2: // an MPEG audio frame, layer III
+		return "audio/mpeg"
+	case bytes.HasPrefix(data, []byte{0x1a, 0x45, 0xdf, 0xa3}): // EBML, used by WEBM and Matroska
+		if bytes.Contains(data, []byte("webm")) {
+			return "video/webm"
+		}
+		return ""
+	case isText(data):
+		return "text/plain"
+	}
+	return ""
+}
+
+// isText returns true if the given data is UTF-8 text without control characters, except for whitespace.
+// The data may end in the middle of a rune, since it may be the start of a longer file.
+func isText(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	for i := 0; i < len(data); {
+		r, size := utf8.DecodeRune(data[i:])
+		if r == utf8.RuneError && size <= 1 {
+			return len(data)-i < utf8.UTFMax && !utf8.FullRune(data[i:])
+		}
+		if r < ' ' && r != '\t' && r != '\n' && r != '\r' && r != '\f' || r == 0x7f {
+			return false
+		}
+		i += size
+	}
+	return true
+}
+
+// sameFileType returns true if a file with the detected MIME type may have an extension that gives the other MIME type.
+// Text files may have any text extension, like .csv or .json, while other files must have the same kind of content.
+func sameFileType(detected, byExtension string) bool {
+	if detected == "text/plain" {
+		return mimeModality(byExtension) == ModalityText
+	}
+	return mimeModality(detected) == mimeModality(byExtension)
+}
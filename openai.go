@@ -0,0 +1,514 @@
+package geminiclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/vertexai/genai"
+	"google.golang.org/api/iterator"
+)
+
+// OpenAIBackend is a Backend for servers with an OpenAI-compatible chat completions API,
+// like llama.cpp, Ollama and vLLM, which is useful for offline development and for CI.
+type OpenAIBackend struct {
+	BaseURL    string       // the URL that /chat/completions is added to, like http://localhost:11434/v1
+	APIKey     string       // sent as a bearer token, if set
+	HTTPClient *http.Client // the default is http.DefaultClient
+}
+
+// The JSON format of the OpenAI chat completions API.
+
+type openAIRequest struct {
+	Model            string                `json:"model"`
+	Messages         []*openAIMessage      `json:"messages"`
+	Tools            []*openAITool         `json:"tools,omitempty"`
+	Temperature      *float32              `json:"temperature,omitempty"`
+	TopP             *float32              `json:"top_p,omitempty"`
+	TopK             *int32                `json:"top_k,omitempty"` // not part of the OpenAI API, but supported by most local servers
+	N                *int32                `json:"n,omitempty"`
+	MaxTokens        *int32                `json:"max_tokens,omitempty"`
+	Stop             []string              `json:"stop,omitempty"`
+	PresencePenalty  *float32              `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32              `json:"frequency_penalty,omitempty"`
+	ResponseFormat   *openAIResponseFormat `json:"response_format,omitempty"`
+	Stream           bool                  `json:"stream,omitempty"`
+	StreamOptions    *openAIStreamOptions  `json:"stream_options,omitempty"`
+}
+
+type openAIMessage struct {
+	Role       string            `json:"role,omitempty"`
+	Content    any               `json:"content"` // a string, a list of content parts, or null
+	ToolCalls  []*openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string            `json:"tool_call_id,omitempty"`
+}
+
+type openAIContentPart struct {
+	Type       string            `json:"type"`
+	Text       string            `json:"text,omitempty"`
+	ImageURL   *openAIImageURL   `json:"image_url,omitempty"`
+	InputAudio *openAIInputAudio `json:"input_audio,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+type openAIInputAudio struct {
+	Data   string `json:"data"`
+	Format string `json:"format"`
+}
+
+type openAIToolCall struct {
+	Index    int                `json:"index,omitempty"` // only used when streaming
+	ID       string             `json:"id,omitempty"`
+	Type     string             `json:"type,omitempty"`
+	Function openAIFunctionCall `json:"function"`
+}
+
+type openAIFunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+type openAITool struct {
+	Type     string         `json:"type"`
+	Function openAIFunction `json:"function"`
+}
+
+type openAIFunction struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+}
+
+type openAIResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *openAIJSONSchema `json:"json_schema,omitempty"`
+}
+
+type openAIJSONSchema struct {
+	Name   string         `json:"name"`
+	Schema map[string]any `json:"schema"`
+}
+
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type openAIResponse struct {
+	Choices []*openAIChoice `json:"choices"`
+	Usage   *openAIUsage    `json:"usage,omitempty"`
+}
+
+type openAIChoice struct {
+	Index        int32          `json:"index"`
+	Message      *openAIMessage `json:"message,omitempty"`
+	Delta        *openAIMessage `json:"delta,omitempty"` // only used when streaming
+	FinishReason string         `json:"finish_reason,omitempty"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int32 `json:"prompt_tokens"`
+	CompletionTokens int32 `json:"completion_tokens"`
+	TotalTokens      int32 `json:"total_tokens"`
+}
+
+// openAIStream is a ResponseIterator for the server-sent events of a streaming request.
+// Tool calls arrive in fragments, so they are collected and returned when the stream is finished.
+type openAIStream struct {
+	events *sseReader
+	calls  map[int]*openAIToolCall
+	err    error
+}
+
+// NewOpenAIBackend creates a new backend for the OpenAI-compatible server at the given URL, like "http://localhost:11434/v1".
+// The API key may be blank.
+func NewOpenAIBackend(baseURL, apiKey string) *OpenAIBackend {
+	return &OpenAIBackend{BaseURL: baseURL, APIKey: apiKey}
+}
+
+// post sends a chat completions request, and returns the response if the status code is 2xx.
+func (b *OpenAIBackend) post(ctx context.Context, req *openAIRequest) (*http.Response, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(b.BaseURL, "/")+"/chat/completions", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if b.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+b.APIKey)
+	}
+	client := b.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, httpError(resp)
+	}
+	return resp, nil
+}
+
+// GenerateContent sends the given contents to the model.
+func (b *OpenAIBackend) GenerateContent(ctx context.Context, cfg *ModelConfig, contents ...*genai.Content) (*genai.GenerateContentResponse, error) {
+	req, err := toOpenAIRequest(cfg, contents)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.post(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var res openAIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	response := &genai.GenerateContentResponse{UsageMetadata: fromOpenAIUsage(res.Usage)}
+	for _, choice := range res.Choices {
+		if choice.Message == nil {
+			continue
+		}
+		candidate, err := fromOpenAIMessage(choice.Index, choice.Message, choice.Message.ToolCalls, choice.FinishReason)
+		if err != nil {
+			return nil, err
+		}
+		response.Candidates = append(response.Candidates, candidate)
+	}
+	return response, nil
+}
+
+// GenerateContentStream sends the given contents to the model, and streams the response.
+func (b *OpenAIBackend) GenerateContentStream(ctx context.Context, cfg *ModelConfig, contents ...*genai.Content) ResponseIterator {
+	req, err := toOpenAIRequest(cfg, contents)
+	if err != nil {
+		return &openAIStream{err: err}
+	}
+	req.Stream = true
+	req.StreamOptions = &openAIStreamOptions{IncludeUsage: true}
+	resp, err := b.post(ctx, req)
+	if err != nil {
+		return &openAIStream{err: err}
+	}
+	return &openAIStream{events: newSSEReader(resp.Body), calls: make(map[int]*openAIToolCall)}
+}
+
+// Next returns the next response, or iterator.Done when there are no more.
+func (s *openAIStream) Next() (*genai.GenerateContentResponse, error) {
+	for s.err == nil {
+		data, err := s.events.Next()
+		if err == io.EOF || data == "[DONE]" {
+			if len(s.calls) > 0 {
+				return s.toolCalls("")
+			}
+			return nil, s.fail(iterator.Done)
+		}
+		if err != nil {
+			return nil, s.fail(err)
+		}
+		var chunk openAIResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, s.fail(fmt.Errorf("invalid streamed response: %v", err))
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta == nil {
+			if chunk.Usage != nil {
+				return &genai.GenerateContentResponse{
+					Candidates:    []*genai.Candidate{{Content: &genai.Content{Role: "model"}}},
+					UsageMetadata: fromOpenAIUsage(chunk.Usage),
+				}, nil
+			}
+			continue
+		}
+		choice := chunk.Choices[0]
+		for _, call := range choice.Delta.ToolCalls {
+			if existing, ok := s.calls[call.Index]; ok {
+				existing.Function.Arguments += call.Function.Arguments
+			} else {
+				s.calls[call.Index] = call
+			}
+		}
+		if choice.FinishReason != "" && len(s.calls) > 0 {
+			return s.toolCalls(choice.FinishReason)
+		}
+		text, _ := choice.Delta.Content.(string)
+		if text == "" && choice.FinishReason == "" {
+			continue
+		}
+		candidate, err := fromOpenAIMessage(0, &openAIMessage{Content: text}, nil, choice.FinishReason)
+		if err != nil {
+			return nil, s.fail(err)
+		}
+		return &genai.GenerateContentResponse{Candidates: []*genai.Candidate{candidate}, UsageMetadata: fromOpenAIUsage(chunk.Usage)}, nil
+	}
+	return nil, s.err
+}
+
+// toolCalls returns the tool calls that have been collected, in order.
+func (s *openAIStream) toolCalls(finishReason string) (*genai.GenerateContentResponse, error) {
+	calls := make([]*openAIToolCall, 0, len(s.calls))
+	for _, call := range s.calls {
+		calls = append(calls, call)
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].Index < calls[j].Index })
+	clear(s.calls)
+	candidate, err := fromOpenAIMessage(0, &openAIMessage{}, calls, finishReason)
+	if err != nil {
+		return nil, s.fail(err)
+	}
+	return &genai.GenerateContentResponse{Candidates: []*genai.Candidate{candidate}}, nil
+}
+
+// fail closes the stream, and makes all further calls to Next return the given error.
+func (s *openAIStream) fail(err error) error {
+	s.err = err
+	if s.events != nil {
+		s.events.Close()
+	}
+	return err
+}
+
+// CountTokens estimates the number of tokens in the given parts, since there is no
+// endpoint for counting tokens in the OpenAI API. See EstimateTokens.
+func (b *OpenAIBackend) CountTokens(ctx context.Context, cfg *ModelConfig, parts ...genai.Part) (int, error) {
+	return EstimateTokens(parts...), nil
+}
+
+// StartChat starts a new chat session.
+func (b *OpenAIBackend) StartChat(cfg *ModelConfig) ChatSession {
+	return NewChatSession(b, cfg)
+}
+
+// toOpenAIRequest converts the given configuration and contents to a chat completions request.
+func toOpenAIRequest(cfg *ModelConfig, contents []*genai.Content) (*openAIRequest, error) {
+	config := cfg.GenerationConfig
+	req := &openAIRequest{
+		Model:            cfg.ModelName,
+		Temperature:      config.Temperature,
+		TopP:             config.TopP,
+		TopK:             config.TopK,
+		N:                config.CandidateCount,
+		MaxTokens:        config.MaxOutputTokens,
+		Stop:             config.StopSequences,
+		PresencePenalty:  config.PresencePenalty,
+		FrequencyPenalty: config.FrequencyPenalty,
+	}
+	if config.ResponseSchema != nil {
+		req.ResponseFormat = &openAIResponseFormat{Type: "json_schema", JSONSchema: &openAIJSONSchema{Name: "response", Schema: jsonSchema(config.ResponseSchema)}}
+	} else if config.ResponseMIMEType == "application/json" {
+		req.ResponseFormat = &openAIResponseFormat{Type: "json_object"}
+	}
+	for _, tool := range cfg.Tools {
+		for _, decl := range tool.FunctionDeclarations {
+			req.Tools = append(req.Tools, &openAITool{
+				Type:     "function",
+				Function: openAIFunction{Name: decl.Name, Description: decl.Description, Parameters: jsonSchema(decl.Parameters)},
+			})
+		}
+	}
+	if cfg.SystemInstruction != nil {
+		var instruction strings.Builder
+		for _, part := range cfg.SystemInstruction.Parts {
+			if text, ok := part.(genai.Text); ok {
+				instruction.WriteString(string(text))
+			}
+		}
+		req.Messages = append(req.Messages, &openAIMessage{Role: "system", Content: instruction.String()})
+	}
+	var pending []*openAIToolCall // the tool calls that have not been answered yet
+	for i, content := range contents {
+		if content.Role == "model" {
+			message, err := toOpenAIAssistantMessage(i, content)
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending[:0], message.ToolCalls...)
+			req.Messages = append(req.Messages, message)
+			continue
+		}
+		var parts []*openAIContentPart
+		for _, part := range content.Parts {
+			if p, ok := part.(genai.FunctionResponse); ok {
+				message, err := toOpenAIToolMessage(p, &pending)
+				if err != nil {
+					return nil, err
+				}
+				req.Messages = append(req.Messages, message)
+				continue
+			}
+			contentPart, err := toOpenAIContentPart(part)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, contentPart)
+		}
+		switch {
+		case len(parts) == 1 && parts[0].Type == "text":
+			req.Messages = append(req.Messages, &openAIMessage{Role: "user", Content: parts[0].Text})
+		case len(parts) > 0:
+			req.Messages = append(req.Messages, &openAIMessage{Role: "user", Content: parts})
+		}
+	}
+	return req, nil
+}
+
+// toOpenAIAssistantMessage converts a response from the model to an assistant message.
+// The tool calls are given IDs that are unique within the request.
+func toOpenAIAssistantMessage(i int, content *genai.Content) (*openAIMessage, error) {
+	message := &openAIMessage{Role: "assistant"}
+	var text strings.Builder
+	for j, part := range content.Parts {
+		switch p := part.(type) {
+		case genai.Text:
+			text.WriteString(string(p))
+		case genai.FunctionCall:
+			args, err := json.Marshal(p.Args)
+			if err != nil {
+				return nil, err
+			}
+			message.ToolCalls = append(message.ToolCalls, &openAIToolCall{
+				ID:       fmt.Sprintf("call_%d_%d", i, j),
+				Type:     "function",
+				Function: openAIFunctionCall{Name: p.Name, Arguments: string(args)},
+			})
+		default:
+			return nil, fmt.Errorf("unsupported part type in a model response: %T", part)
+		}
+	}
+	if text.Len() > 0 || len(message.ToolCalls) == 0 {
+		message.Content = text.String()
+	}
+	return message, nil
+}
+
+// toOpenAIToolMessage converts a function response to a tool message, for the first pending tool call with the same name.
+func toOpenAIToolMessage(response genai.FunctionResponse, pending *[]*openAIToolCall) (*openAIMessage, error) {
+	data, err := json.Marshal(response.Response)
+	if err != nil {
+		return nil, err
+	}
+	message := &openAIMessage{Role: "tool", Content: string(data)}
+	for i, call := range *pending {
+		if call.Function.Name == response.Name {
+			message.ToolCallID = call.ID
+			*pending = append((*pending)[:i], (*pending)[i+1:]...)
+			return message, nil
+		}
+	}
+	return nil, fmt.Errorf("no tool call for the function response: %s", response.Name)
+}
+
+// toOpenAIContentPart converts a part of a user message. Images are sent as data URLs.
+func toOpenAIContentPart(part genai.Part) (*openAIContentPart, error) {
+	switch p := part.(type) {
+	case genai.Text:
+		return &openAIContentPart{Type: "text", Text: string(p)}, nil
+	case genai.Blob:
+		data := base64.StdEncoding.EncodeToString(p.Data)
+		switch {
+		case strings.HasPrefix(p.MIMEType, "image/"):
+			return &openAIContentPart{Type: "image_url", ImageURL: &openAIImageURL{URL: "data:" + p.MIMEType + ";base64," + data}}, nil
+		case p.MIMEType == "audio/wav" || p.MIMEType == "audio/x-wav":
+			return &openAIContentPart{Type: "input_audio", InputAudio: &openAIInputAudio{Data: data, Format: "wav"}}, nil
+		case p.MIMEType == "audio/mpeg" || p.MIMEType == "audio/mp3":
+			return &openAIContentPart{Type: "input_audio", InputAudio: &openAIInputAudio{Data: data, Format: "mp3"}}, nil
+		}
+		return nil, fmt.Errorf("unsupported MIME type for an OpenAI-compatible backend: %s", p.MIMEType)
+	case genai.FileData:
+		if strings.HasPrefix(p.MIMEType, "image/") && (strings.HasPrefix(p.FileURI, "http://") || strings.HasPrefix(p.FileURI, "https://")) {
+			return &openAIContentPart{Type: "image_url", ImageURL: &openAIImageURL{URL: p.FileURI}}, nil
+		}
+		return nil, fmt.Errorf("unsupported file for an OpenAI-compatible backend: %s", p.FileURI)
+	}
+	return nil, fmt.Errorf("unsupported part type: %T", part)
+}
+
+// jsonSchema converts a genai schema to a JSON schema.
+func jsonSchema(schema *genai.Schema) map[string]any {
+	if schema == nil {
+		return nil
+	}
+	s := make(map[string]any)
+	if schema.Type != genai.TypeUnspecified {
+		typeName := strings.ToLower(enumName(restTypes, schema.Type))
+		if schema.Nullable {
+			s["type"] = []string{typeName, "null"}
+		} else {
+			s["type"] = typeName
+		}
+	}
+	if schema.Description != "" {
+		s["description"] = schema.Description
+	}
+	if schema.Format != "" {
+		s["format"] = schema.Format
+	}
+	if len(schema.Enum) > 0 {
+		s["enum"] = schema.Enum
+	}
+	if schema.Items != nil {
+		s["items"] = jsonSchema(schema.Items)
+	}
+	if len(schema.Properties) > 0 {
+		properties := make(map[string]any, len(schema.Properties))
+		for name, property := range schema.Properties {
+			properties[name] = jsonSchema(property)
+		}
+		s["properties"] = properties
+	}
+	if len(schema.Required) > 0 {
+		s["required"] = schema.Required
+	}
+	return s
+}
+
+// fromOpenAIMessage converts a message from the model to a candidate.
+// Like the genai package, a *genai.BlockedError is returned if the response was filtered.
+func fromOpenAIMessage(index int32, message *openAIMessage, calls []*openAIToolCall, finishReason string) (*genai.Candidate, error) {
+	candidate := &genai.Candidate{Index: index, Content: &genai.Content{Role: "model"}}
+	if text, ok := message.Content.(string); ok && text != "" {
+		candidate.Content.Parts = append(candidate.Content.Parts, genai.Text(text))
+	}
+	for _, call := range calls {
+		var args map[string]any
+		if call.Function.Arguments != "" {
+			if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+				return nil, fmt.Errorf("invalid arguments for %s: %v", call.Function.Name, err)
+			}
+		}
+		candidate.Content.Parts = append(candidate.Content.Parts, genai.FunctionCall{Name: call.Function.Name, Args: args})
+	}
+	switch finishReason {
+	case "stop", "tool_calls", "function_call":
+		candidate.FinishReason = genai.FinishReasonStop
+	case "length":
+		candidate.FinishReason = genai.FinishReasonMaxTokens
+	case "content_filter":
+		candidate.FinishReason = genai.FinishReasonSafety
+		return nil, &genai.BlockedError{Candidate: candidate}
+	}
+	return candidate, nil
+}
+
+func fromOpenAIUsage(usage *openAIUsage) *genai.UsageMetadata {
+	if usage == nil {
+		return nil
+	}
+	return &genai.UsageMetadata{
+		PromptTokenCount:     usage.PromptTokens,
+		CandidatesTokenCount: usage.CompletionTokens,
+		TotalTokenCount:      usage.TotalTokens,
+	}
+}
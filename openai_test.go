@@ -0,0 +1,154 @@
+package geminiclient_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/geminiclient"
+)
+
+// newFakeOpenAI starts a fake OpenAI-compatible server that answers tool calls, describes images and echoes the prompt.
+func newFakeOpenAI(t *testing.T) *geminiclient.GeminiClient {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Messages []struct {
+				Role       string          `json:"role"`
+				Content    json.RawMessage `json:"content"`
+				ToolCallID string          `json:"tool_call_id"`
+			} `json:"messages"`
+			Tools          []any          `json:"tools"`
+			Stream         bool           `json:"stream"`
+			ResponseFormat map[string]any `json:"response_format"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		last := req.Messages[len(req.Messages)-1]
+		var reply string
+		switch {
+		case last.Role == "tool":
+			if last.ToolCallID == "" {
+				t.Error("Expected the tool message to refer to the tool call")
+			}
+			reply = "The result is " + string(last.Content)
+		case len(req.Tools) > 0 && req.Stream:
+			// The arguments of a streamed tool call arrive in pieces
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: {\"choices\": [{\"index\": 0, \"delta\": {\"role\": \"assistant\", \"tool_calls\": [{\"index\": 0, \"id\": \"abc\", \"type\": \"function\", \"function\": {\"name\": \"add\", \"arguments\": \"{\\\"param1\\\": 2, \"}}]}}]}\n\n")
+			fmt.Fprint(w, "data: {\"choices\": [{\"index\": 0, \"delta\": {\"tool_calls\": [{\"index\": 0, \"function\": {\"arguments\": \"\\\"param2\\\": 3}\"}}]}}]}\n\n")
+			fmt.Fprint(w, "data: {\"choices\": [{\"index\": 0, \"delta\": {}, \"finish_reason\": \"tool_calls\"}]}\n\n")
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		case len(req.Tools) > 0:
+			fmt.Fprint(w, `{"choices": [{"index": 0, "message": {"role": "assistant", "content": null, "tool_calls": [{"id": "abc", "type": "function", "function": {"name": "add", "arguments": "{\"param1\": 2, \"param2\": 3}"}}]}, "finish_reason": "tool_calls"}]}`)
+			return
+		case strings.Contains(string(last.Content), "data:image/png;base64,"):
+			reply = "an image"
+		case req.ResponseFormat["type"] == "json_object":
+			reply = `{"answer": 42}`
+		default:
+			json.Unmarshal(last.Content, &reply)
+		}
+		if req.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, word := range strings.SplitAfter(reply, " ") {
+				fmt.Fprintf(w, "data: {\"choices\": [{\"index\": 0, \"delta\": {\"content\": %q}}]}\n\n", word)
+			}
+			fmt.Fprint(w, "data: {\"choices\": [{\"index\": 0, \"delta\": {}, \"finish_reason\": \"stop\"}]}\n\n")
+			fmt.Fprint(w, "data: {\"choices\": [], \"usage\": {\"prompt_tokens\": 3, \"completion_tokens\": 4, \"total_tokens\": 7}}\n\n")
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		}
+		data, _ := json.Marshal(reply)
+		fmt.Fprintf(w, `{"choices": [{"index": 0, "message": {"role": "assistant", "content": %s}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 3, "completion_tokens": 4, "total_tokens": 7}}`, data)
+	}))
+	t.Cleanup(server.Close)
+	gc := &geminiclient.GeminiClient{ModelName: "llama3", Functions: map[string]reflect.Value{}}
+	gc.SetBackend(geminiclient.NewOpenAIBackend(server.URL+"/v1", ""))
+	return gc
+}
+
+func TestOpenAIBackend(t *testing.T) {
+	gc := newFakeOpenAI(t)
+
+	result, err := gc.Query("hello there")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "hello there" {
+		t.Errorf("Expected \"hello there\" but got %q", result)
+	}
+
+	data, mimeType := base64.StdEncoding.EncodeToString([]byte("PNG DATA")), "image/png"
+	result, err = gc.MultiQuery("What is this?", &data, &mimeType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "an image" {
+		t.Errorf("Expected the image to be sent as a data URL, but got %q", result)
+	}
+
+	res, err := gc.Generate(context.Background(), geminiclient.NewTextRequest("What is the answer?").WithGenerationConfig(genai.GenerationConfig{ResponseMIMEType: "application/json"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != `{"answer": 42}` {
+		t.Errorf("Expected JSON mode to be used, but got %q", res.Text)
+	}
+
+	var chunks []string
+	gc.AddText("one two three")
+	result, err = gc.SubmitToClientStreaming(context.Background(), func(s string) { chunks = append(chunks, s) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "one two three" || len(chunks) != 3 {
+		t.Errorf("Expected three chunks and \"one two three\" but got %v and %q", chunks, result)
+	}
+	if gc.LastMetadata().UsageMetadata == nil || gc.LastMetadata().UsageMetadata.TotalTokenCount != 7 {
+		t.Errorf("Expected the usage to be streamed, but got %v", gc.LastMetadata().UsageMetadata)
+	}
+}
+
+func TestOpenAIFunctionCall(t *testing.T) {
+	gc := newFakeOpenAI(t)
+	if err := gc.AddFunctionTool("add", "Add two numbers", func(a, b int) int { return a + b }); err != nil {
+		t.Fatal(err)
+	}
+	result, err := gc.Query("What is 2 + 3?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != `The result is "{\"return1\":5}"` {
+		t.Errorf("Expected the function result to be sent back, but got %q", result)
+	}
+}
+
+func TestOpenAIStreamedFunctionCall(t *testing.T) {
+	gc := newFakeOpenAI(t)
+	if err := gc.AddFunctionTool("add", "Add two numbers", func(a, b int) int { return a + b }); err != nil {
+		t.Fatal(err)
+	}
+	gc.AddText("What is 2 + 3?")
+	var streamed strings.Builder
+	result, err := gc.SubmitToClientStreaming(context.Background(), func(s string) { streamed.WriteString(s) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `The result is "{\"return1\":5}"`
+	if result != expected || streamed.String() != expected {
+		t.Errorf("Expected the function result to be sent back and streamed, but got %q and %q", result, streamed.String())
+	}
+}
@@ -0,0 +1,349 @@
+package geminiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Option configures a GeminiClient when it is created, and can be given to all of the constructors.
+type Option func(*GeminiClient) error
+
+// WithModel sets the name of the model that is used for text prompts, like "gemini-1.5-pro".
+func WithModel(modelName string) Option {
+	return func(gc *GeminiClient) error {
+		gc.ModelName = modelName
+		return nil
+	}
+}
+
+// WithMultiModalModel sets the name of the model that is used for multimodal prompts.
+func WithMultiModalModel(modelName string) Option {
+	return func(gc *GeminiClient) error {
+		gc.MultiModalModelName = modelName
+		return nil
+	}
+}
+
+// WithModelRouter sets how the model is picked for each request, see SetModelRouter.
+func WithModelRouter(router ModelRouter) Option {
+	return func(gc *GeminiClient) error {
+		gc.SetModelRouter(router)
+		return nil
+	}
+}
+
+// WithProjectID sets the Google Cloud project ID. If it is empty, Google AI Studio is used if a Gemini API key is set.
+func WithProjectID(projectID string) Option {
+	return func(gc *GeminiClient) error {
+		gc.ProjectID = projectID
+		return nil
+	}
+}
+
+// WithLocation sets the Google Cloud location, like "us-central1".
+func WithLocation(location string) Option {
+	return func(gc *GeminiClient) error {
+		gc.ProjectLocation = location
+		return nil
+	}
+}
+
+// WithTemperature sets the default temperature, from 0 to 2.
+func WithTemperature(temperature float32) Option {
+	return func(gc *GeminiClient) error {
+		gc.Temperature = temperature
+		return nil
+	}
+}
+
+// WithTimeout sets the timeout for the requests that do not have a deadline (0 for no timeout).
+func WithTimeout(timeout time.Duration) Option {
+	return func(gc *GeminiClient) error {
+		gc.Timeout = timeout
+		return nil
+	}
+}
+
+// WithTrim sets if the whitespace around the responses is trimmed.
+func WithTrim(trim bool) Option {
+	return func(gc *GeminiClient) error {
+		gc.Trim = trim
+		return nil
+	}
+}
+
+// WithVerbose sets if more details are logged.
+func WithVerbose(verbose bool) Option {
+	return func(gc *GeminiClient) error {
+		gc.Verbose = verbose
+		return nil
+	}
+}
+
+// WithGenerationConfig sets the generation config for the requests that do not have one.
+// A temperature in the config takes precedence over the one given with WithTemperature.
+func WithGenerationConfig(config genai.GenerationConfig) Option {
+	return func(gc *GeminiClient) error {
+		gc.GenerationConfig = config
+		return nil
+	}
+}
+
+// WithSystemInstruction sets the system instruction for the requests that do not have one.
+func WithSystemInstruction(instruction string) Option {
+	return func(gc *GeminiClient) error {
+		gc.SystemInstruction = instruction
+		return nil
+	}
+}
+
+// WithSafetySettings sets the thresholds for blocking harmful content, for example:
+//
+//	geminiclient.WithSafetySettings(&genai.SafetySetting{Category: genai.HarmCategoryHarassment, Threshold: genai.HarmBlockOnlyHigh})
+func WithSafetySettings(settings ...*genai.SafetySetting) Option {
+	return func(gc *GeminiClient) error {
+		for _, setting := range settings {
+			if setting == nil {
+				return errors.New("a safety setting is nil")
+			}
+		}
+		gc.SafetySettings = settings
+		return nil
+	}
+}
+
+// WithFunction registers a Go function as a tool that the model can call, see AddFunctionTool.
+func WithFunction(name, description string, fn any) Option {
+	return func(gc *GeminiClient) error {
+		if err := gc.AddFunctionTool(name, description, fn); err != nil {
+			return fmt.Errorf("invalid function %s: %w", name, err)
+		}
+		return nil
+	}
+}
+
+// WithRetryPolicy sets the retry policy, see SetRetryPolicy.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(gc *GeminiClient) error {
+		gc.SetRetryPolicy(policy)
+		return nil
+	}
+}
+
+// WithFallbacks sets the fallback models, see SetFallbacks.
+func WithFallbacks(conditions FallbackCondition, fallbacks ...Fallback) Option {
+	return func(gc *GeminiClient) error {
+		for _, fallback := range fallbacks {
+			if fallback.ModelName == "" {
+				return errors.New("a fallback has no model name")
+			}
+		}
+		gc.SetFallbacks(conditions, fallbacks...)
+		return nil
+	}
+}
+
+// WithLocations sets more Google Cloud locations to fail over to, see SetLocations.
+func WithLocations(locations ...string) Option {
+	return func(gc *GeminiClient) error {
+		gc.SetLocations(locations...)
+		return nil
+	}
+}
+
+// WithHedging enables or disables hedged requests, see SetHedging.
+func WithHedging(enabled bool) Option {
+	return func(gc *GeminiClient) error {
+		gc.SetHedging(enabled)
+		return nil
+	}
+}
+
+// WithCircuitBreaker sets the circuit breaker policy, see SetCircuitBreaker.
+func WithCircuitBreaker(policy CircuitBreakerPolicy) Option {
+	return func(gc *GeminiClient) error {
+		gc.SetCircuitBreaker(policy)
+		return nil
+	}
+}
+
+// WithRateLimiter sets a rate limiter, which may be shared between clients, see SetRateLimiter.
+func WithRateLimiter(rl *RateLimiter) Option {
+	return func(gc *GeminiClient) error {
+		gc.SetRateLimiter(rl)
+		return nil
+	}
+}
+
+// WithCache sets a cache for responses, see SetCache.
+func WithCache(cache Cache, ttl time.Duration) Option {
+	return func(gc *GeminiClient) error {
+		gc.SetCache(cache, ttl)
+		return nil
+	}
+}
+
+// WithCoalescing enables or disables coalescing of identical requests, see SetCoalescing.
+func WithCoalescing(enabled bool) Option {
+	return func(gc *GeminiClient) error {
+		gc.SetCoalescing(enabled)
+		return nil
+	}
+}
+
+// WithImagePolicy sets how images are prepared before they are added to the prompt, see SetImagePolicy.
+func WithImagePolicy(policy ImagePolicy) Option {
+	return func(gc *GeminiClient) error {
+		gc.SetImagePolicy(policy)
+		return nil
+	}
+}
+
+// WithStaging sets how large parts are uploaded to Cloud Storage, see SetStaging.
+func WithStaging(policy StagingPolicy) Option {
+	return func(gc *GeminiClient) error {
+		gc.SetStaging(policy)
+		return nil
+	}
+}
+
+// WithDownloadPolicy sets how files are downloaded by AddURL, see SetDownloadPolicy.
+func WithDownloadPolicy(policy DownloadPolicy) Option {
+	return func(gc *GeminiClient) error {
+		gc.SetDownloadPolicy(policy)
+		return nil
+	}
+}
+
+// WithBackend makes the client use the given backend instead of Vertex AI.
+// No Google Cloud project or credentials are needed, which makes it useful for tests, see the geminitest package.
+func WithBackend(backend Backend) Option {
+	return func(gc *GeminiClient) error {
+		gc.Backend = backend
+		return nil
+	}
+}
+
+// WithEndpoint makes the client send the Vertex AI requests to the given endpoint, instead of to the
+// endpoint for the project location, like a Private Service Connect endpoint. An endpoint that starts with
+// http:// or https:// selects the REST transport, while an endpoint like "vertex.example.internal:443" is used
+// with gRPC, unless WithREST is given.
+func WithEndpoint(endpoint string) Option {
+	return func(gc *GeminiClient) error {
+		if endpoint == "" {
+			return fmt.Errorf("the endpoint is empty")
+		}
+		if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+			gc.withREST = true
+		}
+		gc.clientOptions = append(gc.clientOptions, option.WithEndpoint(endpoint))
+		return nil
+	}
+}
+
+// WithREST makes the client use the REST transport for Vertex AI, instead of gRPC.
+func WithREST() Option {
+	return func(gc *GeminiClient) error {
+		gc.withREST = true
+		gc.withGRPC = false
+		return nil
+	}
+}
+
+// WithGRPC makes the client use the gRPC transport for Vertex AI, which is the default.
+// It can not be combined with WithHTTPClient, no matter the order of the options.
+func WithGRPC() Option {
+	return func(gc *GeminiClient) error {
+		gc.withREST = false
+		gc.withGRPC = true
+		return nil
+	}
+}
+
+// WithHTTPClient makes the client send the Vertex AI requests with the given HTTP client, which can be
+// configured with a proxy, a custom CA bundle or client certificates for mTLS. This selects the REST transport.
+// The credentials are still added to the requests, unless WithoutAuthentication is given.
+func WithHTTPClient(client *http.Client) Option {
+	return func(gc *GeminiClient) error {
+		if client == nil {
+			return errors.New("the HTTP client is nil")
+		}
+		gc.httpClient = client
+		gc.withREST = true
+		return nil
+	}
+}
+
+// WithHeader adds a header to all requests to Vertex AI, for both the REST and the gRPC transport.
+func WithHeader(key, value string) Option {
+	return func(gc *GeminiClient) error {
+		if key == "" {
+			return errors.New("the header name is empty")
+		}
+		if gc.headers == nil {
+			gc.headers = make(http.Header)
+		}
+		gc.headers.Add(key, value)
+		return nil
+	}
+}
+
+// WithClientOptions passes the given options on to the Vertex AI client, after the ones from the other options.
+func WithClientOptions(opts ...option.ClientOption) Option {
+	return func(gc *GeminiClient) error {
+		gc.clientOptions = append(gc.clientOptions, opts...)
+		return nil
+	}
+}
+
+// WithoutAuthentication makes the client send the Vertex AI requests without looking up or sending any credentials.
+// This is meant for local servers, like the fake Vertex AI server in the geminitest package,
+// and gRPC connections are then made without TLS.
+func WithoutAuthentication() Option {
+	return func(gc *GeminiClient) error {
+		gc.withoutAuth = true
+		return nil
+	}
+}
+
+// vertexOptions returns the options for creating the Vertex AI client, including the credentials.
+func (gc *GeminiClient) vertexOptions(ctx context.Context) ([]option.ClientOption, error) {
+	var opts []option.ClientOption
+	if gc.httpClient != nil {
+		// A custom HTTP client is used as it is, so the credentials have to be added to it
+		client := *gc.httpClient
+		if !gc.withoutAuth {
+			_, tokenSource, err := gc.credentials(ctx)
+			if err != nil {
+				return nil, err
+			}
+			client.Transport = &oauth2.Transport{Source: tokenSource, Base: client.Transport}
+		}
+		opts = append(opts, option.WithHTTPClient(&client))
+	} else if gc.withoutAuth {
+		opts = append(opts, option.WithoutAuthentication())
+		if !gc.withREST {
+			opts = append(opts, option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())))
+		}
+	} else {
+		credentialOptions, err := gc.credentialOptions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, credentialOptions...)
+	}
+	if gc.withREST {
+		opts = append(opts, genai.WithREST())
+	}
+	return append(opts, gc.clientOptions...), nil
+}
@@ -0,0 +1,171 @@
+package geminiclient_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/env/v2"
+	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+func TestNewClient(t *testing.T) {
+	t.Cleanup(env.Load)
+	t.Setenv("MODEL_NAME", "gemini-from-env")
+	env.Load()
+
+	gc, err := geminiclient.NewClient(context.Background(),
+		geminiclient.WithBackend(geminitest.New()),
+		geminiclient.WithTemperature(0.7),
+		geminiclient.WithTimeout(time.Minute),
+		geminiclient.WithTrim(false),
+		geminiclient.WithRetryPolicy(geminiclient.NoRetryPolicy()),
+		geminiclient.WithLocations("europe-west4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.ModelName != "gemini-from-env" {
+		t.Errorf("Expected the model name from the environment, but got %q", gc.ModelName)
+	}
+	if gc.Temperature != 0.7 || gc.Timeout != time.Minute || gc.Trim || gc.Retry.MaxAttempts != 1 || len(gc.Regions.Locations) != 1 {
+		t.Errorf("Expected the options to be applied, but got %v, %v, %v, %v and %v", gc.Temperature, gc.Timeout, gc.Trim, gc.Retry.MaxAttempts, gc.Regions.Locations)
+	}
+
+	gc, err = geminiclient.NewClient(context.Background(), geminiclient.WithBackend(geminitest.New()), geminiclient.WithModel("gemini-1.5-pro"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.ModelName != "gemini-1.5-pro" {
+		t.Errorf("Expected the option to take precedence over the environment, but got %q", gc.ModelName)
+	}
+}
+
+func TestNewClientValidation(t *testing.T) {
+	_, err := geminiclient.NewClient(context.Background(),
+		geminiclient.WithBackend(geminitest.New()),
+		geminiclient.WithModel(""),
+		geminiclient.WithTemperature(3),
+		geminiclient.WithTimeout(-time.Second),
+		geminiclient.WithEndpoint(""),
+		geminiclient.WithFunction("not_a_function", "Not a function", 42))
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, expected := range []string{"model name", "temperature", "timeout", "endpoint", "not_a_function"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected the error to mention %q, but got %v", expected, err)
+		}
+	}
+}
+
+func TestClientDefaults(t *testing.T) {
+	setting := &genai.SafetySetting{Category: genai.HarmCategoryHarassment, Threshold: genai.HarmBlockOnlyHigh}
+	gc, fake := geminitest.NewClient(t,
+		geminiclient.WithSystemInstruction("Answer in Norwegian."),
+		geminiclient.WithSafetySettings(setting))
+
+	fake.QueueText("Hei")
+	if _, err := gc.Query("Hello"); err != nil {
+		t.Fatal(err)
+	}
+	cfg := fake.LastRequest().Config
+	if cfg.SystemInstruction == nil || cfg.SystemInstruction.Parts[0] != genai.Text("Answer in Norwegian.") {
+		t.Errorf("Expected the system instruction of the client, but got %v", cfg.SystemInstruction)
+	}
+	if len(cfg.SafetySettings) != 1 || *cfg.SafetySettings[0] != *setting {
+		t.Errorf("Expected the safety settings of the client, but got %v", cfg.SafetySettings)
+	}
+
+	fake.QueueText("Hi")
+	if _, err := gc.Generate(context.Background(), geminiclient.NewTextRequest("Hello").WithSystemInstruction("Answer in English.")); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := fake.LastRequest().Config; cfg.SystemInstruction.Parts[0] != genai.Text("Answer in English.") {
+		t.Errorf("Expected the system instruction of the request, but got %v", cfg.SystemInstruction)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	server := geminitest.NewVertexServer(t, geminitest.NewRules())
+	for name, gc := range map[string]*geminiclient.GeminiClient{
+		"REST": server.NewClient(t, geminiclient.WithHeader("X-Team", "search")),
+		"gRPC": server.NewGRPCClient(t, geminiclient.WithHeader("X-Team", "search")),
+	} {
+		if _, err := gc.Query("Hello"); err != nil {
+			t.Fatal(err)
+		}
+		headers := server.Headers()
+		if team := headers[len(headers)-1].Get("X-Team"); team != "search" {
+			t.Errorf("%s: Expected the X-Team header to be sent, but got %q", name, team)
+		}
+	}
+}
+
+// countingTransport counts the requests that are sent through it.
+type countingTransport struct {
+	requests atomic.Int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestHTTPClient(t *testing.T) {
+	clearProjectID(t)
+	server := geminitest.NewVertexServer(t, geminitest.NewRules())
+	server.Token = "secret"
+	transport := &countingTransport{}
+	gc, err := geminiclient.NewClient(context.Background(),
+		geminiclient.WithProjectID("test-project"),
+		geminiclient.WithEndpoint(server.URL),
+		geminiclient.WithHTTPClient(&http.Client{Transport: transport}),
+		geminiclient.WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "secret"})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gc.Query("Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if transport.requests.Load() != 1 {
+		t.Errorf("Expected 1 request through the HTTP client, but got %d", transport.requests.Load())
+	}
+}
+
+func TestGRPCWithHTTPClient(t *testing.T) {
+	clearProjectID(t)
+	withGRPC, withHTTPClient := geminiclient.WithGRPC(), geminiclient.WithHTTPClient(&http.Client{})
+	for _, opts := range [][]geminiclient.Option{{withGRPC, withHTTPClient}, {withHTTPClient, withGRPC}} {
+		_, err := geminiclient.NewClient(context.Background(), append(opts, geminiclient.WithProjectID("test-project"))...)
+		if err == nil || !strings.Contains(err.Error(), "gRPC can not be used together with WithHTTPClient") {
+			t.Errorf("Expected gRPC and an HTTP client to conflict in any order, but got %v", err)
+		}
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	clearProjectID(t)
+	server := geminitest.NewVertexServer(t, geminitest.NewRules())
+	gc, err := geminiclient.NewClient(context.Background(),
+		geminiclient.WithProjectID("test-project"),
+		geminiclient.WithREST(),
+		geminiclient.WithoutAuthentication(),
+		geminiclient.WithClientOptions(option.WithEndpoint(server.URL), option.WithUserAgent("my-agent/1.0")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gc.Query("Hello"); err != nil {
+		t.Fatal(err)
+	}
+	headers := server.Headers()
+	if agent := headers[len(headers)-1].Get("User-Agent"); !strings.Contains(agent, "my-agent/1.0") {
+		t.Errorf("Expected the user agent to be sent, but got %q", agent)
+	}
+}
@@ -1,40 +1,103 @@
 package geminiclient
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"image"
 	"io"
-	"mime"
-	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"cloud.google.com/go/vertexai/genai"
+	"golang.org/x/net/html/charset"
 )
 
 // AddImage reads an image from a file, prepares it for processing,
 // and adds it to the list of parts to be used by the model.
+// The image type is detected from the contents, and an error is returned if the file is not an image.
 // It supports verbose logging of operations if enabled.
 func (gc *GeminiClient) AddImage(filename string) error {
-	imageBytes, err := os.ReadFile(filename)
+	blob, err := gc.readFile(filename)
 	if err != nil {
 		return err
 	}
-	if gc.Verbose {
-		fmt.Printf("Read %d bytes from %s.\n", len(imageBytes), filename)
+	if mimeModality(blob.MIMEType) != ModalityImage {
+		return fmt.Errorf("%w: %s is %s and not an image", ErrFileTypeMismatch, filename, blob.MIMEType)
+	}
+	return gc.addBlob(blob)
+}
+
+// AddFile reads a file, like an image, a PDF document, audio, video or text, and adds it to the list of parts.
+// The MIME type is detected from the contents of the file, and an error is returned if it does not match
+// the file extension, or if none of the configured models supports that kind of file.
+func (gc *GeminiClient) AddFile(filename string) error {
+	blob, err := gc.readFile(filename)
+	if err != nil {
+		return err
+	}
+	return gc.addBlob(blob)
+}
+
+// AddReader is like AddFile, but reads the data from the given reader.
+// The MIME type is detected from the contents only.
+func (gc *GeminiClient) AddReader(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
 	}
-	ext := strings.TrimPrefix(filepath.Ext(filename), ".")
-	if ext == "jpg" {
-		ext = "jpeg"
+	mimeType := DetectMIMEType(data)
+	if mimeType == "" {
+		return ErrUnknownFileType
+	}
+	return gc.addBlob(genai.Blob{MIMEType: mimeType, Data: data})
+}
+
+// readFile reads the given file and detects the MIME type, which must match the file extension, if it is known.
+func (gc *GeminiClient) readFile(filename string) (genai.Blob, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return genai.Blob{}, err
 	}
 	if gc.Verbose {
-		fmt.Printf("Using ext type: %s\n", ext)
+		fmt.Printf("Read %d bytes from %s.\n", len(data), filename)
+	}
+	mimeType := DetectMIMEType(data)
+	if mimeType == "" {
+		return genai.Blob{}, fmt.Errorf("%w: %s", ErrUnknownFileType, filename)
+	}
+	if byExtension := MIMETypeByExtension(filename); byExtension != "" {
+		if !sameFileType(mimeType, byExtension) {
+			return genai.Blob{}, fmt.Errorf("%w: %s looks like %s and not %s", ErrFileTypeMismatch, filename, mimeType, byExtension)
+		}
+		if mimeType == "text/plain" && strings.HasPrefix(byExtension, "text/") {
+			mimeType = byExtension // like text/csv
+		}
 	}
-	img := genai.ImageData(ext, imageBytes)
 	if gc.Verbose {
-		fmt.Printf("Prepared an image blob: %T\n", img)
+		fmt.Printf("Detected MIME type: %s\n", mimeType)
+	}
+	return genai.Blob{MIMEType: mimeType, Data: data}, nil
+}
+
+// addBlob adds the given blob to the parts, if the configured models support it.
+// Images are prepared first, if an image policy is enabled.
+func (gc *GeminiClient) addBlob(blob genai.Blob) error {
+	if err := gc.checkModality(blob); err != nil {
+		return err
 	}
-	gc.Parts = append(gc.Parts, img)
+	if gc.Images.Enabled && mimeModality(blob.MIMEType) == ModalityImage {
+		prepared, err := prepareImage(blob.Data, gc.Images)
+		if err != nil {
+			return err
+		}
+		if gc.Verbose && prepared.to != (image.Point{}) {
+			fmt.Printf("Prepared the image: %dx%d %s of %d bytes became %dx%d %s of %d bytes.\n",
+				prepared.from.X, prepared.from.Y, blob.MIMEType, len(blob.Data), prepared.to.X, prepared.to.Y, prepared.mimeType, len(prepared.data))
+		}
+		blob = genai.Blob{MIMEType: prepared.mimeType, Data: prepared.data}
+	}
+	gc.Parts = append(gc.Parts, blob)
 	return nil
 }
 
@@ -51,39 +114,49 @@ func (gc *GeminiClient) MustAddImage(filename string) {
 // Example URI: "gs://generativeai-downloads/images/scones.jpg"
 func (gc *GeminiClient) AddURI(URI string) {
 	gc.Parts = append(gc.Parts, genai.FileData{
-		MIMEType: mime.TypeByExtension(filepath.Ext(URI)),
+		MIMEType: MIMETypeByExtension(URI),
 		FileURI:  URI,
 	})
 }
 
 // AddURL downloads the file from the given URL, identifies the MIME type,
-// and adds it as a genai.Part.
+// and adds it as a genai.Part. The download follows the download policy, see SetDownloadPolicy.
+// HTML pages are converted to Markdown and added as text, unless the policy keeps HTML, see HTMLToMarkdown.
 func (gc *GeminiClient) AddURL(URL string) error {
-	resp, err := http.Get(URL)
-	if err != nil {
-		return fmt.Errorf("failed to download the file from URL: %v", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status: %s", resp.Status)
+	return gc.AddURLContext(context.Background(), URL)
+}
+
+// AddURLContext is like AddURL, but the download is canceled when the given context is done.
+// Errors are of the type *DownloadError, and wrap errors like ErrBlockedAddress and ErrDownloadTooLarge.
+func (gc *GeminiClient) AddURLContext(ctx context.Context, URL string) error {
+	if gc.Downloads.Timeout <= 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = gc.withTimeout(ctx)
+		defer cancel()
 	}
-	data, err := io.ReadAll(resp.Body)
+	d, err := fetch(ctx, URL, gc.Downloads)
 	if err != nil {
-		return fmt.Errorf("failed to read the response body: %v", err)
-	}
-	mimeType := resp.Header.Get("Content-Type")
-	if mimeType == "" {
-		return fmt.Errorf("could see a Content-Type header for the given URL: %s", URL)
+		return err
 	}
 	if gc.Verbose {
-		fmt.Printf("Downloaded %d bytes with MIME type %s from %s.\n", len(data), mimeType, URL)
+		fmt.Printf("Downloaded %d bytes with MIME type %s from %s.\n", len(d.data), d.mimeType, URL)
 	}
-	fileData := genai.Blob{
-		MIMEType: mimeType,
-		Data:     data,
+	if (d.mimeType == "text/html" || d.mimeType == "application/xhtml+xml") && !gc.Downloads.KeepHTML {
+		r, err := charset.NewReader(bytes.NewReader(d.data), "text/html; charset="+d.charset)
+		if err != nil {
+			return &DownloadError{URL: URL, Err: err}
+		}
+		markdown, err := HTMLToMarkdown(r, URL)
+		if err != nil {
+			return &DownloadError{URL: URL, Err: err}
+		}
+		if gc.Verbose {
+			fmt.Printf("Converted %d bytes of HTML to %d bytes of Markdown.\n", len(d.data), len(markdown))
+		}
+		gc.Parts = append(gc.Parts, genai.Text(markdown))
+		return nil
 	}
-	gc.Parts = append(gc.Parts, fileData)
-	return nil
+	return gc.addBlob(genai.Blob{MIMEType: d.mimeType, Data: d.data})
 }
 
 // AddData adds arbitrary data with a specified MIME type to the parts of the MultiModal instance.
@@ -1,14 +1,25 @@
 package geminiclient_test
 
 import (
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"cloud.google.com/go/vertexai/genai"
 	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
 )
 
 func TestAddImage(t *testing.T) {
-	gc := geminiclient.MustNew()
+	gc, _ := geminitest.NewClient(t)
 
 	// Create a temporary image file for testing
 	tmpfile, err := os.CreateTemp("", "testimage.png")
@@ -17,8 +28,8 @@ func TestAddImage(t *testing.T) {
 	}
 	defer os.Remove(tmpfile.Name())
 
-	// Write some dummy data to the image file
-	if _, err := tmpfile.Write([]byte("PNG DATA")); err != nil {
+	// Write a small PNG image to the image file
+	if err := png.Encode(tmpfile, image.NewGray(image.Rect(0, 0, 2, 2))); err != nil {
 		t.Fatal("Failed to write to temporary image file:", err)
 	}
 	if err := tmpfile.Close(); err != nil {
@@ -35,10 +46,91 @@ func TestAddImage(t *testing.T) {
 	if len(gc.Parts) != 1 {
 		t.Fatalf("Expected 1 part to be added, but got %d", len(gc.Parts))
 	}
+	if blob, ok := gc.Parts[0].(genai.Blob); !ok || blob.MIMEType != "image/png" {
+		t.Errorf("Expected an image/png blob, but got %v", gc.Parts[0])
+	}
+}
+
+func TestAddImageNotAnImage(t *testing.T) {
+	gc, _ := geminitest.NewClient(t)
+
+	filename := filepath.Join(t.TempDir(), "testimage.png")
+	if err := os.WriteFile(filename, []byte("PNG DATA"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.AddImage(filename); !errors.Is(err, geminiclient.ErrFileTypeMismatch) {
+		t.Errorf("Expected ErrFileTypeMismatch for a .png file that contains text, but got %v", err)
+	}
+	if len(gc.Parts) != 0 {
+		t.Fatalf("Expected 0 parts to be added, but got %d", len(gc.Parts))
+	}
+}
+
+func TestDetectMIMEType(t *testing.T) {
+	for expected, data := range map[string]string{
+		"image/png":       "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR",
+		"image/jpeg":      "\xff\xd8\xff\xe0\x00\x10JFIF",
+		"image/gif":       "GIF89a\x01\x00\x01\x00",
+		"image/webp":      "RIFF\x24\x00\x00\x00WEBPVP8 ",
+		"image/heic":      "\x00\x00\x00\x18ftypheic\x00\x00\x00\x00",
+		"application/pdf": "%PDF-1.7\n",
+		"audio/mpeg":      "ID3\x04\x00\x00\x00\x00\x00\x00",
+		"audio/wav":       "RIFF\x24\x00\x00\x00WAVEfmt ",
+		"audio/flac":      "fLaC\x00\x00\x00\x22",
+		"video/mp4":       "\x00\x00\x00\x20ftypisom\x00\x00\x02\x00",
+		"video/quicktime": "\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00",
+		"video/webm":      "\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm",
+		"text/plain":      "Hello, wörld!\n",
+		"":                "\x00\x01\x02\x03",
+	} {
+		if mimeType := geminiclient.DetectMIMEType([]byte(data)); mimeType != expected {
+			t.Errorf("Expected %q but got %q for %q", expected, mimeType, data)
+		}
+	}
+	if mimeType := geminiclient.MIMETypeByExtension("gs://bucket/song.MP3"); mimeType != "audio/mpeg" {
+		t.Errorf("Expected audio/mpeg but got %q", mimeType)
+	}
+}
+
+func TestAddFile(t *testing.T) {
+	gc, _ := geminitest.NewClient(t, geminiclient.WithModel("gemini-1.0-pro"), geminiclient.WithMultiModalModel("gemini-1.0-pro-vision"))
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	if err := gc.AddFile(write("notes.csv", "a,b\n1,2\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.AddFile(write("photo", "\xff\xd8\xff\xe0\x00\x10JFIF")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.AddFile(write("report.txt", "%PDF-1.7\n")); !errors.Is(err, geminiclient.ErrFileTypeMismatch) {
+		t.Errorf("Expected ErrFileTypeMismatch for a .txt file that contains a PDF, but got %v", err)
+	}
+	if err := gc.AddFile(write("song.mp3", "ID3\x04\x00\x00\x00\x00\x00\x00")); !errors.Is(err, geminiclient.ErrUnsupportedModality) {
+		t.Errorf("Expected ErrUnsupportedModality for audio, but got %v", err)
+	}
+	if err := gc.AddReader(strings.NewReader("\x00\x01\x02\x03")); !errors.Is(err, geminiclient.ErrUnknownFileType) {
+		t.Errorf("Expected ErrUnknownFileType, but got %v", err)
+	}
+
+	if len(gc.Parts) != 2 {
+		t.Fatalf("Expected 2 parts to be added, but got %d", len(gc.Parts))
+	}
+	for i, expected := range []string{"text/csv", "image/jpeg"} {
+		if blob := gc.Parts[i].(genai.Blob); blob.MIMEType != expected {
+			t.Errorf("Expected %s but got %s", expected, blob.MIMEType)
+		}
+	}
 }
 
 func TestMustAddImageInvalidPath(t *testing.T) {
-	gc := geminiclient.MustNew()
+	gc, _ := geminitest.NewClient(t)
 
 	// Attempt to add an image from an invalid path
 	defer func() {
@@ -50,7 +142,7 @@ func TestMustAddImageInvalidPath(t *testing.T) {
 }
 
 func TestAddURI(t *testing.T) {
-	gc := geminiclient.MustNew()
+	gc, _ := geminitest.NewClient(t)
 
 	gc.AddURI("gs://generativeai-downloads/images/scones.jpg")
 
@@ -61,7 +153,7 @@ func TestAddURI(t *testing.T) {
 }
 
 func TestAddData(t *testing.T) {
-	gc := geminiclient.MustNew()
+	gc, _ := geminitest.NewClient(t)
 
 	// Test adding data
 	data := []byte("Some data")
@@ -74,7 +166,7 @@ func TestAddData(t *testing.T) {
 }
 
 func TestAddText(t *testing.T) {
-	gc := geminiclient.MustNew()
+	gc, _ := geminitest.NewClient(t)
 
 	// Test adding text
 	gc.AddText("This is a prompt")
@@ -86,7 +178,7 @@ func TestAddText(t *testing.T) {
 }
 
 func TestClearParts(t *testing.T) {
-	gc := geminiclient.MustNew()
+	gc, _ := geminitest.NewClient(t)
 
 	// Add some parts
 	gc.AddText("Text part")
@@ -100,3 +192,24 @@ func TestClearParts(t *testing.T) {
 		t.Fatalf("Expected 0 parts after clearing, but got %d", len(gc.Parts))
 	}
 }
+
+func TestAddURLContextCanceled(t *testing.T) {
+	gc := &geminiclient.GeminiClient{}
+
+	// A server that does not respond until the client gives up
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := gc.AddURLContext(ctx, server.URL)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the download to be canceled, but got: %v", err)
+	}
+	if len(gc.Parts) != 0 {
+		t.Fatalf("Expected 0 parts to be added, but got %d", len(gc.Parts))
+	}
+}
@@ -0,0 +1,224 @@
+package geminiclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/env/v2"
+)
+
+// defaultProfileName is the profile that is used if $GEMINI_PROFILE is not set
+const defaultProfileName = "default"
+
+// Profile is a named set of settings in the profiles file, see ProfilesFile. All fields are optional.
+// Durations are strings like "30s" or "2m", and the safety settings use the names of the REST API,
+// like {"category": "HARM_CATEGORY_HARASSMENT", "threshold": "BLOCK_ONLY_HIGH"}.
+type Profile struct {
+	ProjectID           string                   `json:"projectID,omitempty"`
+	Location            string                   `json:"location,omitempty"`
+	Locations           []string                 `json:"locations,omitempty"` // more locations to fail over to
+	ModelName           string                   `json:"model,omitempty"`
+	MultiModalModelName string                   `json:"multiModalModel,omitempty"`
+	Temperature         *float32                 `json:"temperature,omitempty"`
+	Timeout             string                   `json:"timeout,omitempty"`
+	GenerationConfig    *ProfileGenerationConfig `json:"generationConfig,omitempty"`
+	SafetySettings      []ProfileSafetySetting   `json:"safetySettings,omitempty"`
+	SystemInstruction   string                   `json:"systemInstruction,omitempty"`
+	Retry               *ProfileRetry            `json:"retry,omitempty"`
+	RateLimit           *RateLimit               `json:"rateLimit,omitempty"` // the budget of requests and tokens per minute
+}
+
+// ProfileGenerationConfig is the generation config of a Profile.
+type ProfileGenerationConfig struct {
+	TopP             *float32 `json:"topP,omitempty"`
+	TopK             *int32   `json:"topK,omitempty"`
+	MaxOutputTokens  *int32   `json:"maxOutputTokens,omitempty"`
+	StopSequences    []string `json:"stopSequences,omitempty"`
+	ResponseMIMEType string   `json:"responseMIMEType,omitempty"`
+}
+
+// ProfileSafetySetting is a safety setting of a Profile.
+type ProfileSafetySetting struct {
+	Category  string `json:"category"`
+	Threshold string `json:"threshold"`
+}
+
+// ProfileRetry is the retry policy of a Profile. Settings that are not given are kept from DefaultRetryPolicy.
+type ProfileRetry struct {
+	MaxAttempts int    `json:"maxAttempts,omitempty"`
+	BaseDelay   string `json:"baseDelay,omitempty"`
+	MaxDelay    string `json:"maxDelay,omitempty"`
+}
+
+// ProfilesFile returns the path to the profiles file, which is $XDG_CONFIG_HOME/geminiclient/profiles.json on Linux.
+func ProfilesFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "geminiclient", "profiles.json"), nil
+}
+
+// LoadProfiles reads the profiles from the given JSON file, which is an object with the profile names as keys:
+//
+//	{"default": {"projectID": "my-project", "location": "europe-west4"}, "batch": {"model": "gemini-1.5-pro"}}
+func LoadProfiles(filename string) (map[string]*Profile, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var profiles map[string]*Profile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return profiles, nil
+}
+
+// WithProfile applies the profile with the given name from the profiles file, see ProfilesFile, instead of the
+// profile that is named by $GEMINI_PROFILE, or else the "default" profile. Profiles are applied before all other
+// options, no matter where this option is given, so the other options take precedence over the profile, and so do
+// environment variables like $MODEL_NAME. Several profiles can be given, and are then applied in order.
+func WithProfile(name string) Option {
+	return WithProfileFile("", name)
+}
+
+// WithProfileFile is like WithProfile, but reads the profile from the given file.
+func WithProfileFile(filename, name string) Option {
+	return func(gc *GeminiClient) error {
+		if !gc.profilesApplied {
+			gc.profiles = append(gc.profiles, profileSelection{filename: filename, name: name})
+		}
+		return nil
+	}
+}
+
+// profileSelection is a profile that is selected with WithProfile or WithProfileFile
+type profileSelection struct {
+	filename string // the profiles file, or "" for the file from ProfilesFile
+	name     string
+}
+
+// apply loads the selected profile and configures the client with it.
+func (s profileSelection) apply(gc *GeminiClient) error {
+	filename := s.filename
+	if filename == "" {
+		var err error
+		if filename, err = ProfilesFile(); err != nil {
+			return fmt.Errorf("could not find the profiles file: %v", err)
+		}
+	}
+	profiles, err := LoadProfiles(filename)
+	if err != nil {
+		return fmt.Errorf("could not load the profile %s: %v", s.name, err)
+	}
+	profile, ok := profiles[s.name]
+	if !ok || profile == nil {
+		return fmt.Errorf("there is no profile named %s in %s", s.name, filename)
+	}
+	return profile.apply(gc)
+}
+
+// applyDefaultProfile applies the profile named by $GEMINI_PROFILE, or the "default" profile if there is one.
+func (gc *GeminiClient) applyDefaultProfile() error {
+	if name := env.Str("GEMINI_PROFILE"); name != "" {
+		return profileSelection{name: name}.apply(gc)
+	}
+	filename, err := ProfilesFile()
+	if err != nil {
+		return nil
+	}
+	profiles, err := LoadProfiles(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not load the profiles: %v", err)
+	}
+	if profile, ok := profiles[defaultProfileName]; ok && profile != nil {
+		return profile.apply(gc)
+	}
+	return nil
+}
+
+// apply configures the client with the settings of the profile, except for the ones that are set by environment variables.
+func (p *Profile) apply(gc *GeminiClient) error {
+	var errs []error
+	if p.ProjectID != "" && !env.Has("GCP_PROJECT_ID") && !env.Has("PROJECT_ID") {
+		gc.ProjectID = p.ProjectID
+	}
+	if p.Location != "" && !env.Has("GCP_LOCATION") && !env.Has("PROJECT_LOCATION") {
+		gc.ProjectLocation = p.Location
+	}
+	if len(p.Locations) > 0 {
+		gc.SetLocations(p.Locations...)
+	}
+	if p.ModelName != "" && !env.Has("MODEL_NAME") {
+		gc.ModelName = p.ModelName
+	}
+	if p.MultiModalModelName != "" && !env.Has("MULTI_MODAL_MODEL_NAME") {
+		gc.MultiModalModelName = p.MultiModalModelName
+	}
+	if p.Temperature != nil {
+		gc.Temperature = *p.Temperature
+	}
+	if p.Timeout != "" {
+		if timeout, err := time.ParseDuration(p.Timeout); err != nil {
+			errs = append(errs, fmt.Errorf("invalid timeout in profile: %v", err))
+		} else {
+			gc.Timeout = timeout
+		}
+	}
+	if g := p.GenerationConfig; g != nil {
+		gc.GenerationConfig = genai.GenerationConfig{
+			TopP:             g.TopP,
+			TopK:             g.TopK,
+			MaxOutputTokens:  g.MaxOutputTokens,
+			StopSequences:    g.StopSequences,
+			ResponseMIMEType: g.ResponseMIMEType,
+		}
+	}
+	if len(p.SafetySettings) > 0 {
+		var settings []*genai.SafetySetting
+		for _, s := range p.SafetySettings {
+			category, threshold := slices.Index(restHarmCategories, s.Category), slices.Index(restHarmThresholds, s.Threshold)
+			if category <= 0 || threshold <= 0 {
+				errs = append(errs, fmt.Errorf("invalid safety setting in profile: %s %s", s.Category, s.Threshold))
+				continue
+			}
+			settings = append(settings, &genai.SafetySetting{Category: genai.HarmCategory(category), Threshold: genai.HarmBlockThreshold(threshold)})
+		}
+		gc.SafetySettings = settings
+	}
+	if p.SystemInstruction != "" {
+		gc.SystemInstruction = p.SystemInstruction
+	}
+	if r := p.Retry; r != nil {
+		if r.MaxAttempts > 0 {
+			gc.Retry.MaxAttempts = r.MaxAttempts
+		}
+		for _, d := range []struct {
+			name  string
+			value string
+			delay *time.Duration
+		}{{"baseDelay", r.BaseDelay, &gc.Retry.BaseDelay}, {"maxDelay", r.MaxDelay, &gc.Retry.MaxDelay}} {
+			if d.value == "" {
+				continue
+			}
+			delay, err := time.ParseDuration(d.value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s in profile: %v", d.name, err))
+				continue
+			}
+			*d.delay = delay
+		}
+	}
+	if p.RateLimit != nil {
+		gc.SetRateLimiter(NewRateLimiter(*p.RateLimit))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,165 @@
+package geminiclient_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/env/v2"
+	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
+)
+
+const testProfiles = `{
+	"default": {
+		"projectID": "default-project",
+		"location": "europe-west4",
+		"model": "gemini-1.5-pro",
+		"temperature": 0.5,
+		"timeout": "30s",
+		"generationConfig": {"maxOutputTokens": 100},
+		"safetySettings": [{"category": "HARM_CATEGORY_HARASSMENT", "threshold": "BLOCK_ONLY_HIGH"}],
+		"systemInstruction": "Answer briefly.",
+		"retry": {"maxAttempts": 2, "baseDelay": "10ms"},
+		"rateLimit": {"requestsPerMinute": 60, "tokensPerMinute": 100000}
+	},
+	"batch": {"model": "gemini-1.5-flash", "location": "us-east4"},
+	"invalid": {"timeout": "soon", "safetySettings": [{"category": "HARM_CATEGORY_NICE", "threshold": "BLOCK_NONE"}]}
+}`
+
+// setProfiles writes the test profiles to a new config directory, and sets the given environment variables.
+func setProfiles(t *testing.T, vars ...string) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "geminiclient"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "geminiclient", "profiles.json"), []byte(testProfiles), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(env.Load)
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	for _, name := range []string{"GEMINI_PROFILE", "MODEL_NAME", "GCP_PROJECT_ID", "PROJECT_ID", "GCP_LOCATION", "PROJECT_LOCATION"} {
+		t.Setenv(name, "")
+	}
+	for i := 0; i+1 < len(vars); i += 2 {
+		t.Setenv(vars[i], vars[i+1])
+	}
+	env.Load()
+}
+
+func TestDefaultProfile(t *testing.T) {
+	setProfiles(t)
+	fake := geminitest.New()
+	gc, err := geminiclient.NewClient(context.Background(), geminiclient.WithBackend(fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.ProjectID != "default-project" || gc.ProjectLocation != "europe-west4" || gc.ModelName != "gemini-1.5-pro" {
+		t.Errorf("Expected the settings of the default profile, but got %q, %q and %q", gc.ProjectID, gc.ProjectLocation, gc.ModelName)
+	}
+	if gc.Temperature != 0.5 || gc.Timeout != 30*time.Second || gc.Retry.MaxAttempts != 2 || gc.Retry.BaseDelay != 10*time.Millisecond || gc.RateLimiter == nil {
+		t.Errorf("Expected the settings of the default profile, but got %v, %v, %v, %v and %v", gc.Temperature, gc.Timeout, gc.Retry.MaxAttempts, gc.Retry.BaseDelay, gc.RateLimiter)
+	}
+
+	fake.QueueText("Hi")
+	if _, err := gc.Query("Hello"); err != nil {
+		t.Fatal(err)
+	}
+	cfg := fake.LastRequest().Config
+	if cfg.GenerationConfig.MaxOutputTokens == nil || *cfg.GenerationConfig.MaxOutputTokens != 100 || *cfg.GenerationConfig.Temperature != 0.5 {
+		t.Errorf("Expected the generation config of the profile, but got %v", cfg.GenerationConfig)
+	}
+	if len(cfg.SafetySettings) != 1 || cfg.SafetySettings[0].Category != genai.HarmCategoryHarassment || cfg.SafetySettings[0].Threshold != genai.HarmBlockOnlyHigh {
+		t.Errorf("Expected the safety settings of the profile, but got %v", cfg.SafetySettings)
+	}
+	if cfg.SystemInstruction == nil || cfg.SystemInstruction.Parts[0] != genai.Text("Answer briefly.") {
+		t.Errorf("Expected the system instruction of the profile, but got %v", cfg.SystemInstruction)
+	}
+}
+
+func TestProfilePrecedence(t *testing.T) {
+	setProfiles(t, "GEMINI_PROFILE", "batch", "GCP_LOCATION", "asia-northeast1")
+	gc, err := geminiclient.NewClient(context.Background(), geminiclient.WithBackend(geminitest.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.ModelName != "gemini-1.5-flash" || gc.ProjectLocation != "asia-northeast1" || gc.ProjectID != "" {
+		t.Errorf("Expected the model of the batch profile and the location of the environment, but got %q, %q and %q", gc.ModelName, gc.ProjectLocation, gc.ProjectID)
+	}
+
+	gc, err = geminiclient.NewClient(context.Background(), geminiclient.WithBackend(geminitest.New()), geminiclient.WithLocation("us-west1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.ProjectLocation != "us-west1" {
+		t.Errorf("Expected the option to take precedence, but got %q", gc.ProjectLocation)
+	}
+
+	gc, err = geminiclient.NewClient(context.Background(), geminiclient.WithBackend(geminitest.New()), geminiclient.WithProfile("default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.ModelName != "gemini-1.5-pro" || gc.ProjectLocation != "asia-northeast1" {
+		t.Errorf("Expected the model of the selected profile and the location of the environment, but got %q and %q", gc.ModelName, gc.ProjectLocation)
+	}
+}
+
+func TestSelectedProfile(t *testing.T) {
+	setProfiles(t)
+	// The selected profile replaces the default profile, instead of being applied on top of it
+	gc, err := geminiclient.NewClient(context.Background(), geminiclient.WithModel("gemini-1.0-pro"), geminiclient.WithProfile("batch"), geminiclient.WithBackend(geminitest.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.ModelName != "gemini-1.0-pro" || gc.ProjectLocation != "us-east4" || gc.ProjectID != "" {
+		t.Errorf("Expected the model of the option and the location of the batch profile, but got %q, %q and %q", gc.ModelName, gc.ProjectLocation, gc.ProjectID)
+	}
+	defaults := geminiclient.DefaultRetryPolicy()
+	if gc.Temperature != 0 || gc.Timeout != 3*time.Minute || gc.SystemInstruction != "" || gc.SafetySettings != nil || gc.GenerationConfig.MaxOutputTokens != nil {
+		t.Errorf("Expected no settings from the default profile, but got %v, %v, %q, %v and %v", gc.Temperature, gc.Timeout, gc.SystemInstruction, gc.SafetySettings, gc.GenerationConfig.MaxOutputTokens)
+	}
+	if gc.Retry.MaxAttempts != defaults.MaxAttempts || gc.Retry.BaseDelay != defaults.BaseDelay || gc.RateLimiter != nil {
+		t.Errorf("Expected the default retry policy and no rate limiter, but got %v, %v and %v", gc.Retry.MaxAttempts, gc.Retry.BaseDelay, gc.RateLimiter)
+	}
+}
+
+func TestNewCustomProfile(t *testing.T) {
+	setProfiles(t)
+	// The given arguments take precedence over the profile, also when they are equal to the defaults
+	gc, err := geminiclient.NewCustom("gemini-1.5-flash", "gemini-1.0-pro-vision", "us-east1", "", 0, time.Minute, geminiclient.WithBackend(geminitest.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.ModelName != "gemini-1.5-flash" || gc.Temperature != 0 || gc.ProjectLocation != "us-east1" || gc.Timeout != time.Minute {
+		t.Errorf("Expected the given model, temperature, location and timeout, but got %q, %v, %q and %v", gc.ModelName, gc.Temperature, gc.ProjectLocation, gc.Timeout)
+	}
+	if gc.ProjectID != "default-project" {
+		t.Errorf("Expected the project ID of the profile for an empty project ID, but got %q", gc.ProjectID)
+	}
+
+	// Settings that the constructor does not take are taken from the profile
+	gc, err = geminiclient.New("gemini-1.5-flash", 0, geminiclient.WithBackend(geminitest.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.ModelName != "gemini-1.5-flash" || gc.Temperature != 0 || gc.ProjectLocation != "europe-west4" || gc.Timeout != 30*time.Second {
+		t.Errorf("Expected the given model and temperature, and the location and timeout of the profile, but got %q, %v, %q and %v", gc.ModelName, gc.Temperature, gc.ProjectLocation, gc.Timeout)
+	}
+}
+
+func TestInvalidProfile(t *testing.T) {
+	setProfiles(t, "GEMINI_PROFILE", "invalid")
+	_, err := geminiclient.NewClient(context.Background(), geminiclient.WithBackend(geminitest.New()))
+	if err == nil || !strings.Contains(err.Error(), "timeout") || !strings.Contains(err.Error(), "HARM_CATEGORY_NICE") {
+		t.Errorf("Expected errors for the timeout and the safety setting, but got %v", err)
+	}
+
+	setProfiles(t, "GEMINI_PROFILE", "missing")
+	if _, err := geminiclient.NewClient(context.Background(), geminiclient.WithBackend(geminitest.New())); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("Expected an error for a missing profile, but got %v", err)
+	}
+}
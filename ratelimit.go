@@ -0,0 +1,259 @@
+package geminiclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// RateLimit is the number of requests and tokens that may be used per minute.
+// A value of 0 means that there is no limit.
+type RateLimit struct {
+	RequestsPerMinute int
+	TokensPerMinute   int
+}
+
+// RateLimiter enforces requests per minute (RPM) and tokens per minute (TPM) limits per model.
+// A single RateLimiter can be shared between several clients that use the same project quota.
+// Callers that have to wait are served in the order they arrived.
+type RateLimiter struct {
+	mu           sync.Mutex
+	defaultLimit RateLimit
+	limits       map[string]RateLimit
+	buckets      map[string]*rateBucket
+}
+
+// Reservation is the capacity that was reserved for a single request.
+type Reservation struct {
+	rl    *RateLimiter
+	model string
+	entry *rateEntry
+}
+
+type rateEntry struct {
+	at     time.Time
+	tokens int
+}
+
+type rateWaiter struct {
+	ready chan struct{}
+}
+
+type rateBucket struct {
+	entries []*rateEntry  // requests that were sent within the last minute, oldest first
+	queue   []*rateWaiter // callers that are waiting for capacity, in arrival order
+}
+
+const (
+	rateWindow             = time.Minute
+	estimatedTokensPerRune = 0.25 // roughly 4 characters per token
+	estimatedTokensPerBlob = 258  // the number of tokens that is used for an image
+)
+
+// NewRateLimiter creates a new RateLimiter, where defaultLimit is used for all models
+// that have not been given a limit with SetLimit.
+func NewRateLimiter(defaultLimit RateLimit) *RateLimiter {
+	return &RateLimiter{
+		defaultLimit: defaultLimit,
+		limits:       make(map[string]RateLimit),
+		buckets:      make(map[string]*rateBucket),
+	}
+}
+
+// SetLimit sets the rate limit for the given model name.
+func (rl *RateLimiter) SetLimit(modelName string, limit RateLimit) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.limits[modelName] = limit
+	if b, ok := rl.buckets[modelName]; ok {
+		b.wakeHead()
+	}
+}
+
+// Wait blocks until there is capacity for one more request with the given estimated number of tokens
+// for the given model, or until the context is done.
+func (rl *RateLimiter) Wait(ctx context.Context, modelName string, estimatedTokens int) (*Reservation, error) {
+	rl.mu.Lock()
+	b, ok := rl.buckets[modelName]
+	if !ok {
+		b = &rateBucket{}
+		rl.buckets[modelName] = b
+	}
+	w := &rateWaiter{ready: make(chan struct{}, 1)}
+	b.queue = append(b.queue, w)
+	for {
+		limit := rl.limit(modelName)
+		tokens := estimatedTokens
+		if limit.TokensPerMinute > 0 && tokens > limit.TokensPerMinute {
+			// A single request can not use more than the entire budget, or it would wait forever
+			tokens = limit.TokensPerMinute
+		}
+		now := time.Now()
+		b.prune(now)
+		var wait time.Duration
+		if b.queue[0] == w {
+			wait = b.waitTime(now, limit, tokens)
+			if wait <= 0 {
+				entry := &rateEntry{at: now, tokens: tokens}
+				b.entries = append(b.entries, entry)
+				b.queue = b.queue[1:]
+				b.wakeHead()
+				rl.mu.Unlock()
+				return &Reservation{rl: rl, model: modelName, entry: entry}, nil
+			}
+		}
+		rl.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			rl.mu.Lock()
+			b.remove(w)
+			b.wakeHead()
+			rl.mu.Unlock()
+			return nil, ctx.Err()
+		case <-w.ready:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		rl.mu.Lock()
+	}
+}
+
+// Reconcile replaces the estimated number of tokens for this reservation with the actual number of tokens,
+// for instance from the UsageMetadata of the response. It is safe to call on a nil Reservation.
+func (r *Reservation) Reconcile(actualTokens int) {
+	if r == nil {
+		return
+	}
+	r.rl.mu.Lock()
+	defer r.rl.mu.Unlock()
+	r.entry.tokens = actualTokens
+	if b, ok := r.rl.buckets[r.model]; ok {
+		b.wakeHead()
+	}
+}
+
+// limit returns the rate limit for the given model. rl.mu must be held.
+func (rl *RateLimiter) limit(modelName string) RateLimit {
+	if limit, ok := rl.limits[modelName]; ok {
+		return limit
+	}
+	return rl.defaultLimit
+}
+
+// prune removes the entries that are older than the rate window.
+func (b *rateBucket) prune(now time.Time) {
+	i := 0
+	for i < len(b.entries) && now.Sub(b.entries[i].at) >= rateWindow {
+		i++
+	}
+	b.entries = b.entries[i:]
+}
+
+// waitTime returns how long to wait until a request with the given number of tokens fits within the limit.
+func (b *rateBucket) waitTime(now time.Time, limit RateLimit, tokens int) time.Duration {
+	var wait time.Duration
+	if limit.RequestsPerMinute > 0 && len(b.entries) >= limit.RequestsPerMinute {
+		oldest := b.entries[len(b.entries)-limit.RequestsPerMinute]
+		wait = oldest.at.Add(rateWindow).Sub(now)
+	}
+	if limit.TokensPerMinute > 0 {
+		used := 0
+		for _, entry := range b.entries {
+			used += entry.tokens
+		}
+		for _, entry := range b.entries {
+			if used+tokens <= limit.TokensPerMinute {
+				break
+			}
+			used -= entry.tokens
+			wait = max(wait, entry.at.Add(rateWindow).Sub(now))
+		}
+	}
+	return wait
+}
+
+// wakeHead notifies the first waiter in the queue that it should check for capacity again.
+func (b *rateBucket) wakeHead() {
+	if len(b.queue) == 0 {
+		return
+	}
+	select {
+	case b.queue[0].ready <- struct{}{}:
+	default:
+	}
+}
+
+// remove removes the given waiter from the queue.
+func (b *rateBucket) remove(w *rateWaiter) {
+	for i, queued := range b.queue {
+		if queued == w {
+			b.queue = append(b.queue[:i], b.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// EstimateTokens returns a rough estimate of the number of tokens in the given parts,
+// to be used before the actual number of tokens is known.
+func EstimateTokens(parts ...genai.Part) int {
+	var tokens float64
+	for _, part := range parts {
+		switch p := part.(type) {
+		case genai.Text:
+			tokens += float64(len([]rune(string(p)))) * estimatedTokensPerRune
+		case genai.FunctionCall, genai.FunctionResponse:
+			tokens += float64(len([]rune(fmt.Sprintf("%v", p)))) * estimatedTokensPerRune
+		default:
+			tokens += estimatedTokensPerBlob
+		}
+	}
+	return int(tokens) + 1
+}
+
+// SetRateLimiter configures a rate limiter that all requests to the model must wait for.
+// The same RateLimiter may be given to several clients.
+func (gc *GeminiClient) SetRateLimiter(rl *RateLimiter) {
+	gc.RateLimiter = rl
+}
+
+// reserve waits for capacity for the given parts, if a rate limiter has been configured.
+func (gc *GeminiClient) reserve(ctx context.Context, modelName string, parts ...genai.Part) (*Reservation, error) {
+	if gc.RateLimiter == nil {
+		return nil, nil
+	}
+	return gc.RateLimiter.Wait(ctx, modelName, EstimateTokens(parts...))
+}
+
+// reconcile updates the reservation with the actual token usage from the given response.
+// If the request failed, no tokens are counted. If there is no usage metadata, the estimate is kept.
+func reconcile(r *Reservation, res *genai.GenerateContentResponse, err error) {
+	if err != nil {
+		r.Reconcile(0)
+	} else if res != nil && res.UsageMetadata != nil {
+		r.Reconcile(int(res.UsageMetadata.TotalTokenCount))
+	}
+}
+
+// historyParts returns all parts in the given chat history, followed by the given parts.
+func historyParts(history []*genai.Content, parts ...genai.Part) []genai.Part {
+	var all []genai.Part
+	for _, content := range history {
+		all = append(all, content.Parts...)
+	}
+	return append(all, parts...)
+}
@@ -0,0 +1,65 @@
+package geminiclient_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xyproto/geminiclient"
+)
+
+func TestRateLimiterRequestsPerMinute(t *testing.T) {
+	rl := geminiclient.NewRateLimiter(geminiclient.RateLimit{RequestsPerMinute: 2})
+
+	for i := 0; i < 2; i++ {
+		if _, err := rl.Wait(context.Background(), "gemini-1.5-flash", 10); err != nil {
+			t.Fatalf("Expected request %d to be allowed, but got: %v", i+1, err)
+		}
+	}
+
+	// The third request within the same minute should block until the context expires
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := rl.Wait(ctx, "gemini-1.5-flash", 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the third request to time out, but got: %v", err)
+	}
+
+	// Other models have their own budget
+	if _, err := rl.Wait(context.Background(), "gemini-1.5-pro", 10); err != nil {
+		t.Fatalf("Expected a request for another model to be allowed, but got: %v", err)
+	}
+}
+
+func TestRateLimiterReconcile(t *testing.T) {
+	rl := geminiclient.NewRateLimiter(geminiclient.RateLimit{TokensPerMinute: 1000})
+
+	r, err := rl.Wait(context.Background(), "gemini-1.5-flash", 900)
+	if err != nil {
+		t.Fatalf("Expected the first request to be allowed, but got: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := rl.Wait(context.Background(), "gemini-1.5-flash", 500)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Expected the second request to wait for token capacity, but it returned: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The actual usage turned out to be lower than estimated, which frees up capacity
+	r.Reconcile(200)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected the second request to be allowed after reconciling, but got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the second request to be allowed after reconciling, but it is still waiting")
+	}
+}
@@ -0,0 +1,267 @@
+package geminiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"time"
+)
+
+// RegionPolicy configures failover between several Google Cloud locations, and optional hedged requests.
+type RegionPolicy struct {
+	Locations       []string          // more locations to fail over to, after gc.ProjectLocation
+	Conditions      FallbackCondition // the errors that make a request fail over to the next location
+	UnhealthyAfter  int               // how many failures in a row before a location is considered unhealthy
+	Cooldown        time.Duration     // how long an unhealthy location is tried last
+	Hedge           bool              // send a duplicate request to the next location if the first one is slow
+	HedgePercentile float64           // the latency percentile of the first location to wait for before hedging, like 0.95
+	HedgeMinDelay   time.Duration     // the minimum time to wait before hedging
+}
+
+// RegionStatus is the health of a single location, as seen by this client.
+type RegionStatus struct {
+	Location            string
+	Healthy             bool
+	ConsecutiveFailures int
+	LastFailure         time.Time
+	Latency             time.Duration // the median latency of the recent successful requests
+}
+
+// regionHealth tracks the recent failures and latencies for a location.
+type regionHealth struct {
+	consecutiveFailures int
+	lastFailure         time.Time
+	latencies           []time.Duration // the most recent successful latencies, used as a ring buffer
+	next                int
+}
+
+// regionCall is the result of a request that was sent to a location.
+type regionCall struct {
+	res      *Response
+	location string
+	err      error
+}
+
+const (
+	latencySamples        = 50 // how many latencies to remember per location
+	minHedgeSamples       = 5  // how many latencies that are needed before the percentile is used
+	defaultHedgeDelay     = 2 * time.Second
+	defaultCooldown       = time.Minute
+	defaultUnhealthyAfter = 3
+)
+
+// DefaultRegionPolicy returns the region policy that is used by new clients.
+// No extra locations are configured, so there is no failover until SetLocations is called.
+func DefaultRegionPolicy() RegionPolicy {
+	return RegionPolicy{
+		Conditions:      FallbackOnQuota | FallbackOnUnavailable | FallbackOnTimeout,
+		UnhealthyAfter:  defaultUnhealthyAfter,
+		Cooldown:        defaultCooldown,
+		HedgePercentile: 0.95,
+		HedgeMinDelay:   defaultHedgeDelay,
+	}
+}
+
+// SetLocations configures more Google Cloud locations to fail over to, in order, after gc.ProjectLocation.
+// One genai client is created per location, when it is first needed.
+func (gc *GeminiClient) SetLocations(locations ...string) {
+	gc.Regions.Locations = locations
+}
+
+// SetHedging enables or disables hedged requests. When enabled, a duplicate request is sent to the next
+// location if the first one has not responded within the configured latency percentile, and the slowest
+// request is canceled. Requests with function calls and streaming requests are never hedged.
+func (gc *GeminiClient) SetHedging(enabled bool) {
+	gc.Regions.Hedge = enabled
+}
+
+// RegionHealth returns the health of all configured locations, in the order they will be tried.
+func (gc *GeminiClient) RegionHealth() []RegionStatus {
+	locations := gc.regionOrder()
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	statuses := make([]RegionStatus, 0, len(locations))
+	for _, location := range locations {
+		status := RegionStatus{Location: location, Healthy: gc.healthyLocked(location)}
+		if h, ok := gc.health[location]; ok {
+			status.ConsecutiveFailures = h.consecutiveFailures
+			status.LastFailure = h.lastFailure
+			status.Latency = h.percentile(0.5)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// regionOrder returns gc.ProjectLocation and the other configured locations, with the healthy ones first.
+func (gc *GeminiClient) regionOrder() []string {
+	locations := []string{gc.ProjectLocation}
+	for _, location := range gc.Regions.Locations {
+		if !slices.Contains(locations, location) {
+			locations = append(locations, location)
+		}
+	}
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	sort.SliceStable(locations, func(i, j int) bool {
+		return gc.healthyLocked(locations[i]) && !gc.healthyLocked(locations[j])
+	})
+	return locations
+}
+
+// healthyLocked returns false if the given location has failed too many times in a row recently. gc.mu must be held.
+func (gc *GeminiClient) healthyLocked(location string) bool {
+	h, ok := gc.health[location]
+	if !ok || gc.Regions.UnhealthyAfter <= 0 {
+		return true
+	}
+	return h.consecutiveFailures < gc.Regions.UnhealthyAfter || time.Since(h.lastFailure) >= gc.Regions.Cooldown
+}
+
+// record updates the health of a location after a request has completed.
+func (gc *GeminiClient) record(location string, latency time.Duration, err error) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if gc.health == nil {
+		gc.health = make(map[string]*regionHealth)
+	}
+	h, ok := gc.health[location]
+	if !ok {
+		h = &regionHealth{}
+		gc.health[location] = h
+	}
+	if err != nil {
+		h.consecutiveFailures++
+		h.lastFailure = time.Now()
+		return
+	}
+	h.consecutiveFailures = 0
+	if len(h.latencies) < latencySamples {
+		h.latencies = append(h.latencies, latency)
+	} else {
+		h.latencies[h.next] = latency
+		h.next = (h.next + 1) % latencySamples
+	}
+}
+
+// percentile returns the given percentile (from 0.0 to 1.0) of the recent latencies, or 0 if there are none.
+func (h *regionHealth) percentile(p float64) time.Duration {
+	if len(h.latencies) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(h.latencies)
+	slices.Sort(sorted)
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+// hedgeDelay returns how long to wait for the given location before sending a duplicate request elsewhere.
+func (gc *GeminiClient) hedgeDelay(location string) time.Duration {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	delay := gc.Regions.HedgeMinDelay
+	if h, ok := gc.health[location]; ok && len(h.latencies) >= minHedgeSamples {
+		delay = max(delay, h.percentile(gc.Regions.HedgePercentile))
+	}
+	return delay
+}
+
+// callRegion sends a request to the given location, unless the circuit breaker is open, and records how it went.
+// Only errors that match the failover conditions count as failures for the location,
+// and requests that were canceled by the caller are not counted at all.
+func (gc *GeminiClient) callRegion(ctx context.Context, location, modelName string, fn func(context.Context, Backend, string) (*Response, error)) regionCall {
+	backend, err := gc.backend(ctx, location)
+	if err != nil {
+		return regionCall{location: location, err: err}
+	}
+	done, err := gc.allow(modelName, location)
+	if err != nil {
+		return regionCall{location: location, err: fmt.Errorf("%s in %s: %w", modelName, location, err)}
+	}
+	start := time.Now()
+	res, err := fn(ctx, backend, modelName)
+	done(err)
+	if err == nil {
+		gc.record(location, time.Since(start), nil)
+	} else if ctx.Err() == nil && gc.Regions.Conditions.Matches(err) {
+		gc.record(location, time.Since(start), err)
+	}
+	return regionCall{res: res, location: location, err: err}
+}
+
+// tryRegions sends a request for the given model to the given locations, failing over to the next location
+// when a request fails with one of the conditions in gc.Regions. If hedging is enabled and allowed,
+// a duplicate request may be sent to the next location while waiting for the first one.
+func (gc *GeminiClient) tryRegions(ctx context.Context, modelName string, locations []string, hedge bool, fn func(context.Context, Backend, string) (*Response, error)) regionCall {
+	if len(locations) == 0 {
+		return regionCall{err: errors.New("no locations to try")}
+	}
+	if hedge && gc.Regions.Hedge && len(locations) > 1 {
+		return gc.hedge(ctx, modelName, locations[0], locations[1], fn)
+	}
+	var call regionCall
+	for i, location := range locations {
+		call = gc.callRegion(ctx, location, modelName, fn)
+		if call.err == nil {
+			return call
+		}
+		var noFallback *noFallbackError
+		if i == len(locations)-1 || ctx.Err() != nil || errors.As(call.err, &noFallback) || !gc.Regions.Conditions.Matches(call.err) {
+			return call
+		}
+		if gc.Verbose {
+			fmt.Printf("%s in %s failed (%v), failing over to %s.\n", modelName, location, call.err, locations[i+1])
+		}
+	}
+	return call
+}
+
+// hedge sends a request to the primary location, and a duplicate request to the secondary location if the primary
+// one has not responded in time or failed. The first successful response wins, and the other request is canceled.
+func (gc *GeminiClient) hedge(ctx context.Context, modelName, primary, secondary string, fn func(context.Context, Backend, string) (*Response, error)) regionCall {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // cancel the request that lost
+
+	results := make(chan regionCall, 2)
+	launch := func(location string) {
+		go func() {
+			results <- gc.callRegion(ctx, location, modelName, fn)
+		}()
+	}
+
+	launch(primary)
+	timer := time.NewTimer(gc.hedgeDelay(primary))
+	defer timer.Stop()
+
+	launched, pending := 1, 1
+	var failed regionCall
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if launched == 1 {
+				if gc.Verbose {
+					fmt.Printf("%s in %s is slow, sending a hedged request to %s.\n", modelName, primary, secondary)
+				}
+				launch(secondary)
+				launched, pending = 2, pending+1
+			}
+		case call := <-results:
+			pending--
+			if call.err == nil {
+				call.res.Metadata.Hedged = launched > 1
+				return call
+			}
+			if failed.err == nil {
+				failed = call
+			}
+			if launched == 1 && ctx.Err() == nil && gc.Regions.Conditions.Matches(call.err) {
+				launch(secondary)
+				launched, pending = 2, pending+1
+			}
+		}
+	}
+	return failed
+}
@@ -0,0 +1,167 @@
+package geminiclient_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRegionHealth(t *testing.T) {
+	gc := &geminiclient.GeminiClient{
+		ProjectLocation: "us-central1",
+		Regions:         geminiclient.DefaultRegionPolicy(),
+	}
+	gc.SetLocations("europe-west4", "us-central1", "asia-northeast1")
+
+	statuses := gc.RegionHealth()
+	if len(statuses) != 3 {
+		t.Fatalf("Expected 3 locations, without duplicates, but got %d", len(statuses))
+	}
+	expected := []string{"us-central1", "europe-west4", "asia-northeast1"}
+	for i, status := range statuses {
+		if status.Location != expected[i] {
+			t.Errorf("Expected location %d to be %s, but got %s", i+1, expected[i], status.Location)
+		}
+		if !status.Healthy {
+			t.Errorf("Expected %s to be healthy before any requests have been sent", status.Location)
+		}
+	}
+}
+
+// regionalFake is a LocationBackend with one fake backend per location, where us-central1 is the primary location
+type regionalFake struct {
+	*cancelRecorder
+	fakes map[string]*geminitest.Fake
+}
+
+func (r *regionalFake) WithLocation(ctx context.Context, location string) (geminiclient.Backend, error) {
+	fake, ok := r.fakes[location]
+	if !ok {
+		return nil, fmt.Errorf("unknown location: %s", location)
+	}
+	return &cancelRecorder{Fake: fake, location: location, canceled: r.canceled}, nil
+}
+
+// cancelRecorder is a fake backend that records when a request is canceled
+type cancelRecorder struct {
+	*geminitest.Fake
+	location string
+	canceled chan string // the locations of requests that were canceled, shared by all locations
+}
+
+func (c *cancelRecorder) GenerateContent(ctx context.Context, cfg *geminiclient.ModelConfig, contents ...*genai.Content) (*genai.GenerateContentResponse, error) {
+	res, err := c.Fake.GenerateContent(ctx, cfg, contents...)
+	if ctx.Err() != nil {
+		c.canceled <- c.location
+	}
+	return res, err
+}
+
+func (c *cancelRecorder) StartChat(cfg *geminiclient.ModelConfig) geminiclient.ChatSession {
+	return geminiclient.NewChatSession(c, cfg)
+}
+
+// regionalClient returns a client for us-central1 that can fail over to europe-west4, together with the fake for each location
+func regionalClient(t *testing.T, opts ...geminiclient.Option) (*geminiclient.GeminiClient, *regionalFake) {
+	backend := &regionalFake{fakes: map[string]*geminitest.Fake{"us-central1": geminitest.New(), "europe-west4": geminitest.New()}}
+	backend.cancelRecorder = &cancelRecorder{Fake: backend.fakes["us-central1"], location: "us-central1", canceled: make(chan string, 10)}
+	opts = append([]geminiclient.Option{geminiclient.WithBackend(backend), geminiclient.WithModel(geminitest.DefaultModelName),
+		geminiclient.WithLocation("us-central1"), geminiclient.WithLocations("europe-west4"),
+		geminiclient.WithRetryPolicy(geminiclient.NoRetryPolicy())}, opts...)
+	gc, err := geminiclient.NewClient(context.Background(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for location, fake := range backend.fakes {
+			if n := fake.Pending(); n > 0 {
+				t.Errorf("Expected all responses for %s to be used, but %d are left", location, n)
+			}
+		}
+	})
+	return gc, backend
+}
+
+func TestRegionFailover(t *testing.T) {
+	gc, backend := regionalClient(t)
+	backend.fakes["us-central1"].QueueError(status.Error(codes.Unavailable, "service unavailable"))
+	backend.fakes["europe-west4"].QueueText("Oslo")
+
+	res, err := gc.Generate(context.Background(), geminiclient.NewTextRequest("What is the capital of Norway?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "Oslo" || res.Metadata.Location != "europe-west4" {
+		t.Errorf("Expected \"Oslo\" from europe-west4, but got %q from %s", res.Text, res.Metadata.Location)
+	}
+
+	// Errors that do not match the failover conditions are returned right away
+	backend.fakes["us-central1"].QueueError(status.Error(codes.InvalidArgument, "bad request"))
+	if _, err := gc.Generate(context.Background(), geminiclient.NewTextRequest("What is the capital of Norway?")); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument without failover, but got %v", err)
+	}
+}
+
+func TestRegionHealthDemotion(t *testing.T) {
+	gc, backend := regionalClient(t)
+	gc.Regions.UnhealthyAfter = 2
+	for i := 0; i < 2; i++ {
+		backend.fakes["us-central1"].QueueError(status.Error(codes.Unavailable, "service unavailable"))
+	}
+	for i := 0; i < 3; i++ {
+		backend.fakes["europe-west4"].QueueText("Oslo")
+	}
+
+	for i := 0; i < 3; i++ {
+		res, err := gc.Generate(context.Background(), geminiclient.NewTextRequest("What is the capital of Norway?"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Metadata.Location != "europe-west4" {
+			t.Errorf("Expected request %d to be answered from europe-west4, but got %s", i+1, res.Metadata.Location)
+		}
+	}
+	// The third request goes straight to europe-west4, since us-central1 has failed twice in a row
+	if n := len(backend.fakes["us-central1"].Requests()); n != 2 {
+		t.Errorf("Expected 2 requests to us-central1, but got %d", n)
+	}
+	statuses := gc.RegionHealth()
+	if statuses[0].Location != "europe-west4" || statuses[1].Healthy || statuses[1].ConsecutiveFailures != 2 {
+		t.Errorf("Expected us-central1 to be unhealthy and last, but got %+v", statuses)
+	}
+}
+
+func TestRegionHedging(t *testing.T) {
+	gc, backend := regionalClient(t, geminiclient.WithHedging(true))
+	gc.Regions.HedgeMinDelay = 20 * time.Millisecond
+	backend.fakes["us-central1"].QueueText("Slow Oslo").WithDelay(5 * time.Second)
+	backend.fakes["europe-west4"].QueueText("Fast Oslo")
+
+	start := time.Now()
+	res, err := gc.Generate(context.Background(), geminiclient.NewTextRequest("What is the capital of Norway?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "Fast Oslo" || res.Metadata.Location != "europe-west4" || !res.Metadata.Hedged {
+		t.Errorf("Expected a hedged \"Fast Oslo\" from europe-west4, but got %q from %s (hedged: %v)", res.Text, res.Metadata.Location, res.Metadata.Hedged)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the faster answer to be returned right away, but it took %s", elapsed)
+	}
+	// The slow request in us-central1 is canceled
+	select {
+	case location := <-backend.canceled:
+		if location != "us-central1" {
+			t.Errorf("Expected the request to us-central1 to be canceled, but got %s", location)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the slow request to be canceled")
+	}
+}
@@ -0,0 +1,351 @@
+package geminiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// maxFunctionCallRounds is how many times in a row the model may ask for function calls
+// before Generate gives up.
+const maxFunctionCallRounds = 10
+
+// Request is an immutable description of a single request to the model:
+// the prompt parts, the generation config, the tools and the system instruction.
+// All With* methods return a modified copy, so a Request can be reused and shared between goroutines.
+type Request struct {
+	parts             []genai.Part
+	modelName         string
+	temperature       *float32
+	generationConfig  *genai.GenerationConfig
+	systemInstruction string
+	tools             []*genai.Tool
+	functions         map[string]reflect.Value
+	callback          FunctionCallHandler
+	handlers          map[string]FunctionCallHandler
+	bypassCache       bool
+}
+
+// Response is the result of a request to the model.
+type Response struct {
+	Text     string                         // all text parts of the first candidate
+	Raw      *genai.GenerateContentResponse // the last response from the model
+	Metadata ResponseMetadata
+}
+
+// NewRequest creates a new Request with the given parts.
+func NewRequest(parts ...genai.Part) *Request {
+	return &Request{parts: slices.Clone(parts)}
+}
+
+// NewTextRequest creates a new Request with the given text prompt.
+func NewTextRequest(prompt string) *Request {
+	return NewRequest(genai.Text(prompt))
+}
+
+// clone returns a copy of the request, that can be modified without affecting the original.
+func (req *Request) clone() *Request {
+	c := *req
+	c.parts = slices.Clone(req.parts)
+	c.tools = slices.Clone(req.tools)
+	c.functions = maps.Clone(req.functions)
+	c.handlers = maps.Clone(req.handlers)
+	if req.generationConfig != nil {
+		cfg := *req.generationConfig
+		c.generationConfig = &cfg
+	}
+	return &c
+}
+
+// Parts returns a copy of the prompt parts of the request.
+func (req *Request) Parts() []genai.Part {
+	return slices.Clone(req.parts)
+}
+
+// WithParts returns a copy of the request with the given parts added.
+func (req *Request) WithParts(parts ...genai.Part) *Request {
+	c := req.clone()
+	c.parts = append(c.parts, parts...)
+	return c
+}
+
+// WithText returns a copy of the request with the given text part added.
+func (req *Request) WithText(text string) *Request {
+	return req.WithParts(genai.Text(text))
+}
+
+// WithData returns a copy of the request with the given data and MIME type added.
+func (req *Request) WithData(mimeType string, data []byte) *Request {
+	return req.WithParts(genai.Blob{MIMEType: mimeType, Data: data})
+}
+
+// WithModel returns a copy of the request that uses the given model instead of gc.ModelName.
+func (req *Request) WithModel(modelName string) *Request {
+	c := req.clone()
+	c.modelName = modelName
+	return c
+}
+
+// WithTemperature returns a copy of the request that uses the given temperature instead of gc.Temperature.
+func (req *Request) WithTemperature(temperature float32) *Request {
+	c := req.clone()
+	c.temperature = &temperature
+	return c
+}
+
+// WithGenerationConfig returns a copy of the request that uses the given generation config.
+// A temperature given with WithTemperature takes precedence over the one in the config.
+func (req *Request) WithGenerationConfig(config genai.GenerationConfig) *Request {
+	c := req.clone()
+	c.generationConfig = &config
+	return c
+}
+
+// WithSystemInstruction returns a copy of the request with the given system instruction.
+func (req *Request) WithSystemInstruction(instruction string) *Request {
+	c := req.clone()
+	c.systemInstruction = instruction
+	return c
+}
+
+// WithTools returns a copy of the request with the given tools added.
+// Function calls to these tools must be handled with WithFunctionHandlers.
+func (req *Request) WithTools(tools ...*genai.Tool) *Request {
+	c := req.clone()
+	c.tools = append(c.tools, tools...)
+	return c
+}
+
+// WithFunction returns a copy of the request where the given Go function is available as a tool.
+func (req *Request) WithFunction(name, description string, fn any) (*Request, error) {
+	tool, fnValue, err := functionTool(name, description, fn)
+	if err != nil {
+		return nil, err
+	}
+	c := req.clone()
+	c.tools = append(c.tools, tool)
+	if c.functions == nil {
+		c.functions = make(map[string]reflect.Value)
+	}
+	c.functions[name] = fnValue
+	return c, nil
+}
+
+// WithFunctionCallback returns a copy of the request where the results of the function calls
+// are passed through the given callback before they are sent back to the model.
+func (req *Request) WithFunctionCallback(callback FunctionCallHandler) *Request {
+	c := req.clone()
+	c.callback = callback
+	return c
+}
+
+// WithFunctionHandlers returns a copy of the request where function calls are handled by
+// the given handlers, by function name, instead of by registered Go functions.
+func (req *Request) WithFunctionHandlers(handlers map[string]FunctionCallHandler) *Request {
+	c := req.clone()
+	c.handlers = maps.Clone(handlers)
+	return c
+}
+
+// Request returns a new Request with the parts, tools and functions that are currently
+// registered with the client, using the client model name and temperature.
+func (gc *GeminiClient) Request() *Request {
+	return &Request{
+		parts:     slices.Clone(gc.Parts),
+		tools:     slices.Clone(gc.Tools),
+		functions: maps.Clone(gc.Functions),
+	}
+}
+
+// generationConfig returns the generation config for the given request, or the one of the client if the request has none,
+// with the temperature filled in.
+func (gc *GeminiClient) generationConfig(req *Request) genai.GenerationConfig {
+	config := gc.GenerationConfig
+	if req.generationConfig != nil {
+		config = *req.generationConfig
+	}
+	if req.temperature != nil {
+		config.SetTemperature(*req.temperature)
+	} else if config.Temperature == nil {
+		config.SetTemperature(gc.Temperature)
+	}
+	return config
+}
+
+// modelConfig returns the configuration for sending the given request to the given model.
+func (gc *GeminiClient) modelConfig(modelName string, req *Request) *ModelConfig {
+	cfg := &ModelConfig{
+		ModelName:        modelName,
+		GenerationConfig: gc.generationConfig(req),
+		Tools:            req.tools,
+		SafetySettings:   gc.SafetySettings,
+	}
+	if instruction := gc.systemInstruction(req); instruction != "" {
+		cfg.SystemInstruction = genai.NewUserContent(genai.Text(instruction))
+	}
+	return cfg
+}
+
+// systemInstruction returns the system instruction of the given request, or the one of the client if the request has none.
+func (gc *GeminiClient) systemInstruction(req *Request) string {
+	if req.systemInstruction != "" {
+		return req.systemInstruction
+	}
+	return gc.SystemInstruction
+}
+
+// requestModelName returns the model name that should be used for the given request.
+func (gc *GeminiClient) requestModelName(req *Request) string {
+	if req.modelName != "" {
+		return req.modelName
+	}
+	return gc.ModelName
+}
+
+// Generate sends the given request to the model and returns the response.
+// Function calls requested by the model are handled and sent back to the model until it responds with text.
+// The model is picked by the model router (see SetModelRouter), unless the request asks for one with WithModel.
+// If the model fails and other locations or fallback models are configured with SetLocations
+// or SetFallbacks, they are tried in order.
+// If a cache is configured with SetCache, cached responses are returned without contacting the model,
+// and if coalescing is enabled with SetCoalescing, identical requests that are in flight are shared.
+// Generate does not modify the client, so it is safe to call from several goroutines at the same time.
+func (gc *GeminiClient) Generate(ctx context.Context, req *Request) (response *Response, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic occurred: %v", r)
+		}
+	}()
+	if len(req.parts) == 0 {
+		return nil, ErrEmptyPrompt
+	}
+	if req, err = gc.route(req); err != nil {
+		return nil, err
+	}
+
+	// The cache is looked up before large parts are staged, so that cached responses do not need Cloud Storage
+	key, cached := gc.cacheLookup(req)
+	if cached != nil {
+		return cached, nil
+	}
+
+	// Requests with function calls are not hedged, since the functions could then be called twice
+	hedge := len(req.functions) == 0 && len(req.handlers) == 0
+	return gc.coalesce(ctx, req, nil, func(ctx context.Context, _ func(string)) (*Response, error) {
+		req, err := gc.stage(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		response, err := gc.withFallback(ctx, req, hedge, func(ctx context.Context, backend Backend, modelName string) (*Response, error) {
+			return gc.generate(ctx, backend, modelName, req)
+		})
+		if err != nil {
+			return nil, err
+		}
+		gc.cacheStore(key, response)
+		return response, nil
+	})
+}
+
+// generate sends the given request to the given model, and handles function calls until the model responds with text.
+func (gc *GeminiClient) generate(ctx context.Context, backend Backend, modelName string, req *Request) (*Response, error) {
+	session := backend.StartChat(gc.modelConfig(modelName, req))
+
+	var attempts int
+	parts := req.parts
+	for round := 0; ; round++ {
+		res, n, err := gc.sendMessage(ctx, modelName, session, parts...)
+		attempts += n
+		if err != nil {
+			if round == 0 {
+				return nil, fmt.Errorf("failed to send message: %w", err)
+			}
+			return nil, fmt.Errorf("failed to send function response: %w", err)
+		}
+		if res == nil || len(res.Candidates) == 0 || res.Candidates[0] == nil || res.Candidates[0].Content == nil {
+			return nil, errors.New("empty response from model")
+		}
+		calls := res.Candidates[0].FunctionCalls()
+		if len(calls) == 0 {
+			return gc.newResponse(res, attempts)
+		}
+		if round >= maxFunctionCallRounds {
+			return nil, fmt.Errorf("gave up after %d rounds of function calls", round)
+		}
+		parts = make([]genai.Part, 0, len(calls))
+		for _, call := range calls {
+			responseData, err := req.handleFunctionCall(ctx, call)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, genai.FunctionResponse{
+				Name:     call.Name,
+				Response: responseData,
+			})
+		}
+	}
+}
+
+// newResponse collects the text parts of the first candidate into a Response.
+func (gc *GeminiClient) newResponse(res *genai.GenerateContentResponse, attempts int) (*Response, error) {
+	if len(res.Candidates[0].Content.Parts) == 0 {
+		return nil, errors.New("empty response from model")
+	}
+	var result strings.Builder
+	for _, part := range res.Candidates[0].Content.Parts {
+		if textPart, ok := part.(genai.Text); ok {
+			result.WriteString(string(textPart))
+		}
+	}
+	text := result.String()
+	if gc.Trim {
+		text = strings.TrimSpace(text)
+	}
+	return &Response{
+		Text: text,
+		Raw:  res,
+		Metadata: ResponseMetadata{
+			Attempts:      attempts,
+			UsageMetadata: res.UsageMetadata,
+		},
+	}, nil
+}
+
+// handleFunctionCall handles a function call from the model, either with a handler or with a registered Go function.
+// The function call is abandoned if the context is done before it returns.
+func (req *Request) handleFunctionCall(ctx context.Context, call genai.FunctionCall) (map[string]any, error) {
+	if req.handlers != nil {
+		handler, exists := req.handlers[call.Name]
+		if !exists {
+			return nil, fmt.Errorf("no handler found for function: %s", call.Name)
+		}
+		responseData, err := callWithContext(ctx, func() (map[string]any, error) {
+			return handler(call.Args)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("handler error for function %s: %w", call.Name, err)
+		}
+		return responseData, nil
+	}
+	responseData, err := callWithContext(ctx, func() (map[string]any, error) {
+		return invokeFunction(ctx, req.functions, call.Name, call.Args)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to handle function call: %w", err)
+	}
+	if req.callback != nil {
+		responseData, err = callWithContext(ctx, func() (map[string]any, error) {
+			return req.callback(responseData)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("callback processing failed: %w", err)
+		}
+	}
+	return responseData, nil
+}
@@ -0,0 +1,109 @@
+package geminiclient_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
+)
+
+func TestRequestIsImmutable(t *testing.T) {
+	base := geminiclient.NewTextRequest("What is the capital of France?")
+	withData := base.WithData("text/plain", []byte("Some data"))
+	withText := base.WithText("Reply with a single word.").WithTemperature(0.0)
+
+	if len(base.Parts()) != 1 {
+		t.Fatalf("Expected the original request to still have 1 part, but got %d", len(base.Parts()))
+	}
+	if len(withData.Parts()) != 2 || len(withText.Parts()) != 2 {
+		t.Fatalf("Expected the derived requests to have 2 parts each, but got %d and %d", len(withData.Parts()), len(withText.Parts()))
+	}
+
+	// Modifying the returned parts must not affect the request
+	parts := withText.Parts()
+	parts[0] = nil
+	if withText.Parts()[0] == nil {
+		t.Fatal("Expected Parts to return a copy")
+	}
+}
+
+func TestGenerateEmptyRequest(t *testing.T) {
+	gc := &geminiclient.GeminiClient{}
+	_, err := gc.Generate(context.Background(), geminiclient.NewRequest())
+	if !errors.Is(err, geminiclient.ErrEmptyPrompt) {
+		t.Fatalf("Expected ErrEmptyPrompt, but got: %v", err)
+	}
+}
+
+// capitalsClient returns a client with a backend that knows the capitals of France, Germany and Norway
+func capitalsClient(t *testing.T) *geminiclient.GeminiClient {
+	backend := geminitest.NewRules(
+		geminitest.Rule{Match: "France", Text: "Paris"},
+		geminitest.Rule{Match: "Germany", Text: "Berlin"},
+		geminitest.Rule{Match: "Norway", Text: "Oslo"},
+	)
+	gc, err := geminiclient.NewClient(context.Background(), geminiclient.WithBackend(backend), geminiclient.WithModel(geminitest.DefaultModelName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gc
+}
+
+var capitals = map[string]string{
+	"France":  "Paris",
+	"Germany": "Berlin",
+	"Norway":  "Oslo",
+}
+
+func TestGenerateConcurrently(t *testing.T) {
+	gc := capitalsClient(t)
+
+	var wg sync.WaitGroup
+	for country, capital := range capitals {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := geminiclient.NewTextRequest("What is the capital of " + country + "? Reply with a single word.")
+			res, err := gc.Generate(context.Background(), req)
+			if err != nil {
+				t.Errorf("Failed to query Gemini: %v", err)
+				return
+			}
+			if !strings.Contains(res.Text, capital) {
+				t.Errorf("Expected '%s' to be in the response, but got: %v", capital, res.Text)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestQueryConcurrently is most useful with go test -race, since Query stores the metadata in the client
+func TestQueryConcurrently(t *testing.T) {
+	gc := capitalsClient(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for country, capital := range capitals {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result, err := gc.Query("What is the capital of " + country + "?")
+				if err != nil {
+					t.Errorf("Failed to query Gemini: %v", err)
+					return
+				}
+				if result != capital {
+					t.Errorf("Expected '%s', but got: %v", capital, result)
+				}
+				if metadata := gc.LastMetadata(); metadata.Attempts != 1 {
+					t.Errorf("Expected 1 attempt, but got %d", metadata.Attempts)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
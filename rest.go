@@ -0,0 +1,405 @@
+package geminiclient
+
+import (
+	"encoding/base64"
+	"fmt"
+	"slices"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// The JSON format of the Gemini REST APIs, which is the same for Vertex AI and for Google AI Studio.
+
+type restRequest struct {
+	Contents          []*restContent        `json:"contents"`
+	SystemInstruction *restContent          `json:"systemInstruction,omitempty"`
+	Tools             []*restTool           `json:"tools,omitempty"`
+	GenerationConfig  *restGenerationConfig `json:"generationConfig,omitempty"`
+	SafetySettings    []*restSafetySetting  `json:"safetySettings,omitempty"`
+}
+
+type restContent struct {
+	Role  string      `json:"role,omitempty"`
+	Parts []*restPart `json:"parts"`
+}
+
+type restPart struct {
+	Text             string                `json:"text,omitempty"`
+	InlineData       *restBlob             `json:"inlineData,omitempty"`
+	FileData         *restFileData         `json:"fileData,omitempty"`
+	FunctionCall     *restFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *restFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type restBlob struct {
+	MIMEType string `json:"mimeType"`
+	Data     string `json:"data"` // base64 encoded
+}
+
+type restFileData struct {
+	MIMEType string `json:"mimeType"`
+	FileURI  string `json:"fileUri"`
+}
+
+type restFunctionCall struct {
+	Name string         `json:"name"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+type restFunctionResponse struct {
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+type restTool struct {
+	FunctionDeclarations []*restFunctionDeclaration `json:"functionDeclarations,omitempty"`
+}
+
+type restFunctionDeclaration struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Parameters  *restSchema `json:"parameters,omitempty"`
+	Response    *restSchema `json:"response,omitempty"`
+}
+
+type restSchema struct {
+	Type        string                 `json:"type,omitempty"`
+	Format      string                 `json:"format,omitempty"`
+	Title       string                 `json:"title,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Nullable    bool                   `json:"nullable,omitempty"`
+	Items       *restSchema            `json:"items,omitempty"`
+	Enum        []string               `json:"enum,omitempty"`
+	Properties  map[string]*restSchema `json:"properties,omitempty"`
+	Required    []string               `json:"required,omitempty"`
+}
+
+type restGenerationConfig struct {
+	Temperature      *float32    `json:"temperature,omitempty"`
+	TopP             *float32    `json:"topP,omitempty"`
+	TopK             *int32      `json:"topK,omitempty"`
+	CandidateCount   *int32      `json:"candidateCount,omitempty"`
+	MaxOutputTokens  *int32      `json:"maxOutputTokens,omitempty"`
+	StopSequences    []string    `json:"stopSequences,omitempty"`
+	PresencePenalty  *float32    `json:"presencePenalty,omitempty"`
+	FrequencyPenalty *float32    `json:"frequencyPenalty,omitempty"`
+	ResponseMIMEType string      `json:"responseMimeType,omitempty"`
+	ResponseSchema   *restSchema `json:"responseSchema,omitempty"`
+}
+
+type restResponse struct {
+	Candidates     []*restCandidate    `json:"candidates,omitempty"`
+	PromptFeedback *restPromptFeedback `json:"promptFeedback,omitempty"`
+	UsageMetadata  *restUsageMetadata  `json:"usageMetadata,omitempty"`
+}
+
+type restCandidate struct {
+	Index         int32               `json:"index,omitempty"`
+	Content       *restContent        `json:"content,omitempty"`
+	FinishReason  string              `json:"finishReason,omitempty"`
+	FinishMessage string              `json:"finishMessage,omitempty"`
+	SafetyRatings []*restSafetyRating `json:"safetyRatings,omitempty"`
+}
+
+type restSafetySetting struct {
+	Category  string `json:"category"`
+	Threshold string `json:"threshold"`
+}
+
+type restSafetyRating struct {
+	Category    string `json:"category,omitempty"`
+	Probability string `json:"probability,omitempty"`
+	Blocked     bool   `json:"blocked,omitempty"`
+}
+
+type restPromptFeedback struct {
+	BlockReason        string              `json:"blockReason,omitempty"`
+	BlockReasonMessage string              `json:"blockReasonMessage,omitempty"`
+	SafetyRatings      []*restSafetyRating `json:"safetyRatings,omitempty"`
+}
+
+type restUsageMetadata struct {
+	PromptTokenCount     int32 `json:"promptTokenCount,omitempty"`
+	CandidatesTokenCount int32 `json:"candidatesTokenCount,omitempty"`
+	TotalTokenCount      int32 `json:"totalTokenCount,omitempty"`
+}
+
+type restCountTokensRequest struct {
+	Contents []*restContent `json:"contents"`
+}
+
+type restCountTokensResponse struct {
+	TotalTokens int32 `json:"totalTokens"`
+}
+
+// The names of the enum values, indexed by the genai enum values.
+var (
+	restTypes           = []string{"TYPE_UNSPECIFIED", "STRING", "NUMBER", "INTEGER", "BOOLEAN", "ARRAY", "OBJECT"}
+	restFinishReasons   = []string{"FINISH_REASON_UNSPECIFIED", "STOP", "MAX_TOKENS", "SAFETY", "RECITATION", "OTHER", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "MALFORMED_FUNCTION_CALL"}
+	restBlockReasons    = []string{"BLOCKED_REASON_UNSPECIFIED", "SAFETY", "OTHER", "BLOCKLIST", "PROHIBITED_CONTENT"}
+	restHarmCategories  = []string{"HARM_CATEGORY_UNSPECIFIED", "HARM_CATEGORY_HATE_SPEECH", "HARM_CATEGORY_DANGEROUS_CONTENT", "HARM_CATEGORY_HARASSMENT", "HARM_CATEGORY_SEXUALLY_EXPLICIT"}
+	restHarmProbability = []string{"HARM_PROBABILITY_UNSPECIFIED", "NEGLIGIBLE", "LOW", "MEDIUM", "HIGH"}
+	restHarmThresholds  = []string{"HARM_BLOCK_THRESHOLD_UNSPECIFIED", "BLOCK_LOW_AND_ABOVE", "BLOCK_MEDIUM_AND_ABOVE", "BLOCK_ONLY_HIGH", "BLOCK_NONE"}
+)
+
+// enumName returns the REST name of a genai enum value.
+func enumName[T ~int32](names []string, value T) string {
+	if int(value) < 0 || int(value) >= len(names) {
+		return names[0]
+	}
+	return names[value]
+}
+
+// enumValue returns the genai enum value for a REST name, or 0 if the name is unknown.
+func enumValue[T ~int32](names []string, name string) T {
+	if i := slices.Index(names, name); i >= 0 {
+		return T(i)
+	}
+	return 0
+}
+
+// toRESTRequest converts the given configuration and contents to a REST request.
+func toRESTRequest(cfg *ModelConfig, contents []*genai.Content) (*restRequest, error) {
+	req := &restRequest{
+		GenerationConfig: toRESTGenerationConfig(cfg.GenerationConfig),
+	}
+	var err error
+	if req.Contents, err = toRESTContents(contents); err != nil {
+		return nil, err
+	}
+	if cfg.SystemInstruction != nil {
+		if req.SystemInstruction, err = toRESTContent(cfg.SystemInstruction); err != nil {
+			return nil, err
+		}
+	}
+	for _, tool := range cfg.Tools {
+		restTool := &restTool{}
+		for _, decl := range tool.FunctionDeclarations {
+			restTool.FunctionDeclarations = append(restTool.FunctionDeclarations, &restFunctionDeclaration{
+				Name:        decl.Name,
+				Description: decl.Description,
+				Parameters:  toRESTSchema(decl.Parameters),
+				Response:    toRESTSchema(decl.Response),
+			})
+		}
+		req.Tools = append(req.Tools, restTool)
+	}
+	for _, setting := range cfg.SafetySettings {
+		req.SafetySettings = append(req.SafetySettings, &restSafetySetting{
+			Category:  enumName(restHarmCategories, setting.Category),
+			Threshold: enumName(restHarmThresholds, setting.Threshold),
+		})
+	}
+	return req, nil
+}
+
+func toRESTContents(contents []*genai.Content) ([]*restContent, error) {
+	restContents := make([]*restContent, 0, len(contents))
+	for _, content := range contents {
+		c, err := toRESTContent(content)
+		if err != nil {
+			return nil, err
+		}
+		restContents = append(restContents, c)
+	}
+	return restContents, nil
+}
+
+func toRESTContent(content *genai.Content) (*restContent, error) {
+	c := &restContent{Role: content.Role, Parts: make([]*restPart, 0, len(content.Parts))}
+	for _, part := range content.Parts {
+		p, err := toRESTPart(part)
+		if err != nil {
+			return nil, err
+		}
+		c.Parts = append(c.Parts, p)
+	}
+	return c, nil
+}
+
+func toRESTPart(part genai.Part) (*restPart, error) {
+	switch p := part.(type) {
+	case genai.Text:
+		return &restPart{Text: string(p)}, nil
+	case genai.Blob:
+		return &restPart{InlineData: &restBlob{MIMEType: p.MIMEType, Data: base64.StdEncoding.EncodeToString(p.Data)}}, nil
+	case genai.FileData:
+		return &restPart{FileData: &restFileData{MIMEType: p.MIMEType, FileURI: p.FileURI}}, nil
+	case genai.FunctionCall:
+		return &restPart{FunctionCall: &restFunctionCall{Name: p.Name, Args: p.Args}}, nil
+	case genai.FunctionResponse:
+		return &restPart{FunctionResponse: &restFunctionResponse{Name: p.Name, Response: p.Response}}, nil
+	}
+	return nil, fmt.Errorf("unsupported part type: %T", part)
+}
+
+func toRESTSchema(schema *genai.Schema) *restSchema {
+	if schema == nil {
+		return nil
+	}
+	s := &restSchema{
+		Type:        enumName(restTypes, schema.Type),
+		Format:      schema.Format,
+		Title:       schema.Title,
+		Description: schema.Description,
+		Nullable:    schema.Nullable,
+		Items:       toRESTSchema(schema.Items),
+		Enum:        schema.Enum,
+		Required:    schema.Required,
+	}
+	if schema.Type == genai.TypeUnspecified {
+		s.Type = ""
+	}
+	if len(schema.Properties) > 0 {
+		s.Properties = make(map[string]*restSchema, len(schema.Properties))
+		for name, property := range schema.Properties {
+			s.Properties[name] = toRESTSchema(property)
+		}
+	}
+	return s
+}
+
+func toRESTGenerationConfig(config genai.GenerationConfig) *restGenerationConfig {
+	return &restGenerationConfig{
+		Temperature:      config.Temperature,
+		TopP:             config.TopP,
+		TopK:             config.TopK,
+		CandidateCount:   config.CandidateCount,
+		MaxOutputTokens:  config.MaxOutputTokens,
+		StopSequences:    config.StopSequences,
+		PresencePenalty:  config.PresencePenalty,
+		FrequencyPenalty: config.FrequencyPenalty,
+		ResponseMIMEType: config.ResponseMIMEType,
+		ResponseSchema:   toRESTSchema(config.ResponseSchema),
+	}
+}
+
+// fromRESTResponse converts a REST response to a genai response. Like the genai package,
+// a *genai.BlockedError is returned if the prompt or the response was blocked.
+func fromRESTResponse(res *restResponse) (*genai.GenerateContentResponse, error) {
+	response := &genai.GenerateContentResponse{}
+	for _, c := range res.Candidates {
+		candidate := &genai.Candidate{
+			Index:         c.Index,
+			FinishReason:  enumValue[genai.FinishReason](restFinishReasons, c.FinishReason),
+			FinishMessage: c.FinishMessage,
+			SafetyRatings: fromRESTSafetyRatings(c.SafetyRatings),
+		}
+		if c.Content != nil {
+			content, err := fromRESTContent(c.Content)
+			if err != nil {
+				return nil, err
+			}
+			candidate.Content = content
+		}
+		if candidate.FinishReason == genai.FinishReasonSafety {
+			return nil, &genai.BlockedError{Candidate: candidate}
+		}
+		response.Candidates = append(response.Candidates, candidate)
+	}
+	if res.PromptFeedback != nil && res.PromptFeedback.BlockReason != "" {
+		return nil, &genai.BlockedError{PromptFeedback: &genai.PromptFeedback{
+			BlockReason:        enumValue[genai.BlockedReason](restBlockReasons, res.PromptFeedback.BlockReason),
+			BlockReasonMessage: res.PromptFeedback.BlockReasonMessage,
+			SafetyRatings:      fromRESTSafetyRatings(res.PromptFeedback.SafetyRatings),
+		}}
+	}
+	if u := res.UsageMetadata; u != nil {
+		response.UsageMetadata = &genai.UsageMetadata{
+			PromptTokenCount:     u.PromptTokenCount,
+			CandidatesTokenCount: u.CandidatesTokenCount,
+			TotalTokenCount:      u.TotalTokenCount,
+		}
+	}
+	return response, nil
+}
+
+func fromRESTContent(c *restContent) (*genai.Content, error) {
+	content := &genai.Content{Role: c.Role}
+	for _, p := range c.Parts {
+		switch {
+		case p.InlineData != nil:
+			data, err := base64.StdEncoding.DecodeString(p.InlineData.Data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid inline data: %v", err)
+			}
+			content.Parts = append(content.Parts, genai.Blob{MIMEType: p.InlineData.MIMEType, Data: data})
+		case p.FileData != nil:
+			content.Parts = append(content.Parts, genai.FileData{MIMEType: p.FileData.MIMEType, FileURI: p.FileData.FileURI})
+		case p.FunctionCall != nil:
+			content.Parts = append(content.Parts, genai.FunctionCall{Name: p.FunctionCall.Name, Args: p.FunctionCall.Args})
+		case p.FunctionResponse != nil:
+			content.Parts = append(content.Parts, genai.FunctionResponse{Name: p.FunctionResponse.Name, Response: p.FunctionResponse.Response})
+		default:
+			content.Parts = append(content.Parts, genai.Text(p.Text))
+		}
+	}
+	return content, nil
+}
+
+func fromRESTSafetyRatings(ratings []*restSafetyRating) []*genai.SafetyRating {
+	var safetyRatings []*genai.SafetyRating
+	for _, r := range ratings {
+		safetyRatings = append(safetyRatings, &genai.SafetyRating{
+			Category:    enumValue[genai.HarmCategory](restHarmCategories, r.Category),
+			Probability: enumValue[genai.HarmProbability](restHarmProbability, r.Probability),
+			Blocked:     r.Blocked,
+		})
+	}
+	return safetyRatings
+}
+
+// toRESTResponse converts a genai response to a REST response.
+func toRESTResponse(response *genai.GenerateContentResponse) (*restResponse, error) {
+	res := &restResponse{}
+	for _, candidate := range response.Candidates {
+		if candidate == nil {
+			continue
+		}
+		c := &restCandidate{
+			Index:         candidate.Index,
+			FinishMessage: candidate.FinishMessage,
+			SafetyRatings: toRESTSafetyRatings(candidate.SafetyRatings),
+		}
+		if candidate.FinishReason != genai.FinishReasonUnspecified {
+			c.FinishReason = enumName(restFinishReasons, candidate.FinishReason)
+		}
+		if candidate.Content != nil {
+			content, err := toRESTContent(candidate.Content)
+			if err != nil {
+				return nil, err
+			}
+			c.Content = content
+		}
+		res.Candidates = append(res.Candidates, c)
+	}
+	if pf := response.PromptFeedback; pf != nil {
+		res.PromptFeedback = &restPromptFeedback{
+			BlockReasonMessage: pf.BlockReasonMessage,
+			SafetyRatings:      toRESTSafetyRatings(pf.SafetyRatings),
+		}
+		if pf.BlockReason != genai.BlockedReasonUnspecified {
+			res.PromptFeedback.BlockReason = enumName(restBlockReasons, pf.BlockReason)
+		}
+	}
+	if u := response.UsageMetadata; u != nil {
+		res.UsageMetadata = &restUsageMetadata{
+			PromptTokenCount:     u.PromptTokenCount,
+			CandidatesTokenCount: u.CandidatesTokenCount,
+			TotalTokenCount:      u.TotalTokenCount,
+		}
+	}
+	return res, nil
+}
+
+func toRESTSafetyRatings(ratings []*genai.SafetyRating) []*restSafetyRating {
+	var restRatings []*restSafetyRating
+	for _, r := range ratings {
+		restRatings = append(restRatings, &restSafetyRating{
+			Category:    enumName(restHarmCategories, r.Category),
+			Probability: enumName(restHarmProbability, r.Probability),
+			Blocked:     r.Blocked,
+		})
+	}
+	return restRatings
+}
@@ -0,0 +1,217 @@
+package geminiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy configures how transient errors from Vertex AI are retried.
+type RetryPolicy struct {
+	MaxAttempts    int           // the total number of attempts, including the first one (1 disables retries)
+	BaseDelay      time.Duration // the delay before the first retry
+	MaxDelay       time.Duration // the upper limit for the calculated delay between attempts
+	Multiplier     float64       // how much the delay grows for every attempt
+	Jitter         float64       // the fraction of the delay that is randomized, from 0.0 to 1.0
+	RetryableCodes []codes.Code  // the gRPC status codes that are considered to be transient
+	HonorRetryInfo bool          // use the retry delay suggested by the server, if it is longer
+}
+
+// ResponseMetadata contains information about the most recent response from the model.
+type ResponseMetadata struct {
+	Attempts      int                  // how many attempts were needed, including retries
+	UsageMetadata *genai.UsageMetadata // token usage, as reported by the server
+	ModelName     string               // the model that actually produced the response
+	Location      string               // the Google Cloud location of that model
+	Fallbacks     int                  // how many models failed before this one, see FallbackPolicy
+	Hedged        bool                 // a duplicate request was sent to another location, see RegionPolicy
+	Cached        bool                 // the response was found in the cache, see SetCache
+	Coalesced     bool                 // the response was shared with an identical request that was already in flight, see SetCoalescing
+}
+
+const (
+	defaultMaxAttempts     = 5
+	defaultRetryBaseDelay  = 1 * time.Second
+	defaultRetryMaxDelay   = 30 * time.Second
+	defaultRetryMultiplier = 2.0
+	defaultRetryJitter     = 0.2
+)
+
+// DefaultRetryPolicy returns the retry policy that is used by new clients.
+// ResourceExhausted (429) and Unavailable (503) are retried up to 5 times in total.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    defaultMaxAttempts,
+		BaseDelay:      defaultRetryBaseDelay,
+		MaxDelay:       defaultRetryMaxDelay,
+		Multiplier:     defaultRetryMultiplier,
+		Jitter:         defaultRetryJitter,
+		RetryableCodes: []codes.Code{codes.ResourceExhausted, codes.Unavailable},
+		HonorRetryInfo: true,
+	}
+}
+
+// NoRetryPolicy returns a retry policy where every request is only attempted once.
+func NoRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 1}
+}
+
+// SetRetryPolicy sets the retry policy that is used for all requests to the model.
+func (gc *GeminiClient) SetRetryPolicy(policy RetryPolicy) {
+	gc.Retry = policy
+}
+
+// Retryable returns true if the given error has one of the retryable status codes.
+func (p RetryPolicy) Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	return slices.Contains(p.RetryableCodes, errorCode(err))
+}
+
+// Delay returns how long to wait after the given failed attempt (starting at 1) before trying again.
+func (p RetryPolicy) Delay(attempt int, err error) time.Duration {
+	delay := float64(p.BaseDelay)
+	multiplier := p.Multiplier
+	if multiplier < 1.0 {
+		multiplier = 1.0
+	}
+	for i := 1; i < attempt; i++ {
+		delay *= multiplier
+		if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+			break
+		}
+	}
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if jitter := min(max(p.Jitter, 0.0), 1.0); jitter > 0 {
+		delay = delay*(1.0-jitter) + rand.Float64()*delay*jitter
+	}
+	d := time.Duration(delay)
+	if p.HonorRetryInfo {
+		if serverDelay, ok := retryInfoDelay(err); ok && serverDelay > d {
+			d = serverDelay
+		}
+	}
+	return d
+}
+
+// withRetry calls fn until it succeeds, fails with a non-retryable error or the retry policy
+// gives up. It never waits beyond the deadline of the given context.
+// The number of attempts that were made is returned together with the last error.
+func (gc *GeminiClient) withRetry(ctx context.Context, fn func(context.Context) error) (int, error) {
+	maxAttempts := max(gc.Retry.MaxAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= maxAttempts || !gc.Retry.Retryable(err) {
+			return attempt, err
+		}
+		delay := gc.Retry.Delay(attempt, err)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return attempt, err
+		}
+		if gc.Verbose {
+			fmt.Printf("Attempt %d of %d failed (%v), retrying in %s.\n", attempt, maxAttempts, err, delay)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, err
+		case <-timer.C:
+		}
+	}
+}
+
+// errorCode returns the gRPC status code of the given error, also for errors from the REST transport.
+func errorCode(err error) codes.Code {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return codes.DeadlineExceeded
+	}
+	if errors.Is(err, context.Canceled) {
+		return codes.Canceled
+	}
+	// The REST transport wraps the HTTP error in an APIError without a status code, so look for the HTTP error first
+	var httpErr *googleapi.Error
+	if errors.As(err, &httpErr) && httpErr.Code > 0 {
+		return httpStatusToCode(httpErr.Code)
+	}
+	if apiErr, ok := apierror.FromError(err); ok {
+		if httpCode := apiErr.HTTPCode(); httpCode > 0 {
+			return httpStatusToCode(httpCode)
+		}
+		if s := apiErr.GRPCStatus(); s != nil {
+			return s.Code()
+		}
+	}
+	if s, ok := status.FromError(err); ok {
+		return s.Code()
+	}
+	return codes.Unknown
+}
+
+// httpStatusToCode maps HTTP status codes to the closest gRPC status code.
+func httpStatusToCode(httpCode int) codes.Code {
+	switch httpCode {
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusInternalServerError:
+		return codes.Internal
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	default:
+		return codes.Unknown
+	}
+}
+
+// retryInfoDelay returns the retry delay suggested by the server, if there is one.
+func retryInfoDelay(err error) (time.Duration, bool) {
+	if err == nil {
+		return 0, false
+	}
+	apiErr, ok := apierror.FromError(err)
+	if !ok || apiErr.Details().RetryInfo == nil {
+		return 0, false
+	}
+	return apiErr.Details().RetryInfo.GetRetryDelay().AsDuration(), true
+}
+
+// sendMessage sends the given parts as part of a chat session, retrying transient errors.
+// The chat history is restored before every new attempt, so that the message is only added once.
+func (gc *GeminiClient) sendMessage(ctx context.Context, modelName string, session ChatSession, parts ...genai.Part) (*genai.GenerateContentResponse, int, error) {
+	history := session.History()
+	historyLength := len(history)
+	var res *genai.GenerateContentResponse
+	attempts, err := gc.withRetry(ctx, func(ctx context.Context) error {
+		session.SetHistory(history[:historyLength:historyLength])
+		r, err := gc.reserve(ctx, modelName, historyParts(session.History(), parts...)...)
+		if err != nil {
+			return err
+		}
+		res, err = session.SendMessage(ctx, parts...)
+		reconcile(r, res, err)
+		return err
+	})
+	return res, attempts, err
+}
@@ -0,0 +1,115 @@
+package geminiclient_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryableCodes(t *testing.T) {
+	policy := geminiclient.DefaultRetryPolicy()
+
+	if !policy.Retryable(status.Error(codes.ResourceExhausted, "quota exceeded")) {
+		t.Error("Expected ResourceExhausted to be retryable")
+	}
+	if !policy.Retryable(status.Error(codes.Unavailable, "service unavailable")) {
+		t.Error("Expected Unavailable to be retryable")
+	}
+	if policy.Retryable(status.Error(codes.InvalidArgument, "bad request")) {
+		t.Error("Expected InvalidArgument to not be retryable")
+	}
+	if policy.Retryable(context.Canceled) {
+		t.Error("Expected a canceled context to not be retryable")
+	}
+	if policy.Retryable(errors.New("some other error")) {
+		t.Error("Expected an unknown error to not be retryable")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := geminiclient.RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    300 * time.Millisecond,
+		Multiplier:  2.0,
+	}
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	for i, want := range expected {
+		if got := policy.Delay(i+1, nil); got != want {
+			t.Errorf("Expected a delay of %s after attempt %d, but got %s", want, i+1, got)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := policy.Delay(1, nil); got < 50*time.Millisecond || got > 100*time.Millisecond {
+			t.Fatalf("Expected a jittered delay between 50ms and 100ms, but got %s", got)
+		}
+	}
+}
+
+// fastRetryPolicy returns a retry policy that retries Unavailable errors without jitter, after a few milliseconds
+func fastRetryPolicy(maxAttempts int, baseDelay time.Duration) geminiclient.RetryPolicy {
+	return geminiclient.RetryPolicy{
+		MaxAttempts:    maxAttempts,
+		BaseDelay:      baseDelay,
+		Multiplier:     1.0,
+		RetryableCodes: []codes.Code{codes.Unavailable},
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	gc, fake := geminitest.NewClient(t, geminiclient.WithRetryPolicy(fastRetryPolicy(5, time.Millisecond)))
+	fake.QueueError(status.Error(codes.Unavailable, "service unavailable"))
+	fake.QueueError(status.Error(codes.Unavailable, "service unavailable"))
+	fake.QueueText("Stockholm")
+
+	res, err := gc.Generate(context.Background(), geminiclient.NewTextRequest("What is the capital of Sweden?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "Stockholm" || res.Metadata.Attempts != 3 || len(fake.Requests()) != 3 {
+		t.Errorf("Expected \"Stockholm\" after 3 attempts, but got %q after %d attempts and %d requests", res.Text, res.Metadata.Attempts, len(fake.Requests()))
+	}
+
+	// Errors that are not transient are returned right away
+	fake.QueueError(status.Error(codes.InvalidArgument, "bad request"))
+	_, err = gc.Generate(context.Background(), geminiclient.NewTextRequest("What is the capital of Finland?"))
+	if status.Code(err) != codes.InvalidArgument || len(fake.Requests()) != 4 {
+		t.Errorf("Expected InvalidArgument after 1 attempt, but got %v after %d requests", err, len(fake.Requests())-3)
+	}
+}
+
+func TestWithRetryDeadline(t *testing.T) {
+	// Not created with geminitest.NewClient, since not all of the queued errors are used
+	fake := geminitest.New()
+	gc, err := geminiclient.NewClient(context.Background(), geminiclient.WithBackend(fake), geminiclient.WithModel(geminitest.DefaultModelName),
+		geminiclient.WithRetryPolicy(fastRetryPolicy(100, 40*time.Millisecond)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		fake.QueueError(status.Error(codes.Unavailable, "service unavailable"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = gc.Generate(ctx, geminiclient.NewTextRequest("What is the capital of Denmark?"))
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected the last Unavailable error, but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected the retries to stop before the deadline, but they took %s", elapsed)
+	}
+	if n := len(fake.Requests()); n < 2 || n > 3 {
+		t.Errorf("Expected 2 or 3 attempts before the deadline, but got %d", n)
+	}
+}
@@ -0,0 +1,162 @@
+package geminiclient
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// Modality is a set of kinds of input, like text and images.
+type Modality uint
+
+const (
+	ModalityText Modality = 1 << iota
+	ModalityImage
+	ModalityVideo
+	ModalityAudio
+	ModalityPDF
+
+	ModalityAll = ModalityText | ModalityImage | ModalityVideo | ModalityAudio | ModalityPDF
+)
+
+// ErrUnsupportedModality is returned when none of the configured models supports the parts of a request
+var ErrUnsupportedModality = errors.New("no configured model supports the input")
+
+// ModelRouter picks the model for a request, given the modalities and the parts of the request.
+// It is given the client, for the configured model names. See SetModelRouter.
+type ModelRouter func(gc *GeminiClient, modalities Modality, parts []genai.Part) (string, error)
+
+// modelModalities are the modalities that Gemini models support, by model name prefix. The first match is used.
+var modelModalities = []struct {
+	prefix     string
+	modalities Modality
+}{
+	{"gemini-1.0-pro-vision", ModalityText | ModalityImage | ModalityVideo},
+	{"gemini-pro-vision", ModalityText | ModalityImage | ModalityVideo},
+	{"gemini-1.0-pro", ModalityText},
+	{"gemini-pro", ModalityText},
+	{"gemini-", ModalityAll}, // gemini-1.5 and later
+}
+
+// String returns the modalities, like "text+image".
+func (m Modality) String() string {
+	var names []string
+	for i, name := range []string{"text", "image", "video", "audio", "pdf"} {
+		if m&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "+")
+}
+
+// Has returns true if m includes all of the given modalities.
+func (m Modality) Has(modalities Modality) bool {
+	return m&modalities == modalities
+}
+
+// mimeModality returns the modality of the given MIME type. Other types than images, video, audio and PDF count as text.
+func mimeModality(mimeType string) Modality {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return ModalityImage
+	case strings.HasPrefix(mimeType, "video/"):
+		return ModalityVideo
+	case strings.HasPrefix(mimeType, "audio/"):
+		return ModalityAudio
+	case mimeType == "application/pdf":
+		return ModalityPDF
+	}
+	return ModalityText
+}
+
+// Modalities returns the modalities of the given parts.
+func Modalities(parts ...genai.Part) Modality {
+	var m Modality
+	for _, part := range parts {
+		switch p := part.(type) {
+		case genai.Blob:
+			m |= mimeModality(p.MIMEType)
+		case genai.FileData:
+			m |= mimeModality(p.MIMEType)
+		default:
+			m |= ModalityText
+		}
+	}
+	return m
+}
+
+// SupportedModalities returns the modalities that the given model supports.
+// Models that are not known, like models from other providers, are assumed to support all modalities.
+func SupportedModalities(modelName string) Modality {
+	name := path.Base(modelName) // for names like "publishers/google/models/gemini-1.5-pro"
+	for _, model := range modelModalities {
+		if strings.HasPrefix(name, model.prefix) {
+			return model.modalities
+		}
+	}
+	return ModalityAll
+}
+
+// DefaultModelRouter picks gc.ModelName if it supports the modalities, or else gc.MultiModalModelName.
+func DefaultModelRouter(gc *GeminiClient, modalities Modality, parts []genai.Part) (string, error) {
+	var models []string
+	for _, modelName := range []string{gc.ModelName, gc.MultiModalModelName} {
+		if modelName == "" {
+			continue
+		}
+		if SupportedModalities(modelName).Has(modalities) {
+			return modelName, nil
+		}
+		models = append(models, modelName)
+	}
+	return "", fmt.Errorf("%w: %s is not supported by %s", ErrUnsupportedModality, modalities, strings.Join(models, " or "))
+}
+
+// SetModelRouter configures how the model is picked for requests that do not ask for a model with WithModel.
+// The default is DefaultModelRouter. The router can also be used for picking a cheaper model for short prompts.
+func (gc *GeminiClient) SetModelRouter(router ModelRouter) {
+	gc.Router = router
+}
+
+// route returns the request with the model filled in by the router, if it does not already have one.
+func (gc *GeminiClient) route(req *Request) (*Request, error) {
+	if req.modelName != "" {
+		return req, nil
+	}
+	modalities := Modalities(req.parts...)
+	modelName, err := gc.router()(gc, modalities, req.Parts())
+	if err != nil {
+		return nil, err
+	}
+	if modelName == "" {
+		return nil, fmt.Errorf("%w: the model router picked no model for %s", ErrUnsupportedModality, modalities)
+	}
+	if gc.Verbose && modelName != gc.ModelName {
+		fmt.Printf("Using %s for %s.\n", modelName, modalities)
+	}
+	return req.WithModel(modelName), nil
+}
+
+// router returns the configured model router, or DefaultModelRouter.
+func (gc *GeminiClient) router() ModelRouter {
+	if gc.Router == nil {
+		return DefaultModelRouter
+	}
+	return gc.Router
+}
+
+// checkModality returns an error if none of the configured models supports the given part.
+// Clients without any configured models, like a zero GeminiClient, accept all parts.
+func (gc *GeminiClient) checkModality(part genai.Part) error {
+	if gc.Router == nil && gc.ModelName == "" && gc.MultiModalModelName == "" {
+		return nil
+	}
+	_, err := gc.router()(gc, Modalities(part), []genai.Part{part})
+	return err
+}
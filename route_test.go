@@ -0,0 +1,75 @@
+package geminiclient_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
+)
+
+func TestModalities(t *testing.T) {
+	m := geminiclient.Modalities(genai.Text("Describe these"), genai.ImageData("png", nil), genai.FileData{MIMEType: "application/pdf", FileURI: "gs://bucket/a.pdf"})
+	if m != geminiclient.ModalityText|geminiclient.ModalityImage|geminiclient.ModalityPDF {
+		t.Errorf("Expected text+image+pdf but got %s", m)
+	}
+	if s := geminiclient.SupportedModalities("gemini-1.0-pro-vision"); s.Has(geminiclient.ModalityAudio) || !s.Has(geminiclient.ModalityImage) {
+		t.Errorf("Expected images but not audio to be supported, but got %s", s)
+	}
+	if s := geminiclient.SupportedModalities("llama3"); s != geminiclient.ModalityAll {
+		t.Errorf("Expected unknown models to support everything, but got %s", s)
+	}
+}
+
+func TestModelRouting(t *testing.T) {
+	gc, fake := geminitest.NewClient(t, geminiclient.WithModel("gemini-1.0-pro"), geminiclient.WithMultiModalModel("gemini-1.0-pro-vision"))
+
+	fake.QueueText("A haiku")
+	if _, err := gc.Query("Write a haiku"); err != nil {
+		t.Fatal(err)
+	}
+	if modelName := fake.LastRequest().Config.ModelName; modelName != "gemini-1.0-pro" {
+		t.Errorf("Expected gemini-1.0-pro for text, but got %s", modelName)
+	}
+
+	fake.QueueText("A cat")
+	res, err := gc.Generate(context.Background(), geminiclient.NewTextRequest("What is this?").WithData("image/png", []byte("PNG DATA")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modelName := fake.LastRequest().Config.ModelName; modelName != "gemini-1.0-pro-vision" || res.Metadata.ModelName != modelName {
+		t.Errorf("Expected gemini-1.0-pro-vision for images, but got %s and %s", modelName, res.Metadata.ModelName)
+	}
+
+	_, err = gc.Generate(context.Background(), geminiclient.NewTextRequest("Transcribe this").WithData("audio/mp3", []byte("MP3 DATA")))
+	if !errors.Is(err, geminiclient.ErrUnsupportedModality) {
+		t.Errorf("Expected ErrUnsupportedModality for audio, but got %v", err)
+	}
+
+	fake.QueueText("Forced")
+	if _, err := gc.Generate(context.Background(), geminiclient.NewTextRequest("Hello").WithModel("gemini-1.5-pro")); err != nil {
+		t.Fatal(err)
+	}
+	if modelName := fake.LastRequest().Config.ModelName; modelName != "gemini-1.5-pro" {
+		t.Errorf("Expected the model of the request to be used, but got %s", modelName)
+	}
+}
+
+func TestCustomModelRouter(t *testing.T) {
+	cheap := func(gc *geminiclient.GeminiClient, modalities geminiclient.Modality, parts []genai.Part) (string, error) {
+		if modalities == geminiclient.ModalityText && geminiclient.EstimateTokens(parts...) < 100 {
+			return "gemini-1.5-flash", nil
+		}
+		return "gemini-1.5-pro", nil
+	}
+	gc, fake := geminitest.NewClient(t, geminiclient.WithModelRouter(cheap))
+	fake.QueueText("Hi")
+	if _, err := gc.Query("Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if modelName := fake.LastRequest().Config.ModelName; modelName != "gemini-1.5-flash" {
+		t.Errorf("Expected the cheap model for a short prompt, but got %s", modelName)
+	}
+}
@@ -0,0 +1,512 @@
+package geminiclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/env/v2"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	defaultStagingPrefix    = "geminiclient-staging/"
+	defaultStagingThreshold = 8 << 20  // 8 MiB, which leaves room for other parts within the 20 MB request limit
+	defaultStagingChunkSize = 16 << 20 // 16 MiB
+	defaultStagingTTL       = 24 * time.Hour
+	defaultStorageEndpoint  = "https://storage.googleapis.com"
+	stagingChunkMultiple    = 256 << 10 // the chunks of a resumable upload must be a multiple of 256 KiB
+	statusResumeIncomplete  = 308
+)
+
+// StagingPolicy configures how large parts are uploaded to a Cloud Storage bucket, and sent as gs:// URIs
+// instead of inline data, which has a request size limit. Staging only works with Vertex AI, so parts are sent
+// inline to the other backends, and the Vertex AI service agent of the project must be able to read the bucket.
+// See SetStaging.
+type StagingPolicy struct {
+	Enabled   bool
+	Bucket    string        // the name of the bucket, like "my-project-gemini-staging"
+	Prefix    string        // the prefix of the object names, or "" for "geminiclient-staging/"
+	Threshold int           // parts with more bytes than this are staged, or 0 for the default of 8 MiB
+	ChunkSize int           // the size of each request of a resumable upload, a multiple of 256 KiB, or 0 for 16 MiB
+	TTL       time.Duration // how long staged objects are kept after they were last used, or 0 for 24 hours
+	Endpoint  string        // the Cloud Storage endpoint, or "" for $STORAGE_EMULATOR_HOST or https://storage.googleapis.com
+}
+
+// storageObject is the part of a Cloud Storage object resource that is used
+type storageObject struct {
+	Name        string            `json:"name,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Size        string            `json:"size,omitempty"`
+	CustomTime  *time.Time        `json:"customTime,omitempty"`
+	TimeCreated *time.Time        `json:"timeCreated,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// DefaultStagingPolicy returns a staging policy for the given bucket, with the default settings.
+func DefaultStagingPolicy(bucket string) StagingPolicy {
+	return StagingPolicy{
+		Enabled:   true,
+		Bucket:    bucket,
+		Prefix:    defaultStagingPrefix,
+		Threshold: defaultStagingThreshold,
+		ChunkSize: defaultStagingChunkSize,
+		TTL:       defaultStagingTTL,
+	}
+}
+
+// SetStaging configures the staging of large parts in Cloud Storage. Parts of requests that have more bytes than
+// the threshold are uploaded with a resumable upload, named by the SHA-256 hash of the contents so that the same
+// data is only uploaded once, and replaced by a genai.FileData with a gs:// URI. See also CleanupStaging and
+// ApplyStagingLifecycle, for removing staged objects that are no longer used.
+func (gc *GeminiClient) SetStaging(policy StagingPolicy) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	gc.Staging = policy
+	gc.staged = nil
+	gc.storage = nil
+}
+
+// validate returns an error if the staging policy is enabled and has invalid settings.
+func (policy StagingPolicy) validate() error {
+	if !policy.Enabled {
+		return nil
+	}
+	switch {
+	case policy.Bucket == "":
+		return errors.New("the staging bucket is empty")
+	case policy.Threshold < 0:
+		return fmt.Errorf("the staging threshold must not be negative, but is %d", policy.Threshold)
+	case policy.ChunkSize < 0 || policy.ChunkSize%stagingChunkMultiple != 0:
+		return fmt.Errorf("the staging chunk size must be a multiple of 256 KiB, but is %d", policy.ChunkSize)
+	case policy.TTL < 0:
+		return fmt.Errorf("the staging TTL must not be negative, but is %v", policy.TTL)
+	}
+	return nil
+}
+
+func (policy StagingPolicy) prefix() string {
+	if policy.Prefix == "" {
+		return defaultStagingPrefix
+	}
+	return policy.Prefix
+}
+
+func (policy StagingPolicy) threshold() int {
+	if policy.Threshold == 0 {
+		return defaultStagingThreshold
+	}
+	return policy.Threshold
+}
+
+func (policy StagingPolicy) chunkSize() int {
+	if policy.ChunkSize == 0 {
+		return defaultStagingChunkSize
+	}
+	return policy.ChunkSize
+}
+
+func (policy StagingPolicy) ttl() time.Duration {
+	if policy.TTL == 0 {
+		return defaultStagingTTL
+	}
+	return policy.TTL
+}
+
+// endpoint returns the Cloud Storage endpoint, and true if it is an emulator from $STORAGE_EMULATOR_HOST.
+func (policy StagingPolicy) endpoint() (string, bool) {
+	if policy.Endpoint != "" {
+		return strings.TrimSuffix(policy.Endpoint, "/"), false
+	}
+	if host := env.Str("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		return strings.TrimSuffix(host, "/"), true
+	}
+	return defaultStorageEndpoint, false
+}
+
+// storageClient returns the HTTP client for Cloud Storage, with the credentials of the client.
+func (gc *GeminiClient) storageClient(ctx context.Context) (*http.Client, error) {
+	gc.mu.Lock()
+	client := gc.storage
+	gc.mu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+	base := http.DefaultTransport
+	if gc.httpClient != nil && gc.httpClient.Transport != nil {
+		base = gc.httpClient.Transport
+	}
+	client = &http.Client{Transport: base}
+	if _, emulator := gc.Staging.endpoint(); !gc.withoutAuth && !emulator {
+		_, tokenSource, err := gc.credentials(ctx)
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = &oauth2.Transport{Source: tokenSource, Base: base}
+	}
+	gc.mu.Lock()
+	gc.storage = client
+	gc.mu.Unlock()
+	return client, nil
+}
+
+// storageRequest sends a JSON request to the Cloud Storage JSON API, and decodes the JSON response into result, if it is not nil.
+func (gc *GeminiClient) storageRequest(ctx context.Context, method, path string, body, result any) error {
+	client, err := gc.storageClient(ctx)
+	if err != nil {
+		return err
+	}
+	endpoint, _ := gc.Staging.endpoint()
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return httpError(resp)
+	}
+	defer resp.Body.Close()
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// objectPath returns the path of the given object in the staging bucket.
+func (policy StagingPolicy) objectPath(name string) string {
+	return "/storage/v1/b/" + url.PathEscape(policy.Bucket) + "/o/" + url.PathEscape(name)
+}
+
+// usesVertex returns true if the requests are sent to Vertex AI, and not to another backend.
+func (gc *GeminiClient) usesVertex() bool {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if gc.Backend == nil {
+		return gc.Client != nil
+	}
+	_, ok := gc.Backend.(*VertexBackend)
+	return ok
+}
+
+// stage returns the request with the parts that are larger than the threshold uploaded to Cloud Storage
+// and replaced by gs:// URIs, if staging is enabled.
+func (gc *GeminiClient) stage(ctx context.Context, req *Request) (*Request, error) {
+	parts, err := gc.stageParts(ctx, req.parts)
+	if err != nil {
+		return nil, err
+	}
+	if parts == nil {
+		return req, nil
+	}
+	req = req.clone()
+	req.parts = parts
+	return req, nil
+}
+
+// stageParts returns the given parts with the large blobs replaced by gs:// URIs, or nil if no parts were staged.
+// Nothing is staged for other backends than Vertex AI, since they can not read gs:// URIs.
+func (gc *GeminiClient) stageParts(ctx context.Context, parts []genai.Part) ([]genai.Part, error) {
+	if !gc.Staging.Enabled || !gc.usesVertex() {
+		return nil, nil
+	}
+	var staged []genai.Part
+	for i, part := range parts {
+		blob, ok := part.(genai.Blob)
+		if !ok || len(blob.Data) <= gc.Staging.threshold() {
+			continue
+		}
+		uri, err := gc.stageBlob(ctx, blob)
+		if err != nil {
+			return nil, fmt.Errorf("could not stage a part of %d bytes in Cloud Storage: %w", len(blob.Data), err)
+		}
+		if staged == nil {
+			staged = append([]genai.Part{}, parts...)
+		}
+		staged[i] = genai.FileData{MIMEType: blob.MIMEType, FileURI: uri}
+	}
+	return staged, nil
+}
+
+// stageBlob uploads the given blob to the staging bucket, unless it is already there, and returns the gs:// URI.
+// Objects that are used again get a new custom time, so that they are not removed by the lifecycle rule.
+func (gc *GeminiClient) stageBlob(ctx context.Context, blob genai.Blob) (string, error) {
+	sum := sha256.Sum256(blob.Data)
+	name := gc.Staging.prefix() + hex.EncodeToString(sum[:])
+	uri := "gs://" + gc.Staging.Bucket + "/" + name
+
+	// Objects that were staged or touched recently are used without asking Cloud Storage
+	gc.mu.Lock()
+	touched, ok := gc.staged[name]
+	gc.mu.Unlock()
+	if ok && time.Since(touched) < gc.Staging.ttl()/2 {
+		return uri, nil
+	}
+
+	now := time.Now().UTC()
+	var existing storageObject
+	err := gc.storageRequest(ctx, http.MethodGet, gc.Staging.objectPath(name), nil, &existing)
+	switch {
+	case err == nil && existing.Size == strconv.Itoa(len(blob.Data)):
+		if err := gc.storageRequest(ctx, http.MethodPatch, gc.Staging.objectPath(name), storageObject{CustomTime: &now}, nil); err != nil {
+			return "", err
+		}
+		if gc.Verbose {
+			fmt.Printf("Using %s, which is already staged.\n", uri)
+		}
+	case err == nil || errorCode(err) == codes.NotFound:
+		if err := gc.upload(ctx, name, blob, now); err != nil {
+			return "", err
+		}
+		if gc.Verbose {
+			fmt.Printf("Staged %d bytes as %s.\n", len(blob.Data), uri)
+		}
+	default:
+		return "", err
+	}
+
+	gc.mu.Lock()
+	if gc.staged == nil {
+		gc.staged = make(map[string]time.Time)
+	}
+	gc.staged[name] = now
+	gc.mu.Unlock()
+	return uri, nil
+}
+
+// upload uploads the given blob to the staging bucket with a resumable upload. Chunks that fail with a transient
+// error are retried according to the retry policy, from where the server says that the upload got to.
+// Failing to ask the server where the upload got to counts as a failed attempt of the same chunk.
+func (gc *GeminiClient) upload(ctx context.Context, name string, blob genai.Blob, now time.Time) error {
+	client, err := gc.storageClient(ctx)
+	if err != nil {
+		return err
+	}
+	endpoint, _ := gc.Staging.endpoint()
+	metadata, err := json.Marshal(storageObject{
+		Name:        name,
+		ContentType: blob.MIMEType,
+		CustomTime:  &now,
+		Metadata:    map[string]string{"staged-by": "geminiclient"},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		endpoint+"/upload/storage/v1/b/"+url.PathEscape(gc.Staging.Bucket)+"/o?uploadType=resumable", bytes.NewReader(metadata))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Upload-Content-Type", blob.MIMEType)
+	req.Header.Set("X-Upload-Content-Length", strconv.Itoa(len(blob.Data)))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return httpError(resp)
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return errors.New("no upload session was returned by Cloud Storage")
+	}
+
+	offset, done, resume := 0, false, false
+	for attempt := 1; !done; {
+		var err error
+		if resume {
+			// The failed chunk may have been partly received, so ask where to continue from
+			offset, done, err = uploadStatus(ctx, client, session, len(blob.Data))
+		} else {
+			offset, done, err = gc.putChunk(ctx, client, session, blob.Data, offset)
+		}
+		if err == nil {
+			// Asking for the status is a part of retrying the chunk, so only a sent chunk starts a new attempt budget
+			if !resume {
+				attempt = 1
+			}
+			resume = false
+			continue
+		}
+		if attempt >= max(gc.Retry.MaxAttempts, 1) || !retryableUploadError(gc.Retry, err) {
+			return err
+		}
+		select {
+		case <-time.After(gc.Retry.Delay(attempt, err)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		attempt++
+		resume = true
+	}
+	return nil
+}
+
+// retryableUploadError returns true if the given error from an upload is retryable, including network errors.
+func retryableUploadError(policy RetryPolicy, err error) bool {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	return policy.Retryable(err)
+}
+
+// putChunk sends the next chunk of the data, starting at offset, to the given upload session.
+// It returns the offset of the next chunk, and true if the upload is complete.
+func (gc *GeminiClient) putChunk(ctx context.Context, client *http.Client, session string, data []byte, offset int) (int, bool, error) {
+	end := min(offset+gc.Staging.chunkSize(), len(data))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, session, bytes.NewReader(data[offset:end]))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, len(data)))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	return uploadProgress(resp)
+}
+
+// uploadStatus asks how much of the data the given upload session has received.
+func uploadStatus(ctx context.Context, client *http.Client, session string, size int) (int, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, session, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	return uploadProgress(resp)
+}
+
+// uploadProgress returns the offset that a resumable upload should continue from, and true if the upload is complete.
+func uploadProgress(resp *http.Response) (int, bool, error) {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		resp.Body.Close()
+		return 0, true, nil
+	case statusResumeIncomplete:
+		resp.Body.Close()
+		// The Range header is like "bytes=0-524287", and is missing if nothing has been received
+		last, ok := strings.CutPrefix(resp.Header.Get("Range"), "bytes=0-")
+		if !ok {
+			return 0, false, nil
+		}
+		n, err := strconv.Atoi(last)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid Range header from Cloud Storage: %s", resp.Header.Get("Range"))
+		}
+		return n + 1, false, nil
+	}
+	return 0, false, httpError(resp)
+}
+
+// CleanupStaging removes the staged objects that have not been used for longer than the TTL of the staging policy,
+// and returns how many were removed. See ApplyStagingLifecycle for letting Cloud Storage do this instead.
+func (gc *GeminiClient) CleanupStaging(ctx context.Context) (int, error) {
+	if !gc.Staging.Enabled {
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-gc.Staging.ttl())
+	removed := 0
+	for pageToken := ""; ; {
+		query := url.Values{"prefix": {gc.Staging.prefix()}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		var list struct {
+			Items         []storageObject `json:"items"`
+			NextPageToken string          `json:"nextPageToken"`
+		}
+		if err := gc.storageRequest(ctx, http.MethodGet, "/storage/v1/b/"+url.PathEscape(gc.Staging.Bucket)+"/o?"+query.Encode(), nil, &list); err != nil {
+			return removed, err
+		}
+		for _, object := range list.Items {
+			used := object.CustomTime
+			if used == nil {
+				used = object.TimeCreated
+			}
+			if used == nil || used.After(cutoff) {
+				continue
+			}
+			if err := gc.storageRequest(ctx, http.MethodDelete, gc.Staging.objectPath(object.Name), nil, nil); err != nil && errorCode(err) != codes.NotFound {
+				return removed, err
+			}
+			removed++
+			gc.mu.Lock()
+			delete(gc.staged, object.Name)
+			gc.mu.Unlock()
+		}
+		if pageToken = list.NextPageToken; pageToken == "" {
+			return removed, nil
+		}
+	}
+}
+
+// ApplyStagingLifecycle adds a lifecycle rule to the staging bucket, which makes Cloud Storage delete staged objects
+// that have not been used for longer than the TTL of the staging policy, rounded up to whole days. Other lifecycle
+// rules of the bucket are kept. This needs permission to update the bucket, so it is not done by SetStaging.
+func (gc *GeminiClient) ApplyStagingLifecycle(ctx context.Context) error {
+	if !gc.Staging.Enabled {
+		return errors.New("staging is not enabled")
+	}
+	type lifecycle struct {
+		Rule []map[string]any `json:"rule"`
+	}
+	var bucket struct {
+		Lifecycle lifecycle `json:"lifecycle"`
+	}
+	bucketPath := "/storage/v1/b/" + url.PathEscape(gc.Staging.Bucket)
+	if err := gc.storageRequest(ctx, http.MethodGet, bucketPath+"?fields=lifecycle", nil, &bucket); err != nil {
+		return err
+	}
+	// Replace the rule for the same prefix, if there is one
+	prefix := gc.Staging.prefix()
+	rules := []map[string]any{}
+	for _, rule := range bucket.Lifecycle.Rule {
+		if condition, ok := rule["condition"].(map[string]any); ok {
+			if prefixes, ok := condition["matchesPrefix"].([]any); ok && len(prefixes) == 1 && prefixes[0] == prefix {
+				continue
+			}
+		}
+		rules = append(rules, rule)
+	}
+	days := int((gc.Staging.ttl() + 24*time.Hour - 1) / (24 * time.Hour))
+	rules = append(rules, map[string]any{
+		"action":    map[string]any{"type": "Delete"},
+		"condition": map[string]any{"daysSinceCustomTime": days, "matchesPrefix": []string{prefix}},
+	})
+	return gc.storageRequest(ctx, http.MethodPatch, bucketPath, map[string]any{"lifecycle": lifecycle{Rule: rules}}, nil)
+}
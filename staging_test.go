@@ -0,0 +1,209 @@
+package geminiclient_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
+	"google.golang.org/grpc/codes"
+)
+
+// testStagingPolicy returns a staging policy for parts above 1 KiB, in chunks of 256 KiB, for the given fake Cloud Storage server
+func testStagingPolicy(storage *geminitest.StorageServer) geminiclient.StagingPolicy {
+	policy := geminiclient.DefaultStagingPolicy("staging-bucket")
+	policy.Threshold, policy.ChunkSize, policy.Endpoint = 1024, 256<<10, storage.URL
+	return policy
+}
+
+// stagingClient returns a client that sends requests to a fake Vertex AI server, and stages parts in a fake Cloud Storage server
+func stagingClient(t *testing.T, opts ...geminiclient.Option) (*geminiclient.GeminiClient, *geminitest.Fake, *geminitest.StorageServer) {
+	storage := geminitest.NewStorageServer(t)
+	fake := geminitest.New()
+	t.Cleanup(func() { fake.AssertExhausted(t) })
+	gc := geminitest.NewVertexServer(t, fake).NewClient(t, append([]geminiclient.Option{geminiclient.WithStaging(testStagingPolicy(storage))}, opts...)...)
+	return gc, fake, storage
+}
+
+func TestStaging(t *testing.T) {
+	gc, fake, storage := stagingClient(t)
+	video := bytes.Repeat([]byte("frame"), 120_000) // 600 kB, so 3 chunks
+
+	for i := 0; i < 2; i++ {
+		fake.QueueText("A video of frames")
+		req := geminiclient.NewTextRequest("Describe this video").WithData("video/mp4", video).WithData("image/png", []byte("small"))
+		if _, err := gc.Generate(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		parts := fake.LastRequest().Contents[0].Parts
+		fileData, ok := parts[1].(genai.FileData)
+		if !ok || fileData.MIMEType != "video/mp4" || !strings.HasPrefix(fileData.FileURI, "gs://staging-bucket/geminiclient-staging/") {
+			t.Fatalf("Expected the video to be sent as a gs:// URI, but got %v", parts[1])
+		}
+		if _, ok := parts[2].(genai.Blob); !ok {
+			t.Errorf("Expected the small image to be sent inline, but got %T", parts[2])
+		}
+		name := strings.TrimPrefix(fileData.FileURI, "gs://staging-bucket/")
+		if data, ok := storage.Object("staging-bucket", name); !ok || !bytes.Equal(data, video) {
+			t.Errorf("Expected the video to be uploaded as %s", name)
+		}
+	}
+	if storage.Uploads() != 1 {
+		t.Errorf("Expected the same video to be uploaded once, but it was uploaded %d times", storage.Uploads())
+	}
+}
+
+func TestStagingResume(t *testing.T) {
+	gc, fake, storage := stagingClient(t, geminiclient.WithRetryPolicy(geminiclient.RetryPolicy{
+		MaxAttempts:    3,
+		BaseDelay:      time.Millisecond,
+		RetryableCodes: []codes.Code{codes.Unavailable},
+	}))
+	storage.FailChunks = 2
+	pdf := append([]byte("%PDF-1.7\n"), bytes.Repeat([]byte{0x42}, 700_000)...)
+
+	fake.QueueText("A report")
+	if _, err := gc.Generate(context.Background(), geminiclient.NewRequest(genai.Blob{MIMEType: "application/pdf", Data: pdf})); err != nil {
+		t.Fatal(err)
+	}
+	fileData := fake.LastRequest().Contents[0].Parts[0].(genai.FileData)
+	if data, _ := storage.Object("staging-bucket", strings.TrimPrefix(fileData.FileURI, "gs://staging-bucket/")); !bytes.Equal(data, pdf) {
+		t.Errorf("Expected the resumed upload to have all the data, but got %d of %d bytes", len(data), len(pdf))
+	}
+}
+
+func TestStagingResumeStatus(t *testing.T) {
+	retryPolicy := geminiclient.RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, RetryableCodes: []codes.Code{codes.Unavailable}}
+	gc, fake, storage := stagingClient(t, geminiclient.WithRetryPolicy(retryPolicy))
+	storage.FailChunks, storage.FailStatus = 2, 1
+	pdf := append([]byte("%PDF-1.7\n"), bytes.Repeat([]byte{0x42}, 700_000)...)
+
+	// A failed chunk, a failed status request, a failed chunk and a sent chunk is 4 attempts for the first chunk
+	fake.QueueText("A report")
+	if _, err := gc.Generate(context.Background(), geminiclient.NewRequest(genai.Blob{MIMEType: "application/pdf", Data: pdf})); err != nil {
+		t.Fatal(err)
+	}
+	fileData := fake.LastRequest().Contents[0].Parts[0].(genai.FileData)
+	if data, _ := storage.Object("staging-bucket", strings.TrimPrefix(fileData.FileURI, "gs://staging-bucket/")); !bytes.Equal(data, pdf) {
+		t.Errorf("Expected the resumed upload to have all the data, but got %d of %d bytes", len(data), len(pdf))
+	}
+
+	// Failed status requests use up the attempts of the same chunk
+	retryPolicy.MaxAttempts = 3
+	gc.SetRetryPolicy(retryPolicy)
+	storage.FailChunks, storage.FailStatus = 1, 5
+	_, err := gc.Generate(context.Background(), geminiclient.NewRequest(genai.Blob{MIMEType: "application/pdf", Data: append(pdf, '!')}))
+	if err == nil || !strings.Contains(err.Error(), "the service is unavailable") {
+		t.Errorf("Expected the upload to fail after 3 attempts, but got %v", err)
+	}
+	if storage.FailStatus != 3 {
+		t.Errorf("Expected 2 status requests, but got %d", 5-storage.FailStatus)
+	}
+}
+
+func TestStagingOtherBackends(t *testing.T) {
+	storage := geminitest.NewStorageServer(t)
+	gc, fake := geminitest.NewClient(t, geminiclient.WithStaging(testStagingPolicy(storage)), geminiclient.WithoutAuthentication())
+	video := bytes.Repeat([]byte("frame"), 1000)
+
+	// Other backends than Vertex AI can not read gs:// URIs, so the parts are sent inline
+	fake.QueueText("A video of frames")
+	if _, err := gc.Generate(context.Background(), geminiclient.NewRequest(genai.Blob{MIMEType: "video/mp4", Data: video})); err != nil {
+		t.Fatal(err)
+	}
+	if blob, ok := fake.LastRequest().Contents[0].Parts[0].(genai.Blob); !ok || !bytes.Equal(blob.Data, video) {
+		t.Errorf("Expected the video to be sent inline, but got %T", fake.LastRequest().Contents[0].Parts[0])
+	}
+	if storage.Uploads() != 0 {
+		t.Errorf("Expected nothing to be staged, but %d files were uploaded", storage.Uploads())
+	}
+}
+
+func TestStagingCached(t *testing.T) {
+	cache := geminiclient.NewMemoryCache(10)
+	gc, fake, storage := stagingClient(t, geminiclient.WithCache(cache, 0))
+	other, _, otherStorage := stagingClient(t, geminiclient.WithCache(cache, 0))
+	req := geminiclient.NewTextRequest("Describe this video").WithData("video/mp4", bytes.Repeat([]byte("frame"), 1000))
+
+	fake.QueueText("A video of frames")
+	if _, err := gc.Generate(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if storage.Uploads() != 1 {
+		t.Fatalf("Expected the video to be staged once, but it was uploaded %d times", storage.Uploads())
+	}
+
+	// A cached response is returned without staging the video, also when it is streamed
+	res, err := other.Generate(context.Background(), req)
+	if err != nil || !res.Metadata.Cached {
+		t.Fatalf("Expected a cached response, but got %v and %v", res, err)
+	}
+	var streamed string
+	if res, err = other.GenerateStream(context.Background(), req, func(s string) { streamed += s }); err != nil || !res.Metadata.Cached || streamed != "A video of frames" {
+		t.Fatalf("Expected a cached response to be streamed, but got %q and %v", streamed, err)
+	}
+	if otherStorage.Uploads() != 0 || len(otherStorage.Objects("staging-bucket")) != 0 {
+		t.Errorf("Expected nothing to be staged for cached responses, but %d files were uploaded", otherStorage.Uploads())
+	}
+}
+
+func TestStagingCleanup(t *testing.T) {
+	gc, fake, storage := stagingClient(t)
+	for _, data := range []string{strings.Repeat("old ", 1000), strings.Repeat("new ", 1000)} {
+		fake.QueueText("OK")
+		if _, err := gc.Generate(context.Background(), geminiclient.NewRequest(genai.Blob{MIMEType: "text/plain", Data: []byte(data)})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	objects := storage.Objects("staging-bucket")
+	if len(objects) != 2 {
+		t.Fatalf("Expected 2 staged objects, but got %v", objects)
+	}
+	storage.SetCustomTime("staging-bucket", objects[0], time.Now().Add(-48*time.Hour))
+
+	removed, err := gc.CleanupStaging(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left := storage.Objects("staging-bucket"); removed != 1 || len(left) != 1 || left[0] != objects[1] {
+		t.Errorf("Expected the old object to be removed, but %d were removed and %v are left", removed, left)
+	}
+
+	if err := gc.ApplyStagingLifecycle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.ApplyStagingLifecycle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var lifecycle struct {
+		Rule []struct {
+			Action    struct{ Type string }
+			Condition struct {
+				DaysSinceCustomTime int
+				MatchesPrefix       []string
+			}
+		}
+	}
+	if err := json.Unmarshal(storage.Lifecycle("staging-bucket"), &lifecycle); err != nil {
+		t.Fatal(err)
+	}
+	if len(lifecycle.Rule) != 1 || lifecycle.Rule[0].Action.Type != "Delete" || lifecycle.Rule[0].Condition.DaysSinceCustomTime != 1 || lifecycle.Rule[0].Condition.MatchesPrefix[0] != "geminiclient-staging/" {
+		t.Errorf("Expected one lifecycle rule for deleting staged objects after a day, but got %s", storage.Lifecycle("staging-bucket"))
+	}
+}
+
+func TestStagingPolicy(t *testing.T) {
+	for _, policy := range []geminiclient.StagingPolicy{
+		{Enabled: true},
+		{Enabled: true, Bucket: "b", ChunkSize: 1000},
+	} {
+		if _, err := geminiclient.NewClient(context.Background(), geminiclient.WithBackend(geminitest.New()), geminiclient.WithStaging(policy)); err == nil {
+			t.Errorf("Expected an error for the staging policy %+v", policy)
+		}
+	}
+}
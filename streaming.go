@@ -12,54 +12,151 @@ import (
 
 // SubmitToClientStreaming sends the current parts to Gemini, and streams the response back by calling the streamCallback function.
 func (gc *GeminiClient) SubmitToClientStreaming(ctx context.Context, streamCallback func(string)) (result string, err error) {
-	if streamCallback == nil {
-		return "", errors.New("the given streamCallback function cannot be null")
+	res, err := gc.GenerateStream(ctx, gc.Request(), streamCallback)
+	if err != nil {
+		return "", err
 	}
+	gc.setMetadata(res.Metadata)
+	return res.Text, nil
+}
 
+// GenerateStream sends the given request to the model and streams the response back by calling
+// the streamCallback function for every text part that arrives. A cached response is replayed through
+// the streamCallback function as a single text part.
+// GenerateStream does not modify the client, so it is safe to call from several goroutines at the same time.
+func (gc *GeminiClient) GenerateStream(ctx context.Context, req *Request, streamCallback func(string)) (response *Response, err error) {
+	if streamCallback == nil {
+		return nil, errors.New("the given streamCallback function cannot be null")
+	}
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("panic occurred: %v", r)
 		}
 	}()
+	if len(req.parts) == 0 {
+		return nil, ErrEmptyPrompt
+	}
+	if req, err = gc.route(req); err != nil {
+		return nil, err
+	}
 
-	// Configure the model
-	model := gc.Client.GenerativeModel(gc.ModelName)
-	model.SetTemperature(gc.Temperature)
-
-	// Start streaming the response
-	iter := model.GenerateContentStream(ctx, gc.Parts...)
+	// The cache is looked up before large parts are staged, like in Generate
+	key, cached := gc.cacheLookup(req)
+	if cached != nil {
+		streamCallback(cached.Text)
+		return cached, nil
+	}
 
-	for {
-		resp, err := iter.Next()
-		if err == iterator.Done {
-			// Ensure all remaining parts are processed
-			break
-		}
+	return gc.coalesce(ctx, req, streamCallback, func(ctx context.Context, streamCallback func(string)) (*Response, error) {
+		req, err := gc.stage(ctx, req)
 		if err != nil {
-			return "", fmt.Errorf("streaming error: %v", err)
+			return nil, err
 		}
-		if len(resp.Candidates) == 0 {
-			return "", errors.New("empty response when streaming")
+		response, err := gc.withFallback(ctx, req, false, func(ctx context.Context, backend Backend, modelName string) (*Response, error) {
+			return gc.stream(ctx, backend, modelName, req, streamCallback)
+		})
+		if err != nil {
+			return nil, err
 		}
+		gc.cacheStore(key, response)
+		return response, nil
+	})
+}
 
-		// Process each candidate's parts
-		for _, candidate := range resp.Candidates {
-			for _, part := range candidate.Content.Parts {
-				switch p := part.(type) {
-				case genai.Text:
-					partialResult := string(p)
-					streamCallback(partialResult)
-					result += partialResult
-				default:
-					// Handle or skip other types like Blob, FileData, etc.
+// stream sends the given request to the given model and streams the response back by calling the streamCallback function.
+// Function calls in the streamed response are handled like in generate, and the results are sent back in a new stream.
+// Errors that happen after a part of the response has been streamed are not retried, and do not fall back to other models.
+func (gc *GeminiClient) stream(ctx context.Context, backend Backend, modelName string, req *Request, streamCallback func(string)) (*Response, error) {
+	cfg := gc.modelConfig(modelName, req)
+	contents := []*genai.Content{genai.NewUserContent(req.parts...)}
+	response := &Response{}
+	var result strings.Builder
+	for round := 0; ; round++ {
+		// Start streaming the response. Transient errors are retried until the first response has arrived.
+		var (
+			iter        ResponseIterator
+			resp        *genai.GenerateContentResponse
+			reservation *Reservation
+		)
+		attempts, err := gc.withRetry(ctx, func(ctx context.Context) error {
+			var err error
+			reservation, err = gc.reserve(ctx, modelName, historyParts(contents)...)
+			if err != nil {
+				return err
+			}
+			iter = backend.GenerateContentStream(ctx, cfg, contents...)
+			resp, err = iter.Next()
+			if err != nil && err != iterator.Done {
+				reconcile(reservation, nil, err)
+			}
+			return err
+		})
+		response.Metadata.Attempts += attempts
+
+		var calls []genai.Part
+		response.Raw = nil
+		for ; err != iterator.Done; resp, err = iter.Next() {
+			if err != nil {
+				err = fmt.Errorf("streaming error: %w", err)
+				if result.Len() > 0 || round > 0 { // text has been streamed, or functions have been called
+					return nil, &noFallbackError{err}
+				}
+				return nil, err
+			}
+			if len(resp.Candidates) == 0 {
+				return nil, errors.New("empty response when streaming")
+			}
+			if resp.UsageMetadata != nil {
+				response.Metadata.UsageMetadata = resp.UsageMetadata
+			}
+			response.Raw = joinResponses(response.Raw, resp)
+
+			// Process each candidate's parts
+			for _, candidate := range resp.Candidates {
+				if candidate.Content == nil {
+					continue
+				}
+				for _, part := range candidate.Content.Parts {
+					switch p := part.(type) {
+					case genai.Text:
+						partialResult := string(p)
+						streamCallback(partialResult)
+						result.WriteString(partialResult)
+					case genai.FunctionCall:
+						calls = append(calls, p)
+					default:
+						// Handle or skip other types like Blob, FileData, etc.
+					}
 				}
 			}
 		}
+		reconcile(reservation, &genai.GenerateContentResponse{UsageMetadata: response.Metadata.UsageMetadata}, nil)
+		if len(calls) == 0 {
+			break
+		}
+		if round >= maxFunctionCallRounds {
+			return nil, fmt.Errorf("gave up after %d rounds of function calls", round)
+		}
+
+		// Run the functions, and send the results back together with the conversation so far
+		results := make([]genai.Part, 0, len(calls))
+		for _, part := range calls {
+			call := part.(genai.FunctionCall)
+			responseData, err := req.handleFunctionCall(ctx, call)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, genai.FunctionResponse{
+				Name:     call.Name,
+				Response: responseData,
+			})
+		}
+		contents = append(contents, &genai.Content{Role: "model", Parts: calls}, genai.NewUserContent(results...))
 	}
 
-	// Final call to ensure all results are processed and returned
+	response.Text = result.String()
 	if gc.Trim {
-		result = strings.TrimSpace(result)
+		response.Text = strings.TrimSpace(response.Text)
 	}
-	return result, nil
+	return response, nil
 }
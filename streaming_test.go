@@ -2,48 +2,39 @@ package geminiclient_test
 
 import (
 	"context"
-	"fmt"
+	"slices"
 	"strings"
 	"testing"
-	"time"
 
-	"github.com/xyproto/geminiclient"
+	"github.com/xyproto/geminiclient/geminitest"
 )
 
 // TestSubmitToClientStreaming tests the SubmitToClientStreaming function.
 func TestSubmitToClientStreaming(t *testing.T) {
-	// Initialize a new GeminiClient
-	gc := geminiclient.MustNewWithTimeout("gemini-1.5-pro", 0.0, 10*time.Second)
-
-	// Create a context
-	ctx := context.Background()
+	gc, fake := geminitest.NewClient(t)
+	chunks := []string{"Once upon a time, ", "a magic backpack ", "carried the world."}
+	fake.QueueStream(chunks...)
 
 	// Define a prompt and add it as text to the GeminiClient
 	prompt := "Write a story about a magic backpack, around 50 words. Make sure to include the phrase \"magic backpack\"."
 	gc.AddText(prompt)
 
 	// Capture the streamed content
-	var streamedContent strings.Builder
-	streamCallback := func(part string) {
-		fmt.Println("Streaming part:", part) // Debugging output
-		streamedContent.WriteString(part)
-	}
-
-	// Run the SubmitToClientStreaming function
-	_, err := gc.SubmitToClientStreaming(ctx, streamCallback)
+	var streamed []string
+	result, err := gc.SubmitToClientStreaming(context.Background(), func(part string) {
+		streamed = append(streamed, part)
+	})
 	if err != nil {
 		t.Fatalf("Streaming failed: %v", err)
 	}
 
-	// Check if the streamed content is not empty
-	if streamedContent.Len() == 0 {
-		t.Fatal("Expected streamed content, but got empty result")
+	if !slices.Equal(streamed, chunks) {
+		t.Errorf("Expected the chunks %q to be streamed, but got %q", chunks, streamed)
 	}
-
-	// Optional: Check if the streamed content contains expected text
-	if !strings.Contains(streamedContent.String(), "magic backpack") {
-		t.Fatalf("Expected streamed content to contain 'magic backpack', but it didn't. Actual content: %s", streamedContent.String())
+	if result != strings.Join(chunks, "") {
+		t.Errorf("Expected the whole story to be returned, but got %q", result)
+	}
+	if req := fake.LastRequest(); req.Method != "GenerateContentStream" || req.Text() != prompt {
+		t.Errorf("Expected a streaming request with the prompt, but got %s with %q", req.Method, req.Text())
 	}
-
-	fmt.Println("Streamed content:", streamedContent.String())
 }
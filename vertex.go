@@ -0,0 +1,158 @@
+package geminiclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/googleapis/gax-go/v2/callctx"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// VertexBackend is a Backend for Gemini models on Vertex AI. This is the default backend.
+type VertexBackend struct {
+	Client    *genai.Client
+	ProjectID string
+	Location  string
+	Headers   http.Header // Extra headers for every request
+
+	options []option.ClientOption // for creating clients for other locations
+}
+
+// vertexStream is a ResponseIterator that works around the REST transport of the genai package,
+// which can fail with a JSON syntax error at the closing bracket of a streamed response.
+type vertexStream struct {
+	iter      *genai.GenerateContentResponseIterator
+	projectID string
+	received  bool
+}
+
+// vertexChat is a ChatSession that uses the chat sessions of the genai package.
+type vertexChat struct {
+	session *genai.ChatSession
+	backend *VertexBackend
+}
+
+// NewVertexBackend creates a new Vertex AI backend for the given Google Cloud project and location.
+func NewVertexBackend(ctx context.Context, projectID, location string, opts ...option.ClientOption) (*VertexBackend, error) {
+	client, err := genai.NewClient(ctx, projectID, location, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create genai client: %v", err)
+	}
+	return &VertexBackend{
+		Client:    client,
+		ProjectID: projectID,
+		Location:  location,
+		options:   opts,
+	}, nil
+}
+
+// WithLocation returns a new Vertex AI backend for the same project, but for another location.
+func (b *VertexBackend) WithLocation(ctx context.Context, location string) (Backend, error) {
+	backend, err := NewVertexBackend(ctx, b.ProjectID, location, b.options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create genai client for %s: %v", location, err)
+	}
+	backend.Headers = b.Headers
+	return backend, nil
+}
+
+// context returns a context with the extra headers, which are sent with both the REST and the gRPC transport.
+func (b *VertexBackend) context(ctx context.Context) context.Context {
+	var keyvals []string
+	for key, values := range b.Headers {
+		for _, value := range values {
+			keyvals = append(keyvals, strings.ToLower(key), value)
+		}
+	}
+	if len(keyvals) == 0 {
+		return ctx
+	}
+	return callctx.SetHeaders(ctx, keyvals...)
+}
+
+// Close closes the underlying genai client.
+func (b *VertexBackend) Close() error {
+	return b.Client.Close()
+}
+
+// model configures a GenerativeModel with the given configuration.
+func (b *VertexBackend) model(cfg *ModelConfig) *genai.GenerativeModel {
+	model := b.Client.GenerativeModel(cfg.ModelName)
+	model.GenerationConfig = cfg.GenerationConfig
+	model.SystemInstruction = cfg.SystemInstruction
+	model.SafetySettings = cfg.SafetySettings
+	if len(cfg.Tools) > 0 {
+		model.Tools = cfg.Tools
+	}
+	return model
+}
+
+// session returns a chat session with all but the last of the given contents as the history.
+func (b *VertexBackend) session(cfg *ModelConfig, contents []*genai.Content) (*genai.ChatSession, []genai.Part) {
+	session := b.model(cfg).StartChat()
+	if len(contents) == 0 {
+		return session, nil
+	}
+	session.History = contents[:len(contents)-1]
+	return session, contents[len(contents)-1].Parts
+}
+
+// GenerateContent sends the given contents to the model.
+func (b *VertexBackend) GenerateContent(ctx context.Context, cfg *ModelConfig, contents ...*genai.Content) (*genai.GenerateContentResponse, error) {
+	session, parts := b.session(cfg, contents)
+	resp, err := session.SendMessage(b.context(ctx), parts...)
+	return resp, vertexError(b.ProjectID, err)
+}
+
+// GenerateContentStream sends the given contents to the model, and streams the response.
+func (b *VertexBackend) GenerateContentStream(ctx context.Context, cfg *ModelConfig, contents ...*genai.Content) ResponseIterator {
+	session, parts := b.session(cfg, contents)
+	return &vertexStream{iter: session.SendMessageStream(b.context(ctx), parts...), projectID: b.ProjectID}
+}
+
+// Next returns the next response, or iterator.Done at the end.
+func (s *vertexStream) Next() (*genai.GenerateContentResponse, error) {
+	resp, err := s.iter.Next()
+	var syntaxErr *json.SyntaxError
+	if s.received && errors.As(err, &syntaxErr) && strings.Contains(syntaxErr.Error(), "']'") {
+		return nil, iterator.Done
+	}
+	s.received = s.received || err == nil
+	return resp, vertexError(s.projectID, err)
+}
+
+// CountTokens counts the tokens in the given parts.
+func (b *VertexBackend) CountTokens(ctx context.Context, cfg *ModelConfig, parts ...genai.Part) (int, error) {
+	resp, err := b.model(cfg).CountTokens(b.context(ctx), parts...)
+	if err != nil {
+		return 0, vertexError(b.ProjectID, err)
+	}
+	return int(resp.TotalTokens), nil
+}
+
+// StartChat starts a new chat session.
+func (b *VertexBackend) StartChat(cfg *ModelConfig) ChatSession {
+	return &vertexChat{session: b.model(cfg).StartChat(), backend: b}
+}
+
+// SendMessage sends the given parts, together with the history.
+func (c *vertexChat) SendMessage(ctx context.Context, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	resp, err := c.session.SendMessage(c.backend.context(ctx), parts...)
+	return resp, vertexError(c.backend.ProjectID, err)
+}
+
+// History returns the messages so far.
+func (c *vertexChat) History() []*genai.Content {
+	return c.session.History
+}
+
+// SetHistory replaces the messages so far.
+func (c *vertexChat) SetHistory(history []*genai.Content) {
+	c.session.History = history
+}
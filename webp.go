@@ -0,0 +1,392 @@
+package geminiclient
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"sort"
+)
+
+// This is a small encoder for lossless WEBP (VP8L) images, since there is no WEBP encoder in the standard library
+// or in golang.org/x/image. It uses the subtract green and predictor transforms and one set of prefix codes,
+// but no color cache or backward references, so the images are a bit larger than the ones from libwebp.
+
+const (
+	webpTileBits        = 4 // the predictor modes are chosen per 16x16 tile
+	webpMaxCodeLength   = 15
+	webpMaxLengthLength = 7 // the code lengths of the code length code are written with 3 bits
+	webpGreenAlphabet   = 256 + 24
+	webpDistanceSymbols = 40
+)
+
+// webpCodeLengthOrder is the order that the code lengths of the code length code are written in
+var webpCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// webpPredictors are the predictor modes that are tried for each tile: L, T, Average2(L, T) and Select(L, T, TL)
+var webpPredictors = []uint8{1, 2, 7, 11}
+
+// bitWriter writes bits to a buffer, least significant bit first.
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nBits uint
+}
+
+func (w *bitWriter) writeBits(value uint32, n uint) {
+	w.acc |= uint64(value) << w.nBits
+	w.nBits += n
+	for w.nBits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nBits -= 8
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.nBits > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.nBits = 0, 0
+	}
+	return w.buf
+}
+
+// prefixCode is a canonical prefix (Huffman) code. A code with a single symbol uses no bits for it.
+type prefixCode struct {
+	lengths []uint8  // the code lengths, as written in the header
+	codes   []uint16 // the codes, with the bits reversed, ready for writing
+	bits    []uint8  // the number of bits that are written for each symbol
+}
+
+func (c *prefixCode) write(w *bitWriter, symbol int) {
+	w.writeBits(uint32(c.codes[symbol]), uint(c.bits[symbol]))
+}
+
+// huffmanLengths returns the code lengths of a Huffman code for the given symbol counts, limited to maxLength bits.
+// At least two symbols must have a count above zero.
+func huffmanLengths(counts []int, maxLength uint8) []uint8 {
+	type node struct {
+		weight      int
+		symbol      int // -1 for internal nodes
+		left, right int
+	}
+	for minCount := 1; ; minCount *= 2 {
+		var nodes []node
+		for symbol, count := range counts {
+			if count > 0 {
+				nodes = append(nodes, node{weight: max(count, minCount), symbol: symbol})
+			}
+		}
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].weight < nodes[j].weight })
+		// Merge the two lightest nodes until one is left. The merged nodes are appended in order of weight,
+		// so the lightest node is either the next leaf or the next merged node.
+		numLeaves, leaf, merged := len(nodes), 0, len(nodes)
+		lightest := func() int {
+			if leaf < numLeaves && (merged >= len(nodes) || nodes[leaf].weight <= nodes[merged].weight) {
+				leaf++
+				return leaf - 1
+			}
+			merged++
+			return merged - 1
+		}
+		for i := 0; i < numLeaves-1; i++ {
+			a, b := lightest(), lightest()
+			nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, symbol: -1, left: a, right: b})
+		}
+		lengths := make([]uint8, len(counts))
+		tooLong := false
+		var walk func(i int, depth uint8)
+		walk = func(i int, depth uint8) {
+			if nodes[i].symbol >= 0 {
+				lengths[nodes[i].symbol] = depth
+				tooLong = tooLong || depth > maxLength
+				return
+			}
+			walk(nodes[i].left, depth+1)
+			walk(nodes[i].right, depth+1)
+		}
+		walk(len(nodes)-1, 0)
+		if !tooLong {
+			return lengths
+		}
+	}
+}
+
+// newPrefixCode creates a canonical prefix code from the given code lengths.
+func newPrefixCode(lengths []uint8) *prefixCode {
+	c := &prefixCode{lengths: lengths, codes: make([]uint16, len(lengths)), bits: make([]uint8, len(lengths))}
+	var lengthCounts [webpMaxCodeLength + 1]int
+	used := 0
+	for _, length := range lengths {
+		if length > 0 {
+			lengthCounts[length]++
+			used++
+		}
+	}
+	if used == 1 {
+		return c // a single symbol is written with zero bits
+	}
+	var nextCode [webpMaxCodeLength + 1]int
+	code := 0
+	for length := 1; length <= webpMaxCodeLength; length++ {
+		code = (code + lengthCounts[length-1]) << 1
+		nextCode[length] = code
+	}
+	for symbol, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		code := nextCode[length]
+		nextCode[length]++
+		reversed := 0
+		for i := uint8(0); i < length; i++ {
+			reversed |= (code >> i & 1) << (length - 1 - i)
+		}
+		c.codes[symbol], c.bits[symbol] = uint16(reversed), length
+	}
+	return c
+}
+
+// writePrefixCode writes a prefix code for the given symbol counts, and returns it.
+func writePrefixCode(w *bitWriter, counts []int) *prefixCode {
+	var symbols []int
+	for symbol, count := range counts {
+		if count > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+	if len(symbols) == 0 {
+		symbols = []int{0}
+	}
+	if len(symbols) <= 2 && symbols[len(symbols)-1] < 256 {
+		// A simple code, with one or two 8 bit symbols
+		w.writeBits(1, 1)
+		w.writeBits(uint32(len(symbols)-1), 1)
+		w.writeBits(1, 1)
+		lengths := make([]uint8, len(counts))
+		for _, symbol := range symbols {
+			w.writeBits(uint32(symbol), 8)
+			lengths[symbol] = uint8(len(symbols) - 1)
+		}
+		c := &prefixCode{lengths: lengths, codes: make([]uint16, len(counts)), bits: lengths}
+		if len(symbols) == 2 {
+			c.codes[symbols[1]] = 1
+		}
+		return c
+	}
+	c := newPrefixCode(huffmanLengths(counts, webpMaxCodeLength))
+
+	// The code lengths are written with a code length code, without run lengths
+	lengthCounts := make([]int, len(webpCodeLengthOrder))
+	for _, length := range c.lengths {
+		lengthCounts[length]++
+	}
+	var lengthCode *prefixCode
+	if used := len(lengthCounts) - countZeros(lengthCounts); used == 1 {
+		lengths := make([]uint8, len(lengthCounts))
+		for length, count := range lengthCounts {
+			if count > 0 {
+				lengths[length] = 1
+			}
+		}
+		lengthCode = newPrefixCode(lengths)
+	} else {
+		lengthCode = newPrefixCode(huffmanLengths(lengthCounts, webpMaxLengthLength))
+	}
+	numCodes := 4
+	for i, length := range webpCodeLengthOrder {
+		if lengthCode.lengths[length] > 0 {
+			numCodes = max(numCodes, i+1)
+		}
+	}
+	w.writeBits(0, 1) // a normal code
+	w.writeBits(uint32(numCodes-4), 4)
+	for _, length := range webpCodeLengthOrder[:numCodes] {
+		w.writeBits(uint32(lengthCode.lengths[length]), 3)
+	}
+	w.writeBits(0, 1) // all symbols have a code length
+	for _, length := range c.lengths {
+		lengthCode.write(w, int(length))
+	}
+	return c
+}
+
+func countZeros(counts []int) int {
+	zeros := 0
+	for _, count := range counts {
+		if count == 0 {
+			zeros++
+		}
+	}
+	return zeros
+}
+
+// writeWEBPPixels writes an entropy coded image, which is the pixels as NRGBA bytes, with one set of prefix codes.
+// The meta prefix code bit is only written for the main image.
+func writeWEBPPixels(w *bitWriter, pix []byte, main bool) {
+	w.writeBits(0, 1) // no color cache
+	if main {
+		w.writeBits(0, 1) // no meta prefix codes
+	}
+	counts := [4][]int{make([]int, webpGreenAlphabet), make([]int, 256), make([]int, 256), make([]int, 256)}
+	for p := 0; p < len(pix); p += 4 {
+		counts[0][pix[p+1]]++
+		counts[1][pix[p+0]]++
+		counts[2][pix[p+2]]++
+		counts[3][pix[p+3]]++
+	}
+	var codes [4]*prefixCode
+	for i := range counts {
+		codes[i] = writePrefixCode(w, counts[i])
+	}
+	writePrefixCode(w, make([]int, webpDistanceSymbols))
+	for p := 0; p < len(pix); p += 4 {
+		codes[0].write(w, int(pix[p+1]))
+		codes[1].write(w, int(pix[p+0]))
+		codes[2].write(w, int(pix[p+2]))
+		codes[3].write(w, int(pix[p+3]))
+	}
+}
+
+// webpPredict returns the prediction for the channel at p of the given NRGBA pixels, with the given predictor mode.
+func webpPredict(pix []byte, p, top int, mode uint8) byte {
+	l, t := pix[p-4], pix[top]
+	switch mode {
+	case 1:
+		return l
+	case 2:
+		return t
+	case 7:
+		return byte((int(l) + int(t)) / 2)
+	}
+	// Select, which looks at all four channels of the pixels
+	c := p &^ 3
+	ct := top &^ 3
+	var predictLeft, predictTop int
+	for i := 0; i < 4; i++ {
+		predictLeft += absInt(int(pix[ct-4+i]) - int(pix[ct+i]))
+		predictTop += absInt(int(pix[ct-4+i]) - int(pix[c-4+i]))
+	}
+	if predictLeft < predictTop {
+		return l
+	}
+	return t
+}
+
+func absInt(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// webpResiduals applies the predictor transform to the given NRGBA pixels, and returns the residuals and the
+// predictor modes, as a sub-image of NRGBA pixels with the mode in the green channel.
+func webpResiduals(pix []byte, width, height int) (residuals, modes []byte) {
+	tiles := func(size int) int { return (size + 1<<webpTileBits - 1) >> webpTileBits }
+	tilesX, tilesY := tiles(width), tiles(height)
+	modes = make([]byte, 4*tilesX*tilesY)
+	residuals = make([]byte, len(pix))
+	stride := 4 * width
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			// Choose the mode with the smallest residuals in this tile
+			best, bestCost := webpPredictors[0], -1
+			for _, mode := range webpPredictors {
+				cost := 0
+				for y := max(ty<<webpTileBits, 1); y < min((ty+1)<<webpTileBits, height); y++ {
+					for x := max(tx<<webpTileBits, 1); x < min((tx+1)<<webpTileBits, width); x++ {
+						p := y*stride + 4*x
+						for i := 0; i < 4; i++ {
+							cost += absInt(int(int8(pix[p+i] - webpPredict(pix, p+i, p+i-stride, mode))))
+						}
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			q := 4 * (ty*tilesX + tx)
+			modes[q+1], modes[q+3] = best, 0xff
+		}
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := y*stride + 4*x
+			for i := 0; i < 4; i++ {
+				var prediction byte
+				switch {
+				case x == 0 && y == 0:
+					if i == 3 {
+						prediction = 0xff
+					}
+				case y == 0:
+					prediction = pix[p+i-4]
+				case x == 0:
+					prediction = pix[p+i-stride]
+				default:
+					prediction = webpPredict(pix, p+i, p+i-stride, modes[4*((y>>webpTileBits)*tilesX+(x>>webpTileBits))+1])
+				}
+				residuals[p+i] = pix[p+i] - prediction
+			}
+		}
+	}
+	return residuals, modes
+}
+
+// encodeWEBP writes the given image as a lossless WEBP image.
+func encodeWEBP(out io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 || width > 1<<14 || height > 1<<14 {
+		return errors.New("the image is too small or too large for WEBP")
+	}
+	nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(nrgba, nrgba.Bounds(), img, b.Min, draw.Src)
+	opaque := nrgba.Opaque()
+
+	// The subtract green transform, followed by the predictor transform
+	pix := nrgba.Pix
+	for p := 0; p < len(pix); p += 4 {
+		pix[p+0] -= pix[p+1]
+		pix[p+2] -= pix[p+1]
+	}
+	residuals, modes := webpResiduals(pix, width, height)
+
+	w := &bitWriter{}
+	w.writeBits(0x2f, 8)
+	w.writeBits(uint32(width-1), 14)
+	w.writeBits(uint32(height-1), 14)
+	if opaque {
+		w.writeBits(0, 1)
+	} else {
+		w.writeBits(1, 1)
+	}
+	w.writeBits(0, 3) // version
+	w.writeBits(1, 1)
+	w.writeBits(2, 2) // subtract green
+	w.writeBits(1, 1)
+	w.writeBits(0, 2) // predictor
+	w.writeBits(webpTileBits-2, 3)
+	writeWEBPPixels(w, modes, false)
+	w.writeBits(0, 1) // no more transforms
+	writeWEBPPixels(w, residuals, true)
+	data := w.bytes()
+
+	// The RIFF container, with the VP8L chunk padded to an even size
+	chunkSize := len(data)
+	if len(data)%2 == 1 {
+		data = append(data, 0)
+	}
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(12+len(data)))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(chunkSize))
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+	_, err := out.Write(data)
+	return err
+}